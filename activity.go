@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"github.com/adelolmo/scanpi/auth"
+	"github.com/adelolmo/scanpi/logger"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// activityLog is the file in the work directory recording which user
+// scanned, changed or deleted what.
+const activityLog = "activity.log"
+
+var activityMutex sync.Mutex
+
+// userName returns the name of the user of the request, for the activity
+// log.
+func userName(r *http.Request) string {
+	if user, found := auth.CurrentUser(r); found {
+		return user.Name
+	}
+	return "-"
+}
+
+// recordActivity appends the action of the user to the activity log, with
+// the time.
+func recordActivity(user string, format string, args ...interface{}) {
+	action := fmt.Sprintf(format, args...)
+	logger.Info("%s %s", user, action)
+
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+	file, err := os.OpenFile(path.Join(appConfiguration.WorkDirectory, activityLog),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		logger.Error(fmt.Sprintf("cannot open the activity log. Error: %s", err))
+		return
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%s %q %s\n", time.Now().Format(time.RFC3339), user, action); err != nil {
+		logger.Error(fmt.Sprintf("cannot write to the activity log. Error: %s", err))
+	}
+}
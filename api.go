@@ -0,0 +1,338 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/adelolmo/scanpi/auth"
+	"github.com/adelolmo/scanpi/fsutils"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// apiBodyLimit is the largest json body the api reads.
+const apiBodyLimit = 1 << 20
+
+// openApiDocument describes the api, keep it in step with registerApi.
+//
+//go:embed openapi.json
+var openApiDocument []byte
+
+type apiError struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+type apiJob struct {
+	Name      string    `json:"name"`
+	Created   time.Time `json:"created"`
+	PageCount int       `json:"pageCount"`
+	// Pages are only listed for a single job
+	Pages []apiPage `json:"pages,omitempty"`
+}
+
+type apiPage struct {
+	Name   string `json:"name"`
+	Number int    `json:"number"`
+	File   string `json:"file"`
+	// DocumentPages is the number of pages of a pdf document
+	DocumentPages int `json:"documentPages,omitempty"`
+}
+
+type apiJobRequest struct {
+	Name string `json:"name"`
+}
+
+type apiOrderRequest struct {
+	Pages []string `json:"pages"`
+}
+
+// registerApi adds the json api to the router, under /api/v1.
+func registerApi(router *mux.Router) {
+	router.HandleFunc("/api/openapi.json", openApiHandler).Methods("GET")
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusNotFound, apiError{Status: http.StatusNotFound, Error: "not found"})
+	})
+	api.HandleFunc("/jobs", apiJobsHandler).Methods("GET")
+	api.HandleFunc("/jobs", apiCreateJobHandler).Methods("POST")
+	api.HandleFunc("/jobs/{job}", apiJobHandler).Methods("GET")
+	api.HandleFunc("/jobs/{job}", apiRenameJobHandler).Methods("PATCH")
+	api.HandleFunc("/jobs/{job}", apiDeleteJobHandler).Methods("DELETE")
+	api.HandleFunc("/jobs/{job}/download", apiDownloadJobHandler).Methods("GET")
+	api.HandleFunc("/jobs/{job}/pages", apiPagesHandler).Methods("GET")
+	api.HandleFunc("/jobs/{job}/pages/order", apiReorderPagesHandler).Methods("PUT")
+	api.HandleFunc("/jobs/{job}/pages/{page}", apiPageHandler).Methods("GET")
+	api.HandleFunc("/jobs/{job}/pages/{page}", apiDeletePageHandler).Methods("DELETE")
+	api.HandleFunc("/jobs/{job}/pages/{page}/file", apiPageFileHandler).Methods("GET")
+	api.HandleFunc("/jobs/{job}/scans", apiStartScanHandler).Methods("POST")
+	api.HandleFunc("/scans", apiScansHandler).Methods("GET")
+	api.HandleFunc("/scans/{id}", apiScanHandler).Methods("GET")
+	api.HandleFunc("/settings", apiSettingsHandler).Methods("GET")
+	api.HandleFunc("/settings", apiUpdateSettingsHandler).Methods("PUT")
+}
+
+// openApiHandler serves the description of the api, with the server the
+// request reached, behind a proxy too.
+func openApiHandler(w http.ResponseWriter, r *http.Request) {
+	var document map[string]interface{}
+	if err := json.Unmarshal(openApiDocument, &document); err != nil {
+		writeApiError(w, err)
+		return
+	}
+	document["servers"] = []map[string]string{{"url": auth.Prefix(r) + "/api/v1"}}
+	writeJson(w, http.StatusOK, document)
+}
+
+func apiJobsHandler(w http.ResponseWriter, r *http.Request) {
+	jobs := make([]apiJob, 0)
+	for _, jobName := range listJobs() {
+		job, err := readApiJob(jobName, false)
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	writeJson(w, http.StatusOK, jobs)
+}
+
+func apiCreateJobHandler(w http.ResponseWriter, r *http.Request) {
+	var request apiJobRequest
+	if !readJson(w, r, &request) {
+		return
+	}
+	created, err := createJob(userName(r), request.Name)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+	if !created {
+		writeApiError(w, fmt.Errorf("%w: '%s'", fsutils.ErrJobExists, request.Name))
+		return
+	}
+	writeApiJob(w, r, request.Name, http.StatusCreated)
+}
+
+func apiJobHandler(w http.ResponseWriter, r *http.Request) {
+	writeApiJob(w, r, mux.Vars(r)["job"], http.StatusOK)
+}
+
+func apiRenameJobHandler(w http.ResponseWriter, r *http.Request) {
+	var request apiJobRequest
+	if !readJson(w, r, &request) {
+		return
+	}
+	if err := renameJob(userName(r), mux.Vars(r)["job"], request.Name); err != nil {
+		writeApiError(w, err)
+		return
+	}
+	writeApiJob(w, r, request.Name, http.StatusOK)
+}
+
+func apiDeleteJobHandler(w http.ResponseWriter, r *http.Request) {
+	if err := deleteJob(userName(r), mux.Vars(r)["job"]); err != nil {
+		writeApiError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiDownloadJobHandler(w http.ResponseWriter, r *http.Request) {
+	download, err := prepareJobDownload(r, mux.Vars(r)["job"], r.FormValue("envelope"))
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+	writeJobDownload(w, download, writeApiError)
+}
+
+func apiPagesHandler(w http.ResponseWriter, r *http.Request) {
+	pages, err := readApiPages(mux.Vars(r)["job"])
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, pages)
+}
+
+func apiReorderPagesHandler(w http.ResponseWriter, r *http.Request) {
+	jobName := mux.Vars(r)["job"]
+	var request apiOrderRequest
+	if !readJson(w, r, &request) {
+		return
+	}
+	if err := reorderPages(userName(r), jobName, request.Pages); err != nil {
+		writeApiError(w, err)
+		return
+	}
+	pages, err := readApiPages(jobName)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, pages)
+}
+
+func apiPageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if _, err := resolver.Scan(vars["job"], vars["page"]); err != nil {
+		writeApiError(w, err)
+		return
+	}
+	pages, err := readApiPages(vars["job"])
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+	for _, page := range pages {
+		if page.Name == vars["page"] {
+			writeJson(w, http.StatusOK, page)
+			return
+		}
+	}
+	writeApiError(w, fmt.Errorf("page %s is not a scan: %w", vars["page"], errScanNotFound))
+}
+
+func apiDeletePageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := deletePage(userName(r), vars["job"], vars["page"]); err != nil {
+		writeApiError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiPageFileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if _, err := resolver.Scan(vars["job"], vars["page"]); err != nil {
+		writeApiError(w, err)
+		return
+	}
+	serveImage(w, r, vars["job"], vars["page"], "")
+}
+
+func apiStartScanHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := startScan(userName(r), mux.Vars(r)["job"])
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+	w.Header().Set("Location", auth.Prefix(r)+"/api/v1/scans/"+status.Id)
+	writeJson(w, http.StatusAccepted, status)
+}
+
+func apiScansHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, scanStatuses())
+}
+
+func apiScanHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := findScanStatus(mux.Vars(r)["id"])
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, status)
+}
+
+func apiSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, readSettings())
+}
+
+func apiUpdateSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	settings := readSettings()
+	if !readJson(w, r, settings) {
+		return
+	}
+	if err := saveSettings(userName(r), settings); err != nil {
+		writeApiError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, settings)
+}
+
+func readApiJob(jobName string, withPages bool) (apiJob, error) {
+	scans, err := listJobImages(jobName)
+	if err != nil {
+		return apiJob{}, err
+	}
+	job := apiJob{
+		Name:      jobName,
+		Created:   jobCreationDate(jobName, scans),
+		PageCount: len(scans),
+	}
+	if withPages {
+		countDocumentPages(jobName, scans)
+		job.Pages = apiPages(scans)
+	}
+	return job, nil
+}
+
+func readApiPages(jobName string) ([]apiPage, error) {
+	scans, err := listJobImages(jobName)
+	if err != nil {
+		return nil, err
+	}
+	countDocumentPages(jobName, scans)
+	return apiPages(scans), nil
+}
+
+func apiPages(scans []image) []apiPage {
+	pages := make([]apiPage, 0, len(scans))
+	for _, scan := range scans {
+		pages = append(pages, apiPage{
+			Name:          scan.LinkName,
+			Number:        scan.Number(),
+			File:          scan.Name,
+			DocumentPages: scan.Pages,
+		})
+	}
+	return pages
+}
+
+func writeApiJob(w http.ResponseWriter, r *http.Request, jobName string, status int) {
+	job, err := readApiJob(jobName, true)
+	if err != nil {
+		writeApiError(w, err)
+		return
+	}
+	if status == http.StatusCreated {
+		w.Header().Set("Location", auth.Prefix(r)+"/api/v1/jobs/"+url.PathEscape(jobName))
+	}
+	writeJson(w, status, job)
+}
+
+// readJson decodes the body of the request, or answers with 400 and returns
+// false.
+func readJson(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiBodyLimit))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeJson(w, http.StatusBadRequest, apiError{
+			Status: http.StatusBadRequest,
+			Error:  fmt.Sprintf("invalid json body: %s", err),
+		})
+		return false
+	}
+	return true
+}
+
+// writeApiError answers with the status matching the error, the same the
+// pages answer with.
+func writeApiError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		fmt.Println(err)
+	}
+	writeJson(w, status, apiError{Status: status, Error: err.Error()})
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Println(err)
+	}
+}
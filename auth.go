@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adelolmo/scanpi/auth"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+type pageLogin struct {
+	Navigation string
+	// Setup asks for the first user instead of signing in
+	Setup bool
+	Next  string
+	Error string
+}
+
+// localRedirect returns the path to go back to after signing in, only when
+// it stays on this server.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func showLogin(w http.ResponseWriter, r *http.Request, status int, page *pageLogin) {
+	page.Navigation = "login"
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(status)
+	if err := render(w, r, loginTemplate, page); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func loginPage(w http.ResponseWriter, r *http.Request) {
+	if users.Empty() {
+		redirect(w, r, "/setup")
+		return
+	}
+	showLogin(w, r, http.StatusOK, &pageLogin{Next: localRedirect(r.FormValue("next"))})
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	next := localRedirect(r.FormValue("next"))
+	user, err := users.Authenticate(r.FormValue("user"), r.FormValue("password"))
+	if err != nil {
+		showLogin(w, r, http.StatusUnauthorized, &pageLogin{Next: next, Error: err.Error()})
+		return
+	}
+	if err := authenticator.SignIn(w, r, user.Name); err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	redirect(w, r, next)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if err := authenticator.SignOut(w, r); err != nil {
+		fmt.Println(err)
+	}
+	redirect(w, r, "/login")
+}
+
+func setupPage(w http.ResponseWriter, r *http.Request) {
+	if !users.Empty() {
+		redirect(w, r, "/login")
+		return
+	}
+	showLogin(w, r, http.StatusOK, &pageLogin{Setup: true})
+}
+
+// setupHandler creates the first user, an administrator, and signs them in.
+func setupHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("user")
+	password := r.FormValue("password")
+	if password != r.FormValue("confirmation") {
+		showLogin(w, r, http.StatusBadRequest, &pageLogin{Setup: true, Error: "the passwords do not match"})
+		return
+	}
+	err := users.Setup(name, password)
+	if errors.Is(err, auth.ErrSetupDone) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		showLogin(w, r, http.StatusBadRequest, &pageLogin{Setup: true, Error: err.Error()})
+		return
+	}
+	if err := authenticator.SignIn(w, r, name); err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	redirect(w, r, "/")
+}
+
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.CurrentUser(r)
+	if _, err := users.Authenticate(user.Name, r.FormValue("currentPassword")); err != nil {
+		http.Error(w, "the current password is wrong", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("password") != r.FormValue("confirmation") {
+		http.Error(w, "the passwords do not match", http.StatusBadRequest)
+		return
+	}
+	if err := users.SetPassword(user.Name, r.FormValue("password")); err != nil {
+		userError(w, err)
+		return
+	}
+	recordActivity(userName(r), "changed their password")
+
+	redirect(w, r, "/settings")
+}
+
+func addUserHandler(w http.ResponseWriter, r *http.Request) {
+	if user, _ := auth.CurrentUser(r); !user.Admin {
+		http.Error(w, "only administrators can add users", http.StatusForbidden)
+		return
+	}
+	if err := users.Add(r.FormValue("user"), r.FormValue("password"), r.FormValue("admin") == "on"); err != nil {
+		userError(w, err)
+		return
+	}
+	recordActivity(userName(r), "added user %q", r.FormValue("user"))
+
+	redirect(w, r, "/settings")
+}
+
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.CurrentUser(r)
+	if !user.Admin {
+		http.Error(w, "only administrators can delete users", http.StatusForbidden)
+		return
+	}
+	name := r.FormValue("user")
+	if name == user.Name {
+		http.Error(w, "you cannot delete yourself", http.StatusBadRequest)
+		return
+	}
+	if err := users.Delete(name); err != nil {
+		userError(w, err)
+		return
+	}
+	if err := sessions.DeleteUser(name); err != nil {
+		fmt.Println(err)
+	}
+	if err := tokens.DeleteUser(name); err != nil {
+		fmt.Println(err)
+	}
+	recordActivity(userName(r), "deleted user %q", name)
+
+	redirect(w, r, "/settings")
+}
+
+// addUsers shows the signed in user on the settings, and every user to
+// administrators.
+func addUsers(settings *settings, r *http.Request) {
+	settings.User, _ = auth.CurrentUser(r)
+	_, err := users.Find(settings.User.Name)
+	settings.LocalUser = err == nil
+	if settings.User.Admin {
+		settings.Users = users.List()
+	}
+	settings.Tokens = tokens.List(settings.User.Name)
+}
+
+// scanRoutes are the routes changing anything that tokens with the scan
+// scope may call, by method and path template.
+var scanRoutes = map[string]bool{
+	"POST /job":                     true,
+	"POST /scan":                    true,
+	"POST /api/v1/jobs":             true,
+	"POST /api/v1/jobs/{job}/scans": true,
+}
+
+// scopeMiddleware keeps the requests authenticated with a token to what its
+// scope allows.
+func scopeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := auth.CurrentToken(r)
+		if !found || token.Scope == auth.ScopeAdmin || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if token.Scope == auth.ScopeScan {
+			if template, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil && scanRoutes[r.Method+" "+template] {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		writeJson(w, http.StatusForbidden, apiError{
+			Status: http.StatusForbidden,
+			Error:  fmt.Sprintf("the token with the %s scope cannot do this", token.Scope),
+		})
+	})
+}
+
+// createTokenHandler shows the settings with the secret of the new token,
+// the only time it is shown.
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.CurrentUser(r)
+	token, secret, err := tokens.Create(user.Name, r.FormValue("name"), r.FormValue("scope"))
+	if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrInvalidScope) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordActivity(user.Name, "created the %s token %q", token.Scope, token.Name)
+
+	settings := readSettings()
+	addUsers(settings, r)
+	settings.NewToken = secret
+	w.Header().Add("Content-Type", "text/html")
+	if err := render(w, r, settingsTemplate, settings); err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.CurrentUser(r)
+	err := tokens.Revoke(user.Name, r.FormValue("id"))
+	if errors.Is(err, auth.ErrTokenNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordActivity(user.Name, "revoked token %s", r.FormValue("id"))
+
+	redirect(w, r, "/settings")
+}
+
+// userError answers with the status matching an error of the users.
+func userError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, auth.ErrUserExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, auth.ErrWeakPassword), errors.Is(err, auth.ErrInvalidUserName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// healthHandler tells monitoring that the service is up.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	// CSRFCookieName is the name of the cookie the form tokens are derived from.
+	CSRFCookieName = "scanpi_csrf"
+	// CSRFField is the name of the form field carrying the token.
+	CSRFField = "csrf_token"
+	// CSRFHeader is the header carrying the token of scripted requests.
+	CSRFHeader = "X-CSRF-Token"
+)
+
+type csrfKey struct{}
+
+// CSRFMiddleware rejects requests changing anything that do not carry the
+// token of the form scanpi rendered for the session, so other sites cannot
+// post forms on behalf of its users. The token is derived from a random
+// cookie of the browser and the session cookie, so it changes with every
+// sign in. Requests authenticated with a token need none.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// browsers do not send the Authorization header on their own
+		if _, found := CurrentToken(r); found {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		secret := ""
+		if cookie, err := r.Cookie(CSRFCookieName); err == nil && len(cookie.Value) == 64 {
+			secret = cookie.Value
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			token := r.Header.Get(CSRFHeader)
+			if token == "" {
+				token = r.PostFormValue(CSRFField)
+			}
+			if secret == "" || !hmac.Equal([]byte(token), []byte(csrfToken(secret, r))) {
+				writeError(w, r, "invalid or missing form token, reload the page and try again", http.StatusForbidden)
+				return
+			}
+		}
+
+		if secret == "" {
+			random := make([]byte, 32)
+			if _, err := rand.Read(random); err != nil {
+				writeError(w, r, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			secret = hex.EncodeToString(random)
+			http.SetCookie(w, &http.Cookie{
+				Name:     CSRFCookieName,
+				Value:    secret,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfKey{}, secret)))
+	})
+}
+
+// CSRFToken returns the token the forms rendered for the request must carry.
+func CSRFToken(r *http.Request) string {
+	secret, _ := r.Context().Value(csrfKey{}).(string)
+	if secret == "" {
+		return ""
+	}
+	return csrfToken(secret, r)
+}
+
+func csrfToken(secret string, r *http.Request) string {
+	session := ""
+	if cookie, err := r.Cookie(CookieName); err == nil {
+		session = cookie.Value
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(session))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	authenticator, users, sessions, tokens := testAuthenticator(t)
+	if err := users.Setup("admin", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := sessions.Create("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSession, _, err := sessions.Create("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secret, err := tokens.Create("admin", "script", ScopeAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrfSecret := strings.Repeat("ab", 32)
+	otherSecret := strings.Repeat("cd", 32)
+	// formToken returns the token rendered in the forms of the session
+	formToken := func(secret, session string) string {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.AddCookie(&http.Cookie{Name: CookieName, Value: session})
+		return csrfToken(secret, request)
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		session       string
+		csrfCookie    string
+		header        string
+		field         string
+		authorization string
+		wantStatus    int
+	}{
+		{"page", http.MethodGet, session, "", "", "", "", http.StatusOK},
+		{"head", http.MethodHead, session, "", "", "", "", http.StatusOK},
+		{"token in the header", http.MethodPost, session, csrfSecret, formToken(csrfSecret, session), "", "", http.StatusOK},
+		{"token in the form", http.MethodPost, session, csrfSecret, "", formToken(csrfSecret, session), "", http.StatusOK},
+		{"delete with token", http.MethodDelete, session, csrfSecret, formToken(csrfSecret, session), "", "", http.StatusOK},
+		{"without token", http.MethodPost, session, csrfSecret, "", "", "", http.StatusForbidden},
+		{"delete without token", http.MethodDelete, session, csrfSecret, "", "", "", http.StatusForbidden},
+		{"token of another session", http.MethodPost, session, csrfSecret, formToken(csrfSecret, otherSession), "", "", http.StatusForbidden},
+		{"token of another browser", http.MethodPost, session, csrfSecret, formToken(otherSecret, session), "", "", http.StatusForbidden},
+		{"without csrf cookie", http.MethodPost, session, "", formToken(csrfSecret, session), "", "", http.StatusForbidden},
+		{"malformed csrf cookie", http.MethodPost, session, "ab", formToken("ab", session), "", "", http.StatusForbidden},
+		// scripts authenticated with a token are the only ones exempted
+		{"bearer token", http.MethodPost, "", "", "", "", "Bearer " + secret, http.StatusOK},
+		{"bearer token with a session", http.MethodDelete, session, csrfSecret, "", "", "Bearer " + secret, http.StatusOK},
+		{"invalid bearer token", http.MethodPost, session, csrfSecret, "", "", "Bearer scanpi_0000", http.StatusUnauthorized},
+		{"other authorization", http.MethodPost, session, csrfSecret, "", "", "Basic YWRtaW46Y29ycmVjdCBob3JzZQ==", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := ""
+			if test.field != "" {
+				body = url.Values{CSRFField: {test.field}}.Encode()
+			}
+			request := httptest.NewRequest(test.method, "/jobs", strings.NewReader(body))
+			if test.field != "" {
+				request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if test.session != "" {
+				request.AddCookie(&http.Cookie{Name: CookieName, Value: test.session})
+			}
+			if test.csrfCookie != "" {
+				request.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: test.csrfCookie})
+			}
+			if test.header != "" {
+				request.Header.Set(CSRFHeader, test.header)
+			}
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			authenticator.Middleware(CSRFMiddleware(currentUserHandler)).ServeHTTP(recorder, request)
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, test.wantStatus, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestCSRFMiddlewareSetsTheCookie(t *testing.T) {
+	var token string
+	handler := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = CSRFToken(r)
+	}))
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+	request.AddCookie(&http.Cookie{Name: CookieName, Value: "session"})
+	handler.ServeHTTP(recorder, request)
+
+	var secret string
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == CSRFCookieName {
+			secret = cookie.Value
+			if !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+				t.Errorf("cookie %+v is not http only and strict", cookie)
+			}
+		}
+	}
+	if len(secret) != 64 {
+		t.Fatalf("csrf cookie is %q", secret)
+	}
+	if token == "" || token != csrfToken(secret, request) {
+		t.Errorf("form token %q does not match the cookie", token)
+	}
+
+	// the token is accepted on the next post of the browser
+	post := httptest.NewRequest(http.MethodPost, "/jobs", nil)
+	post.AddCookie(&http.Cookie{Name: CookieName, Value: "session"})
+	post.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: secret})
+	post.Header.Set(CSRFHeader, token)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, post)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if len(recorder.Result().Cookies()) != 0 {
+		t.Error("csrf cookie replaced")
+	}
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CookieName is the name of the session cookie.
+const CookieName = "scanpi_session"
+
+type contextKey struct{}
+
+type prefixKey struct{}
+
+type tokenKey struct{}
+
+// Authenticator lets only signed in users through, except to the open paths.
+// Users authenticated by a trusted proxy or by the token of a script in the
+// Authorization header are let through as well. While there is no user, every
+// other request is sent to the setup of the first one.
+type Authenticator struct {
+	users     *Users
+	sessions  *Sessions
+	tokens    *Tokens
+	proxy     *Proxy
+	openPaths []string
+}
+
+// NewAuthenticator leaves the paths open, besides the login, the setup and
+// the assets. A path ending with a slash opens the paths below it.
+func NewAuthenticator(users *Users, sessions *Sessions, tokens *Tokens, proxy *Proxy, openPaths []string) *Authenticator {
+	return &Authenticator{
+		users:     users,
+		sessions:  sessions,
+		tokens:    tokens,
+		proxy:     proxy,
+		openPaths: append([]string{"/login", "/setup", "/assets/"}, openPaths...),
+	}
+}
+
+// Middleware checks the session of the requests before handing them over.
+// Pages answer with a redirect to the login, other requests with 401.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := a.proxy.Prefix(r)
+		r = r.WithContext(context.WithValue(r.Context(), prefixKey{}, prefix))
+		if a.open(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+			token, found := a.tokens.Authenticate(strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer ")))
+			if !found {
+				writeError(w, r, "invalid or revoked token", http.StatusUnauthorized)
+				return
+			}
+			ctx := context.WithValue(r.Context(), contextKey{}, a.user(token.User))
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, tokenKey{}, token)))
+			return
+		}
+		if user, found := a.ProxyUser(r); found {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, user)))
+			return
+		}
+		if a.users.Empty() && isApi(r) {
+			writeError(w, r, "create the first user on the setup page", http.StatusUnauthorized)
+			return
+		}
+		if a.users.Empty() {
+			w.Header().Set("Location", prefix+"/setup")
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		}
+		if user, found := a.SessionUser(r); found {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, user)))
+			return
+		}
+
+		if r.Method == http.MethodGet && !isApi(r) && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			w.Header().Set("Location", prefix+"/login?next="+url.QueryEscape(r.URL.RequestURI()))
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		}
+		writeError(w, r, "authentication required", http.StatusUnauthorized)
+	})
+}
+
+// ProxyUser returns the user a trusted proxy authenticated. Users unknown to
+// scanpi are no administrators.
+func (a *Authenticator) ProxyUser(r *http.Request) (User, bool) {
+	name, found := a.proxy.User(r)
+	if !found {
+		return User{}, false
+	}
+	return a.user(name), true
+}
+
+// user returns the user with the name, users known to the proxy only are no
+// administrators.
+func (a *Authenticator) user(name string) User {
+	if user, err := a.users.Find(name); err == nil {
+		return user
+	}
+	return User{Name: name}
+}
+
+// SessionUser returns the user of the session cookie of the request.
+func (a *Authenticator) SessionUser(r *http.Request) (User, bool) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return User{}, false
+	}
+	name, found := a.sessions.User(cookie.Value)
+	if !found {
+		return User{}, false
+	}
+	user, err := a.users.Find(name)
+	if err != nil {
+		return User{}, false
+	}
+	return user, true
+}
+
+// SignIn starts a session for the user and sets its cookie.
+func (a *Authenticator) SignIn(w http.ResponseWriter, r *http.Request, user string) error {
+	token, expires, err := a.sessions.Create(user)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// SignOut ends the session of the request and removes its cookie.
+func (a *Authenticator) SignOut(w http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	if cookie, err := r.Cookie(CookieName); err == nil {
+		return a.sessions.Delete(cookie.Value)
+	}
+	return nil
+}
+
+// CurrentUser returns the user the middleware let through.
+func CurrentUser(r *http.Request) (User, bool) {
+	user, found := r.Context().Value(contextKey{}).(User)
+	return user, found
+}
+
+// CurrentToken returns the token the middleware let the request through with.
+func CurrentToken(r *http.Request) (Token, bool) {
+	token, found := r.Context().Value(tokenKey{}).(Token)
+	return token, found
+}
+
+// Prefix returns the sub-path scanpi is served under, to be put in front of
+// its links.
+func Prefix(r *http.Request) string {
+	prefix, _ := r.Context().Value(prefixKey{}).(string)
+	return prefix
+}
+
+// writeError answers with the message, as json to the requests to the api.
+func writeError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if !isApi(r) {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}{status, message})
+}
+
+func isApi(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+func (a *Authenticator) open(requestPath string) bool {
+	for _, openPath := range a.openPaths {
+		if requestPath == openPath || strings.HasSuffix(openPath, "/") && strings.HasPrefix(requestPath, openPath) {
+			return true
+		}
+	}
+	return false
+}
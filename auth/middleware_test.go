@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAuthenticator returns an authenticator with its stores in a temporary
+// directory, with the paths below /open/ left open.
+func testAuthenticator(t *testing.T) (*Authenticator, *Users, *Sessions, *Tokens) {
+	directory := t.TempDir()
+	users, err := LoadUsers(path.Join(directory, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := LoadSessions(path.Join(directory, "sessions.json"), time.Hour)
+	tokens, err := LoadTokens(path.Join(directory, "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewProxy("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAuthenticator(users, sessions, tokens, proxy, []string{"/open/", "/health"}), users, sessions, tokens
+}
+
+// currentUserHandler answers with the name of the user let through.
+var currentUserHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	user, _ := CurrentUser(r)
+	w.Write([]byte("user " + user.Name))
+})
+
+func TestMiddlewareWithoutUsers(t *testing.T) {
+	authenticator, _, _, _ := testAuthenticator(t)
+	tests := []struct {
+		name         string
+		target       string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"page", "/", http.StatusSeeOther, "/setup"},
+		{"api", "/api/v1/jobs", http.StatusUnauthorized, ""},
+		{"setup", "/setup", http.StatusOK, ""},
+		{"open path", "/health", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, test.target, nil)
+			request.Header.Set("Accept", "text/html")
+			recorder := httptest.NewRecorder()
+			authenticator.Middleware(currentUserHandler).ServeHTTP(recorder, request)
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if location := recorder.Header().Get("Location"); location != test.wantLocation {
+				t.Errorf("location = %s, want %s", location, test.wantLocation)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	authenticator, users, sessions, _ := testAuthenticator(t)
+	if err := users.Setup("admin", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := sessions.Create("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a session outliving its user
+	if err := users.Add("bob", "battery staple", false); err != nil {
+		t.Fatal(err)
+	}
+	orphan, _, err := sessions.Create("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Delete("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		html         bool
+		session      string
+		wantStatus   int
+		wantLocation string
+		wantUser     string
+	}{
+		{"signed in page", http.MethodGet, "/jobs", true, session, http.StatusOK, "", "admin"},
+		{"signed in post", http.MethodPost, "/jobs", false, session, http.StatusOK, "", "admin"},
+		{"signed in api", http.MethodGet, "/api/v1/jobs", false, session, http.StatusOK, "", "admin"},
+		{"page", http.MethodGet, "/jobs?sort=name", true, "", http.StatusSeeOther, "/login?next=%2Fjobs%3Fsort%3Dname", ""},
+		{"page with unknown session", http.MethodGet, "/jobs", true, "0123", http.StatusSeeOther, "/login?next=%2Fjobs", ""},
+		{"page of a deleted user", http.MethodGet, "/jobs", true, orphan, http.StatusSeeOther, "/login?next=%2Fjobs", ""},
+		{"form post", http.MethodPost, "/jobs", true, "", http.StatusUnauthorized, "", ""},
+		{"image", http.MethodGet, "/image?jobName=job", false, "", http.StatusUnauthorized, "", ""},
+		{"api", http.MethodGet, "/api/v1/jobs", true, "", http.StatusUnauthorized, "", ""},
+		{"login", http.MethodPost, "/login", true, "", http.StatusOK, "", ""},
+		{"assets", http.MethodGet, "/assets/css/style.css", false, "", http.StatusOK, "", ""},
+		{"open path", http.MethodGet, "/health", false, "", http.StatusOK, "", ""},
+		{"below an open directory", http.MethodGet, "/open/file", false, "", http.StatusOK, "", ""},
+		{"path starting like an open one", http.MethodGet, "/healthz", false, "", http.StatusUnauthorized, "", ""},
+		{"open directory without slash", http.MethodGet, "/open", false, "", http.StatusUnauthorized, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, test.target, nil)
+			if test.html {
+				request.Header.Set("Accept", "text/html,application/xhtml+xml")
+			}
+			if test.session != "" {
+				request.AddCookie(&http.Cookie{Name: CookieName, Value: test.session})
+			}
+			recorder := httptest.NewRecorder()
+			authenticator.Middleware(currentUserHandler).ServeHTTP(recorder, request)
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if location := recorder.Header().Get("Location"); location != test.wantLocation {
+				t.Errorf("location = %s, want %s", location, test.wantLocation)
+			}
+			if test.wantStatus == http.StatusOK && recorder.Body.String() != "user "+test.wantUser {
+				t.Errorf("answer = %q, want the user %q", recorder.Body.String(), test.wantUser)
+			}
+			if test.wantStatus == http.StatusUnauthorized && strings.HasPrefix(test.target, "/api/") &&
+				recorder.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("api error answered as %s", recorder.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
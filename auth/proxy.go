@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// PrefixHeader is the header a reverse proxy serving scanpi under a sub-path
+// names that path in.
+const PrefixHeader = "X-Forwarded-Prefix"
+
+// Proxy trusts the headers of the reverse proxies in front of scanpi: the
+// user it authenticated and the sub-path it serves scanpi under. Headers of
+// requests coming from anywhere else are ignored.
+type Proxy struct {
+	userHeader string
+	networks   []*net.IPNet
+}
+
+// NewProxy trusts the proxies in the networks, given in CIDR notation or as
+// single addresses. An empty user header leaves authentication to scanpi.
+func NewProxy(userHeader string, networks []string) (*Proxy, error) {
+	p := &Proxy{userHeader: userHeader}
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("invalid proxy address %s", network))
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			network = fmt.Sprintf("%s/%d", network, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid proxy network %s. Error: %s", network, err))
+		}
+		p.networks = append(p.networks, ipNet)
+	}
+	if userHeader != "" && len(p.networks) == 0 {
+		return nil, errors.New(fmt.Sprintf("the proxy header %s needs the networks of the trusted proxies", userHeader))
+	}
+	return p, nil
+}
+
+// Trusted tells whether the request comes from a trusted proxy.
+func (p *Proxy) Trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// User returns the user the trusted proxy authenticated.
+func (p *Proxy) User(r *http.Request) (string, bool) {
+	if p.userHeader == "" || !p.Trusted(r) {
+		return "", false
+	}
+	user := strings.TrimSpace(r.Header.Get(p.userHeader))
+	return user, user != ""
+}
+
+// Prefix returns the sub-path the trusted proxy serves scanpi under, without
+// a trailing slash, or an empty string at the root.
+func (p *Proxy) Prefix(r *http.Request) string {
+	prefix := r.Header.Get(PrefixHeader)
+	if prefix == "" || !p.Trusted(r) {
+		return ""
+	}
+	prefix = path.Clean("/" + prefix)
+	if prefix == "/" || strings.ContainsAny(prefix, "\\?#\"'<> ") {
+		return ""
+	}
+	return prefix
+}
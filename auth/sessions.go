@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/adelolmo/scanpi/logger"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+type session struct {
+	User    string    `json:"user"`
+	Expires time.Time `json:"expires"`
+}
+
+// Sessions keeps the signed in users by the token of their cookie. The
+// sessions are stored in a json file to survive restarts, by the hash of
+// their token so the file does not give access.
+type Sessions struct {
+	path     string
+	lifetime time.Duration
+	mutex    sync.Mutex
+	sessions map[string]session
+}
+
+// LoadSessions reads the sessions that did not expire yet from the file.
+func LoadSessions(sessionsPath string, lifetime time.Duration) *Sessions {
+	s := &Sessions{
+		path:     sessionsPath,
+		lifetime: lifetime,
+		sessions: make(map[string]session),
+	}
+	data, err := ioutil.ReadFile(sessionsPath)
+	if err == nil {
+		if err := json.Unmarshal(data, &s.sessions); err != nil {
+			logger.Error(fmt.Sprintf("cannot read sessions from %s. Error: %s", sessionsPath, err))
+		}
+	}
+	for hash, session := range s.sessions {
+		if time.Now().After(session.Expires) {
+			delete(s.sessions, hash)
+		}
+	}
+	return s
+}
+
+// Create signs the user in and returns the token of the session with its
+// expiry.
+func (s *Sessions) Create(user string) (string, time.Time, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", time.Time{}, err
+	}
+	encoded := hex.EncodeToString(token)
+	expires := time.Now().Add(s.lifetime)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions[tokenHash(encoded)] = session{User: user, Expires: expires}
+	return encoded, expires, s.save()
+}
+
+// User returns the user signed in with the token.
+func (s *Sessions) User(token string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	hash := tokenHash(token)
+	session, found := s.sessions[hash]
+	if !found {
+		return "", false
+	}
+	if time.Now().After(session.Expires) {
+		delete(s.sessions, hash)
+		return "", false
+	}
+	return session.User, true
+}
+
+// Delete signs the session out.
+func (s *Sessions) Delete(token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, tokenHash(token))
+	return s.save()
+}
+
+// DeleteUser signs every session of the user out.
+func (s *Sessions) DeleteUser(user string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for hash, session := range s.sessions {
+		if session.User == user {
+			delete(s.sessions, hash)
+		}
+	}
+	return s.save()
+}
+
+func (s *Sessions) save() error {
+	data, err := json.Marshal(s.sessions)
+	if err != nil {
+		return err
+	}
+	temporaryPath := path.Join(path.Dir(s.path), "."+path.Base(s.path))
+	if err := ioutil.WriteFile(temporaryPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, s.path)
+}
+
+func tokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	sessionsPath := path.Join(t.TempDir(), "sessions.json")
+	sessions := LoadSessions(sessionsPath, time.Hour)
+	token, expires, err := sessions.Create("bob")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if time.Until(expires) < 59*time.Minute || time.Until(expires) > time.Hour {
+		t.Errorf("session expires at %s, want in an hour", expires)
+	}
+	other, _, err := sessions.Create("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == other {
+		t.Error("sessions share their token")
+	}
+	if user, found := sessions.User(token); !found || user != "bob" {
+		t.Errorf("User() = %s, %v, want bob", user, found)
+	}
+	if _, found := sessions.User(token + "0"); found {
+		t.Error("unknown token signs in")
+	}
+
+	// the tokens themselves are not stored, only their hashes
+	data, err := os.ReadFile(sessionsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), token) {
+		t.Error("session token written to the file")
+	}
+	loaded := LoadSessions(sessionsPath, time.Hour)
+	if user, found := loaded.User(token); !found || user != "bob" {
+		t.Errorf("User() after loading = %s, %v, want bob", user, found)
+	}
+
+	if err := loaded.Delete(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := loaded.User(token); found {
+		t.Error("signed out session is valid")
+	}
+	if _, found := loaded.User(other); !found {
+		t.Error("other session was signed out")
+	}
+	if err := loaded.DeleteUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := LoadSessions(sessionsPath, time.Hour).User(other); found {
+		t.Error("session of a deleted user is valid")
+	}
+}
+
+func TestSessionsExpire(t *testing.T) {
+	sessionsPath := path.Join(t.TempDir(), "sessions.json")
+	expired := LoadSessions(sessionsPath, -time.Second)
+	token, _, err := expired.Create("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := expired.User(token); found {
+		t.Error("expired session is valid")
+	}
+
+	// expired sessions are dropped when loading
+	if _, _, err := expired.Create("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if sessions := LoadSessions(sessionsPath, time.Hour); len(sessions.sessions) != 0 {
+		t.Errorf("%d expired sessions loaded", len(sessions.sessions))
+	}
+}
@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/adelolmo/scanpi/logger"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The scopes limit what a token may do, on top of the rights of its user.
+const (
+	// ScopeRead only reads, with GET requests
+	ScopeRead = "read"
+	// ScopeScan reads, creates jobs and scans
+	ScopeScan = "scan"
+	// ScopeAdmin does anything its user can do
+	ScopeAdmin = "admin"
+)
+
+// tokenPrefix starts every token, so they are easy to tell apart from other
+// secrets.
+const tokenPrefix = "scanpi_"
+
+// tokenSaveInterval is how often the last use of the tokens is written to
+// the file at most, so scripts calling often do not wear out the sd card.
+const tokenSaveInterval = time.Minute
+
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrInvalidScope  = errors.New("the scope must be read, scan or admin")
+	ErrInvalidToken  = errors.New("the token needs a name")
+)
+
+// Token lets scripts call scanpi on behalf of a user, without the password of
+// the user. Only the hash of the token is stored, it is shown once when
+// created.
+type Token struct {
+	Id       string    `json:"id"`
+	Name     string    `json:"name"`
+	User     string    `json:"user"`
+	Scope    string    `json:"scope"`
+	Hash     string    `json:"hash"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// Tokens keeps the tokens in a json file.
+type Tokens struct {
+	path     string
+	mutex    sync.Mutex
+	tokens   []Token
+	lastSave time.Time
+}
+
+// LoadTokens reads the tokens from the file, which is created with the first
+// token.
+func LoadTokens(tokensPath string) (*Tokens, error) {
+	t := &Tokens{path: tokensPath}
+	data, err := ioutil.ReadFile(tokensPath)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &t.tokens); err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot read tokens from %s. Error: %s", tokensPath, err))
+	}
+	return t, nil
+}
+
+// Create makes a token for the user and returns it with its secret, the
+// only time the secret is known.
+func (t *Tokens) Create(user, name, scope string) (Token, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Token{}, "", ErrInvalidToken
+	}
+	if scope != ScopeRead && scope != ScopeScan && scope != ScopeAdmin {
+		return Token{}, "", ErrInvalidScope
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Token{}, "", err
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return Token{}, "", err
+	}
+	secret := tokenPrefix + hex.EncodeToString(random)
+	token := Token{
+		Id:      hex.EncodeToString(id),
+		Name:    name,
+		User:    user,
+		Scope:   scope,
+		Hash:    tokenHash(secret),
+		Created: time.Now(),
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tokens := t.tokens
+	t.tokens = append(append([]Token{}, tokens...), token)
+	if err := t.save(); err != nil {
+		t.tokens = tokens
+		return Token{}, "", err
+	}
+	return token, secret, nil
+}
+
+// List returns the tokens of the user, the newest first.
+func (t *Tokens) List(user string) []Token {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var tokens []Token
+	for _, token := range t.tokens {
+		if token.User == user {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.After(tokens[j].Created)
+	})
+	return tokens
+}
+
+// Revoke deletes the token of the user.
+func (t *Tokens) Revoke(user, id string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, token := range t.tokens {
+		if token.Id == id && token.User == user {
+			tokens := t.tokens
+			t.tokens = append(append([]Token{}, tokens[:i]...), tokens[i+1:]...)
+			if err := t.save(); err != nil {
+				t.tokens = tokens
+				return err
+			}
+			return nil
+		}
+	}
+	return ErrTokenNotFound
+}
+
+// DeleteUser revokes every token of the user.
+func (t *Tokens) DeleteUser(user string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tokens := t.tokens
+	t.tokens = make([]Token, 0, len(tokens))
+	for _, token := range tokens {
+		if token.User != user {
+			t.tokens = append(t.tokens, token)
+		}
+	}
+	if err := t.save(); err != nil {
+		t.tokens = tokens
+		return err
+	}
+	return nil
+}
+
+// Authenticate returns the token with the secret, and records its use.
+func (t *Tokens) Authenticate(secret string) (Token, bool) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return Token{}, false
+	}
+	hash := tokenHash(secret)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, token := range t.tokens {
+		if token.Hash == hash {
+			t.tokens[i].LastUsed = time.Now()
+			if time.Since(t.lastSave) > tokenSaveInterval {
+				if err := t.save(); err != nil {
+					logger.Error(fmt.Sprintf("cannot record the use of token %s. Error: %s", token.Id, err))
+				}
+			}
+			return t.tokens[i], true
+		}
+	}
+	return Token{}, false
+}
+
+// save writes the tokens to a temporary file first, so a failure does not
+// lose them.
+func (t *Tokens) save() error {
+	data, err := json.MarshalIndent(t.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporaryPath := path.Join(path.Dir(t.path), "."+path.Base(t.path))
+	if err := ioutil.WriteFile(temporaryPath, data, 0600); err != nil {
+		return err
+	}
+	t.lastSave = time.Now()
+	return os.Rename(temporaryPath, t.path)
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestTokensAuthenticate(t *testing.T) {
+	tokensPath := path.Join(t.TempDir(), "tokens.json")
+	tokens, err := LoadTokens(tokensPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, secret, err := tokens.Create("bob", " script ", ScopeScan)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if token.Name != "script" || token.User != "bob" || token.Scope != ScopeScan || !strings.HasPrefix(secret, tokenPrefix) {
+		t.Errorf("Create() = %+v, %s", token, secret)
+	}
+	data, err := os.ReadFile(tokensPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Error("secret written to the file")
+	}
+
+	loaded, err := LoadTokens(tokensPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		secret string
+		found  bool
+	}{
+		{"secret", secret, true},
+		{"secret without prefix", strings.TrimPrefix(secret, tokenPrefix), false},
+		{"other secret", tokenPrefix + strings.Repeat("0", 64), false},
+		{"truncated secret", secret[:len(secret)-1], false},
+		{"hash of the secret", token.Hash, false},
+		{"empty", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, found := loaded.Authenticate(test.secret)
+			if found != test.found {
+				t.Fatalf("Authenticate() found = %v, want %v", found, test.found)
+			}
+			if found && (got.Id != token.Id || got.User != "bob" || got.LastUsed.IsZero()) {
+				t.Errorf("Authenticate() = %+v", got)
+			}
+		})
+	}
+}
+
+func TestTokensCreateInvalid(t *testing.T) {
+	tokens, err := LoadTokens(path.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tokens.Create("bob", " ", ScopeRead); err != ErrInvalidToken {
+		t.Errorf("Create() without name error = %v, want %v", err, ErrInvalidToken)
+	}
+	if _, _, err := tokens.Create("bob", "script", "write"); err != ErrInvalidScope {
+		t.Errorf("Create() of unknown scope error = %v, want %v", err, ErrInvalidScope)
+	}
+	if list := tokens.List("bob"); len(list) != 0 {
+		t.Errorf("List() = %+v, want no tokens", list)
+	}
+}
+
+func TestTokensRevoke(t *testing.T) {
+	tokensPath := path.Join(t.TempDir(), "tokens.json")
+	tokens, err := LoadTokens(tokensPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, firstSecret, err := tokens.Create("bob", "first", ScopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, secondSecret, err := tokens.Create("bob", "second", ScopeAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, aliceSecret, err := tokens.Create("alice", "alice", ScopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens are revoked by their user only
+	if err := tokens.Revoke("alice", first.Id); err != ErrTokenNotFound {
+		t.Errorf("Revoke() by another user error = %v, want %v", err, ErrTokenNotFound)
+	}
+	if err := tokens.Revoke("bob", first.Id); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if err := tokens.Revoke("bob", first.Id); err != ErrTokenNotFound {
+		t.Errorf("Revoke() twice error = %v, want %v", err, ErrTokenNotFound)
+	}
+	loaded, err := LoadTokens(tokensPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := loaded.Authenticate(firstSecret); found {
+		t.Error("revoked token authenticates")
+	}
+	if token, found := loaded.Authenticate(secondSecret); !found || token.Id != second.Id {
+		t.Error("other token of the user was revoked")
+	}
+
+	if err := loaded.DeleteUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := loaded.Authenticate(secondSecret); found {
+		t.Error("token of a deleted user authenticates")
+	}
+	if _, found := loaded.Authenticate(aliceSecret); !found {
+		t.Error("token of another user was revoked")
+	}
+}
+
+func TestTokensUnchangedWhenSaveFails(t *testing.T) {
+	tokensPath := path.Join(t.TempDir(), "tokens.json")
+	tokens, err := LoadTokens(tokensPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, secret, err := tokens.Create("bob", "script", ScopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	breakSave(t, tokensPath)
+
+	if err := tokens.Revoke("bob", token.Id); err == nil {
+		t.Error("Revoke() did not fail")
+	}
+	if err := tokens.DeleteUser("bob"); err == nil {
+		t.Error("DeleteUser() did not fail")
+	}
+	if _, _, err := tokens.Create("bob", "other", ScopeRead); err == nil {
+		t.Error("Create() did not fail")
+	}
+	if list := tokens.List("bob"); len(list) != 1 || list[0].Id != token.Id {
+		t.Errorf("tokens are %+v, want the first one", list)
+	}
+	if _, found := tokens.Authenticate(secret); !found {
+		t.Error("token no longer authenticates")
+	}
+}
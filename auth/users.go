@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinPasswordLength is the length passwords must have at least.
+const MinPasswordLength = 8
+
+var (
+	ErrInvalidCredentials = errors.New("invalid user name or password")
+	ErrUserExists         = errors.New("user already exists")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrSetupDone          = errors.New("the first user was already created")
+	ErrWeakPassword       = fmt.Errorf("the password needs at least %d characters", MinPasswordLength)
+	ErrInvalidUserName    = errors.New("the user name cannot be empty or contain spaces")
+)
+
+type User struct {
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"passwordHash"`
+	Admin        bool      `json:"admin"`
+	Created      time.Time `json:"created"`
+}
+
+// Users keeps the users in a json file, with their passwords hashed by bcrypt.
+type Users struct {
+	path  string
+	mutex sync.Mutex
+	users []User
+	// dummyHash is compared against when the user does not exist, so
+	// unknown users take as long to reject as wrong passwords
+	dummyHash []byte
+}
+
+// LoadUsers reads the users from the file, which is created with the first
+// user.
+func LoadUsers(usersPath string) (*Users, error) {
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("scanpi"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	u := &Users{path: usersPath, dummyHash: dummyHash}
+	data, err := ioutil.ReadFile(usersPath)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &u.users); err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot read users from %s. Error: %s", usersPath, err))
+	}
+	return u, nil
+}
+
+// Empty tells whether the first user still has to be created.
+func (u *Users) Empty() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return len(u.users) == 0
+}
+
+// List returns the users sorted by name.
+func (u *Users) List() []User {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	users := append([]User{}, u.users...)
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return users
+}
+
+// Find returns the user with the name.
+func (u *Users) Find(name string) (User, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if i := u.index(name); i >= 0 {
+		return u.users[i], nil
+	}
+	return User{}, ErrUserNotFound
+}
+
+// Setup creates the first user, an administrator. It fails once there is a
+// user.
+func (u *Users) Setup(name, password string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if len(u.users) > 0 {
+		return ErrSetupDone
+	}
+	return u.add(name, password, true)
+}
+
+func (u *Users) Add(name, password string, admin bool) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.add(name, password, admin)
+}
+
+func (u *Users) Delete(name string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	i := u.index(name)
+	if i < 0 {
+		return ErrUserNotFound
+	}
+	users := u.users
+	u.users = append(append([]User{}, users[:i]...), users[i+1:]...)
+	if err := u.save(); err != nil {
+		u.users = users
+		return err
+	}
+	return nil
+}
+
+func (u *Users) SetPassword(name, password string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	i := u.index(name)
+	if i < 0 {
+		return ErrUserNotFound
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	previous := u.users[i].PasswordHash
+	u.users[i].PasswordHash = hash
+	if err := u.save(); err != nil {
+		u.users[i].PasswordHash = previous
+		return err
+	}
+	return nil
+}
+
+// Authenticate returns the user when the password is right.
+func (u *Users) Authenticate(name, password string) (User, error) {
+	u.mutex.Lock()
+	i := u.index(name)
+	var user User
+	hash := u.dummyHash
+	if i >= 0 {
+		user = u.users[i]
+		hash = []byte(user.PasswordHash)
+	}
+	u.mutex.Unlock()
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || i < 0 {
+		return User{}, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+func (u *Users) add(name, password string, admin bool) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return ErrInvalidUserName
+	}
+	if u.index(name) >= 0 {
+		return ErrUserExists
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	users := u.users
+	u.users = append(append([]User{}, users...), User{Name: name, PasswordHash: hash, Admin: admin, Created: time.Now()})
+	if err := u.save(); err != nil {
+		u.users = users
+		return err
+	}
+	return nil
+}
+
+func (u *Users) index(name string) int {
+	for i, user := range u.users {
+		if user.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// save writes the users to a temporary file first, so a failure does not
+// lose them. The callers put the users back as they were when it fails.
+func (u *Users) save() error {
+	data, err := json.MarshalIndent(u.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporaryPath := path.Join(path.Dir(u.path), "."+path.Base(u.path))
+	if err := ioutil.WriteFile(temporaryPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, u.path)
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
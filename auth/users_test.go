@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUsersAuthenticate(t *testing.T) {
+	usersPath := path.Join(t.TempDir(), "users.json")
+	users, err := LoadUsers(usersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Setup("admin", "correct horse"); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	if err := users.Add("bob", "battery staple", false); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// the users are read back from the file
+	loaded, err := LoadUsers(usersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		user      string
+		password  string
+		wantAdmin bool
+		wantErr   error
+	}{
+		{"administrator", "admin", "correct horse", true, nil},
+		{"user", "bob", "battery staple", false, nil},
+		{"wrong password", "bob", "correct horse", false, ErrInvalidCredentials},
+		{"empty password", "bob", "", false, ErrInvalidCredentials},
+		{"unknown user", "eve", "battery staple", false, ErrInvalidCredentials},
+		// the dummy hash is not a password that signs anyone in
+		{"unknown user with the dummy password", "eve", "scanpi", false, ErrInvalidCredentials},
+		{"user name of another case", "Bob", "battery staple", false, ErrInvalidCredentials},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := loaded.Authenticate(test.user, test.password)
+			if err != test.wantErr {
+				t.Fatalf("Authenticate() error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && (user.Name != test.user || user.Admin != test.wantAdmin) {
+				t.Errorf("Authenticate() = %+v", user)
+			}
+			if err != nil && user != (User{}) {
+				t.Errorf("Authenticate() = %+v, want no user", user)
+			}
+		})
+	}
+}
+
+func TestUsersUnknownUserTakesAsLongAsWrongPassword(t *testing.T) {
+	users, err := LoadUsers(path.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Setup("admin", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	measure := func(name string) time.Duration {
+		start := time.Now()
+		if _, err := users.Authenticate(name, "wrong password"); err != ErrInvalidCredentials {
+			t.Fatalf("Authenticate(%s) error = %v", name, err)
+		}
+		return time.Since(start)
+	}
+	known, unknown := measure("admin"), measure("eve")
+	// both compare against a bcrypt hash of the same cost
+	if unknown < known/4 {
+		t.Errorf("unknown user rejected in %s, wrong password in %s", unknown, known)
+	}
+}
+
+func TestUsersAddAndSetup(t *testing.T) {
+	users, err := LoadUsers(path.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		add      func() error
+		wantErr  error
+		wantUser string
+	}{
+		{"weak password", func() error { return users.Setup("admin", "short") }, ErrWeakPassword, ""},
+		{"empty name", func() error { return users.Setup("", "correct horse") }, ErrInvalidUserName, ""},
+		{"name with spaces", func() error { return users.Setup("the admin", "correct horse") }, ErrInvalidUserName, ""},
+		{"first user", func() error { return users.Setup("admin", "correct horse") }, nil, "admin"},
+		{"setup done", func() error { return users.Setup("root", "correct horse") }, ErrSetupDone, ""},
+		{"user", func() error { return users.Add("bob", "battery staple", false) }, nil, "bob"},
+		{"existing user", func() error { return users.Add("bob", "battery staple", true) }, ErrUserExists, ""},
+	}
+	for _, test := range tests {
+		if err := test.add(); err != test.wantErr {
+			t.Errorf("%s: error = %v, want %v", test.name, err, test.wantErr)
+		}
+		if test.wantUser == "" {
+			continue
+		}
+		if _, err := users.Find(test.wantUser); err != nil {
+			t.Errorf("%s: Find() error = %v", test.name, err)
+		}
+	}
+	var names []string
+	for _, user := range users.List() {
+		names = append(names, user.Name)
+	}
+	if len(names) != 2 || names[0] != "admin" || names[1] != "bob" {
+		t.Errorf("List() = %v, want admin and bob", names)
+	}
+}
+
+func TestUsersSetupRacingAdd(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		users, err := LoadUsers(path.Join(t.TempDir(), "users.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		errs := make([]error, 4)
+		for j := range errs {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				if j == 0 {
+					errs[j] = users.Add("bob", "battery staple", false)
+					return
+				}
+				errs[j] = users.Setup([]string{"", "admin", "root", "alice"}[j], "correct horse")
+			}(j)
+		}
+		wg.Wait()
+
+		if errs[0] != nil {
+			t.Fatalf("Add() error = %v", errs[0])
+		}
+		setups := 0
+		for _, err := range errs[1:] {
+			switch err {
+			case nil:
+				setups++
+			case ErrSetupDone:
+			default:
+				t.Fatalf("Setup() error = %v", err)
+			}
+		}
+		// a setup after the user was added fails, so at most one
+		// administrator is made by the setups
+		admins := 0
+		for _, user := range users.List() {
+			if user.Admin {
+				admins++
+			}
+		}
+		if setups > 1 || admins != setups || len(users.List()) != 1+setups {
+			t.Errorf("%d setups succeeded, %d administrators of %d users", setups, admins, len(users.List()))
+		}
+	}
+}
+
+// breakSave makes the next saves to the file fail, replacing it by a
+// directory the temporary file cannot be renamed over.
+func breakSave(t *testing.T, filePath string) {
+	if err := os.Remove(filePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(filePath, "taken"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUsersUnchangedWhenSaveFails(t *testing.T) {
+	usersPath := path.Join(t.TempDir(), "users.json")
+	users, err := LoadUsers(usersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Setup("admin", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Add("bob", "battery staple", false); err != nil {
+		t.Fatal(err)
+	}
+	breakSave(t, usersPath)
+
+	if err := users.Delete("bob"); err == nil {
+		t.Error("Delete() did not fail")
+	}
+	if err := users.Add("carol", "correct horse", false); err == nil {
+		t.Error("Add() did not fail")
+	}
+	if err := users.SetPassword("bob", "new password"); err == nil {
+		t.Error("SetPassword() did not fail")
+	}
+
+	var names []string
+	for _, user := range users.List() {
+		names = append(names, user.Name)
+	}
+	if len(names) != 2 || names[0] != "admin" || names[1] != "bob" {
+		t.Errorf("users are %v, want admin and bob", names)
+	}
+	if _, err := users.Authenticate("bob", "battery staple"); err != nil {
+		t.Errorf("old password of bob: %v", err)
+	}
+	if _, err := users.Authenticate("bob", "new password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("new password of bob: %v", err)
+	}
+}
+
+func TestUsersDelete(t *testing.T) {
+	users, err := LoadUsers(path.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"admin", "bob", "carol"} {
+		if err := users.Add(name, "correct horse", name == "admin"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := users.Delete("bob"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := users.Delete("bob"); err != ErrUserNotFound {
+		t.Errorf("Delete() of a deleted user error = %v, want %v", err, ErrUserNotFound)
+	}
+	if _, err := users.Authenticate("bob", "correct horse"); err != ErrInvalidCredentials {
+		t.Errorf("deleted user signed in: %v", err)
+	}
+	if _, err := users.Authenticate("carol", "correct horse"); err != nil {
+		t.Errorf("Authenticate(carol) error = %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/adelolmo/scanpi/auth"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setUpAuth signs up an administrator and returns the secrets of a token of
+// every scope.
+func setUpAuth(t *testing.T) map[string]string {
+	var err error
+	if users, err = auth.LoadUsers(path.Join(appConfiguration.WorkDirectory, "users.json")); err != nil {
+		t.Fatal(err)
+	}
+	sessions = auth.LoadSessions(path.Join(appConfiguration.WorkDirectory, "sessions.json"), time.Hour)
+	if tokens, err = auth.LoadTokens(path.Join(appConfiguration.WorkDirectory, "tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := auth.NewProxy("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator = auth.NewAuthenticator(users, sessions, tokens, proxy, nil)
+	if err := users.Setup("admin", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	secrets := make(map[string]string)
+	for _, scope := range []string{auth.ScopeRead, auth.ScopeScan, auth.ScopeAdmin} {
+		_, secret, err := tokens.Create("admin", scope, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secrets[scope] = secret
+	}
+	return secrets
+}
+
+func TestScopeMiddleware(t *testing.T) {
+	_, closePools := setUpJob(t, "job")
+	closePools()
+	secrets := setUpAuth(t)
+	router := newRouter()
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		// wantStatus is the status by scope
+		wantStatus map[string]int
+	}{
+		{"read", http.MethodGet, "/api/v1/jobs", "", map[string]int{
+			auth.ScopeRead: http.StatusOK, auth.ScopeScan: http.StatusOK, auth.ScopeAdmin: http.StatusOK,
+		}},
+		{"create a job", http.MethodPost, "/api/v1/jobs", `{"name": "%s"}`, map[string]int{
+			auth.ScopeRead: http.StatusForbidden, auth.ScopeScan: http.StatusCreated, auth.ScopeAdmin: http.StatusCreated,
+		}},
+		{"create a job on the page", http.MethodPost, "/job", "", map[string]int{
+			auth.ScopeRead: http.StatusForbidden, auth.ScopeScan: http.StatusBadRequest, auth.ScopeAdmin: http.StatusBadRequest,
+		}},
+		{"delete a job", http.MethodDelete, "/api/v1/jobs/missing", "", map[string]int{
+			auth.ScopeRead: http.StatusForbidden, auth.ScopeScan: http.StatusForbidden, auth.ScopeAdmin: http.StatusNotFound,
+		}},
+		{"delete a page", http.MethodDelete, "/api/v1/jobs/job/pages/1.jpeg", "", map[string]int{
+			auth.ScopeRead: http.StatusForbidden, auth.ScopeScan: http.StatusForbidden, auth.ScopeAdmin: http.StatusNotFound,
+		}},
+		{"change the settings", http.MethodPut, "/api/v1/settings", "{}", map[string]int{
+			auth.ScopeRead: http.StatusForbidden, auth.ScopeScan: http.StatusForbidden, auth.ScopeAdmin: http.StatusOK,
+		}},
+	}
+	for _, test := range tests {
+		for _, scope := range []string{auth.ScopeRead, auth.ScopeScan, auth.ScopeAdmin} {
+			t.Run(test.name+" with "+scope, func(t *testing.T) {
+				body := strings.ReplaceAll(test.body, "%s", scope+"-job")
+				request := httptest.NewRequest(test.method, test.target, strings.NewReader(body))
+				request.Header.Set("Authorization", "Bearer "+secrets[scope])
+				request.Header.Set("Content-Type", "application/json")
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, request)
+				if recorder.Code != test.wantStatus[scope] {
+					t.Errorf("status = %d, want %d: %s", recorder.Code, test.wantStatus[scope], recorder.Body.String())
+				}
+			})
+		}
+	}
+}
+
+// TestScanRoutesExist keeps the routes granted to the scan scope in line with
+// the router, a renamed route would be out of reach of the scan tokens.
+func TestScanRoutesExist(t *testing.T) {
+	_, closePools := setUpJob(t, "job")
+	closePools()
+	setUpAuth(t)
+	routes := make(map[string]bool)
+	err := newRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			routes[method+" "+template] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for route := range scanRoutes {
+		if !routes[route] {
+			t.Errorf("scan route %s is not routed", route)
+		}
+		if strings.HasPrefix(route, http.MethodGet+" ") {
+			t.Errorf("scan route %s needs no scan scope", route)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The states of a scan.
+const (
+	ScanRunning = "scanning"
+	ScanDone    = "done"
+	ScanFailed  = "failed"
+)
+
+// The envelopes a job downloads in.
+const (
+	Zip  = "zip"
+	Tiff = "tiff"
+	Pdf  = "pdf"
+	PdfA = "pdfa"
+)
+
+// Error is the answer of scanpi to a request that failed.
+type Error struct {
+	Status  int    `json:"status"`
+	Message string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("scanpi answered %d: %s", e.Status, e.Message)
+}
+
+// NotFound tells whether the error is scanpi not finding the job, page or
+// scan.
+func NotFound(err error) bool {
+	var apiError *Error
+	return errors.As(err, &apiError) && apiError.Status == http.StatusNotFound
+}
+
+type Job struct {
+	Name      string    `json:"name"`
+	Created   time.Time `json:"created"`
+	PageCount int       `json:"pageCount"`
+	// Pages are only listed for a single job
+	Pages []Page `json:"pages,omitempty"`
+}
+
+type Page struct {
+	Name   string `json:"name"`
+	Number int    `json:"number"`
+	File   string `json:"file"`
+	// DocumentPages is the number of pages of a pdf document
+	DocumentPages int `json:"documentPages,omitempty"`
+}
+
+type Scan struct {
+	Id  string `json:"id"`
+	Job string `json:"job"`
+	// Page is the page the scan is stored as, once done
+	Page     string     `json:"page,omitempty"`
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+type Settings struct {
+	Mode       string `json:"mode"`
+	Format     string `json:"format"`
+	Resolution string `json:"resolution"`
+}
+
+// DownloadOptions select the pages of a job download and their conversion.
+// The zero value downloads every page as it was scanned.
+type DownloadOptions struct {
+	// Pages are like 1-3,5, every page when empty
+	Pages string
+	// Format is jpeg, png or tiff to convert the scans to
+	Format    string
+	Quality   int
+	MaxSize   int
+	Dpi       int
+	Grayscale bool
+}
+
+// Client calls the api of a scanpi server on behalf of the user of an api
+// token.
+type Client struct {
+	baseUrl    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewClient returns a client for the scanpi at the url, like
+// https://scanpi.local:8080, authenticated with the api token. A nil
+// httpClient uses http.DefaultClient.
+func NewClient(baseUrl, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseUrl:    strings.TrimSuffix(baseUrl, "/"),
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+// Jobs lists the jobs, without their pages.
+func (c *Client) Jobs(ctx context.Context) ([]Job, error) {
+	var jobs []Job
+	return jobs, c.call(ctx, http.MethodGet, "/jobs", nil, &jobs)
+}
+
+// Job returns the job with its pages.
+func (c *Client) Job(ctx context.Context, name string) (Job, error) {
+	var job Job
+	return job, c.call(ctx, http.MethodGet, jobPath(name), nil, &job)
+}
+
+// CreateJob creates the job, it fails with 409 when it exists.
+func (c *Client) CreateJob(ctx context.Context, name string) (Job, error) {
+	var job Job
+	return job, c.call(ctx, http.MethodPost, "/jobs", map[string]string{"name": name}, &job)
+}
+
+func (c *Client) RenameJob(ctx context.Context, name, newName string) (Job, error) {
+	var job Job
+	return job, c.call(ctx, http.MethodPatch, jobPath(name), map[string]string{"name": newName}, &job)
+}
+
+// DeleteJob moves the job to the trash.
+func (c *Client) DeleteJob(ctx context.Context, name string) error {
+	return c.call(ctx, http.MethodDelete, jobPath(name), nil, nil)
+}
+
+// Pages lists the pages of the job, in order.
+func (c *Client) Pages(ctx context.Context, job string) ([]Page, error) {
+	var pages []Page
+	return pages, c.call(ctx, http.MethodGet, jobPath(job)+"/pages", nil, &pages)
+}
+
+func (c *Client) Page(ctx context.Context, job, page string) (Page, error) {
+	var p Page
+	return p, c.call(ctx, http.MethodGet, pagePath(job, page), nil, &p)
+}
+
+// ReorderPages numbers the pages of the job again in the order given, which
+// lists every page of the job, and returns them with their new names.
+func (c *Client) ReorderPages(ctx context.Context, job string, pages []string) ([]Page, error) {
+	var reordered []Page
+	return reordered, c.call(ctx, http.MethodPut, jobPath(job)+"/pages/order",
+		map[string][]string{"pages": pages}, &reordered)
+}
+
+// DeletePage moves the page to the trash.
+func (c *Client) DeletePage(ctx context.Context, job, page string) error {
+	return c.call(ctx, http.MethodDelete, pagePath(job, page), nil, nil)
+}
+
+// StartScan scans a page into the job with the current settings. The scan
+// runs in background, WaitScan tells when it is done.
+func (c *Client) StartScan(ctx context.Context, job string) (Scan, error) {
+	var scan Scan
+	return scan, c.call(ctx, http.MethodPost, jobPath(job)+"/scans", nil, &scan)
+}
+
+// Scans returns the status of the latest scans, the newest first.
+func (c *Client) Scans(ctx context.Context) ([]Scan, error) {
+	var scans []Scan
+	return scans, c.call(ctx, http.MethodGet, "/scans", nil, &scans)
+}
+
+func (c *Client) Scan(ctx context.Context, id string) (Scan, error) {
+	var scan Scan
+	return scan, c.call(ctx, http.MethodGet, "/scans/"+url.PathEscape(id), nil, &scan)
+}
+
+// WaitScan asks for the status of the scan every interval until it is done
+// or failed. A failed scan is returned with an error.
+func (c *Client) WaitScan(ctx context.Context, id string, interval time.Duration) (Scan, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		scan, err := c.Scan(ctx, id)
+		if err != nil {
+			return scan, err
+		}
+		switch scan.State {
+		case ScanDone:
+			return scan, nil
+		case ScanFailed:
+			return scan, fmt.Errorf("scan %s failed: %s", id, scan.Error)
+		}
+		select {
+		case <-ctx.Done():
+			return scan, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) Settings(ctx context.Context) (Settings, error) {
+	var settings Settings
+	return settings, c.call(ctx, http.MethodGet, "/settings", nil, &settings)
+}
+
+// UpdateSettings changes the settings of the next scans.
+func (c *Client) UpdateSettings(ctx context.Context, settings Settings) (Settings, error) {
+	var saved Settings
+	return saved, c.call(ctx, http.MethodPut, "/settings", settings, &saved)
+}
+
+// DownloadPage writes the scan of the page, an image or a pdf document, to w.
+func (c *Client) DownloadPage(ctx context.Context, job, page string, w io.Writer) error {
+	return c.download(ctx, pagePath(job, page)+"/file", w)
+}
+
+// DownloadJob writes the pages of the job to w, in a single file of the
+// envelope: Zip, Tiff, Pdf or PdfA.
+func (c *Client) DownloadJob(ctx context.Context, job, envelope string, options DownloadOptions, w io.Writer) error {
+	query := url.Values{}
+	query.Set("envelope", envelope)
+	if options.Pages != "" {
+		query.Set("pages", options.Pages)
+	}
+	if options.Format != "" {
+		query.Set("format", options.Format)
+	}
+	for name, value := range map[string]int{
+		"quality": options.Quality,
+		"maxSize": options.MaxSize,
+		"dpi":     options.Dpi,
+	} {
+		if value > 0 {
+			query.Set(name, strconv.Itoa(value))
+		}
+	}
+	if options.Grayscale {
+		query.Set("gray", "true")
+	}
+	return c.download(ctx, jobPath(job)+"/download?"+query.Encode(), w)
+}
+
+func (c *Client) download(ctx context.Context, path string, w io.Writer) error {
+	response, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if _, err := io.Copy(w, response.Body); err != nil {
+		return fmt.Errorf("cannot download %s: %w", path, err)
+	}
+	return nil
+}
+
+// call sends the body as json and decodes the json answer into result,
+// unless nil.
+func (c *Client) call(ctx context.Context, method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	response, err := c.do(ctx, method, path, reader)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("cannot read the answer to %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// do sends the request, and turns answers other than 2xx into an *Error.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, c.baseUrl+"/api/v1"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return response, nil
+	}
+	defer response.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1<<16))
+	apiError := &Error{}
+	if err := json.Unmarshal(data, apiError); err != nil || apiError.Message == "" {
+		// answered by the pages or a proxy rather than the api
+		apiError.Message = strings.TrimSpace(string(data))
+	}
+	apiError.Status = response.StatusCode
+	return nil, apiError
+}
+
+func jobPath(job string) string {
+	return "/jobs/" + url.PathEscape(job)
+}
+
+func pagePath(job, page string) string {
+	return jobPath(job) + "/pages/" + url.PathEscape(page)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/adelolmo/scanpi/fsutils"
+	"github.com/adelolmo/scanpi/graphic"
+	"github.com/adelolmo/scanpi/worker"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const usage = `usage: scanpi [command] [flags]
+
+Without command the web interface is served.
+
+commands:
+  serve                                   serve the web interface and the api
+  scan --job X [--profile Y]              scan a page into the job, created when missing
+  jobs list                               list the jobs with their number of pages
+  export --job X [--format pdf] [-o file] write the pages of the job to the file
+  thumbnails rebuild                      regenerate the missing and stale thumbnails of every job
+  fsck [--repair]                         check the links, sidecars and thumbnails of every job
+
+Run a command with -h for its flags.
+`
+
+// profilesFile is the file in the work directory naming sets of scan
+// settings, like {"invoices": {"mode": "Gray", "format": "jpeg", "resolution": "300"}}.
+const profilesFile = "profiles.json"
+
+var errProfileNotFound = errors.New("profile not found")
+
+// runCommand runs the command given on the command line, serving the web
+// interface without one, and returns the exit code.
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	switch args[0] {
+	case "serve":
+		if len(args) == 1 {
+			serveWeb()
+			return 0
+		}
+	case "scan":
+		return scanCommand(args[1:])
+	case "jobs":
+		if len(args) == 2 && args[1] == "list" {
+			return listJobsCommand()
+		}
+	case "export":
+		return exportCommand(args[1:])
+	case "thumbnails":
+		if len(args) == 2 && args[1] == "rebuild" {
+			return rebuildThumbnails()
+		}
+	case "fsck":
+		return fsckCommand(args[1:])
+	}
+	fmt.Fprint(os.Stderr, usage)
+	return 2
+}
+
+// newFlagSet returns the flags of the command, which print their usage to the
+// standard error.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet("scanpi "+name, flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	return flags
+}
+
+// parseFlags tells whether the arguments are valid for the flags, and the
+// required ones are set.
+func parseFlags(flags *flag.FlagSet, args []string, required ...string) bool {
+	if err := flags.Parse(args); err != nil {
+		return false
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument: %s\n", flags.Arg(0))
+		flags.Usage()
+		return false
+	}
+	for _, name := range required {
+		if flags.Lookup(name).Value.String() == "" {
+			fmt.Fprintf(os.Stderr, "flag needs a value: -%s\n", name)
+			flags.Usage()
+			return false
+		}
+	}
+	return true
+}
+
+// commandUser returns the user running the command, for the activity log.
+func commandUser() string {
+	current, err := user.Current()
+	if err != nil {
+		return "-"
+	}
+	return current.Username
+}
+
+func scanCommand(args []string) int {
+	flags := newFlagSet("scan")
+	jobName := flags.String("job", "", "the job to scan the page into, created when missing")
+	profile := flags.String("profile", "", "the profile of "+profilesFile+" to scan with, the settings of the web interface when empty")
+	if !parseFlags(flags, args, "job") {
+		return 2
+	}
+
+	settings := readSettings()
+	if *profile != "" {
+		var err error
+		if settings, err = readProfile(*profile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	username := commandUser()
+	if _, err := createJob(username, *jobName); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resolution, _ := strconv.Atoi(settings.Resolution)
+	format := graphic.ToFormat(settings.Format)
+	imageDetails, err := scanTarget(*jobName, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	thumbnails := worker.NewPool("thumbnail", appConfiguration.Workers, workerQueueSize)
+	recognition := worker.NewPool("ocr", appConfiguration.Workers, workerQueueSize)
+	scanJob := graphic.NewScanJob(
+		graphic.ToMode(settings.Mode),
+		format,
+		resolution,
+		graphic.NewPostProcessor(thumb, ocr, thumbnails, recognition),
+		path.Join(appConfiguration.WorkDirectory, scannerLockFile),
+	)
+	imageDetails, err = scanJob.Scan(imageDetails)
+	// the thumbnail queues the text recognition, it is closed first
+	thumbnails.Close()
+	recognition.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	recordActivity(username, "scanned page %q into job %q", imageDetails.LinkFilename(), *jobName)
+	fmt.Println(imageDetails.LinkPath())
+	return 0
+}
+
+// readProfile returns the scan settings of the profile, checked like the
+// settings of the web interface.
+func readProfile(name string) (*settings, error) {
+	profilesPath := path.Join(appConfiguration.WorkDirectory, profilesFile)
+	data, err := ioutil.ReadFile(profilesPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: '%s', %s does not exist", errProfileNotFound, name, profilesPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var profiles map[string]*settings
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot read profiles from %s. Error: %s", profilesPath, err))
+	}
+	profile, found := profiles[name]
+	if !found {
+		return nil, fmt.Errorf("%w: '%s'", errProfileNotFound, name)
+	}
+	if err := validateSettings(profile); err != nil {
+		return nil, fmt.Errorf("profile '%s': %w", name, err)
+	}
+	return profile, nil
+}
+
+func listJobsCommand() int {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tPAGES\tCREATED")
+	for _, jobName := range listJobs() {
+		scans, err := listJobImages(jobName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", jobName, len(scans),
+			jobCreationDate(jobName, scans).Format("2006-01-02 15:04"))
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func exportCommand(args []string) int {
+	flags := newFlagSet("export")
+	jobName := flags.String("job", "", "the job to export")
+	envelope := flags.String("format", "pdf", "the file to export the pages in: zip, tiff, pdf or pdfa")
+	pages := flags.String("pages", "", "the pages to export, like 1-3,5, every page when empty")
+	output := flags.String("o", "", "the file to write, the standard output when empty or -")
+	if !parseFlags(flags, args, "job") {
+		return 2
+	}
+	if _, err := envelopeExtension(*envelope); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	scans, err := listJobImages(*jobName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if scans, err = selectPages(scans, *pages); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *output == "" || *output == "-" {
+		if err := writeJob(os.Stdout, *jobName, *envelope, scans, graphic.Conversion{}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	if err := exportToFile(*output, *jobName, *envelope, scans); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%d pages of job %s exported to %s\n", len(scans), *jobName, *output)
+	return 0
+}
+
+// exportToFile writes the pages next to the file first, so a failed export
+// does not leave half a file behind or replace the previous one.
+func exportToFile(output, jobName, envelope string, scans []image) error {
+	file, err := ioutil.TempFile(path.Dir(output), "."+path.Base(output)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err := writeJob(file, jobName, envelope, scans, graphic.Conversion{}); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), output)
+}
+
+func rebuildThumbnails() int {
+	err := thumbnailRebuild.Run(func(progress graphic.RebuildProgress) {
+		fmt.Printf("\r%d/%d scans, %d regenerated, %d skipped, %d failed",
+			progress.Processed, progress.Total, progress.Regenerated, progress.Skipped, progress.Failed)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	progress := thumbnailRebuild.Progress()
+	fmt.Printf("\rthumbnails of %d scans rebuilt in %.1fs, %d regenerated, %d skipped, %d failed\n",
+		progress.Total, progress.Finished.Sub(progress.Started).Seconds(),
+		progress.Regenerated, progress.Skipped, progress.Failed)
+	if progress.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// fsckCommand reports the problems of every job, and repairs them when asked.
+// It exits with 1 while problems are left.
+func fsckCommand(args []string) int {
+	flags := newFlagSet("fsck")
+	repair := flags.Bool("repair", false, "repair the problems found")
+	if !parseFlags(flags, args) {
+		return 2
+	}
+	if *repair {
+		// a scan writes its file before linking it, the repair would take
+		// the file for an orphan
+		unlock, err := fsutils.LockFile(path.Join(appConfiguration.WorkDirectory, scannerLockFile))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer unlock()
+	}
+
+	found, left := 0, 0
+	report := func(jobName, description string, repairProblem func() error) {
+		found++
+		if !*repair {
+			fmt.Printf("%s: %s\n", jobName, description)
+			left++
+			return
+		}
+		if err := repairProblem(); err != nil {
+			fmt.Printf("%s: %s, cannot repair: %s\n", jobName, description, err)
+			left++
+			return
+		}
+		fmt.Printf("%s: %s, repaired\n", jobName, description)
+	}
+
+	for _, jobName := range listJobs() {
+		jobPath, err := resolver.Job(jobName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		problems, err := fsutils.CheckJob(jobPath, pageSidecars...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, problem := range problems {
+			report(jobName, problem.Description, problem.Repair)
+		}
+
+		// the links are repaired first, so the thumbnails of pages linked
+		// again are checked too
+		scans, err := listJobImages(jobName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, scan := range scans {
+			imagePath := path.Join(jobPath, scan.Name)
+			if _, err := os.Stat(thumb.PreviewPath(imagePath)); !os.IsNotExist(err) {
+				continue
+			}
+			ext := path.Ext(scan.Name)
+			imageDetails := graphic.ImageDetails{
+				Name:          strings.TrimSuffix(scan.Name, ext),
+				LinkName:      strings.TrimSuffix(scan.LinkName, ext),
+				Format:        graphic.ToFormat(ext[1:]),
+				Directory:     jobName,
+				BaseDirectory: appConfiguration.OutputDirectory,
+			}
+			report(jobName, fmt.Sprintf("page %s has no thumbnail", scan.LinkName), func() error {
+				return thumb.GenerateThumbnail(imageDetails)
+			})
+		}
+	}
+
+	switch {
+	case found == 0:
+		fmt.Println("no problems found")
+	case left == 0:
+		fmt.Printf("%d problems repaired\n", found)
+	case *repair:
+		fmt.Printf("%d problems found, %d left\n", found, left)
+	default:
+		fmt.Printf("%d problems found, run scanpi fsck --repair to repair them\n", found)
+	}
+	if left > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,131 @@
+package fsutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Problem is an inconsistency between the scans of a job and their links.
+type Problem struct {
+	Description string
+	repair      func() error
+}
+
+// Repair fixes the problem, removing what is left of deleted pages and
+// linking the scans that lost their page at the end of the job.
+func (p Problem) Repair() error {
+	return p.repair()
+}
+
+// CheckJob looks in the directory of a job for links to missing files,
+// sidecars of missing scans and scans no page links to.
+func CheckJob(dir string, sidecars ...string) ([]Problem, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var problems []Problem
+	linked := make(map[string]bool)
+	for _, file := range files {
+		if file.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		linkPath := path.Join(dir, file.Name())
+		target, err := os.Readlink(linkPath)
+		if err != nil {
+			return nil, err
+		}
+		if ValidName(target) != nil {
+			// links to files outside of the directory are not scans
+			continue
+		}
+		if _, err := os.Stat(path.Join(dir, target)); os.IsNotExist(err) {
+			problems = append(problems, Problem{
+				Description: fmt.Sprintf("%s links to the missing file %s", file.Name(), target),
+				repair: func() error {
+					return os.Remove(linkPath)
+				},
+			})
+			continue
+		}
+		linked[target] = true
+	}
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		filePath := path.Join(dir, file.Name())
+		if scan, isSidecar := sidecarOf(file.Name(), sidecars); isSidecar {
+			if _, err := os.Stat(path.Join(dir, scan)); os.IsNotExist(err) {
+				problems = append(problems, Problem{
+					Description: fmt.Sprintf("%s belongs to the missing scan %s", file.Name(), scan),
+					repair: func() error {
+						return os.Remove(filePath)
+					},
+				})
+			}
+			continue
+		}
+		if !isScan(file.Name()) || linked[file.Name()] {
+			continue
+		}
+		filename := file.Name()
+		problems = append(problems, Problem{
+			Description: fmt.Sprintf("%s is not a page of the job", filename),
+			repair: func() error {
+				return linkScan(dir, filename, sidecars)
+			},
+		})
+	}
+	return problems, nil
+}
+
+// linkScan links the scan, and its sidecars, as the last page of the job.
+func linkScan(dir, filename string, sidecars []string) error {
+	linkName, err := NextLinkName(dir)
+	if err != nil {
+		return err
+	}
+	linkName += path.Ext(filename)
+	if err := os.Symlink(filename, path.Join(dir, linkName)); err != nil {
+		return err
+	}
+	for _, sidecar := range sidecars {
+		if _, err := os.Stat(path.Join(dir, filename+sidecar)); err != nil {
+			continue
+		}
+		if err := os.Symlink(filename+sidecar, path.Join(dir, linkName+sidecar)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sidecarOf returns the scan the file is a sidecar of.
+func sidecarOf(filename string, sidecars []string) (string, bool) {
+	for _, sidecar := range sidecars {
+		if strings.HasSuffix(filename, sidecar) {
+			return strings.TrimSuffix(filename, sidecar), true
+		}
+	}
+	return "", false
+}
+
+// isScan tells whether the file is a scan, like 20060102150405.jpeg. The
+// sidecars, and the temporary files written next to the scans, like
+// 20060102150405.jpeg.thumbnail.jpeg, have more than one extension.
+func isScan(filename string) bool {
+	ext := path.Ext(filename)
+	if strings.Contains(strings.TrimSuffix(filename, ext), ".") {
+		return false
+	}
+	switch ext {
+	case ".tiff", ".png", ".jpeg", ".pnm", ".pdf":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package fsutils
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestIsScan(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     bool
+	}{
+		{"20240102030405.jpeg", true},
+		{"20240102030405.png", true},
+		{"20240102030405.tiff", true},
+		{"20240102030405.pnm", true},
+		{"20240102030405.pdf", true},
+		{"20240102030405.jpeg.thumbnail", false},
+		{"20240102030405.jpeg.txt", false},
+		{"20240102030405.jpeg.hocr", false},
+		{"20240102030405.jpeg.thumbnail.jpeg", false},
+		{"20240102030405.png.upload", false},
+		{"20240102030405.txt", false},
+		{"20240102030405", false},
+	}
+	for _, test := range tests {
+		if got := isScan(test.filename); got != test.want {
+			t.Errorf("isScan(%q) = %v, want %v", test.filename, got, test.want)
+		}
+	}
+}
+
+func TestCheckJob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"20240102030405.jpeg", "20240102030405.jpeg.thumbnail", "20240102030405.jpeg.thumbnail.jpeg",
+		"20240102030406.png", "20240102030407.jpeg.txt",
+	} {
+		if err := os.WriteFile(path.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"1.jpeg":           "20240102030405.jpeg",
+		"1.jpeg.thumbnail": "20240102030405.jpeg.thumbnail",
+		"2.tiff":           "20240102030408.tiff",
+	} {
+		if err := os.Symlink(target, path.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := CheckJob(dir, ".thumbnail", ".txt", ".hocr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var descriptions []string
+	for _, problem := range problems {
+		descriptions = append(descriptions, problem.Description)
+	}
+	want := []string{
+		"2.tiff links to the missing file 20240102030408.tiff",
+		"20240102030406.png is not a page of the job",
+		"20240102030407.jpeg.txt belongs to the missing scan 20240102030407.jpeg",
+	}
+	if !reflect.DeepEqual(descriptions, want) {
+		t.Errorf("CheckJob() = %q, want %q", descriptions, want)
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/adelolmo/scanpi/logger"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -17,6 +21,12 @@ type FileMetaData struct {
 	LinkName string
 }
 
+// ErrInvalidOrder tells that a new order of the pages does not list every
+// page of the job exactly once.
+var ErrInvalidOrder = errors.New("the order must list every page of the job once")
+
+// ImageFilesOnDirectory returns the scans linked in the directory, in the
+// order of their link numbers. Links without a number go last, by date.
 func ImageFilesOnDirectory(dir string) ([]FileMetaData, error) {
 	metaData := make([]FileMetaData, 0)
 	files, err := ioutil.ReadDir(dir)
@@ -24,7 +34,15 @@ func ImageFilesOnDirectory(dir string) ([]FileMetaData, error) {
 		logger.Error(fmt.Sprintf("unable to get images from directory '%s'", dir))
 		return []FileMetaData{}, err
 	}
-	sort.Slice(files, func(i, j int) bool {
+	sort.SliceStable(files, func(i, j int) bool {
+		first, firstNumbered := linkNumber(files[i].Name())
+		second, secondNumbered := linkNumber(files[j].Name())
+		if firstNumbered && secondNumbered {
+			return first < second
+		}
+		if firstNumbered != secondNumbered {
+			return firstNumbered
+		}
 		return files[i].ModTime().Before(files[j].ModTime())
 	})
 	for _, file := range files {
@@ -39,9 +57,7 @@ func ImageFilesOnDirectory(dir string) ([]FileMetaData, error) {
 			fmt.Println("error: " + err.Error())
 			continue
 		}
-
-		ext := path.Ext(readlink)
-		if ext != ".tiff" && ext != ".png" && ext != ".jpeg" && ext != ".pnm" && ext != ".pdf" {
+		if !pageTarget(readlink) {
 			continue
 		}
 		metaData = append(metaData, FileMetaData{
@@ -53,15 +69,47 @@ func ImageFilesOnDirectory(dir string) ([]FileMetaData, error) {
 	return metaData, nil
 }
 
+// pageTarget tells whether a link pointing to the file makes a page: links to
+// files outside of the directory and to other files than scans do not.
+func pageTarget(readlink string) bool {
+	if ValidName(readlink) != nil {
+		return false
+	}
+	switch path.Ext(readlink) {
+	case ".tiff", ".png", ".jpeg", ".pnm", ".pdf":
+		return true
+	}
+	return false
+}
+
 func GenerateDateFilename() string {
 	return time.Now().Format("20060102150405")
 }
 
+// AvailableDateFilename returns the dated filename with the extension, or the
+// first one after it that is not taken in the directory.
+func AvailableDateFilename(dir, name, ext string) string {
+	filename := name + ext
+	for {
+		if _, err := os.Lstat(path.Join(dir, filename)); os.IsNotExist(err) {
+			return filename
+		}
+		date, err := time.ParseInLocation("20060102150405", strings.TrimSuffix(filename, ext), time.Local)
+		if err != nil {
+			date = time.Now()
+		}
+		filename = date.Add(time.Second).Format("20060102150405") + ext
+	}
+}
+
 func DeleteFileAndLink(filePath string) error {
 	readlink, err := os.Readlink(filePath)
 	if err != nil {
 		return errors.New(fmt.Sprintf("unable to resolve symlink %s. error: %v", filePath, err))
 	}
+	if err := ValidName(readlink); err != nil {
+		return err
+	}
 
 	// delete file
 	if err := os.Remove(path.Join(path.Dir(filePath), readlink)); err != nil {
@@ -75,3 +123,358 @@ func DeleteFileAndLink(filePath string) error {
 
 	return nil
 }
+
+// NextLinkName returns the number following the highest numbered link in the
+// directory.
+func NextLinkName(dir string) (string, error) {
+	files, err := ImageFilesOnDirectory(dir)
+	if err != nil {
+		return "", err
+	}
+	last := 0
+	for _, file := range files {
+		if number, numbered := linkNumber(file.LinkName); numbered && number > last {
+			last = number
+		}
+	}
+	return strconv.Itoa(last + 1), nil
+}
+
+// ReorderLinks numbers the links of the directory again from 1, in the order
+// of the link names given, which must be every scan of the directory. The
+// links of the sidecars are renamed along.
+func ReorderLinks(dir string, linkNames []string, sidecars ...string) error {
+	files, err := ImageFilesOnDirectory(dir)
+	if err != nil {
+		return err
+	}
+	remaining := make(map[string]bool)
+	for _, file := range files {
+		remaining[file.LinkName] = true
+	}
+	if len(linkNames) != len(files) {
+		return ErrInvalidOrder
+	}
+	for _, linkName := range linkNames {
+		if !remaining[linkName] {
+			return ErrInvalidOrder
+		}
+		delete(remaining, linkName)
+	}
+
+	// the links are moved aside first, so the new names do not clash with the
+	// current ones
+	suffixes := append([]string{""}, sidecars...)
+	for i, linkName := range linkNames {
+		for _, suffix := range suffixes {
+			err := os.Rename(path.Join(dir, linkName+suffix), path.Join(dir, fmt.Sprintf(".reorder-%d%s", i, suffix)))
+			if err != nil && !os.IsNotExist(err) {
+				return errors.New(fmt.Sprintf("unable to rename symlink %s. error: %v", linkName+suffix, err))
+			}
+		}
+	}
+	for i, linkName := range linkNames {
+		newName := strconv.Itoa(i+1) + path.Ext(linkName)
+		for _, suffix := range suffixes {
+			err := os.Rename(path.Join(dir, fmt.Sprintf(".reorder-%d%s", i, suffix)), path.Join(dir, newName+suffix))
+			if err != nil && !os.IsNotExist(err) {
+				return errors.New(fmt.Sprintf("unable to rename symlink %s. error: %v", newName+suffix, err))
+			}
+		}
+	}
+	return nil
+}
+
+// linkNumber returns the number of the link name, e.g. 3 for 3.jpeg.
+func linkNumber(linkName string) (int, bool) {
+	number, err := strconv.Atoi(strings.TrimSuffix(linkName, path.Ext(linkName)))
+	return number, err == nil
+}
+
+// TransferFileAndLink moves, or copies when keepSource is set, the file behind
+// the symlink into the target directory and links it there with the next link
+// number. The files named after it with one of the sidecar suffixes go along,
+// and so do their symlinks. The file keeps its name unless it is taken in the
+// target directory, in which case the date of the name is moved forward.
+func TransferFileAndLink(linkPath, targetDir string, keepSource bool, sidecars ...string) (string, error) {
+	linkName, err := NextLinkName(targetDir)
+	if err != nil {
+		return "", err
+	}
+	return transferFileAndLink(linkPath, targetDir, linkName, keepSource, sidecars)
+}
+
+// transferFileAndLink transfers the file like TransferFileAndLink, linking it
+// with the given number. When a file or link of the page fails, the ones
+// already transferred are taken back.
+func transferFileAndLink(linkPath, targetDir, linkName string, keepSource bool, sidecars []string) (string, error) {
+	readlink, err := os.Readlink(linkPath)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("unable to resolve symlink %s. error: %v", linkPath, err))
+	}
+	if err := ValidName(readlink); err != nil {
+		return "", err
+	}
+	sourceDir := path.Dir(linkPath)
+	ext := path.Ext(readlink)
+
+	filename := AvailableDateFilename(targetDir, strings.TrimSuffix(readlink, ext), ext)
+	linkFilename := linkName + ext
+
+	var undo []func() error
+	fail := func(err error) (string, error) {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if undoErr := undo[i](); undoErr != nil {
+				return "", errors.New(fmt.Sprintf("%s, and the page is left half transferred. error: %v", err, undoErr))
+			}
+		}
+		return "", err
+	}
+	for _, suffix := range append([]string{""}, sidecars...) {
+		source := path.Join(sourceDir, readlink+suffix)
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			continue
+		}
+		target := path.Join(targetDir, filename+suffix)
+		if keepSource {
+			err = copyFile(source, target)
+		} else {
+			err = moveFile(source, target)
+		}
+		if err != nil {
+			return fail(errors.New(fmt.Sprintf("unable to transfer file %s to %s. error: %v", source, target, err)))
+		}
+		if keepSource {
+			undo = append(undo, func() error { return os.Remove(target) })
+		} else {
+			undo = append(undo, func() error { return moveFile(target, source) })
+		}
+
+		sourceLink := path.Join(sourceDir, path.Base(linkPath)+suffix)
+		sourceTarget, err := os.Readlink(sourceLink)
+		if err != nil {
+			continue
+		}
+		targetLink := path.Join(targetDir, linkFilename+suffix)
+		if err := os.Symlink(filename+suffix, targetLink); err != nil {
+			return fail(errors.New(fmt.Sprintf("unable to create symlink %s. error: %v", linkFilename+suffix, err)))
+		}
+		undo = append(undo, func() error { return os.Remove(targetLink) })
+		if !keepSource {
+			if err := os.Remove(sourceLink); err != nil {
+				return fail(errors.New(fmt.Sprintf("unable to delete symlink %s. error: %v", sourceLink, err)))
+			}
+			undo = append(undo, func() error { return os.Symlink(sourceTarget, sourceLink) })
+		}
+	}
+	return linkFilename, nil
+}
+
+// RevertTransfer takes back the page TransferFileAndLink transferred to the
+// target link: a moved page goes back to the source link, a copied one is
+// deleted.
+func RevertTransfer(targetLinkPath, sourceLinkPath string, keepSource bool, sidecars ...string) error {
+	if !keepSource {
+		sourceLinkName := path.Base(sourceLinkPath)
+		_, err := transferFileAndLink(targetLinkPath, path.Dir(sourceLinkPath),
+			strings.TrimSuffix(sourceLinkName, path.Ext(sourceLinkName)), false, sidecars)
+		return err
+	}
+	readlink, err := os.Readlink(targetLinkPath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to resolve symlink %s. error: %v", targetLinkPath, err))
+	}
+	if err := ValidName(readlink); err != nil {
+		return err
+	}
+	targetDir := path.Dir(targetLinkPath)
+	for _, suffix := range append([]string{""}, sidecars...) {
+		for _, name := range []string{path.Join(targetDir, readlink+suffix), targetLinkPath + suffix} {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return errors.New(fmt.Sprintf("unable to delete %s. error: %v", name, err))
+			}
+		}
+	}
+	return nil
+}
+
+// CheckTransfer tells whether the pages of the links can be transferred into
+// the target directory before any is: their files can be read, the directory
+// can be written and it has room for the files copied, which are the moved
+// ones too when it is on another file system.
+func CheckTransfer(targetDir string, linkPaths []string, keepSource bool, sidecars ...string) error {
+	target, err := os.Stat(targetDir)
+	if err != nil {
+		return err
+	}
+	targetDevice := target.Sys().(*syscall.Stat_t).Dev
+	var size int64
+	for _, linkPath := range linkPaths {
+		readlink, err := os.Readlink(linkPath)
+		if err != nil {
+			return errors.New(fmt.Sprintf("unable to resolve symlink %s. error: %v", linkPath, err))
+		}
+		if err := ValidName(readlink); err != nil {
+			return err
+		}
+		for _, suffix := range append([]string{""}, sidecars...) {
+			info, err := os.Stat(path.Join(path.Dir(linkPath), readlink+suffix))
+			if os.IsNotExist(err) && suffix != "" {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if keepSource || info.Sys().(*syscall.Stat_t).Dev != targetDevice {
+				size += info.Size()
+			}
+		}
+	}
+
+	probe, err := ioutil.TempFile(targetDir, ".transfer-")
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to write into %s. error: %v", targetDir, err))
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	if size == 0 {
+		return nil
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(targetDir, &stat); err != nil {
+		return err
+	}
+	if free := int64(stat.Bavail) * int64(stat.Bsize); size > free {
+		return errors.New(fmt.Sprintf("%d MB to transfer into %s, only %d MB free", size>>20, targetDir, free>>20))
+	}
+	return nil
+}
+
+// makeRoomForLink renumbers the links from the number on one up, with the
+// links of their sidecars, when a link already has the number. It tells
+// whether the links were renumbered.
+func makeRoomForLink(dir string, number int, sidecars []string) (bool, error) {
+	files, err := ImageFilesOnDirectory(dir)
+	if err != nil {
+		return false, err
+	}
+	taken := false
+	for _, file := range files {
+		if n, numbered := linkNumber(file.LinkName); numbered && n == number {
+			taken = true
+		}
+	}
+	if !taken {
+		return false, nil
+	}
+	// the files are sorted by number, the highest is moved first so the new
+	// names are free
+	suffixes := append([]string{""}, sidecars...)
+	for i := len(files) - 1; i >= 0; i-- {
+		n, numbered := linkNumber(files[i].LinkName)
+		if !numbered || n < number {
+			continue
+		}
+		newName := strconv.Itoa(n+1) + path.Ext(files[i].LinkName)
+		for _, suffix := range suffixes {
+			err := os.Rename(path.Join(dir, files[i].LinkName+suffix), path.Join(dir, newName+suffix))
+			if err != nil && !os.IsNotExist(err) {
+				return true, errors.New(fmt.Sprintf("unable to rename symlink %s. error: %v", files[i].LinkName+suffix, err))
+			}
+		}
+	}
+	return true, nil
+}
+
+// closeRoomForLink undoes makeRoomForLink: the links after the number go one
+// down, with the links of their sidecars. No link may have the number.
+func closeRoomForLink(dir string, number int, sidecars []string) error {
+	files, err := ImageFilesOnDirectory(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if n, numbered := linkNumber(file.LinkName); numbered && n == number {
+			return errors.New(fmt.Sprintf("unable to renumber the links after %s, it is linked", file.LinkName))
+		}
+	}
+	// the files are sorted by number, the lowest is moved first so the new
+	// names are free
+	suffixes := append([]string{""}, sidecars...)
+	for _, file := range files {
+		n, numbered := linkNumber(file.LinkName)
+		if !numbered || n <= number {
+			continue
+		}
+		newName := strconv.Itoa(n-1) + path.Ext(file.LinkName)
+		for _, suffix := range suffixes {
+			err := os.Rename(path.Join(dir, file.LinkName+suffix), path.Join(dir, newName+suffix))
+			if err != nil && !os.IsNotExist(err) {
+				return errors.New(fmt.Sprintf("unable to rename symlink %s. error: %v", file.LinkName+suffix, err))
+			}
+		}
+	}
+	return nil
+}
+
+func copyFile(source, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// moveFile renames the file or directory, copying it when the target is on
+// another file system.
+func moveFile(source, target string) error {
+	err := os.Rename(source, target)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyTree(source, target); err != nil {
+		os.RemoveAll(target)
+		return err
+	}
+	return os.RemoveAll(source)
+}
+
+// copyTree copies the file, the symlink or the directory with its content.
+func copyTree(source, target string) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	case info.IsDir():
+		if err := os.Mkdir(target, info.Mode().Perm()); err != nil {
+			return err
+		}
+		files, err := ioutil.ReadDir(source)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := copyTree(path.Join(source, file.Name()), path.Join(target, file.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return copyFile(source, target)
+}
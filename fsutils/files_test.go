@@ -0,0 +1,373 @@
+package fsutils
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writePages writes the files of the pages, by link name, into the directory
+// with a linked thumbnail and an unlinked text of every page.
+func writePages(t *testing.T, dir string, pages map[string]string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, filename := range pages {
+		for _, suffix := range []string{"", ".thumbnail", ".txt"} {
+			if err := os.WriteFile(path.Join(dir, filename+suffix), []byte(filename+suffix), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if suffix == ".txt" {
+				continue
+			}
+			if err := os.Symlink(filename+suffix, path.Join(dir, link+suffix)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// regularFiles returns the names of the files of the directory that are not
+// links.
+func regularFiles(t *testing.T, dir string) []string {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, file := range files {
+		if file.Type().IsRegular() {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pageLinks returns the links of the pages and their thumbnails, like
+// jobLinks, for the pages given by link name and file name.
+func pageLinks(pages map[string]string) map[string]string {
+	links := make(map[string]string)
+	for link, filename := range pages {
+		links[link] = filename
+		links[link+".thumbnail"] = filename + ".thumbnail"
+	}
+	return links
+}
+
+// pageFiles returns the names of the files of the pages, like regularFiles.
+func pageFiles(filenames ...string) []string {
+	names := make([]string, 0)
+	for _, filename := range filenames {
+		names = append(names, filename, filename+".thumbnail", filename+".txt")
+	}
+	sort.Strings(names)
+	return names
+}
+
+var sidecars = []string{".thumbnail", ".txt"}
+
+func TestNextLinkName(t *testing.T) {
+	tests := []struct {
+		name  string
+		pages map[string]string
+		// links are written besides the pages
+		links map[string]string
+		want  string
+	}{
+		{"empty directory", nil, nil, "1"},
+		{"pages", map[string]string{"1.jpeg": "20240102030401.jpeg", "2.png": "20240102030402.png"}, nil, "3"},
+		{"gap in the numbers", map[string]string{"1.jpeg": "20240102030401.jpeg", "3.jpeg": "20240102030403.jpeg"}, nil, "4"},
+		{"links not numbered", map[string]string{"2.jpeg": "20240102030402.jpeg", "cover.jpeg": "20240102030401.jpeg"}, nil, "3"},
+		{"links of sidecars and other files", map[string]string{"1.jpeg": "20240102030401.jpeg"}, map[string]string{
+			"7.jpeg.thumbnail": "20240102030401.jpeg.thumbnail",
+			"8.txt":            "20240102030401.jpeg.txt",
+			"9.jpeg":           "../20240102030401.jpeg",
+		}, "2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := path.Join(t.TempDir(), "job")
+			writePages(t, dir, test.pages)
+			for link, target := range test.links {
+				if err := os.Symlink(target, path.Join(dir, link)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := NextLinkName(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("NextLinkName() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTransferFileAndLink(t *testing.T) {
+	source := map[string]string{"1.jpeg": "20240102030401.jpeg", "2.jpeg": "20240102030402.jpeg"}
+	tests := []struct {
+		name       string
+		keepSource bool
+		target     map[string]string
+		// change is done to the target before the transfer
+		change         func(t *testing.T, targetDir string)
+		wantLinkName   string
+		wantLinks      map[string]string
+		wantFiles      []string
+		wantSourceLeft map[string]string
+		wantErr        bool
+	}{
+		{"move into an empty job", false, nil, nil, "1.jpeg",
+			pageLinks(map[string]string{"1.jpeg": "20240102030402.jpeg"}),
+			pageFiles("20240102030402.jpeg"),
+			map[string]string{"1.jpeg": "20240102030401.jpeg"}, false},
+		{"copy", true, nil, nil, "1.jpeg",
+			pageLinks(map[string]string{"1.jpeg": "20240102030402.jpeg"}),
+			pageFiles("20240102030402.jpeg"),
+			source, false},
+		{"after a gap in the numbers", false, map[string]string{"1.png": "20240101000001.png", "3.png": "20240101000003.png"}, nil, "4.jpeg",
+			pageLinks(map[string]string{"1.png": "20240101000001.png", "3.png": "20240101000003.png", "4.jpeg": "20240102030402.jpeg"}),
+			pageFiles("20240101000001.png", "20240101000003.png", "20240102030402.jpeg"),
+			map[string]string{"1.jpeg": "20240102030401.jpeg"}, false},
+		{"file name taken", false, map[string]string{"1.jpeg": "20240102030402.jpeg", "2.jpeg": "20240102030403.jpeg"}, nil, "3.jpeg",
+			pageLinks(map[string]string{"1.jpeg": "20240102030402.jpeg", "2.jpeg": "20240102030403.jpeg", "3.jpeg": "20240102030404.jpeg"}),
+			pageFiles("20240102030402.jpeg", "20240102030403.jpeg", "20240102030404.jpeg"),
+			map[string]string{"1.jpeg": "20240102030401.jpeg"}, false},
+		// the thumbnail cannot be moved over the directory, the scan moved
+		// already is taken back
+		{"sidecar failing", false, nil, func(t *testing.T, targetDir string) {
+			if err := os.MkdirAll(path.Join(targetDir, "20240102030402.jpeg.thumbnail", "taken"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}, "", map[string]string{}, []string{}, source, true},
+		{"sidecar failing on a copy", true, nil, func(t *testing.T, targetDir string) {
+			if err := os.MkdirAll(path.Join(targetDir, "20240102030402.jpeg.thumbnail", "taken"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}, "", map[string]string{}, []string{}, source, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := t.TempDir()
+			sourceDir, targetDir := path.Join(directory, "source"), path.Join(directory, "target")
+			writePages(t, sourceDir, source)
+			writePages(t, targetDir, test.target)
+			if test.change != nil {
+				test.change(t, targetDir)
+			}
+
+			linkName, err := TransferFileAndLink(path.Join(sourceDir, "2.jpeg"), targetDir, test.keepSource, sidecars...)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("TransferFileAndLink() error = %v, want error %v", err, test.wantErr)
+			}
+			if linkName != test.wantLinkName {
+				t.Errorf("TransferFileAndLink() = %s, want %s", linkName, test.wantLinkName)
+			}
+			if got := jobLinks(t, targetDir); !reflect.DeepEqual(got, test.wantLinks) {
+				t.Errorf("target links = %v, want %v", got, test.wantLinks)
+			}
+			if got := regularFiles(t, targetDir); !reflect.DeepEqual(got, test.wantFiles) {
+				t.Errorf("target files = %v, want %v", got, test.wantFiles)
+			}
+			if got := jobLinks(t, sourceDir); !reflect.DeepEqual(got, pageLinks(test.wantSourceLeft)) {
+				t.Errorf("source links = %v, want %v", got, pageLinks(test.wantSourceLeft))
+			}
+			var sourceFiles []string
+			for _, filename := range test.wantSourceLeft {
+				sourceFiles = append(sourceFiles, filename)
+			}
+			if got := regularFiles(t, sourceDir); !reflect.DeepEqual(got, pageFiles(sourceFiles...)) {
+				t.Errorf("source files = %v, want %v", got, pageFiles(sourceFiles...))
+			}
+		})
+	}
+}
+
+func TestRevertTransfer(t *testing.T) {
+	for _, keepSource := range []bool{false, true} {
+		directory := t.TempDir()
+		sourceDir, targetDir := path.Join(directory, "source"), path.Join(directory, "target")
+		source := map[string]string{"1.jpeg": "20240102030401.jpeg", "2.jpeg": "20240102030402.jpeg"}
+		target := map[string]string{"1.jpeg": "20240102030402.jpeg"}
+		writePages(t, sourceDir, source)
+		writePages(t, targetDir, target)
+
+		linkName, err := TransferFileAndLink(path.Join(sourceDir, "1.jpeg"), targetDir, keepSource, sidecars...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RevertTransfer(path.Join(targetDir, linkName), path.Join(sourceDir, "1.jpeg"), keepSource, sidecars...); err != nil {
+			t.Fatalf("RevertTransfer(keepSource %v) error = %v", keepSource, err)
+		}
+		if got := jobLinks(t, sourceDir); !reflect.DeepEqual(got, pageLinks(source)) {
+			t.Errorf("source links with keepSource %v = %v, want %v", keepSource, got, pageLinks(source))
+		}
+		if got := regularFiles(t, sourceDir); !reflect.DeepEqual(got, pageFiles("20240102030401.jpeg", "20240102030402.jpeg")) {
+			t.Errorf("source files with keepSource %v = %v", keepSource, got)
+		}
+		if got := jobLinks(t, targetDir); !reflect.DeepEqual(got, pageLinks(target)) {
+			t.Errorf("target links with keepSource %v = %v, want %v", keepSource, got, pageLinks(target))
+		}
+		if got := regularFiles(t, targetDir); !reflect.DeepEqual(got, pageFiles("20240102030402.jpeg")) {
+			t.Errorf("target files with keepSource %v = %v", keepSource, got)
+		}
+	}
+}
+
+func TestReorderLinks(t *testing.T) {
+	pages := map[string]string{"1.jpeg": "20240102030401.jpeg", "3.png": "20240102030403.png", "7.jpeg": "20240102030407.jpeg"}
+	tests := []struct {
+		name    string
+		order   []string
+		want    map[string]string
+		wantErr error
+	}{
+		{"closes the gaps", []string{"1.jpeg", "3.png", "7.jpeg"}, map[string]string{
+			"1.jpeg": "20240102030401.jpeg", "2.png": "20240102030403.png", "3.jpeg": "20240102030407.jpeg",
+		}, nil},
+		{"new order", []string{"7.jpeg", "1.jpeg", "3.png"}, map[string]string{
+			"1.jpeg": "20240102030407.jpeg", "2.jpeg": "20240102030401.jpeg", "3.png": "20240102030403.png",
+		}, nil},
+		{"missing page", []string{"7.jpeg", "1.jpeg"}, pages, ErrInvalidOrder},
+		{"page twice", []string{"7.jpeg", "1.jpeg", "1.jpeg"}, pages, ErrInvalidOrder},
+		{"unknown page", []string{"7.jpeg", "1.jpeg", "2.png"}, pages, ErrInvalidOrder},
+		{"sidecar as page", []string{"7.jpeg", "1.jpeg", "3.png.thumbnail"}, pages, ErrInvalidOrder},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := path.Join(t.TempDir(), "job")
+			writePages(t, dir, pages)
+			if err := ReorderLinks(dir, test.order, sidecars...); !errors.Is(err, test.wantErr) {
+				t.Fatalf("ReorderLinks() error = %v, want %v", err, test.wantErr)
+			}
+			if got := jobLinks(t, dir); !reflect.DeepEqual(got, pageLinks(test.want)) {
+				t.Errorf("links = %v, want %v", got, pageLinks(test.want))
+			}
+			if got := regularFiles(t, dir); !reflect.DeepEqual(got, pageFiles("20240102030401.jpeg", "20240102030403.png", "20240102030407.jpeg")) {
+				t.Errorf("files = %v", got)
+			}
+		})
+	}
+}
+
+func TestMakeRoomForLink(t *testing.T) {
+	pages := map[string]string{"1.jpeg": "20240102030401.jpeg", "2.png": "20240102030402.png", "4.jpeg": "20240102030404.jpeg"}
+	tests := []struct {
+		name   string
+		number int
+		want   map[string]string
+	}{
+		{"number taken", 2, map[string]string{
+			"1.jpeg": "20240102030401.jpeg", "3.png": "20240102030402.png", "5.jpeg": "20240102030404.jpeg",
+		}},
+		{"first number", 1, map[string]string{
+			"2.jpeg": "20240102030401.jpeg", "3.png": "20240102030402.png", "5.jpeg": "20240102030404.jpeg",
+		}},
+		{"number in a gap", 3, pages},
+		{"number after the last", 5, pages},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := path.Join(t.TempDir(), "job")
+			writePages(t, dir, pages)
+			moved, err := makeRoomForLink(dir, test.number, sidecars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantMoved := !reflect.DeepEqual(test.want, pages); moved != wantMoved {
+				t.Errorf("makeRoomForLink() = %v, want %v", moved, wantMoved)
+			}
+			if got := jobLinks(t, dir); !reflect.DeepEqual(got, pageLinks(test.want)) {
+				t.Errorf("links = %v, want %v", got, pageLinks(test.want))
+			}
+		})
+	}
+}
+
+func TestCloseRoomForLink(t *testing.T) {
+	pages := map[string]string{"1.jpeg": "20240102030401.jpeg", "2.png": "20240102030402.png", "4.jpeg": "20240102030404.jpeg"}
+	tests := []struct {
+		name     string
+		number   int
+		makeRoom bool
+		want     map[string]string
+		wantErr  bool
+	}{
+		{"room made", 2, true, pages, false},
+		{"room made for the first", 1, true, pages, false},
+		{"number in a gap", 3, false, map[string]string{
+			"1.jpeg": "20240102030401.jpeg", "2.png": "20240102030402.png", "3.jpeg": "20240102030404.jpeg",
+		}, false},
+		{"number after the last", 5, false, pages, false},
+		{"number linked", 1, false, pages, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := path.Join(t.TempDir(), "job")
+			writePages(t, dir, pages)
+			if test.makeRoom {
+				if _, err := makeRoomForLink(dir, test.number, sidecars); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := closeRoomForLink(dir, test.number, sidecars)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("closeRoomForLink() error = %v, want error %v", err, test.wantErr)
+			}
+			if got := jobLinks(t, dir); !reflect.DeepEqual(got, pageLinks(test.want)) {
+				t.Errorf("links = %v, want %v", got, pageLinks(test.want))
+			}
+		})
+	}
+}
+
+func TestCheckTransfer(t *testing.T) {
+	directory := t.TempDir()
+	sourceDir, targetDir := path.Join(directory, "source"), path.Join(directory, "target")
+	writePages(t, sourceDir, map[string]string{"1.jpeg": "20240102030401.jpeg"})
+	writePages(t, targetDir, nil)
+	for link, target := range map[string]string{
+		"2.jpeg": "20240102030402.jpeg",
+		"3.jpeg": "../20240102030403.jpeg",
+	} {
+		if err := os.Symlink(target, path.Join(sourceDir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name      string
+		links     []string
+		targetDir string
+		wantErr   error
+	}{
+		{"page", []string{"1.jpeg"}, targetDir, nil},
+		{"no pages", nil, targetDir, nil},
+		{"link to a missing file", []string{"1.jpeg", "2.jpeg"}, targetDir, os.ErrNotExist},
+		{"link out of the job", []string{"1.jpeg", "3.jpeg"}, targetDir, ErrInvalidName},
+		{"missing link", []string{"4.jpeg"}, targetDir, os.ErrNotExist},
+		{"missing target", []string{"1.jpeg"}, path.Join(directory, "missing"), os.ErrNotExist},
+	}
+	for _, test := range tests {
+		for _, keepSource := range []bool{false, true} {
+			var linkPaths []string
+			for _, link := range test.links {
+				linkPaths = append(linkPaths, path.Join(sourceDir, link))
+			}
+			err := CheckTransfer(test.targetDir, linkPaths, keepSource, sidecars...)
+			if test.wantErr == nil && err != nil || test.wantErr != nil && err == nil {
+				t.Errorf("%s: CheckTransfer(keepSource %v) error = %v, want %v", test.name, keepSource, err, test.wantErr)
+			}
+			if test.wantErr == ErrInvalidName && !errors.Is(err, ErrInvalidName) {
+				t.Errorf("%s: CheckTransfer(keepSource %v) error = %v, want %v", test.name, keepSource, err, test.wantErr)
+			}
+		}
+	}
+	if files, _ := os.ReadDir(targetDir); len(files) != 0 {
+		t.Errorf("target has %d files after the checks", len(files))
+	}
+}
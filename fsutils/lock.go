@@ -0,0 +1,24 @@
+package fsutils
+
+import (
+	"os"
+	"syscall"
+)
+
+// LockFile takes an exclusive lock on the file, created when missing, and
+// waits while another process holds it. The lock is released by the returned
+// function, or when the process exits.
+func LockFile(lockPath string) (func(), error) {
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		// closing the file releases the lock
+		file.Close()
+	}, nil
+}
@@ -0,0 +1,122 @@
+package fsutils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInvalidName tells that a job or scan name is not a plain file name, so it
+// could point outside of its directory.
+var ErrInvalidName = errors.New("invalid name")
+
+// ValidName checks that the name is a single element of a path: not empty,
+// not hidden, without separators and without control characters.
+func ValidName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("%w '%s'", ErrInvalidName, name)
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("%w '%s'", ErrInvalidName, name)
+		}
+	}
+	return nil
+}
+
+// Resolver turns the names of the jobs and of their scans into paths confined
+// to the output directory. Names are validated, and symlinks must resolve to
+// files inside the same directory. Missing jobs and scans give errors that
+// match os.ErrNotExist.
+type Resolver struct {
+	directory string
+}
+
+func NewResolver(directory string) *Resolver {
+	return &Resolver{directory: directory}
+}
+
+// JobPath returns the path of the job, which may not exist yet.
+func (r *Resolver) JobPath(jobName string) (string, error) {
+	if err := ValidName(jobName); err != nil {
+		return "", err
+	}
+	return path.Join(r.directory, jobName), nil
+}
+
+// Job returns the path of an existing job.
+func (r *Resolver) Job(jobName string) (string, error) {
+	jobPath, err := r.JobPath(jobName)
+	if err != nil {
+		return "", err
+	}
+	if err := r.inside(jobPath, r.directory); err != nil {
+		return "", fmt.Errorf("job '%s' not found: %w", jobName, err)
+	}
+	info, err := os.Stat(jobPath)
+	if err != nil {
+		return "", fmt.Errorf("job '%s' not found: %w", jobName, os.ErrNotExist)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("job '%s' not found: %w", jobName, os.ErrNotExist)
+	}
+	return jobPath, nil
+}
+
+// Scan returns the path of an existing scan of the job, by its file or link
+// name. The path is not resolved, so the link name is kept. Only the pages of
+// the job are found, not their sidecars nor other files of the directory.
+func (r *Resolver) Scan(jobName, scan string) (string, error) {
+	jobPath, err := r.Job(jobName)
+	if err != nil {
+		return "", err
+	}
+	if err := ValidName(scan); err != nil {
+		return "", err
+	}
+	scanPath := path.Join(jobPath, scan)
+	if err := r.inside(scanPath, jobPath); err != nil {
+		return "", fmt.Errorf("scan '%s' not found: %w", scan, err)
+	}
+	if info, err := os.Lstat(scanPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		// a link name, only its own link is read
+		if readlink, err := os.Readlink(scanPath); err == nil && pageTarget(readlink) {
+			return scanPath, nil
+		}
+		return "", fmt.Errorf("scan '%s' not found: %w", scan, os.ErrNotExist)
+	}
+	// a file name, which is a page when a link of the job points to it
+	pages, err := ImageFilesOnDirectory(jobPath)
+	if err != nil {
+		return "", err
+	}
+	for _, page := range pages {
+		if page.Filename == scan {
+			return scanPath, nil
+		}
+	}
+	return "", fmt.Errorf("scan '%s' not found: %w", scan, os.ErrNotExist)
+}
+
+// inside checks that the file, once its symlinks are resolved, is in the
+// directory.
+func (r *Resolver) inside(file, directory string) error {
+	resolved, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+	resolvedDirectory, err := filepath.EvalSymlinks(directory)
+	if err != nil {
+		return err
+	}
+	if filepath.Dir(resolved) != resolvedDirectory {
+		return ErrInvalidName
+	}
+	return nil
+}
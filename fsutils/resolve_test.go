@@ -0,0 +1,174 @@
+package fsutils
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestValidName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"job", true},
+		{"Invoices 2024", true},
+		{"20240102030405.jpeg", true},
+		{"résumé", true},
+		{"a..b", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{".hidden", false},
+		{"../job", false},
+		{"job/..", false},
+		{"/etc", false},
+		{"/", false},
+		{"job/page", false},
+		{"..\\job", false},
+		{"job\\page", false},
+		{"job\x00", false},
+		{"job\nname", false},
+		{"job\x1b[31m", false},
+		{"job\x7f", false},
+	}
+	for _, test := range tests {
+		err := ValidName(test.name)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidName(%q) = %v, want valid %v", test.name, err, test.valid)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidName) {
+			t.Errorf("ValidName(%q) = %v, want ErrInvalidName", test.name, err)
+		}
+	}
+}
+
+// resolverDirectory writes an output directory with a job of one page and its
+// thumbnail, links escaping the job and a job linking out of the directory.
+func resolverDirectory(t *testing.T) string {
+	root := t.TempDir()
+	outputDirectory := path.Join(root, "output")
+	jobPath := path.Join(outputDirectory, "job")
+	for _, dir := range []string{jobPath, path.Join(outputDirectory, "other"), path.Join(root, "outside")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{
+		path.Join(jobPath, "20240102030405.jpeg"),
+		path.Join(jobPath, "20240102030405.jpeg.thumbnail"),
+		path.Join(jobPath, "20240102030406.jpeg"),
+		path.Join(jobPath, "notes.txt"),
+		path.Join(outputDirectory, "other", "20240102030407.jpeg"),
+		path.Join(outputDirectory, "file"),
+		path.Join(root, "outside", "20240102030408.jpeg"),
+	} {
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		path.Join(jobPath, "1.jpeg"):              "20240102030405.jpeg",
+		path.Join(jobPath, "1.jpeg.thumbnail"):    "20240102030405.jpeg.thumbnail",
+		path.Join(jobPath, "2.jpeg"):              "../other/20240102030407.jpeg",
+		path.Join(jobPath, "3.jpeg"):              path.Join(root, "outside", "20240102030408.jpeg"),
+		path.Join(jobPath, "4.jpeg"):              "20240102030409.jpeg",
+		path.Join(jobPath, "5.txt"):               "notes.txt",
+		path.Join(jobPath, "escape.jpeg"):         "../../outside/20240102030408.jpeg",
+		path.Join(outputDirectory, "elsewhere"):   path.Join(root, "outside"),
+		path.Join(outputDirectory, "jobs-inside"): "job",
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return outputDirectory
+}
+
+func TestResolverJob(t *testing.T) {
+	outputDirectory := resolverDirectory(t)
+	resolver := NewResolver(outputDirectory)
+	tests := []struct {
+		jobName string
+		want    string
+		// wantErr is ErrInvalidName or os.ErrNotExist
+		wantErr error
+	}{
+		{"job", path.Join(outputDirectory, "job"), nil},
+		{"jobs-inside", path.Join(outputDirectory, "jobs-inside"), nil},
+		{"missing", "", os.ErrNotExist},
+		{"file", "", os.ErrNotExist},
+		{"..", "", ErrInvalidName},
+		{"../output/job", "", ErrInvalidName},
+		{"/tmp", "", ErrInvalidName},
+		{"..\\job", "", ErrInvalidName},
+		{".job", "", ErrInvalidName},
+		{"job\r", "", ErrInvalidName},
+		{"", "", ErrInvalidName},
+		{"elsewhere", "", ErrInvalidName},
+	}
+	for _, test := range tests {
+		t.Run(test.jobName, func(t *testing.T) {
+			got, err := resolver.Job(test.jobName)
+			if !errors.Is(err, test.wantErr) || (err == nil) != (test.wantErr == nil) {
+				t.Fatalf("Job() error = %v, want %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("Job() = %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	// a job to create is not required to exist, only its name is checked
+	if jobPath, err := resolver.JobPath("new"); err != nil || jobPath != path.Join(outputDirectory, "new") {
+		t.Errorf("JobPath(new) = %s, %v", jobPath, err)
+	}
+	if _, err := resolver.JobPath("../new"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("JobPath(../new) error = %v, want ErrInvalidName", err)
+	}
+}
+
+func TestResolverScan(t *testing.T) {
+	outputDirectory := resolverDirectory(t)
+	resolver := NewResolver(outputDirectory)
+	jobPath := path.Join(outputDirectory, "job")
+	tests := []struct {
+		name    string
+		jobName string
+		scan    string
+		want    string
+		wantErr error
+	}{
+		{"link name", "job", "1.jpeg", path.Join(jobPath, "1.jpeg"), nil},
+		{"file name", "job", "20240102030405.jpeg", path.Join(jobPath, "20240102030405.jpeg"), nil},
+		{"file without link", "job", "20240102030406.jpeg", "", os.ErrNotExist},
+		{"sidecar link", "job", "1.jpeg.thumbnail", "", os.ErrNotExist},
+		{"sidecar file", "job", "20240102030405.jpeg.thumbnail", "", os.ErrNotExist},
+		{"link to another file than a scan", "job", "5.txt", "", os.ErrNotExist},
+		{"link to a missing file", "job", "4.jpeg", "", os.ErrNotExist},
+		{"missing scan", "job", "9.jpeg", "", os.ErrNotExist},
+		{"missing job", "missing", "1.jpeg", "", os.ErrNotExist},
+		{"link to another job", "job", "2.jpeg", "", ErrInvalidName},
+		{"absolute link out of the directory", "job", "3.jpeg", "", ErrInvalidName},
+		{"relative link out of the directory", "job", "escape.jpeg", "", ErrInvalidName},
+		{"parent directory", "job", "../other/20240102030407.jpeg", "", ErrInvalidName},
+		{"absolute path", "job", path.Join(jobPath, "1.jpeg"), "", ErrInvalidName},
+		{"backslash", "job", "..\\1.jpeg", "", ErrInvalidName},
+		{"hidden name", "job", ".1.jpeg", "", ErrInvalidName},
+		{"control character", "job", "1.jpeg\n", "", ErrInvalidName},
+		{"job out of the directory", "elsewhere", "20240102030408.jpeg", "", ErrInvalidName},
+		{"job name with a path", "job/..", "1.jpeg", "", ErrInvalidName},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolver.Scan(test.jobName, test.scan)
+			if !errors.Is(err, test.wantErr) || (err == nil) != (test.wantErr == nil) {
+				t.Fatalf("Scan() error = %v, want %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("Scan() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
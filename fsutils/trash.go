@@ -0,0 +1,358 @@
+package fsutils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/adelolmo/scanpi/logger"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	trashEntryFile = "entry.json"
+	trashFiles     = "files"
+)
+
+var trashId = regexp.MustCompile("^[0-9a-f]{16}$")
+
+// ErrJobExists tells that a job cannot be restored because another job took
+// its name.
+var ErrJobExists = errors.New("job already exists")
+
+// TrashEntry is a job or a page of a job that was deleted.
+type TrashEntry struct {
+	Id      string `json:"id"`
+	JobName string `json:"jobName"`
+	// LinkName is the name of the deleted page, empty when the whole job
+	// was deleted
+	LinkName string    `json:"linkName,omitempty"`
+	Pages    int       `json:"pages"`
+	Deleted  time.Time `json:"deleted"`
+}
+
+// Trash keeps the deleted jobs and pages in a directory, every one in its
+// own directory with the entry that records where it came from. Entries older
+// than the retention are purged, none when the retention is zero.
+type Trash struct {
+	directory string
+	retention time.Duration
+	resolver  *Resolver
+}
+
+func NewTrash(directory string, retention time.Duration, resolver *Resolver) *Trash {
+	return &Trash{
+		directory: directory,
+		retention: retention,
+		resolver:  resolver,
+	}
+}
+
+// Retention is how long the entries are kept.
+func (t *Trash) Retention() time.Duration {
+	return t.retention
+}
+
+// DeleteJob moves the job into the trash.
+func (t *Trash) DeleteJob(jobName string) error {
+	jobPath, err := t.resolver.Job(jobName)
+	if err != nil {
+		return err
+	}
+	pages, err := ImageFilesOnDirectory(jobPath)
+	if err != nil {
+		return err
+	}
+	entry, err := t.create(TrashEntry{JobName: jobName, Pages: len(pages)})
+	if err != nil {
+		return err
+	}
+	if err := moveFile(jobPath, path.Join(t.directory, entry.Id, trashFiles)); err != nil {
+		os.RemoveAll(path.Join(t.directory, entry.Id))
+		return errors.New(fmt.Sprintf("unable to move job %s to the trash. error: %v", jobName, err))
+	}
+	logger.Info("job %s moved to the trash as %s", jobName, entry.Id)
+	return nil
+}
+
+// DeletePage moves the page of the job, with its sidecar files, into the
+// trash.
+func (t *Trash) DeletePage(jobName, linkName string, sidecars ...string) error {
+	linkPath, err := t.resolver.Scan(jobName, linkName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Readlink(linkPath); err != nil {
+		return fmt.Errorf("page '%s' not found: %w", linkName, os.ErrNotExist)
+	}
+	entry, err := t.create(TrashEntry{JobName: jobName, LinkName: linkName, Pages: 1})
+	if err != nil {
+		return err
+	}
+	entryPath := path.Join(t.directory, entry.Id)
+	filesPath := path.Join(entryPath, trashFiles)
+	if err := os.Mkdir(filesPath, os.ModePerm); err != nil {
+		os.RemoveAll(entryPath)
+		return err
+	}
+	if _, err := TransferFileAndLink(linkPath, filesPath, false, sidecars...); err != nil {
+		// the files already moved go back to the job before the entry is
+		// removed, they would be lost otherwise
+		if undoErr := undoTransfer(filesPath, linkPath, sidecars); undoErr != nil {
+			logger.Error(fmt.Sprintf("unable to move page %s of %s back from the trash entry %s. Error: %s",
+				linkName, jobName, entry.Id, undoErr))
+			return err
+		}
+		os.RemoveAll(entryPath)
+		return err
+	}
+	logger.Info("page %s of %s moved to the trash as %s", linkName, jobName, entry.Id)
+	return nil
+}
+
+// undoTransfer moves the files of a page that were transferred into the
+// directory back next to its link, and links again those whose link was
+// removed.
+func undoTransfer(directory, linkPath string, sidecars []string) error {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+	linked := make(map[string]bool)
+	for _, file := range files {
+		if file.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if target, err := os.Readlink(path.Join(directory, file.Name())); err == nil {
+			linked[target] = true
+		}
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		if err := moveFile(path.Join(directory, file.Name()), path.Join(path.Dir(linkPath), file.Name())); err != nil {
+			return err
+		}
+		if !linked[file.Name()] {
+			continue
+		}
+		sourceLink := linkPath
+		if scan, isSidecar := sidecarOf(file.Name(), sidecars); isSidecar {
+			sourceLink += file.Name()[len(scan):]
+		}
+		if _, err := os.Lstat(sourceLink); os.IsNotExist(err) {
+			if err := os.Symlink(file.Name(), sourceLink); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Entries returns the entries of the trash, the most recently deleted first.
+func (t *Trash) Entries() ([]TrashEntry, error) {
+	directories, err := ioutil.ReadDir(t.directory)
+	if os.IsNotExist(err) {
+		return []TrashEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]TrashEntry, 0, len(directories))
+	for _, directory := range directories {
+		entry, err := t.Entry(directory.Name())
+		if err != nil {
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.After(entries[j].Deleted)
+	})
+	return entries, nil
+}
+
+// Entry returns the entry with the id.
+func (t *Trash) Entry(id string) (*TrashEntry, error) {
+	if !trashId.MatchString(id) {
+		return nil, fmt.Errorf("%w '%s'", ErrInvalidName, id)
+	}
+	data, err := ioutil.ReadFile(path.Join(t.directory, id, trashEntryFile))
+	if err != nil {
+		return nil, fmt.Errorf("trash entry '%s' not found: %w", id, os.ErrNotExist)
+	}
+	entry := &TrashEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Restore moves the entry back to the output directory. A job is restored
+// with its name, unless another job took it. A page gets its number back, the
+// pages from it on moving one up, or is added at the end of its job when the
+// job has fewer pages now. The job is created again if it was deleted too.
+func (t *Trash) Restore(id string, sidecars ...string) (*TrashEntry, error) {
+	entry, err := t.Entry(id)
+	if err != nil {
+		return nil, err
+	}
+	filesPath := path.Join(t.directory, id, trashFiles)
+
+	jobPath, err := t.resolver.JobPath(entry.JobName)
+	if err != nil {
+		return nil, err
+	}
+	if entry.LinkName == "" {
+		if _, err := os.Lstat(jobPath); err == nil {
+			return nil, fmt.Errorf("%w: %s", ErrJobExists, entry.JobName)
+		}
+		if err := moveFile(filesPath, jobPath); err != nil {
+			return nil, errors.New(fmt.Sprintf("unable to restore job %s. error: %v", entry.JobName, err))
+		}
+	} else {
+		_, err := os.Lstat(jobPath)
+		created := os.IsNotExist(err)
+		if err := os.MkdirAll(jobPath, os.ModePerm); err != nil {
+			return nil, err
+		}
+		pages, err := ImageFilesOnDirectory(filesPath)
+		if err != nil || len(pages) == 0 {
+			return nil, errors.New(fmt.Sprintf("unable to find page %s in the trash", entry.LinkName))
+		}
+		linkName, moved, err := restoredLinkName(jobPath, entry.LinkName, sidecars)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := transferFileAndLink(path.Join(filesPath, pages[0].LinkName), jobPath, linkName, false, sidecars); err != nil {
+			// the pages moved up for the restored one take their numbers
+			// back, the entry is kept with what is left of the page
+			if moved {
+				number, _ := strconv.Atoi(linkName)
+				if undoErr := closeRoomForLink(jobPath, number, sidecars); undoErr != nil {
+					logger.Error(fmt.Sprintf("unable to number the pages of %s back. Error: %s", entry.JobName, undoErr))
+				}
+			}
+			if created {
+				os.Remove(jobPath)
+			}
+			return nil, err
+		}
+	}
+	logger.Info("%s restored into %s", id, entry.JobName)
+
+	// files the restore did not take, sidecars no longer known for
+	// instance, are not deleted with the entry
+	left, err := ioutil.ReadDir(filesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, file := range left {
+		if file.Mode().IsRegular() {
+			return nil, errors.New(fmt.Sprintf("%s restored into %s, but %s is left in the trash", id, entry.JobName, file.Name()))
+		}
+	}
+	return entry, os.RemoveAll(path.Join(t.directory, id))
+}
+
+// restoredLinkName returns the number to link a restored page with, making
+// room for it among the pages of the job. It tells whether pages were
+// renumbered to make room.
+func restoredLinkName(jobPath, linkName string, sidecars []string) (string, bool, error) {
+	next, err := NextLinkName(jobPath)
+	if err != nil {
+		return "", false, err
+	}
+	number, numbered := linkNumber(linkName)
+	if last, _ := strconv.Atoi(next); !numbered || number < 1 || number >= last {
+		return next, false, nil
+	}
+	moved, err := makeRoomForLink(jobPath, number, sidecars)
+	if err != nil {
+		return "", moved, err
+	}
+	return strconv.Itoa(number), moved, nil
+}
+
+// Purge deletes the entry for good.
+func (t *Trash) Purge(id string) error {
+	if _, err := t.Entry(id); err != nil {
+		return err
+	}
+	logger.Info("purge %s from the trash", id)
+	return os.RemoveAll(path.Join(t.directory, id))
+}
+
+// PurgeExpired deletes the entries older than the retention.
+func (t *Trash) PurgeExpired() error {
+	if t.retention == 0 {
+		return nil
+	}
+	entries, err := t.Entries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if time.Since(entry.Deleted) < t.retention {
+			continue
+		}
+		if err := t.Purge(entry.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expires returns when the entry is purged, the zero time if never.
+func (t *Trash) Expires(entry TrashEntry) time.Time {
+	if t.retention == 0 {
+		return time.Time{}
+	}
+	return entry.Deleted.Add(t.retention)
+}
+
+// create makes the directory of a new entry and records it.
+func (t *Trash) create(entry TrashEntry) (*TrashEntry, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	entry.Id = hex.EncodeToString(id)
+	entry.Deleted = time.Now()
+
+	entryPath := path.Join(t.directory, entry.Id)
+	if err := os.MkdirAll(entryPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path.Join(entryPath, trashEntryFile), data, 0644); err != nil {
+		os.RemoveAll(entryPath)
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// PreviewPath returns the path of the thumbnail of the first page of the
+// entry.
+func (t *Trash) PreviewPath(id string) (string, error) {
+	if _, err := t.Entry(id); err != nil {
+		return "", err
+	}
+	filesPath := path.Join(t.directory, id, trashFiles)
+	pages, err := ImageFilesOnDirectory(filesPath)
+	if err != nil || len(pages) == 0 {
+		return "", fmt.Errorf("trash entry '%s' without pages: %w", id, os.ErrNotExist)
+	}
+	return path.Join(filesPath, pages[0].Filename+".thumbnail"), nil
+}
@@ -0,0 +1,201 @@
+package fsutils
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// jobLinks returns the targets of the links of the job by link name.
+func jobLinks(t *testing.T, jobPath string) map[string]string {
+	files, err := os.ReadDir(jobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := make(map[string]string)
+	for _, file := range files {
+		if file.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := os.Readlink(path.Join(jobPath, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		links[file.Name()] = target
+	}
+	return links
+}
+
+func TestTrashRestoresPagesToTheirNumber(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		// change is done to the job while the page is in the trash
+		change func(t *testing.T, jobPath string)
+		want   map[string]string
+	}{
+		{"first page", "1.jpeg", nil, map[string]string{
+			"1.jpeg": "20240102030401.jpeg", "1.jpeg.thumbnail": "20240102030401.jpeg.thumbnail",
+			"2.jpeg": "20240102030402.jpeg", "2.jpeg.thumbnail": "20240102030402.jpeg.thumbnail",
+			"3.jpeg": "20240102030403.jpeg", "3.jpeg.thumbnail": "20240102030403.jpeg.thumbnail",
+		}},
+		{"last page", "3.jpeg", nil, map[string]string{
+			"1.jpeg": "20240102030401.jpeg", "1.jpeg.thumbnail": "20240102030401.jpeg.thumbnail",
+			"2.jpeg": "20240102030402.jpeg", "2.jpeg.thumbnail": "20240102030402.jpeg.thumbnail",
+			"3.jpeg": "20240102030403.jpeg", "3.jpeg.thumbnail": "20240102030403.jpeg.thumbnail",
+		}},
+		{"number taken by another page", "2.jpeg", func(t *testing.T, jobPath string) {
+			for _, suffix := range []string{"", ".thumbnail"} {
+				if err := os.Rename(path.Join(jobPath, "3.jpeg"+suffix), path.Join(jobPath, "2.jpeg"+suffix)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}, map[string]string{
+			"1.jpeg": "20240102030401.jpeg", "1.jpeg.thumbnail": "20240102030401.jpeg.thumbnail",
+			"2.jpeg": "20240102030402.jpeg", "2.jpeg.thumbnail": "20240102030402.jpeg.thumbnail",
+			"3.jpeg": "20240102030403.jpeg", "3.jpeg.thumbnail": "20240102030403.jpeg.thumbnail",
+		}},
+		{"job with fewer pages", "2.jpeg", func(t *testing.T, jobPath string) {
+			for _, name := range []string{"3.jpeg", "3.jpeg.thumbnail"} {
+				if err := os.Remove(path.Join(jobPath, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}, map[string]string{
+			"1.jpeg": "20240102030401.jpeg", "1.jpeg.thumbnail": "20240102030401.jpeg.thumbnail",
+			"2.jpeg": "20240102030402.jpeg", "2.jpeg.thumbnail": "20240102030402.jpeg.thumbnail",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outputPath := t.TempDir()
+			jobPath := path.Join(outputPath, "job")
+			if err := os.Mkdir(jobPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for i, name := range []string{"20240102030401.jpeg", "20240102030402.jpeg", "20240102030403.jpeg"} {
+				for _, suffix := range []string{"", ".thumbnail"} {
+					if err := os.WriteFile(path.Join(jobPath, name+suffix), nil, 0644); err != nil {
+						t.Fatal(err)
+					}
+					link := strconv.Itoa(i+1) + ".jpeg" + suffix
+					if err := os.Symlink(name+suffix, path.Join(jobPath, link)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			trash := NewTrash(t.TempDir(), time.Hour, NewResolver(outputPath))
+
+			if err := trash.DeletePage("job", test.page, ".thumbnail"); err != nil {
+				t.Fatal(err)
+			}
+			if test.change != nil {
+				test.change(t, jobPath)
+			}
+			entries, err := trash.Entries()
+			if err != nil || len(entries) != 1 {
+				t.Fatalf("Entries() = %v, %v, want one entry", entries, err)
+			}
+			if _, err := trash.Restore(entries[0].Id, ".thumbnail"); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := jobLinks(t, jobPath); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("links = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTrashRestoreFailureKeepsTheEntry(t *testing.T) {
+	tests := []struct {
+		name string
+		// change is done to the job and the entry while the page is in the
+		// trash, to make the restore fail
+		change    func(t *testing.T, jobPath, filesPath string)
+		wantLinks map[string]string
+		// wantFiles are the files left in the entry
+		wantFiles []string
+	}{
+		{"sidecar failing", func(t *testing.T, jobPath, filesPath string) {
+			for _, suffix := range []string{"", ".thumbnail"} {
+				if err := os.Rename(path.Join(jobPath, "3.jpeg"+suffix), path.Join(jobPath, "2.jpeg"+suffix)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.MkdirAll(path.Join(jobPath, "20240102030402.jpeg.thumbnail", "taken"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{
+			"1.jpeg": "20240102030401.jpeg", "1.jpeg.thumbnail": "20240102030401.jpeg.thumbnail",
+			"2.jpeg": "20240102030403.jpeg", "2.jpeg.thumbnail": "20240102030403.jpeg.thumbnail",
+		}, []string{"20240102030402.jpeg", "20240102030402.jpeg.thumbnail"}},
+		{"file not restored", func(t *testing.T, jobPath, filesPath string) {
+			if err := os.WriteFile(path.Join(filesPath, "20240102030402.jpeg.unknown"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{
+			"1.jpeg": "20240102030401.jpeg", "1.jpeg.thumbnail": "20240102030401.jpeg.thumbnail",
+			"2.jpeg": "20240102030402.jpeg", "2.jpeg.thumbnail": "20240102030402.jpeg.thumbnail",
+			"3.jpeg": "20240102030403.jpeg", "3.jpeg.thumbnail": "20240102030403.jpeg.thumbnail",
+		}, []string{"20240102030402.jpeg.unknown"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outputPath := t.TempDir()
+			jobPath := path.Join(outputPath, "job")
+			if err := os.Mkdir(jobPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for i, name := range []string{"20240102030401.jpeg", "20240102030402.jpeg", "20240102030403.jpeg"} {
+				for _, suffix := range []string{"", ".thumbnail"} {
+					if err := os.WriteFile(path.Join(jobPath, name+suffix), nil, 0644); err != nil {
+						t.Fatal(err)
+					}
+					link := strconv.Itoa(i+1) + ".jpeg" + suffix
+					if err := os.Symlink(name+suffix, path.Join(jobPath, link)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			trashPath := t.TempDir()
+			trash := NewTrash(trashPath, time.Hour, NewResolver(outputPath))
+
+			if err := trash.DeletePage("job", "2.jpeg", ".thumbnail"); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := trash.Entries()
+			if err != nil || len(entries) != 1 {
+				t.Fatalf("Entries() = %v, %v, want one entry", entries, err)
+			}
+			filesPath := path.Join(trashPath, entries[0].Id, trashFiles)
+			test.change(t, jobPath, filesPath)
+			if _, err := trash.Restore(entries[0].Id, ".thumbnail"); err == nil {
+				t.Fatal("Restore() did not fail")
+			}
+
+			if got := jobLinks(t, jobPath); !reflect.DeepEqual(got, test.wantLinks) {
+				t.Errorf("links = %v, want %v", got, test.wantLinks)
+			}
+			if _, err := trash.Entry(entries[0].Id); err != nil {
+				t.Errorf("entry removed: %v", err)
+			}
+			files, err := os.ReadDir(filesPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var left []string
+			for _, file := range files {
+				if file.Type().IsRegular() {
+					left = append(left, file.Name())
+				}
+			}
+			if !reflect.DeepEqual(left, test.wantFiles) {
+				t.Errorf("files left in the entry = %v, want %v", left, test.wantFiles)
+			}
+		})
+	}
+}
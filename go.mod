@@ -6,5 +6,6 @@ require (
 	github.com/disintegration/imaging v1.6.1
 	github.com/gorilla/mux v1.7.3
 	github.com/jung-kurt/gofpdf v1.12.1
+	golang.org/x/crypto v0.14.0
 	golang.org/x/image v0.0.0-20190910094157-69e4b8554b2a
 )
@@ -0,0 +1,130 @@
+package graphic
+
+import (
+	"errors"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"path"
+)
+
+// pageWidthInches is the width every page is assumed to have when a target
+// resolution is requested, the same as in the pdf and tiff documents.
+const pageWidthInches = 210 / 25.4
+
+const defaultJpegQuality = 85
+
+// Conversion describes how an image is transformed when it is downloaded. The
+// zero value leaves the image as it is stored.
+type Conversion struct {
+	// Format is the target format, empty to keep the stored one
+	Format string
+	// Quality is the JPEG quality from 1 to 100
+	Quality int
+	// MaxSize limits the width and height of the image in pixels
+	MaxSize int
+	// Dpi limits the resolution of the image, assuming an A4 page
+	Dpi       int
+	Grayscale bool
+}
+
+func (c Conversion) Enabled() bool {
+	return c != Conversion{}
+}
+
+// TargetFormat returns the format an image stored in the source format is
+// converted to. Pnm images, which cannot be encoded, are converted to png.
+func (c Conversion) TargetFormat(source Format) Format {
+	if c.Format == "" {
+		if source == Pnm {
+			return Png
+		}
+		return source
+	}
+	return ToFormat(c.Format)
+}
+
+// Apply decodes the image and scales it down and turns it gray as requested.
+// Images are never scaled up. It fails when decoding the image needs more
+// memory than the limit, in bytes.
+func (c Conversion) Apply(imagePath string, limit int64) (image.Image, error) {
+	ext := path.Ext(imagePath)
+	if ext != ".jpeg" && ext != ".png" && ext != ".tiff" && ext != ".pnm" {
+		return nil, errors.New(fmt.Sprintf("image format not supported: %s", ext))
+	}
+	img, err := decodeImage(imagePath, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	maxWidth, maxHeight := bounds.Dx(), bounds.Dy()
+	if c.MaxSize > 0 {
+		maxWidth, maxHeight = minInt(maxWidth, c.MaxSize), minInt(maxHeight, c.MaxSize)
+	}
+	if c.Dpi > 0 {
+		scale := float64(c.Dpi) * pageWidthInches / float64(bounds.Dx())
+		if scale < 1 {
+			maxWidth = minInt(maxWidth, int(math.Round(float64(bounds.Dx())*scale)))
+			maxHeight = minInt(maxHeight, int(math.Round(float64(bounds.Dy())*scale)))
+		}
+	}
+	if maxWidth < bounds.Dx() || maxHeight < bounds.Dy() {
+		img = imaging.Fit(img, maxWidth, maxHeight, imaging.Lanczos)
+	}
+
+	if c.Grayscale {
+		if _, isGray := img.(*image.Gray); !isGray {
+			bounds = img.Bounds()
+			gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+			draw.Draw(gray, gray.Bounds(), img, bounds.Min, draw.Src)
+			img = gray
+		}
+	}
+	return img, nil
+}
+
+// Encode writes the image in the given format.
+func (c Conversion) Encode(w io.Writer, img image.Image, format Format) error {
+	switch format {
+	case Jpeg:
+		quality := c.Quality
+		if quality == 0 {
+			quality = defaultJpegQuality
+		}
+		return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(quality))
+	case Png:
+		switch img.(type) {
+		case *image.Gray, *image.NRGBA, *image.RGBA, *image.Paletted:
+		default:
+			// other images, like the decoded jpeg ones, are written with
+			// 16 bit samples, which the pdf documents do not support
+			img = imaging.Clone(img)
+		}
+		return imaging.Encode(w, img, imaging.PNG)
+	case Tiff:
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate})
+	}
+	return errors.New(fmt.Sprintf("image format not supported: %s", format))
+}
+
+// Convert streams the converted image to the writer, decoding it within the
+// memory limit like Apply.
+func (c Conversion) Convert(imagePath string, w io.Writer, limit int64) error {
+	img, err := c.Apply(imagePath, limit)
+	if err != nil {
+		return err
+	}
+	return c.Encode(w, img, c.TargetFormat(ToFormat(path.Ext(imagePath)[1:])))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,53 @@
+package graphic
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestConversionApply(t *testing.T) {
+	encoded := new(bytes.Buffer)
+	if err := png.Encode(encoded, gradient(200, 100, false)); err != nil {
+		t.Fatal(err)
+	}
+	pngPath := writeTestFile(t, "20240102030405.png", encoded.Bytes())
+	pnmPath := writeTestFile(t, "20240102030405.pnm", []byte("P5\n1 1\n255\n\x00"))
+	pdfPath := writeTestFile(t, "20240102030405.pdf", []byte("%PDF-1.4\n"))
+
+	tests := []struct {
+		name       string
+		conversion Conversion
+		imagePath  string
+		limit      int64
+		wantSize   image.Point
+		wantGray   bool
+		wantErr    bool
+	}{
+		{"unchanged", Conversion{Format: "jpeg"}, pngPath, 1 << 20, image.Pt(200, 100), false, false},
+		{"max size", Conversion{MaxSize: 50}, pngPath, 1 << 20, image.Pt(50, 25), false, false},
+		{"never scaled up", Conversion{MaxSize: 500}, pngPath, 1 << 20, image.Pt(200, 100), false, false},
+		{"grayscale", Conversion{Grayscale: true}, pngPath, 1 << 20, image.Pt(200, 100), true, false},
+		{"over the memory limit", Conversion{MaxSize: 50}, pngPath, 200 * 100, image.Point{}, false, true},
+		{"pnm", Conversion{MaxSize: 50}, pnmPath, 1 << 20, image.Pt(1, 1), true, false},
+		{"unsupported format", Conversion{MaxSize: 50}, pdfPath, 1 << 20, image.Point{}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img, err := test.conversion.Apply(test.imagePath, test.limit)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Apply() error = %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if size := img.Bounds().Size(); size != test.wantSize {
+				t.Errorf("image is %v, want %v", size, test.wantSize)
+			}
+			if _, isGray := img.(*image.Gray); isGray != test.wantGray {
+				t.Errorf("image is gray %v, want %v", isGray, test.wantGray)
+			}
+		})
+	}
+}
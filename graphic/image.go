@@ -1,46 +1,36 @@
 package graphic
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"github.com/adelolmo/scanpi/fsutils"
 	"github.com/adelolmo/scanpi/logger"
 	"github.com/disintegration/imaging"
-	"golang.org/x/image/tiff"
-	"image"
-	"image/jpeg"
-	"image/png"
 	"os"
-	"path"
 	"time"
 )
 
 type Thumbnail struct {
 	filter        imaging.ResampleFilter
+	filterName    string
 	baseDirectory string
+	memoryLimit   int64
 }
 
-func NewThumbnail(thumbnailName, baseDirectory string) *Thumbnail {
+// NewThumbnail creates thumbnails decoding the scans with at most memoryLimit
+// bytes.
+func NewThumbnail(thumbnailName, baseDirectory string, memoryLimit int64) *Thumbnail {
 	return &Thumbnail{
 		filter:        toThumbnailFilter(thumbnailName),
+		filterName:    thumbnailName,
 		baseDirectory: baseDirectory,
+		memoryLimit:   memoryLimit,
 	}
 }
 
-func (t Thumbnail) Preview(originalImage string) (*bytes.Buffer, error) {
-	previewPath := originalImage + ".thumbnail"
-	preview, err := imaging.Open(previewPath)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("failed to open image: %v\n", err))
-
-	}
-	buf := new(bytes.Buffer)
-	if err := jpeg.Encode(buf, preview, nil); err != nil {
-		return nil, errors.New(fmt.Sprintf("failed to encode preview: %v\n", err))
-
-	}
-	return buf, nil
+// PreviewPath returns the path of the jpeg thumbnail of the image.
+func (t Thumbnail) PreviewPath(originalImage string) string {
+	return originalImage + ".thumbnail"
 }
 
 func (t Thumbnail) GenerateThumbnail(imageDetails ImageDetails) error {
@@ -50,19 +40,12 @@ func (t Thumbnail) GenerateThumbnail(imageDetails ImageDetails) error {
 
 	logger.Info("(%s) Generating preview...", imageDetails.Filename())
 
-	logger.Info("(%s) read file", imageDetails.Filename())
-	file, err := os.ReadFile(imageDetails.ImagePath())
-	if err != nil {
-		return errors.New(fmt.Sprintf("Cannot read image on %s. Error: %s", imageDetails.Filename(), err))
-	}
-	logger.Info("(%s) done", imageDetails.Filename())
-
-	logger.Info("(%s) decode image", imageDetails.Filename())
-	srcImage, err := decodeImage(bytes.NewReader(file), imageDetails.ImagePath())
+	srcImage, memory, err := decodeReduced(imageDetails.ImagePath(), 0, 250, t.memoryLimit)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Cannot decode image on %s. Error: %s", imageDetails.Filename(), err))
 	}
-	logger.Info("(%s) done", imageDetails.Filename())
+	bounds := srcImage.Bounds()
+	logger.Info("(%s) decoded at %dx%d using about %d KB", imageDetails.Filename(), bounds.Dx(), bounds.Dy(), memory>>10)
 
 	logger.Info("(%s) resize image", imageDetails.Filename())
 	dst := imaging.Resize(srcImage, 0, 250, t.filter)
@@ -80,6 +63,19 @@ func (t Thumbnail) GenerateThumbnail(imageDetails ImageDetails) error {
 		return errors.New(fmt.Sprintf("Cannot rename Thumbnail on %s. Error: %s", previewPath+".jpeg", err))
 	}
 
+	if imageDetails.Format == Pdf {
+		// the pages are counted once, not on every listing of the job
+		if _, err := CachedPdfPageCount(imageDetails.ImagePath()); err != nil {
+			logger.Error(fmt.Sprintf("Cannot count the pages of '%s'. Error: %s", imageDetails.Filename(), err))
+		}
+	}
+
+	if _, err := os.Lstat(imageDetails.LinkPath() + ".thumbnail"); err == nil {
+		// the thumbnail was regenerated, the link already points to it
+		logger.Info("(%s) Generation took %fs", imageDetails.Filename(), time.Now().Sub(start).Seconds())
+		return nil
+	}
+
 	logger.Info("(%s) creating symlink", imageDetails.Filename())
 	err = os.Symlink(imageDetails.Filename()+".thumbnail", imageDetails.LinkPath()+".thumbnail")
 	if err != nil {
@@ -97,31 +93,6 @@ func (t Thumbnail) DeletePreview(originalImage string) error {
 	return fsutils.DeleteFileAndLink(previewPath)
 }
 
-func decodeImage(r *bytes.Reader, originalImage string) (image.Image, error) {
-	ext := path.Ext(originalImage)
-	switch ext {
-	case ".tiff":
-		srcImage, err := tiff.Decode(r)
-		if err != nil {
-			return nil, err
-		}
-		return srcImage, nil
-	case ".jpeg":
-		srcImage, err := jpeg.Decode(r)
-		if err != nil {
-			return nil, err
-		}
-		return srcImage, nil
-	case ".png":
-		srcImage, err := png.Decode(r)
-		if err != nil {
-			return nil, err
-		}
-		return srcImage, nil
-	}
-	return nil, errors.New(fmt.Sprintf("image format not supported: %s\n", ext))
-}
-
 func toThumbnailFilter(filter string) imaging.ResampleFilter {
 	switch filter {
 	case "NearestNeighbor":
@@ -0,0 +1,89 @@
+package graphic
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/adelolmo/scanpi/logger"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DetectFormat identifies the format of an image from its first bytes.
+func DetectFormat(header []byte) (Format, error) {
+	switch {
+	case bytes.HasPrefix(header, []byte{0xff, 0xd8, 0xff}):
+		return Jpeg, nil
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return Png, nil
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		return Tiff, nil
+	case bytes.HasPrefix(header, []byte("%PDF-")):
+		return Pdf, nil
+	case len(header) > 2 && header[0] == 'P' && header[1] >= '4' && header[1] <= '6':
+		return Pnm, nil
+	case len(header) > 2 && header[0] == 'P' && header[1] >= '1' && header[1] <= '3':
+		// the plain pnm formats cannot be decoded for the thumbnails
+		return Pnm, errors.New("plain pnm format not supported, use binary pnm")
+	}
+	return Jpeg, errors.New("unknown image format")
+}
+
+// ImportImage stores an image that was not scanned, like a photo, the same way
+// a scan is stored. The thumbnail and the text recognition run in background.
+func ImportImage(r io.Reader, imageDetails ImageDetails, postProcessor *PostProcessor) error {
+	logger.Info("Importing '%s' with symlink '%s'", imageDetails.Filename(), imageDetails.LinkFilename())
+
+	temporaryPath := imageDetails.ImagePath() + ".upload"
+	file, err := os.OpenFile(temporaryPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Cannot create image file on '%s'. Error: %s", imageDetails.Filename(), err))
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(temporaryPath)
+		return errors.New(fmt.Sprintf("Cannot write image file on '%s'. Error: %s", imageDetails.Filename(), err))
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(temporaryPath)
+		return errors.New(fmt.Sprintf("Cannot write image file on '%s'. Error: %s", imageDetails.Filename(), err))
+	}
+	if err := os.Rename(temporaryPath, imageDetails.ImagePath()); err != nil {
+		return errors.New(fmt.Sprintf("Cannot write image file on '%s'. Error: %s", imageDetails.Filename(), err))
+	}
+
+	if err := os.Symlink(imageDetails.Filename(), imageDetails.LinkPath()); err != nil {
+		return errors.New(fmt.Sprintf("Cannot create symlink to image file on '%s'. Error: %s", imageDetails.LinkPath(), err))
+	}
+
+	postProcessor.Process(imageDetails)
+	return nil
+}
+
+// ExtractPdfPages renders every page of the pdf document as png image into the
+// directory, using a locally installed pdftoppm. It returns the paths of the
+// images in page order.
+func ExtractPdfPages(pdfPath, directory string, resolution int) ([]string, error) {
+	prefix := filepath.Join(directory, "page")
+	command := exec.Command("/usr/bin/pdftoppm",
+		"-r", fmt.Sprintf("%d", resolution),
+		"-png",
+		pdfPath,
+		prefix)
+	logger.Info(strings.Join(command.Args, " "))
+	if out, err := command.CombinedOutput(); err != nil {
+		return nil, errors.New(fmt.Sprintf("Error executing pdftoppm command. Output: %s. Error:%v", out, err))
+	}
+
+	// page numbers are zero padded to the same length
+	pages, err := filepath.Glob(prefix + "-*.png")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(pages)
+	return pages, nil
+}
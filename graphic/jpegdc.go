@@ -0,0 +1,424 @@
+package graphic
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// jpegHuffman is a huffman table of a jpeg image, in the canonical form of
+// the specification: the codes of every length are consecutive numbers.
+type jpegHuffman struct {
+	maxCode [17]int32
+	valPtr  [17]int32
+	minCode [17]int32
+	values  []byte
+}
+
+type jpegComponent struct {
+	id         byte
+	h, v       int
+	quantTable byte
+	dcTable    byte
+	acTable    byte
+	prediction int32
+	// plane holds the average of every block of the component
+	plane       []uint8
+	planeStride int
+}
+
+// jpegBits reads the entropy coded data of a scan bit by bit. It stops at
+// the markers, which are not part of the data.
+type jpegBits struct {
+	r      *bufio.Reader
+	bits   uint32
+	nBits  uint
+	marker byte
+}
+
+func (b *jpegBits) bit() (uint32, error) {
+	if b.nBits == 0 {
+		if b.marker != 0 {
+			// the data is padded with ones up to the marker
+			return 1, nil
+		}
+		c, err := b.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c == 0xff {
+			next, err := b.r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			if next != 0 {
+				b.marker = next
+				return 1, nil
+			}
+		}
+		b.bits, b.nBits = uint32(c), 8
+	}
+	b.nBits--
+	return (b.bits >> b.nBits) & 1, nil
+}
+
+func (b *jpegBits) receive(n int) (int32, error) {
+	var value int32
+	for i := 0; i < n; i++ {
+		bit, err := b.bit()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<1 | int32(bit)
+	}
+	return value, nil
+}
+
+func (b *jpegBits) decode(h *jpegHuffman) (byte, error) {
+	var code int32
+	for length := 1; length <= 16; length++ {
+		bit, err := b.bit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | int32(bit)
+		if code <= h.maxCode[length] {
+			return h.values[h.valPtr[length]+code-h.minCode[length]], nil
+		}
+	}
+	return 0, errors.New("corrupt jpeg huffman code")
+}
+
+// restart skips the restart marker that follows a restart interval.
+func (b *jpegBits) restart() error {
+	b.nBits = 0
+	if b.marker == 0 {
+		for {
+			c, err := b.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if c != 0xff {
+				continue
+			}
+			if b.marker, err = b.r.ReadByte(); err != nil {
+				return err
+			}
+			if b.marker != 0 && b.marker != 0xff {
+				break
+			}
+		}
+	}
+	if b.marker < 0xd0 || b.marker > 0xd7 {
+		return errors.New("missing jpeg restart marker")
+	}
+	b.marker = 0
+	return nil
+}
+
+// decodeJpegDc decodes baseline jpeg images at an eighth of their size. Only
+// the DC coefficient of every block is used, which is the average of the 8x8
+// pixels of the block, so the blocks are neither dequantized nor transformed.
+// The image is decoded at full size by the standard decoder when an eighth is
+// smaller than the requested size, or when it is progressive.
+func decodeJpegDc(r *bufio.Reader, width, height int, limit int64) (image.Image, int64, error) {
+	marker := make([]byte, 2)
+	if _, err := io.ReadFull(r, marker); err != nil {
+		return nil, 0, err
+	}
+	if marker[0] != 0xff || marker[1] != 0xd8 {
+		return nil, 0, errors.New("missing jpeg start of image")
+	}
+
+	var quantDc [4]int32
+	var dcTables, acTables [4]*jpegHuffman
+	var components []*jpegComponent
+	var imageWidth, imageHeight, restartInterval int
+	adobeRgb := false
+
+	for {
+		if _, err := io.ReadFull(r, marker); err != nil {
+			return nil, 0, err
+		}
+		for marker[1] == 0xff {
+			// fill bytes
+			var err error
+			if marker[1], err = r.ReadByte(); err != nil {
+				return nil, 0, err
+			}
+		}
+		if marker[0] != 0xff {
+			return nil, 0, errors.New("corrupt jpeg marker")
+		}
+		if marker[1] == 0xd9 {
+			return nil, 0, errors.New("jpeg image without scan")
+		}
+		lengthBytes := make([]byte, 2)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return nil, 0, err
+		}
+		length := int(lengthBytes[0])<<8 | int(lengthBytes[1]) - 2
+		if length < 0 {
+			return nil, 0, errors.New("corrupt jpeg segment")
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, 0, err
+		}
+
+		switch marker[1] {
+		case 0xc0, 0xc1:
+			if length < 6 || segment[0] != 8 {
+				return nil, 0, errReductionUnsupported
+			}
+			imageHeight = int(segment[1])<<8 | int(segment[2])
+			imageWidth = int(segment[3])<<8 | int(segment[4])
+			count := int(segment[5])
+			if imageWidth == 0 || imageHeight == 0 || (count != 1 && count != 3) || length < 6+3*count {
+				return nil, 0, errReductionUnsupported
+			}
+			if imageWidth/8 < width || imageHeight/8 < height {
+				return nil, 0, errReductionUnsupported
+			}
+			for i := 0; i < count; i++ {
+				c := segment[6+3*i:]
+				component := &jpegComponent{id: c[0], h: int(c[1] >> 4), v: int(c[1] & 0x0f), quantTable: c[2] & 3}
+				if component.h < 1 || component.v < 1 || component.h > 4 || component.v > 4 {
+					return nil, 0, errors.New("corrupt jpeg sampling factors")
+				}
+				components = append(components, component)
+			}
+		case 0xc2, 0xc3, 0xc5, 0xc6, 0xc7, 0xc9, 0xca, 0xcb, 0xcd, 0xce, 0xcf:
+			// progressive, lossless, hierarchical and arithmetic coding
+			return nil, 0, errReductionUnsupported
+		case 0xdb:
+			for i := 0; i < len(segment); {
+				precision, table := segment[i]>>4, segment[i]&3
+				if i+1 >= len(segment) {
+					return nil, 0, errors.New("corrupt jpeg quantization table")
+				}
+				if precision == 0 {
+					quantDc[table] = int32(segment[i+1])
+					i += 65
+				} else {
+					if i+2 >= len(segment) {
+						return nil, 0, errors.New("corrupt jpeg quantization table")
+					}
+					quantDc[table] = int32(segment[i+1])<<8 | int32(segment[i+2])
+					i += 129
+				}
+			}
+		case 0xc4:
+			for i := 0; i < len(segment); {
+				if i+17 > len(segment) {
+					return nil, 0, errors.New("corrupt jpeg huffman table")
+				}
+				class, table := segment[i]>>4, segment[i]&3
+				huffman := &jpegHuffman{}
+				var code int32
+				total := 0
+				for length := 1; length <= 16; length++ {
+					count := int(segment[i+length])
+					huffman.valPtr[length] = int32(total)
+					huffman.minCode[length] = code
+					code += int32(count)
+					total += count
+					huffman.maxCode[length] = -1
+					if count > 0 {
+						huffman.maxCode[length] = code - 1
+					}
+					code <<= 1
+				}
+				if i+17+total > len(segment) {
+					return nil, 0, errors.New("corrupt jpeg huffman table")
+				}
+				huffman.values = segment[i+17 : i+17+total]
+				if class == 0 {
+					dcTables[table] = huffman
+				} else {
+					acTables[table] = huffman
+				}
+				i += 17 + total
+			}
+		case 0xdd:
+			if length >= 2 {
+				restartInterval = int(segment[0])<<8 | int(segment[1])
+			}
+		case 0xee:
+			// the Adobe segment tells whether the components are RGB
+			if length >= 12 && string(segment[:5]) == "Adobe" {
+				adobeRgb = segment[11] == 0
+			}
+		case 0xda:
+			if components == nil || length < 1 {
+				return nil, 0, errors.New("jpeg scan without frame")
+			}
+			count := int(segment[0])
+			if count != len(components) || length < 1+2*count {
+				// components in separate scans
+				return nil, 0, errReductionUnsupported
+			}
+			for i := 0; i < count; i++ {
+				s := segment[1+2*i:]
+				found := false
+				for _, component := range components {
+					if component.id == s[0] {
+						component.dcTable, component.acTable = s[1]>>4&3, s[1]&3
+						found = true
+					}
+				}
+				if !found {
+					return nil, 0, errors.New("corrupt jpeg scan")
+				}
+			}
+			for _, component := range components {
+				if dcTables[component.dcTable] == nil || acTables[component.acTable] == nil {
+					return nil, 0, errors.New("missing jpeg huffman table")
+				}
+			}
+			return decodeJpegScan(r, components, imageWidth, imageHeight, restartInterval, quantDc,
+				dcTables, acTables, adobeRgb, limit)
+		}
+	}
+}
+
+func decodeJpegScan(r *bufio.Reader, components []*jpegComponent, imageWidth, imageHeight, restartInterval int,
+	quantDc [4]int32, dcTables, acTables [4]*jpegHuffman, adobeRgb bool, limit int64) (image.Image, int64, error) {
+
+	hMax, vMax := 1, 1
+	for _, component := range components {
+		if component.h > hMax {
+			hMax = component.h
+		}
+		if component.v > vMax {
+			vMax = component.v
+		}
+	}
+	// a single component is not interleaved, its blocks are not grouped by
+	// the sampling factors
+	if len(components) == 1 {
+		components[0].h, components[0].v, hMax, vMax = 1, 1, 1, 1
+	}
+	mcusX := (imageWidth + 8*hMax - 1) / (8 * hMax)
+	mcusY := (imageHeight + 8*vMax - 1) / (8 * vMax)
+
+	reducedWidth, reducedHeight := (imageWidth+7)/8, (imageHeight+7)/8
+	memory := int64(reducedWidth * reducedHeight * 4)
+	for _, component := range components {
+		component.planeStride = mcusX * component.h
+		memory += int64(component.planeStride * mcusY * component.v)
+	}
+	if memory > limit {
+		return nil, memory, errors.New(fmt.Sprintf("%dx%d image needs %d MB to decode, more than the limit of %d MB",
+			imageWidth, imageHeight, memory>>20, limit>>20))
+	}
+	for _, component := range components {
+		component.plane = make([]uint8, component.planeStride*mcusY*component.v)
+	}
+
+	bits := &jpegBits{r: r}
+	mcu := 0
+	for my := 0; my < mcusY; my++ {
+		for mx := 0; mx < mcusX; mx++ {
+			if restartInterval > 0 && mcu > 0 && mcu%restartInterval == 0 {
+				if err := bits.restart(); err != nil {
+					return nil, 0, err
+				}
+				for _, component := range components {
+					component.prediction = 0
+				}
+			}
+			mcu++
+			for _, component := range components {
+				for by := 0; by < component.v; by++ {
+					for bx := 0; bx < component.h; bx++ {
+						dc, err := decodeJpegBlock(bits, component, dcTables[component.dcTable], acTables[component.acTable])
+						if err != nil {
+							return nil, 0, err
+						}
+						// the DC coefficient is eight times the average
+						// of the block, shifted by 128
+						average := dc*quantDc[component.quantTable]/8 + 128
+						if average < 0 {
+							average = 0
+						} else if average > 0xff {
+							average = 0xff
+						}
+						x := mx*component.h + bx
+						y := my*component.v + by
+						component.plane[y*component.planeStride+x] = uint8(average)
+					}
+				}
+			}
+		}
+	}
+
+	sample := func(component *jpegComponent, x, y int) uint8 {
+		return component.plane[y*component.v/vMax*component.planeStride+x*component.h/hMax]
+	}
+	if len(components) == 1 {
+		gray := image.NewGray(image.Rect(0, 0, reducedWidth, reducedHeight))
+		for y := 0; y < reducedHeight; y++ {
+			for x := 0; x < reducedWidth; x++ {
+				gray.Pix[y*gray.Stride+x] = sample(components[0], x, y)
+			}
+		}
+		return gray, memory, nil
+	}
+	rgba := image.NewNRGBA(image.Rect(0, 0, reducedWidth, reducedHeight))
+	for y := 0; y < reducedHeight; y++ {
+		for x := 0; x < reducedWidth; x++ {
+			c0, c1, c2 := sample(components[0], x, y), sample(components[1], x, y), sample(components[2], x, y)
+			if !adobeRgb {
+				c0, c1, c2 = color.YCbCrToRGB(c0, c1, c2)
+			}
+			i := y*rgba.Stride + x*4
+			rgba.Pix[i], rgba.Pix[i+1], rgba.Pix[i+2], rgba.Pix[i+3] = c0, c1, c2, 0xff
+		}
+	}
+	return rgba, memory, nil
+}
+
+// decodeJpegBlock returns the DC coefficient of the next block, skipping its
+// AC coefficients.
+func decodeJpegBlock(bits *jpegBits, component *jpegComponent, dcTable, acTable *jpegHuffman) (int32, error) {
+	size, err := bits.decode(dcTable)
+	if err != nil {
+		return 0, err
+	}
+	if size > 11 {
+		return 0, errors.New("corrupt jpeg DC coefficient")
+	}
+	diff, err := bits.receive(int(size))
+	if err != nil {
+		return 0, err
+	}
+	if size > 0 && diff < 1<<(size-1) {
+		diff -= 1<<size - 1
+	}
+	component.prediction += diff
+
+	for k := 1; k < 64; k++ {
+		symbol, err := bits.decode(acTable)
+		if err != nil {
+			return 0, err
+		}
+		run, size := int(symbol>>4), int(symbol&0x0f)
+		if size == 0 {
+			if run != 15 {
+				// end of block
+				break
+			}
+			k += 15
+			continue
+		}
+		k += run
+		if _, err := bits.receive(size); err != nil {
+			return 0, err
+		}
+	}
+	return component.prediction, nil
+}
@@ -0,0 +1,120 @@
+package graphic
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// dcReduce scales the image down to an eighth the way the DC coefficients
+// do: every sample of a plane is the average of its 8x8 block, and the chroma
+// blocks of subsampled images cover more pixels than the luma ones.
+func dcReduce(img image.Image) image.Image {
+	ycbcr, ok := img.(*image.YCbCr)
+	if !ok {
+		return boxReduce(img, 8)
+	}
+	average := func(plane []uint8, stride, width, height, x0, y0 int) uint8 {
+		sum, count := 0, 0
+		for y := y0; y < y0+8 && y < height; y++ {
+			for x := x0; x < x0+8 && x < width; x++ {
+				sum += int(plane[y*stride+x])
+				count++
+			}
+		}
+		return uint8((sum + count/2) / count)
+	}
+	bounds := ycbcr.Bounds()
+	chroma := ycbcr.COffset(bounds.Max.X-1, bounds.Max.Y-1)
+	chromaWidth, chromaHeight := chroma%ycbcr.CStride+1, chroma/ycbcr.CStride+1
+	// the luma samples of a chroma block
+	scaleX, scaleY := (bounds.Dx()+chromaWidth-1)/chromaWidth, (bounds.Dy()+chromaHeight-1)/chromaHeight
+	reduced := image.NewNRGBA(image.Rect(0, 0, (bounds.Dx()+7)/8, (bounds.Dy()+7)/8))
+	for ry := 0; ry < reduced.Rect.Dy(); ry++ {
+		for rx := 0; rx < reduced.Rect.Dx(); rx++ {
+			y := average(ycbcr.Y, ycbcr.YStride, bounds.Dx(), bounds.Dy(), rx*8, ry*8)
+			cx, cy := rx/scaleX*8, ry/scaleY*8
+			cb := average(ycbcr.Cb, ycbcr.CStride, chromaWidth, chromaHeight, cx, cy)
+			cr := average(ycbcr.Cr, ycbcr.CStride, chromaWidth, chromaHeight, cx, cy)
+			r, g, b := color.YCbCrToRGB(y, cb, cr)
+			reduced.SetNRGBA(rx, ry, color.NRGBA{R: r, G: g, B: b, A: 0xff})
+		}
+	}
+	return reduced
+}
+
+func TestDecodeJpegDc(t *testing.T) {
+	encode := func(img image.Image) []byte {
+		buffer := new(bytes.Buffer)
+		if err := jpeg.Encode(buffer, img, &jpeg.Options{Quality: 95}); err != nil {
+			t.Fatal(err)
+		}
+		return buffer.Bytes()
+	}
+	tests := []struct {
+		name          string
+		img           image.Image
+		width, height int
+		// tolerance allows for the rounding of the DC coefficients and of the
+		// padding of the partial blocks
+		tolerance int
+	}{
+		{"gray", gradient(256, 128, true), 8, 8, 2},
+		{"gray with partial blocks", gradient(100, 61, true), 4, 4, 3},
+		{"color", gradient(256, 128, false), 8, 8, 3},
+		{"color with partial blocks", gradient(100, 61, false), 4, 4, 6},
+		{"any size", gradient(64, 64, true), 0, 0, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := encode(test.img)
+			full, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			img, _, err := decodeJpegDc(bufio.NewReader(bytes.NewReader(data)), test.width, test.height, 1<<20)
+			if err != nil {
+				t.Fatalf("decodeJpegDc() error = %v", err)
+			}
+			compareImages(t, img, dcReduce(full), test.tolerance)
+		})
+	}
+}
+
+func TestDecodeJpegDcFailures(t *testing.T) {
+	img := new(bytes.Buffer)
+	if err := jpeg.Encode(img, gradient(64, 64, false), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := img.Bytes()
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height int
+		limit         int64
+		wantErr       error
+	}{
+		{"an eighth smaller than asked", data, 16, 4, 1 << 20, errReductionUnsupported},
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n"), 4, 4, 1 << 20, nil},
+		{"truncated", data[:len(data)/2], 4, 4, 1 << 20, nil},
+		{"over the memory limit", data, 4, 4, 16, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := decodeJpegDc(bufio.NewReader(bytes.NewReader(test.data)), test.width, test.height, test.limit)
+			if err == nil {
+				t.Fatal("decodeJpegDc() did not fail")
+			}
+			if test.wantErr != nil && err != test.wantErr {
+				t.Errorf("decodeJpegDc() error = %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr == nil && err == errReductionUnsupported {
+				t.Errorf("decodeJpegDc() error = %v, want a failure", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package graphic
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adelolmo/scanpi/logger"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Ocr struct {
+	language string
+}
+
+// NewOcr creates a text recognizer for the given tesseract language, for instance
+// "eng" or "deu+eng". An empty language disables the recognition.
+func NewOcr(language string) *Ocr {
+	return &Ocr{
+		language: language,
+	}
+}
+
+func (o Ocr) Enabled() bool {
+	return o.language != ""
+}
+
+// Recognize runs tesseract on the image and stores the plain text and the hOCR
+// output next to it, as <image>.txt and <image>.hocr.
+func (o Ocr) Recognize(imageDetails ImageDetails) error {
+	if !o.Enabled() {
+		return nil
+	}
+	start := time.Now()
+
+	logger.Info("(%s) Recognizing text...", imageDetails.Filename())
+	command := exec.Command("/usr/bin/tesseract",
+		imageDetails.ImagePath(),
+		imageDetails.ImagePath(),
+		"-l", o.language,
+		"txt", "hocr")
+	logger.Info(strings.Join(command.Args, " "))
+	if out, err := command.CombinedOutput(); err != nil {
+		return errors.New(fmt.Sprintf("Error executing tesseract command. Output: %s. Error:%v", out, err))
+	}
+
+	logger.Info("(%s) Recognition took %fs", imageDetails.Filename(), time.Now().Sub(start).Seconds())
+	return nil
+}
+
+// DeleteText removes the recognized text of the image. The image path can be
+// the symlink of the scan.
+func (o Ocr) DeleteText(originalImage string) error {
+	if readlink, err := os.Readlink(originalImage); err == nil {
+		originalImage = filepath.Join(filepath.Dir(originalImage), readlink)
+	}
+	for _, ext := range []string{".txt", ".hocr"} {
+		if err := os.Remove(originalImage + ext); err != nil && !os.IsNotExist(err) {
+			return errors.New(fmt.Sprintf("unable to delete file %s. Error: %v", originalImage+ext, err))
+		}
+	}
+	return nil
+}
+
+// HocrPath returns the hOCR file of the image, or an empty string when no text
+// was recognized for it.
+func (o Ocr) HocrPath(originalImage string) string {
+	hocrPath := originalImage + ".hocr"
+	if _, err := os.Stat(hocrPath); err != nil {
+		return ""
+	}
+	return hocrPath
+}
@@ -0,0 +1,675 @@
+package graphic
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"github.com/adelolmo/scanpi/logger"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	pdftoppmPath = "/usr/bin/pdftoppm"
+	pdfinfoPath  = "/usr/bin/pdfinfo"
+
+	// PageCountSuffix names the file caching the number of pages of a pdf
+	// document, next to it.
+	PageCountSuffix = ".pages"
+)
+
+var (
+	pdfImage     = regexp.MustCompile(`/Subtype\s*/Image`)
+	pdfWidth     = regexp.MustCompile(`/Width\s+(\d+)`)
+	pdfHeight    = regexp.MustCompile(`/Height\s+(\d+)`)
+	pdfBits      = regexp.MustCompile(`/BitsPerComponent\s+(\d+)`)
+	pdfColors    = regexp.MustCompile(`/ColorSpace\s*/Device(Gray|RGB)`)
+	pdfPredictor = regexp.MustCompile(`/Predictor\s+(\d+)`)
+	pdfPages     = regexp.MustCompile(`(?m)^Pages:\s+(\d+)`)
+	pdfObjStart  = regexp.MustCompile(`(?:^|\s)(\d+)\s+\d+\s+obj$`)
+	pdfRoot      = regexp.MustCompile(`/Root\s+(\d+)\s+\d+\s+R`)
+	pdfPagesRef  = regexp.MustCompile(`/Pages\s+(\d+)\s+\d+\s+R`)
+	pdfPageTree  = regexp.MustCompile(`/Type\s*/Pages`)
+	pdfKids      = regexp.MustCompile(`/Kids\s*\[([^\]]*)\]`)
+	pdfParent    = regexp.MustCompile(`/Parent\s+(\d+)\s+\d+\s+R`)
+	pdfResources = regexp.MustCompile(`/Resources\s+(\d+)\s+\d+\s+R`)
+	pdfXObjects  = regexp.MustCompile(`(?s)/XObject\s*(?:(\d+)\s+\d+\s+R|<<(.*?)>>)`)
+	pdfReference = regexp.MustCompile(`(\d+)\s+\d+\s+R`)
+	pdfContents  = regexp.MustCompile(`/Contents\s+(\d+)\s+\d+\s+R`)
+	pdfDraw      = regexp.MustCompile(`/([^\s/\[\]<>()]+)\s+Do\b`)
+	pdfNamedRef  = regexp.MustCompile(`/([^\s/\[\]<>()]+)\s+(\d+)\s+\d+\s+R`)
+)
+
+// decodePdf renders the first page of the pdf document at a size still at
+// least twice as big as the given width and height. The locally installed
+// pdftoppm is used when available. Otherwise only documents made of images,
+// like the scanned ones, can be rendered: the image of the first page is
+// decoded, or the first image of the document when the pages cannot be found.
+func decodePdf(file *os.File, width, height int, limit int64) (image.Image, int64, error) {
+	if _, err := os.Stat(pdftoppmPath); err == nil {
+		img, memory, err := renderPdfPage(file.Name(), width, height, limit)
+		if err == nil {
+			return img, memory, nil
+		}
+		logger.Error(fmt.Sprintf("cannot render %s with pdftoppm, looking for an image instead. Error: %s",
+			file.Name(), err))
+	}
+	offset, err := firstPageImage(file)
+	if err != nil {
+		logger.Info("cannot find the image of the first page of %s, using the first image instead. Error: %s",
+			file.Name(), err)
+		offset = 0
+	}
+	return decodePdfImage(file, offset, width, height, limit)
+}
+
+func renderPdfPage(pdfPath string, width, height int, limit int64) (image.Image, int64, error) {
+	var scale []string
+	switch {
+	case width == 0:
+		scale = []string{"-scale-to-x", "-1", "-scale-to-y", strconv.Itoa(2 * height)}
+	case height == 0:
+		scale = []string{"-scale-to-x", strconv.Itoa(2 * width), "-scale-to-y", "-1"}
+	default:
+		scale = []string{"-scale-to", strconv.Itoa(2 * maxInt(width, height))}
+	}
+	return pdftoppmPage(pdfPath, 1, scale, limit)
+}
+
+// pdftoppmPage renders the page of the document, counted from 1, with the
+// scaling arguments of pdftoppm.
+func pdftoppmPage(pdfPath string, number int, scale []string, limit int64) (image.Image, int64, error) {
+	directory, err := os.MkdirTemp("", "pdfpage")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.RemoveAll(directory)
+
+	args := append([]string{"-f", strconv.Itoa(number), "-l", strconv.Itoa(number), "-singlefile", "-png"}, scale...)
+	prefix := filepath.Join(directory, "page")
+	command := exec.Command(pdftoppmPath, append(args, pdfPath, prefix)...)
+	logger.Info(strings.Join(command.Args, " "))
+	if out, err := command.CombinedOutput(); err != nil {
+		return nil, 0, errors.New(fmt.Sprintf("Error executing pdftoppm command. Output: %s. Error:%v", out, err))
+	}
+
+	page, err := os.Open(prefix + ".png")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer page.Close()
+	return decodeFull(page, limit)
+}
+
+// decodePdfPages decodes the pages of the pdf document one after the other,
+// rendered at the resolution in dots per inch. The locally installed pdftoppm
+// is used when available. Otherwise only documents made of images, like the
+// scanned ones, can be decoded: the image of every page is decoded at full
+// size.
+func decodePdfPages(pdfPath string, resolution int, limit int64, page func(image.Image) error) error {
+	if _, err := os.Stat(pdftoppmPath); err == nil {
+		count, err := PdfPageCount(pdfPath)
+		if err != nil {
+			return err
+		}
+		for number := 1; number <= count; number++ {
+			img, _, err := pdftoppmPage(pdfPath, number, []string{"-r", strconv.Itoa(resolution)}, limit)
+			if err != nil {
+				return err
+			}
+			if err := page(img); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(pdfPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	offsets, err := pageImages(file, 0)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot find the images of the pages of %s. Error: %s", pdfPath, err))
+	}
+	for _, offset := range offsets {
+		img, _, err := decodePdfImage(file, offset, fullSize, fullSize, limit)
+		if err != nil {
+			return err
+		}
+		if err := page(img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodePdfImage reads the document from the offset until the first jpeg or
+// deflate compressed image and decodes it at a reduced scale.
+func decodePdfImage(file *os.File, offset int64, width, height int, limit int64) (image.Image, int64, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	r := bufio.NewReader(file)
+	// window keeps the last bytes read, enough for the dictionary of the
+	// stream that follows
+	window := make([]byte, 0, 8192)
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return nil, 0, errors.New("no image found in pdf document")
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		offset++
+		if len(window) == cap(window) {
+			window = append(window[:0], window[len(window)-1024:]...)
+		}
+		window = append(window, c)
+
+		if !bytes.HasSuffix(window, []byte("stream")) || bytes.HasSuffix(window, []byte("endstream")) {
+			continue
+		}
+		// the stream data starts after the end of line
+		if c, err = r.ReadByte(); err != nil {
+			return nil, 0, err
+		}
+		offset++
+		if c == '\r' {
+			if next, err := r.Peek(1); err == nil && next[0] == '\n' {
+				r.ReadByte()
+				offset++
+			}
+		}
+
+		dictionary := window
+		if start := bytes.LastIndex(window, []byte("obj")); start >= 0 {
+			dictionary = window[start:]
+		}
+		if !pdfImage.Match(dictionary) {
+			continue
+		}
+		switch {
+		case bytes.Contains(dictionary, []byte("/DCTDecode")) && !bytes.Contains(dictionary, []byte("/FlateDecode")):
+			img, memory, err := decodeJpegDc(r, width, height, limit)
+			if err != errReductionUnsupported {
+				return img, memory, err
+			}
+			info, err := file.Stat()
+			if err != nil {
+				return nil, 0, err
+			}
+			return decodeFull(io.NewSectionReader(file, offset, info.Size()-offset), limit)
+		case bytes.Contains(dictionary, []byte("/FlateDecode")) && !bytes.Contains(dictionary, []byte("/DCTDecode")):
+			img, memory, err := decodePdfFlate(r, dictionary, width, height, limit)
+			if err != errReductionUnsupported {
+				return img, memory, err
+			}
+		}
+	}
+}
+
+// firstPageImage returns the offset of the first image object used by the
+// first page of the document. Only documents with a plain cross reference,
+// like the ones written by gofpdf, are understood.
+func firstPageImage(file *os.File) (int64, error) {
+	offsets, err := pageImages(file, 1)
+	if err != nil {
+		return 0, err
+	}
+	return offsets[0], nil
+}
+
+// pageImages returns the offsets of the first image object used by each page
+// of the document, in page order, up to the given number of pages, or every
+// page when zero.
+func pageImages(file *os.File, count int) ([]int64, error) {
+	objects, err := indexPdfObjects(file)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	tail := make([]byte, minInt(4096, int(info.Size())))
+	if _, err := file.ReadAt(tail, info.Size()-int64(len(tail))); err != nil {
+		return nil, err
+	}
+	root := pdfRoot.FindSubmatch(tail)
+	if root == nil {
+		return nil, errors.New("pdf trailer without root")
+	}
+	catalog, err := pdfObject(file, objects, string(root[1]))
+	if err != nil {
+		return nil, err
+	}
+	node := pdfPagesRef.FindSubmatch(catalog)
+	if node == nil {
+		return nil, errors.New("pdf catalog without pages")
+	}
+
+	// the pages are the leaves of the page tree, walked depth first
+	var offsets []int64
+	var walk func(number string, depth int) error
+	walk = func(number string, depth int) error {
+		if depth > 32 {
+			return errors.New("malformed pdf page tree")
+		}
+		page, err := pdfObject(file, objects, number)
+		if err != nil {
+			return err
+		}
+		if !pdfPageTree.Match(page) {
+			offset, err := pageImage(file, objects, page)
+			if err != nil {
+				return err
+			}
+			offsets = append(offsets, offset)
+			return nil
+		}
+		kids := pdfKids.FindSubmatch(page)
+		if kids == nil {
+			return errors.New("malformed pdf page tree")
+		}
+		for _, kid := range pdfReference.FindAllSubmatch(kids[1], -1) {
+			if count > 0 && len(offsets) == count {
+				return nil
+			}
+			if err := walk(string(kid[1]), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(string(node[1]), 0); err != nil {
+		return nil, err
+	}
+	if len(offsets) == 0 {
+		return nil, errors.New("pdf document without pages")
+	}
+	return offsets, nil
+}
+
+// pageImage returns the offset of the first image object used by the page.
+func pageImage(file *os.File, objects map[string]int64, page []byte) (int64, error) {
+	// the resources are inherited from the parents when the page has none
+	var err error
+	resources := page
+	for depth := 0; !bytes.Contains(resources, []byte("/Resources")); depth++ {
+		parent := pdfParent.FindSubmatch(resources)
+		if parent == nil || depth > 32 {
+			return 0, errors.New("pdf page without resources")
+		}
+		if resources, err = pdfObject(file, objects, string(parent[1])); err != nil {
+			return 0, err
+		}
+	}
+	if reference := pdfResources.FindSubmatch(resources); reference != nil {
+		if resources, err = pdfObject(file, objects, string(reference[1])); err != nil {
+			return 0, err
+		}
+	}
+	xObjects := pdfXObjects.FindSubmatch(resources)
+	if xObjects == nil {
+		return 0, errors.New("pdf page without images")
+	}
+	names := xObjects[2]
+	if xObjects[1] != nil {
+		if names, err = pdfObject(file, objects, string(xObjects[1])); err != nil {
+			return 0, err
+		}
+	}
+	// the pages may share their resources, like in the documents written by
+	// gofpdf, the image drawn by the content of the page is preferred
+	if content, err := pageContent(file, objects, page); err == nil {
+		for _, drawn := range pdfDraw.FindAllSubmatch(content, -1) {
+			for _, entry := range pdfNamedRef.FindAllSubmatch(names, -1) {
+				if !bytes.Equal(entry[1], drawn[1]) {
+					continue
+				}
+				object, err := pdfObject(file, objects, string(entry[2]))
+				if err == nil && pdfImage.Match(object) {
+					return objects[string(entry[2])], nil
+				}
+			}
+		}
+	}
+	for _, reference := range pdfReference.FindAllSubmatch(names, -1) {
+		object, err := pdfObject(file, objects, string(reference[1]))
+		if err == nil && pdfImage.Match(object) {
+			return objects[string(reference[1])], nil
+		}
+	}
+	return 0, errors.New("pdf page without images")
+}
+
+// pageContent returns the content stream of the page, up to its first
+// megabyte. Only uncompressed and deflate compressed streams are read.
+func pageContent(file *os.File, objects map[string]int64, page []byte) ([]byte, error) {
+	reference := pdfContents.FindSubmatch(page)
+	if reference == nil {
+		return nil, errors.New("pdf page without content")
+	}
+	number := string(reference[1])
+	dictionary, err := pdfObject(file, objects, number)
+	if err != nil {
+		return nil, err
+	}
+	// the stream data starts after the end of line that follows the keyword
+	offset := objects[number] + int64(len(dictionary)) + int64(len("stream"))
+	eol := make([]byte, 2)
+	if _, err := file.ReadAt(eol, offset); err != nil {
+		return nil, err
+	}
+	switch {
+	case eol[0] == '\r' && eol[1] == '\n':
+		offset += 2
+	case eol[0] == '\n' || eol[0] == '\r':
+		offset++
+	default:
+		return nil, errors.New(fmt.Sprintf("pdf object %s is not a stream", number))
+	}
+
+	var r io.Reader = io.NewSectionReader(file, offset, 1<<20)
+	switch {
+	case bytes.Contains(dictionary, []byte("/FlateDecode")):
+		z, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		r = z
+	case bytes.Contains(dictionary, []byte("/Filter")):
+		return nil, errors.New(fmt.Sprintf("pdf content %s has an unsupported filter", number))
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if end := bytes.Index(content, []byte("endstream")); end >= 0 {
+		content = content[:end]
+	}
+	return content, nil
+}
+
+// indexPdfObjects returns the offsets of the objects of the document by
+// their number, the last definition of every object winning.
+func indexPdfObjects(file *os.File) (map[string]int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(file)
+	objects := make(map[string]int64)
+	var offset int64
+	window := make([]byte, 0, 64)
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset++
+		if len(window) == cap(window) {
+			window = append(window[:0], window[len(window)-32:]...)
+		}
+		window = append(window, c)
+		if c != 'j' || !bytes.HasSuffix(window, []byte("obj")) || bytes.HasSuffix(window, []byte("endobj")) {
+			continue
+		}
+		if match := pdfObjStart.FindSubmatch(window); match != nil {
+			objects[string(match[1])] = offset
+		}
+	}
+}
+
+// pdfObject returns the beginning of the object, up to its stream.
+func pdfObject(file *os.File, objects map[string]int64, number string) ([]byte, error) {
+	offset, found := objects[number]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("pdf object %s not found", number))
+	}
+	object := make([]byte, 4096)
+	n, err := file.ReadAt(object, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	object = object[:n]
+	if end := bytes.Index(object, []byte("stream")); end >= 0 {
+		object = object[:end]
+	}
+	if end := bytes.Index(object, []byte("endobj")); end >= 0 {
+		object = object[:end]
+	}
+	return object, nil
+}
+
+// decodePdfFlate decodes a deflate compressed image with 8 bit gray or RGB
+// samples, the way gofpdf embeds png images, row by row.
+func decodePdfFlate(r io.Reader, dictionary []byte, width, height int, limit int64) (image.Image, int64, error) {
+	number := func(pattern *regexp.Regexp, defaultValue int) int {
+		match := pattern.FindSubmatch(dictionary)
+		if match == nil {
+			return defaultValue
+		}
+		value, err := strconv.Atoi(string(match[1]))
+		if err != nil {
+			return defaultValue
+		}
+		return value
+	}
+	imageWidth, imageHeight := number(pdfWidth, 0), number(pdfHeight, 0)
+	colors := pdfColors.FindSubmatch(dictionary)
+	if imageWidth < 1 || imageHeight < 1 || number(pdfBits, 0) != 8 || colors == nil {
+		return nil, 0, errReductionUnsupported
+	}
+	if imageWidth > maxImageSide || imageHeight > maxImageSide {
+		return nil, 0, errors.New(fmt.Sprintf("%dx%d pdf image too large", imageWidth, imageHeight))
+	}
+	channels := 1
+	if string(colors[1]) == "RGB" {
+		channels = 3
+	}
+	// predictors from 10 on prefix every row with its png filter
+	predictor := number(pdfPredictor, 1)
+	if predictor != 1 && predictor < 10 {
+		return nil, 0, errReductionUnsupported
+	}
+
+	factor := reductionFactor(imageWidth, imageHeight, width, height)
+	rowBytes := imageWidth * channels
+	if predictor >= 10 {
+		rowBytes++
+	}
+	memory := boxReducerMemory(imageWidth, imageHeight, channels, factor) + int64(2*rowBytes)
+	if memory > limit {
+		return nil, memory, errors.New(fmt.Sprintf("%dx%d image needs %d MB to decode, more than the limit of %d MB",
+			imageWidth, imageHeight, memory>>20, limit>>20))
+	}
+	reducer := newBoxReducer(imageWidth, imageHeight, channels, factor)
+	row := make([]byte, rowBytes)
+	previous := make([]byte, rowBytes)
+
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer z.Close()
+	for y := 0; y < imageHeight; y++ {
+		if _, err := io.ReadFull(z, row); err != nil {
+			return nil, 0, errors.New(fmt.Sprintf("cannot read row %d of pdf image. Error: %s", y, err))
+		}
+		samples := row
+		if predictor >= 10 {
+			if err := unfilterPngRow(row[0], row[1:], previous[1:], channels); err != nil {
+				return nil, 0, err
+			}
+			samples = row[1:]
+		}
+		reducer.addRow(samples)
+		row, previous = previous, row
+	}
+	return reducer.image(), memory, nil
+}
+
+// unfilterPngRow reverses the png filter of the row, given the previous row
+// already unfiltered.
+func unfilterPngRow(filter byte, row, previous []byte, bytesPerPixel int) error {
+	switch filter {
+	case 0:
+	case 1:
+		for i := bytesPerPixel; i < len(row); i++ {
+			row[i] += row[i-bytesPerPixel]
+		}
+	case 2:
+		for i := range row {
+			row[i] += previous[i]
+		}
+	case 3:
+		for i := range row {
+			var left int
+			if i >= bytesPerPixel {
+				left = int(row[i-bytesPerPixel])
+			}
+			row[i] += byte((left + int(previous[i])) / 2)
+		}
+	case 4:
+		for i := range row {
+			var left, upperLeft int
+			if i >= bytesPerPixel {
+				left, upperLeft = int(row[i-bytesPerPixel]), int(previous[i-bytesPerPixel])
+			}
+			row[i] += paeth(left, int(previous[i]), upperLeft)
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown png filter %d", filter))
+	}
+	return nil
+}
+
+func paeth(left, up, upperLeft int) byte {
+	p := left + up - upperLeft
+	pa, pb, pc := absInt(p-left), absInt(p-up), absInt(p-upperLeft)
+	switch {
+	case pa <= pb && pa <= pc:
+		return byte(left)
+	case pb <= pc:
+		return byte(up)
+	}
+	return byte(upperLeft)
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// PdfPageCount returns the number of pages of the pdf document, using the
+// locally installed pdfinfo when available. Otherwise the page objects are
+// counted, which misses the pages stored in compressed object streams.
+func PdfPageCount(pdfPath string) (int, error) {
+	if _, err := os.Stat(pdfinfoPath); err == nil {
+		out, err := exec.Command(pdfinfoPath, pdfPath).Output()
+		if err == nil {
+			if match := pdfPages.FindSubmatch(out); match != nil {
+				return strconv.Atoi(string(match[1]))
+			}
+		}
+	}
+
+	file, err := os.Open(pdfPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return countPdfPages(bufio.NewReader(file))
+}
+
+// CachedPdfPageCount returns the number of pages of the pdf document stored
+// in the .pages file next to it. The pages are counted, and the file written,
+// when it is missing or older than the document.
+func CachedPdfPageCount(pdfPath string) (int, error) {
+	countPath := pdfPath + PageCountSuffix
+	document, err := os.Stat(pdfPath)
+	if err != nil {
+		return 0, err
+	}
+	if cache, err := os.Stat(countPath); err == nil && !cache.ModTime().Before(document.ModTime()) {
+		data, err := ioutil.ReadFile(countPath)
+		if err == nil {
+			if count, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && count >= 0 {
+				return count, nil
+			}
+		}
+	}
+
+	count, err := PdfPageCount(pdfPath)
+	if err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(countPath+".tmp", []byte(strconv.Itoa(count)), 0644); err != nil {
+		return 0, errors.New(fmt.Sprintf("cannot save the page count of %s. Error: %s", pdfPath, err))
+	}
+	if err := os.Rename(countPath+".tmp", countPath); err != nil {
+		os.Remove(countPath + ".tmp")
+		return 0, errors.New(fmt.Sprintf("cannot save the page count of %s. Error: %s", pdfPath, err))
+	}
+	return count, nil
+}
+
+// countPdfPages counts the /Type /Page entries, reading the names of the
+// document one by one.
+func countPdfPages(r *bufio.Reader) (int, error) {
+	pages := 0
+	previous := ""
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return pages, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if c != '/' {
+			continue
+		}
+		var name []byte
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				break
+			}
+			if strings.IndexByte("/<>[]() \t\r\n\f", c) >= 0 {
+				r.UnreadByte()
+				break
+			}
+			name = append(name, c)
+		}
+		if previous == "Type" && string(name) == "Page" {
+			pages++
+		}
+		previous = string(name)
+	}
+}
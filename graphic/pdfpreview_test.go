@@ -0,0 +1,298 @@
+package graphic
+
+import (
+	"bytes"
+	"github.com/jung-kurt/gofpdf"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// filterPngRow applies the png filter to the row, the inverse of
+// unfilterPngRow.
+func filterPngRow(filter byte, row, previous []byte, bytesPerPixel int) []byte {
+	filtered := make([]byte, len(row))
+	for i := range row {
+		var left, upperLeft int
+		if i >= bytesPerPixel {
+			left, upperLeft = int(row[i-bytesPerPixel]), int(previous[i-bytesPerPixel])
+		}
+		up := int(previous[i])
+		switch filter {
+		case 0:
+			filtered[i] = row[i]
+		case 1:
+			filtered[i] = row[i] - byte(left)
+		case 2:
+			filtered[i] = row[i] - byte(up)
+		case 3:
+			filtered[i] = row[i] - byte((left+up)/2)
+		case 4:
+			filtered[i] = row[i] - paeth(left, up, upperLeft)
+		}
+	}
+	return filtered
+}
+
+func TestUnfilterPngRow(t *testing.T) {
+	previous := []byte{0, 10, 250, 30, 128, 255, 7, 90, 200}
+	row := []byte{255, 3, 120, 64, 64, 1, 180, 90, 17}
+	tests := []struct {
+		name          string
+		filter        byte
+		bytesPerPixel int
+		wantErr       bool
+	}{
+		{"none", 0, 1, false},
+		{"sub gray", 1, 1, false},
+		{"sub rgb", 1, 3, false},
+		{"up", 2, 3, false},
+		{"average gray", 3, 1, false},
+		{"average rgb", 3, 3, false},
+		{"paeth gray", 4, 1, false},
+		{"paeth rgb", 4, 3, false},
+		{"unknown", 5, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := filterPngRow(test.filter, row, previous, test.bytesPerPixel)
+			err := unfilterPngRow(test.filter, got, previous, test.bytesPerPixel)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("unfilterPngRow() error = %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && !bytes.Equal(got, row) {
+				t.Errorf("unfilterPngRow() = %v, want %v", got, row)
+			}
+		})
+	}
+}
+
+func TestIndexPdfObjects(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		want     map[string]int64
+	}{
+		{"objects", "%PDF-1.3\n1 0 obj\n<<>>\nendobj\n12 0 obj\n<<>>\nendobj\n",
+			map[string]int64{"1": 16, "12": 37}},
+		{"redefined object", "%PDF-1.3\n1 0 obj\n<<>>\nendobj\n1 0 obj\n<</A 1>>\nendobj\n",
+			map[string]int64{"1": 36}},
+		{"objects on the same line", "%PDF-1.3\n1 0 obj <<>> endobj 2 0 obj <<>> endobj",
+			map[string]int64{"1": 16, "2": 36}},
+		{"object numbers in the data", "%PDF-1.3\n1 0 obj\n(3 0 objection)\nendobj\n",
+			map[string]int64{"1": 16}},
+		{"no objects", "%PDF-1.3\n", map[string]int64{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			documentPath := path.Join(t.TempDir(), "document.pdf")
+			if err := os.WriteFile(documentPath, []byte(test.document), 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(documentPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			got, err := indexPdfObjects(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(test.want) {
+				t.Errorf("indexPdfObjects() = %v, want %v", got, test.want)
+			}
+			for number, offset := range test.want {
+				if got[number] != offset {
+					t.Errorf("object %s at %d, want %d", number, got[number], offset)
+				}
+				if !strings.HasSuffix(test.document[:offset], "obj") {
+					t.Errorf("object %s offset %d does not follow obj", number, offset)
+				}
+			}
+		})
+	}
+}
+
+// pngPage returns a png image of the size, filled with the gray level.
+func pngPage(t *testing.T, width, height int, level uint8) *bytes.Buffer {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = level
+	}
+	buffer := new(bytes.Buffer)
+	if err := png.Encode(buffer, img); err != nil {
+		t.Fatal(err)
+	}
+	return buffer
+}
+
+// writeGofpdf writes a document with a page for every image, registering the
+// images in the given order.
+func writeGofpdf(t *testing.T, registered []string, pages []string, images map[string]*bytes.Buffer) string {
+	document := gofpdf.New("P", "mm", "A4", "")
+	options := gofpdf.ImageOptions{ImageType: "png"}
+	for _, name := range registered {
+		document.RegisterImageOptionsReader(name, options, images[name])
+	}
+	for _, name := range pages {
+		document.AddPage()
+		document.ImageOptions(name, 0, 0, 210, 297, false, options, 0, "")
+	}
+	documentPath := path.Join(t.TempDir(), "document.pdf")
+	if err := document.OutputFileAndClose(documentPath); err != nil {
+		t.Fatal(err)
+	}
+	return documentPath
+}
+
+func TestPageImages(t *testing.T) {
+	tests := []struct {
+		name       string
+		registered []string
+		pages      []string
+		count      int
+		// want are the widths of the images found for the pages
+		want []int
+	}{
+		{"single page", []string{"a"}, []string{"a"}, 1, []int{40}},
+		{"first page", []string{"a", "b"}, []string{"a", "b"}, 1, []int{40}},
+		{"first page with the image registered last", []string{"b", "a"}, []string{"a", "b"}, 1, []int{40}},
+		{"every page", []string{"b", "a"}, []string{"a", "b"}, 0, []int{40, 20}},
+		{"image used twice", []string{"a", "b"}, []string{"b", "a", "b"}, 0, []int{20, 40, 20}},
+	}
+	images := map[string]func() *bytes.Buffer{
+		"a": func() *bytes.Buffer { return pngPage(t, 40, 30, 0x20) },
+		"b": func() *bytes.Buffer { return pngPage(t, 20, 10, 0xe0) },
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffers := make(map[string]*bytes.Buffer)
+			for name, image := range images {
+				buffers[name] = image()
+			}
+			file, err := os.Open(writeGofpdf(t, test.registered, test.pages, buffers))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			offsets, err := pageImages(file, test.count)
+			if err != nil {
+				t.Fatalf("pageImages() error = %v", err)
+			}
+			if len(offsets) != len(test.want) {
+				t.Fatalf("pageImages() found %d images, want %d", len(offsets), len(test.want))
+			}
+			for i, offset := range offsets {
+				img, _, err := decodePdfImage(file, offset, fullSize, fullSize, 1<<20)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if width := img.Bounds().Dx(); width != test.want[i] {
+					t.Errorf("page %d image is %d wide, want %d", i+1, width, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFirstPageImage(t *testing.T) {
+	documentPath := writeGofpdf(t, []string{"b", "a"}, []string{"a", "b"}, map[string]*bytes.Buffer{
+		"a": pngPage(t, 40, 30, 0x20),
+		"b": pngPage(t, 20, 10, 0xe0),
+	})
+	file, err := os.Open(documentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	offset, err := firstPageImage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := decodePdfImage(file, offset, 0, 0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 40 || bounds.Dy() != 30 {
+		t.Errorf("first page image is %dx%d, want 40x30", bounds.Dx(), bounds.Dy())
+	}
+	if got := color.GrayModel.Convert(img.At(5, 5)).(color.Gray).Y; got != 0x20 {
+		t.Errorf("first page image is %#x, want 0x20", got)
+	}
+}
+
+func TestDecodePdfFlateFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		dictionary string
+		width      int
+	}{
+		// checked before anything is allocated for the image
+		{"oversized dictionary", "/Width 2000000000 /Height 1 /BitsPerComponent 8 /ColorSpace /DeviceGray", 10},
+		{"oversized dictionary at full size", "/Width 1000000 /Height 1000000 /BitsPerComponent 8 /ColorSpace /DeviceRGB", fullSize},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := decodePdfFlate(strings.NewReader(""), []byte(test.dictionary), test.width, test.width, 1<<20)
+			if err == nil || err == errReductionUnsupported {
+				t.Errorf("decodePdfFlate() error = %v, want a failure", err)
+			}
+		})
+	}
+}
+
+func TestCachedPdfPageCount(t *testing.T) {
+	images := map[string]*bytes.Buffer{"first": pngPage(t, 10, 10, 0x20), "second": pngPage(t, 12, 10, 0x40)}
+	documentPath := writeGofpdf(t, []string{"first", "second"}, []string{"first", "second"}, images)
+	document, err := os.Stat(documentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		cache string
+		// age is how much older than the document the cache is
+		age  time.Duration
+		want int
+	}{
+		{"without cache", "", 0, 2},
+		{"cached", "7", 0, 7},
+		{"cache older than the document", "7", time.Minute, 2},
+		{"malformed cache", "seven", 0, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			countPath := documentPath + PageCountSuffix
+			os.Remove(countPath)
+			if test.cache != "" {
+				if err := os.WriteFile(countPath, []byte(test.cache), 0644); err != nil {
+					t.Fatal(err)
+				}
+				modified := document.ModTime().Add(-test.age)
+				if err := os.Chtimes(countPath, modified, modified); err != nil {
+					t.Fatal(err)
+				}
+			}
+			count, err := CachedPdfPageCount(documentPath)
+			if err != nil || count != test.want {
+				t.Fatalf("CachedPdfPageCount() = %d, %v, want %d", count, err, test.want)
+			}
+			data, err := os.ReadFile(countPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cached, _ := strconv.Atoi(string(data)); cached != test.want {
+				t.Errorf("cache is %q, want %d", data, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package graphic
+
+import (
+	"errors"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"image"
+	"image/color"
+	"math"
+	"os"
+)
+
+type Point struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// Quadrilateral holds the corners of a document on a photo, clockwise from the
+// top left one.
+type Quadrilateral [4]Point
+
+// detectionSize is the size the photo is reduced to before looking for the
+// document. Details are irrelevant to find the outline of a sheet of paper.
+const detectionSize = 400
+
+// pageBytesPerPixel is the memory per pixel of a rectified page while it is
+// turned into a document: the page, its gray, blurred and sharpened copies of
+// 4 bytes per pixel, and the final gray page.
+const pageBytesPerPixel = 4*4 + 1
+
+// OpenPhoto decodes the photo rotated by its EXIF orientation, as an NRGBA
+// image. It fails when the memory needed exceeds the limit, in bytes: the
+// decoded photo and its oriented copy, or the oriented photo and the reduced
+// copies made of it to find the document, are held at once.
+func OpenPhoto(photoPath string, limit int64) (image.Image, error) {
+	file, err := os.Open(photoPath)
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	decoded := bytesPerPixel(config.ColorModel)
+	if decoded < 4 {
+		decoded = 4
+	}
+	memory := int64(config.Width) * int64(config.Height) * (decoded + 4)
+	if memory > limit {
+		return nil, errors.New(fmt.Sprintf("%dx%d photo needs %d MB to decode, more than the limit of %d MB",
+			config.Width, config.Height, memory>>20, limit>>20))
+	}
+	img, err := imaging.Open(photoPath, imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, err
+	}
+	if _, isNRGBA := img.(*image.NRGBA); !isNRGBA {
+		// photos with no orientation to apply are still in their decoded form
+		img = imaging.Clone(img)
+	}
+	return img, nil
+}
+
+// DetectDocument looks for the outline of a sheet of paper on a photo. The
+// sheet is expected to be brighter than the surface it lies on. The corners of
+// the whole photo are returned when no sheet is found.
+func DetectDocument(img image.Image) Quadrilateral {
+	bounds := img.Bounds()
+	whole := Quadrilateral{
+		{0, 0},
+		{bounds.Dx() - 1, 0},
+		{bounds.Dx() - 1, bounds.Dy() - 1},
+		{0, bounds.Dy() - 1},
+	}
+
+	small := imaging.Blur(imaging.Grayscale(imaging.Fit(img, detectionSize, detectionSize, imaging.Box)), 2)
+	width, height := small.Bounds().Dx(), small.Bounds().Dy()
+	if width == 0 || height == 0 {
+		return whole
+	}
+	luminance := make([]uint8, width*height)
+	for i := range luminance {
+		luminance[i] = small.Pix[i*4]
+	}
+	threshold := otsuThreshold(luminance)
+
+	component := largestComponent(luminance, width, height, threshold)
+	if len(component) < width*height/10 {
+		return whole
+	}
+
+	// the corners are the extremes along the diagonals
+	topLeft, topRight, bottomRight, bottomLeft := component[0], component[0], component[0], component[0]
+	for _, i := range component {
+		x, y := i%width, i/width
+		if x+y < topLeft%width+topLeft/width {
+			topLeft = i
+		}
+		if x+y > bottomRight%width+bottomRight/width {
+			bottomRight = i
+		}
+		if x-y > topRight%width-topRight/width {
+			topRight = i
+		}
+		if x-y < bottomLeft%width-bottomLeft/width {
+			bottomLeft = i
+		}
+	}
+
+	scaleX := float64(bounds.Dx()) / float64(width)
+	scaleY := float64(bounds.Dy()) / float64(height)
+	corner := func(i int) Point {
+		return Point{
+			X: int(math.Min(float64(i%width)*scaleX, float64(bounds.Dx()-1))),
+			Y: int(math.Min(float64(i/width)*scaleY, float64(bounds.Dy()-1))),
+		}
+	}
+	return Quadrilateral{corner(topLeft), corner(topRight), corner(bottomRight), corner(bottomLeft)}
+}
+
+// otsuThreshold returns the luminance that best separates the dark from the
+// bright pixels.
+func otsuThreshold(luminance []uint8) uint8 {
+	var histogram [256]float64
+	for _, l := range luminance {
+		histogram[l]++
+	}
+	total := float64(len(luminance))
+	var sum float64
+	for i, count := range histogram {
+		sum += float64(i) * count
+	}
+
+	var sumBackground, weightBackground, bestVariance float64
+	var threshold uint8
+	for i, count := range histogram {
+		weightBackground += count
+		if weightBackground == 0 {
+			continue
+		}
+		weightForeground := total - weightBackground
+		if weightForeground == 0 {
+			break
+		}
+		sumBackground += float64(i) * count
+		meanBackground := sumBackground / weightBackground
+		meanForeground := (sum - sumBackground) / weightForeground
+		variance := weightBackground * weightForeground * (meanBackground - meanForeground) * (meanBackground - meanForeground)
+		if variance > bestVariance {
+			bestVariance = variance
+			threshold = uint8(i)
+		}
+	}
+	return threshold
+}
+
+// largestComponent returns the pixel indexes of the largest area of connected
+// pixels brighter than the threshold.
+func largestComponent(luminance []uint8, width, height int, threshold uint8) []int {
+	visited := make([]bool, len(luminance))
+	var largest []int
+	for start := range luminance {
+		if visited[start] || luminance[start] <= threshold {
+			continue
+		}
+		component := []int{start}
+		visited[start] = true
+		for next := 0; next < len(component); next++ {
+			i := component[next]
+			x, y := i%width, i/width
+			for _, neighbour := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				nx, ny := neighbour[0], neighbour[1]
+				if nx < 0 || ny < 0 || nx >= width || ny >= height {
+					continue
+				}
+				n := ny*width + nx
+				if visited[n] || luminance[n] <= threshold {
+					continue
+				}
+				visited[n] = true
+				component = append(component, n)
+			}
+		}
+		if len(component) > len(largest) {
+			largest = component
+		}
+	}
+	return largest
+}
+
+// Rectify maps the quadrilateral of the photo onto a flat rectangle, as if the
+// document had been photographed from straight above. The rectangle never has
+// more pixels than the photo, and fewer when the memory limit, in bytes,
+// leaves no room for the page at full size to be turned into a document.
+func Rectify(img image.Image, corners Quadrilateral, limit int64) (image.Image, error) {
+	distance := func(a, b Point) float64 {
+		return math.Hypot(float64(a.X-b.X), float64(a.Y-b.Y))
+	}
+	width := int(math.Max(distance(corners[0], corners[1]), distance(corners[3], corners[2])))
+	height := int(math.Max(distance(corners[0], corners[3]), distance(corners[1], corners[2])))
+	if width < 1 || height < 1 {
+		return img, nil
+	}
+
+	src, isNRGBA := img.(*image.NRGBA)
+	bounds := img.Bounds()
+	photoPixels := int64(bounds.Dx()) * int64(bounds.Dy())
+	memory := photoPixels * 4
+	if !isNRGBA || bounds.Min != (image.Point{}) {
+		memory += photoPixels * 4
+	}
+	maxPixels := (limit - memory) / pageBytesPerPixel
+	if maxPixels > photoPixels {
+		maxPixels = photoPixels
+	}
+	if pixels := int64(width) * int64(height); pixels > maxPixels {
+		scale := math.Sqrt(math.Max(float64(maxPixels), 0) / float64(pixels))
+		width, height = int(float64(width)*scale), int(float64(height)*scale)
+		if width < 1 || height < 1 {
+			return nil, errors.New(fmt.Sprintf("%dx%d photo leaves no memory to rectify it within the limit of %d MB",
+				bounds.Dx(), bounds.Dy(), limit>>20))
+		}
+	}
+
+	// the homography maps every point of the rectangle onto the photo
+	h, ok := homography(
+		[4][2]float64{{0, 0}, {float64(width), 0}, {float64(width), float64(height)}, {0, float64(height)}},
+		[4][2]float64{
+			{float64(corners[0].X), float64(corners[0].Y)},
+			{float64(corners[1].X), float64(corners[1].Y)},
+			{float64(corners[2].X), float64(corners[2].Y)},
+			{float64(corners[3].X), float64(corners[3].Y)},
+		})
+	if !ok {
+		return img, nil
+	}
+
+	if !isNRGBA || bounds.Min != (image.Point{}) {
+		src = imaging.Clone(img)
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx, fy := float64(x)+0.5, float64(y)+0.5
+			w := h[6]*fx + h[7]*fy + 1
+			u := (h[0]*fx + h[1]*fy + h[2]) / w
+			v := (h[3]*fx + h[4]*fy + h[5]) / w
+			dst.SetNRGBA(x, y, bilinear(src, u-0.5, v-0.5))
+		}
+	}
+	return dst, nil
+}
+
+// homography solves the eight parameters of the projective transformation
+// that maps the points from onto the points to.
+func homography(from, to [4][2]float64) ([8]float64, bool) {
+	var m [8][9]float64
+	for i := 0; i < 4; i++ {
+		x, y := from[i][0], from[i][1]
+		u, v := to[i][0], to[i][1]
+		m[2*i] = [9]float64{x, y, 1, 0, 0, 0, -u * x, -u * y, u}
+		m[2*i+1] = [9]float64{0, 0, 0, x, y, 1, -v * x, -v * y, v}
+	}
+
+	// gaussian elimination with partial pivoting
+	for col := 0; col < 8; col++ {
+		pivot := col
+		for row := col + 1; row < 8; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return [8]float64{}, false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		for row := 0; row < 8; row++ {
+			if row == col {
+				continue
+			}
+			factor := m[row][col] / m[col][col]
+			for k := col; k < 9; k++ {
+				m[row][k] -= factor * m[col][k]
+			}
+		}
+	}
+
+	var h [8]float64
+	for i := range h {
+		h[i] = m[i][8] / m[i][i]
+	}
+	return h, true
+}
+
+func bilinear(img *image.NRGBA, x, y float64) color.NRGBA {
+	bounds := img.Bounds()
+	clamp := func(v, max int) int {
+		if v < 0 {
+			return 0
+		}
+		if v > max {
+			return max
+		}
+		return v
+	}
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	dx, dy := x-float64(x0), y-float64(y0)
+	x1, y1 := clamp(x0+1, bounds.Dx()-1), clamp(y0+1, bounds.Dy()-1)
+	x0, y0 = clamp(x0, bounds.Dx()-1), clamp(y0, bounds.Dy()-1)
+
+	var result [4]uint8
+	for c := 0; c < 4; c++ {
+		top := float64(img.Pix[img.PixOffset(x0, y0)+c])*(1-dx) + float64(img.Pix[img.PixOffset(x1, y0)+c])*dx
+		bottom := float64(img.Pix[img.PixOffset(x0, y1)+c])*(1-dx) + float64(img.Pix[img.PixOffset(x1, y1)+c])*dx
+		result[c] = uint8(math.Round(top*(1-dy) + bottom*dy))
+	}
+	return color.NRGBA{R: result[0], G: result[1], B: result[2], A: result[3]}
+}
+
+// DocumentMode turns the photo of a document into a clean gray page: the
+// levels are stretched so the paper becomes white and the ink black, and the
+// text is sharpened.
+func DocumentMode(img image.Image) *image.Gray {
+	gray := imaging.Grayscale(img)
+
+	var histogram [256]int
+	for i := 0; i < len(gray.Pix); i += 4 {
+		histogram[gray.Pix[i]]++
+	}
+	pixels := len(gray.Pix) / 4
+	low, high := 0, 255
+	for count := 0; low < 255 && count+histogram[low] < pixels/100; low++ {
+		count += histogram[low]
+	}
+	for count := 0; high > 0 && count+histogram[high] < pixels/20; high-- {
+		count += histogram[high]
+	}
+	if high <= low {
+		low, high = 0, 255
+	}
+
+	sharpened := imaging.Sharpen(gray, 1)
+	bounds := sharpened.Bounds()
+	page := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for i := range page.Pix {
+		v := (int(sharpened.Pix[i*4]) - low) * 255 / (high - low)
+		if v < 0 {
+			v = 0
+		}
+		if v > 255 {
+			v = 255
+		}
+		page.Pix[i] = uint8(v)
+	}
+	return page
+}
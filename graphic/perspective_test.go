@@ -0,0 +1,247 @@
+package graphic
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+// sheetPhoto returns a photo of a white sheet, the quadrilateral, lying on a
+// dark surface.
+func sheetPhoto(width, height int, sheet Quadrilateral) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	inside := func(x, y float64) bool {
+		for i := range sheet {
+			a, b := sheet[i], sheet[(i+1)%4]
+			// the corners go clockwise, the inside is on the right of every edge
+			if (float64(b.X-a.X))*(y-float64(a.Y))-(float64(b.Y-a.Y))*(x-float64(a.X)) < 0 {
+				return false
+			}
+		}
+		return true
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{R: 0x30, G: 0x28, B: 0x20, A: 0xff}
+			if inside(float64(x)+0.5, float64(y)+0.5) {
+				c = color.NRGBA{R: 0xf0, G: 0xf0, B: 0xe8, A: 0xff}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+var tiltedSheet = Quadrilateral{{60, 30}, {330, 50}, {300, 270}, {40, 250}}
+
+func TestHomography(t *testing.T) {
+	rectangle := [4][2]float64{{0, 0}, {200, 0}, {200, 100}, {0, 100}}
+	tests := []struct {
+		name   string
+		to     [4][2]float64
+		wantOk bool
+	}{
+		{"identity", rectangle, true},
+		{"scale and shift", [4][2]float64{{10, 20}, {410, 20}, {410, 220}, {10, 220}}, true},
+		{"perspective", [4][2]float64{{60, 30}, {330, 50}, {300, 270}, {40, 250}}, true},
+		{"collinear points", [4][2]float64{{0, 0}, {1, 1}, {2, 2}, {3, 3}}, false},
+	}
+	apply := func(h [8]float64, x, y float64) (float64, float64) {
+		w := h[6]*x + h[7]*y + 1
+		return (h[0]*x + h[1]*y + h[2]) / w, (h[3]*x + h[4]*y + h[5]) / w
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, ok := homography(rectangle, test.to)
+			if ok != test.wantOk {
+				t.Fatalf("homography() ok = %v, want %v", ok, test.wantOk)
+			}
+			if !ok {
+				return
+			}
+			for i, from := range rectangle {
+				u, v := apply(h, from[0], from[1])
+				if math.Abs(u-test.to[i][0]) > 1e-6 || math.Abs(v-test.to[i][1]) > 1e-6 {
+					t.Errorf("point %v maps to (%f, %f), want %v", from, u, v, test.to[i])
+				}
+			}
+			// the inverse mapping brings the points back
+			inverse, ok := homography(test.to, rectangle)
+			if !ok {
+				t.Fatal("no inverse homography")
+			}
+			for _, point := range [][2]float64{{50, 50}, {150, 25}, {199, 99}} {
+				u, v := apply(h, point[0], point[1])
+				x, y := apply(inverse, u, v)
+				if math.Abs(x-point[0]) > 1e-6 || math.Abs(y-point[1]) > 1e-6 {
+					t.Errorf("point %v comes back as (%f, %f)", point, x, y)
+				}
+			}
+		})
+	}
+}
+
+func TestRectify(t *testing.T) {
+	photo := sheetPhoto(400, 300, tiltedSheet)
+	pageWidth, pageHeight := 271, 220
+	tests := []struct {
+		name  string
+		img   image.Image
+		limit int64
+		// wantWidth is the width of the page, zero for a failure
+		wantWidth int
+	}{
+		{"full size", photo, 1 << 30, pageWidth},
+		{"gray photo", imageToGray(photo), 1 << 30, pageWidth},
+		// the photo takes 480 KB, the page at full size 1 MB more
+		{"reduced to the limit", photo, 400*300*4 + 271*220*pageBytesPerPixel/4, pageWidth / 2},
+		{"no memory left", photo, 400 * 300 * 4, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page, err := Rectify(test.img, tiltedSheet, test.limit)
+			if test.wantWidth == 0 {
+				if err == nil {
+					t.Error("Rectify() did not fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			bounds := page.Bounds()
+			if math.Abs(float64(bounds.Dx()-test.wantWidth)) > 1 {
+				t.Errorf("page is %dx%d, want %d wide", bounds.Dx(), bounds.Dy(), test.wantWidth)
+			}
+			if ratio := float64(bounds.Dx()) / float64(bounds.Dy()); math.Abs(ratio-float64(pageWidth)/float64(pageHeight)) > 0.02 {
+				t.Errorf("page is %dx%d, want the ratio of %dx%d", bounds.Dx(), bounds.Dy(), pageWidth, pageHeight)
+			}
+			// the page is the sheet only, apart from its blended border
+			dark := 0
+			for y := 2; y < bounds.Dy()-2; y++ {
+				for x := 2; x < bounds.Dx()-2; x++ {
+					if r, _, _, _ := page.At(x, y).RGBA(); r>>8 < 0xc0 {
+						dark++
+					}
+				}
+			}
+			if dark > 0 {
+				t.Errorf("%d pixels of the surface on the page", dark)
+			}
+		})
+	}
+}
+
+func imageToGray(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray.Set(x, y, img.At(x, y))
+		}
+	}
+	return gray
+}
+
+func TestDetectDocument(t *testing.T) {
+	tests := []struct {
+		name string
+		img  image.Image
+		want Quadrilateral
+	}{
+		{"tilted sheet", sheetPhoto(400, 300, tiltedSheet), tiltedSheet},
+		{"sheet on a large photo", sheetPhoto(1200, 900, Quadrilateral{{180, 90}, {990, 150}, {900, 810}, {120, 750}}),
+			Quadrilateral{{180, 90}, {990, 150}, {900, 810}, {120, 750}}},
+		{"no sheet", sheetPhoto(400, 300, Quadrilateral{}), Quadrilateral{{0, 0}, {399, 0}, {399, 299}, {0, 299}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := DetectDocument(test.img)
+			// the corners are found on the reduced photo, blurred
+			tolerance := float64(test.img.Bounds().Dx()) / 50
+			for i := range got {
+				if math.Hypot(float64(got[i].X-test.want[i].X), float64(got[i].Y-test.want[i].Y)) > tolerance {
+					t.Errorf("DetectDocument() = %v, want %v", got, test.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestOtsuThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		levels    map[uint8]int
+		wantAbove uint8
+		wantBelow uint8
+	}{
+		{"dark and bright", map[uint8]int{40: 600, 200: 400}, 40, 200},
+		{"mostly bright", map[uint8]int{30: 50, 35: 50, 220: 900}, 35, 220},
+		{"close levels", map[uint8]int{100: 500, 110: 500}, 100, 110},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var luminance []uint8
+			for level, count := range test.levels {
+				for i := 0; i < count; i++ {
+					luminance = append(luminance, level)
+				}
+			}
+			if got := otsuThreshold(luminance); got < test.wantAbove || got >= test.wantBelow {
+				t.Errorf("otsuThreshold() = %d, want from %d to %d", got, test.wantAbove, test.wantBelow)
+			}
+		})
+	}
+}
+
+func TestOpenPhoto(t *testing.T) {
+	directory := t.TempDir()
+	write := func(name string, img image.Image) string {
+		file, err := os.Create(path.Join(directory, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if err := png.Encode(file, img); err != nil {
+			t.Fatal(err)
+		}
+		return file.Name()
+	}
+	colorPhoto := write("color.png", sheetPhoto(40, 30, tiltedSheet))
+	grayPhoto := write("gray.png", imageToGray(sheetPhoto(40, 30, tiltedSheet)))
+	tests := []struct {
+		name    string
+		photo   string
+		limit   int64
+		wantErr bool
+	}{
+		{"color", colorPhoto, 1 << 20, false},
+		{"gray", grayPhoto, 1 << 20, false},
+		// the decoded photo and its copy are counted
+		{"decoded photo only", colorPhoto, 40 * 30 * 4, true},
+		{"photo and its copy", colorPhoto, 40 * 30 * 8, false},
+		{"gray photo and its copy", grayPhoto, 40*30*8 - 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img, err := OpenPhoto(test.photo, test.limit)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("OpenPhoto() error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if _, isNRGBA := img.(*image.NRGBA); !isNRGBA {
+				t.Errorf("photo decoded as %T", img)
+			}
+			if size := img.Bounds().Size(); size != image.Pt(40, 30) {
+				t.Errorf("photo is %v", size)
+			}
+		})
+	}
+}
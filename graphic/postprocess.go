@@ -0,0 +1,38 @@
+package graphic
+
+import (
+	"github.com/adelolmo/scanpi/worker"
+)
+
+// PostProcessor runs the stages that follow storing an image, each one in its
+// own pool of workers: first the thumbnail, then the text recognition.
+type PostProcessor struct {
+	thumbnail   *Thumbnail
+	ocr         *Ocr
+	thumbnails  *worker.Pool
+	recognition *worker.Pool
+}
+
+func NewPostProcessor(thumbnail *Thumbnail, ocr *Ocr, thumbnails, recognition *worker.Pool) *PostProcessor {
+	return &PostProcessor{
+		thumbnail:   thumbnail,
+		ocr:         ocr,
+		thumbnails:  thumbnails,
+		recognition: recognition,
+	}
+}
+
+// Process queues the thumbnail of the stored image. Its text is queued for
+// recognition once the thumbnail is done, even when the thumbnail failed. The
+// text of pdf documents is not recognized.
+func (p *PostProcessor) Process(imageDetails ImageDetails) {
+	p.thumbnails.Submit("thumbnail "+imageDetails.Filename(), func() error {
+		err := p.thumbnail.GenerateThumbnail(imageDetails)
+		if p.ocr.Enabled() && imageDetails.Format != Pdf {
+			p.recognition.Submit("ocr "+imageDetails.Filename(), func() error {
+				return p.ocr.Recognize(imageDetails)
+			})
+		}
+		return err
+	})
+}
@@ -0,0 +1,213 @@
+package graphic
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/adelolmo/scanpi/fsutils"
+	"github.com/adelolmo/scanpi/logger"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RebuildProgress tells how far the regeneration of the thumbnails is.
+type RebuildProgress struct {
+	Running     bool      `json:"running"`
+	Total       int       `json:"total"`
+	Processed   int       `json:"processed"`
+	Regenerated int       `json:"regenerated"`
+	Skipped     int       `json:"skipped"`
+	Failed      int       `json:"failed"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+}
+
+// ThumbnailRebuild regenerates the thumbnails of every job that are missing,
+// older than their scan or made with another filter than the configured one.
+type ThumbnailRebuild struct {
+	thumbnail  *Thumbnail
+	markerPath string
+	workers    int
+	mutex      sync.Mutex
+	progress   RebuildProgress
+}
+
+// rebuildMarker records the filter the thumbnails were last rebuilt with.
+type rebuildMarker struct {
+	Filter string `json:"filter"`
+}
+
+// NewThumbnailRebuild processes up to workers scans at the same time. The
+// marker file keeps the filter of the last complete rebuild.
+func NewThumbnailRebuild(thumbnail *Thumbnail, markerPath string, workers int) *ThumbnailRebuild {
+	if workers < 1 {
+		workers = 1
+	}
+	return &ThumbnailRebuild{
+		thumbnail:  thumbnail,
+		markerPath: markerPath,
+		workers:    workers,
+	}
+}
+
+func (b *ThumbnailRebuild) Progress() RebuildProgress {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.progress
+}
+
+// Start runs the rebuild in the background. It returns false when a rebuild
+// is already running.
+func (b *ThumbnailRebuild) Start() bool {
+	if !b.begin() {
+		return false
+	}
+	go b.run(nil)
+	return true
+}
+
+// Run rebuilds the thumbnails and waits until it is done, reporting the
+// progress after every scan.
+func (b *ThumbnailRebuild) Run(report func(RebuildProgress)) error {
+	if !b.begin() {
+		return fmt.Errorf("thumbnails are already being rebuilt")
+	}
+	b.run(report)
+	return nil
+}
+
+func (b *ThumbnailRebuild) begin() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.progress.Running {
+		return false
+	}
+	b.progress = RebuildProgress{Running: true, Started: time.Now()}
+	return true
+}
+
+func (b *ThumbnailRebuild) run(report func(RebuildProgress)) {
+	// without marker the filter of the thumbnails is unknown, they are
+	// assumed to be made with the configured one
+	marker, found := b.readMarker()
+	filterChanged := found && marker.Filter != b.thumbnail.filterName
+	var scans []ImageDetails
+	for _, job := range fsutils.JobDirectories(b.thumbnail.baseDirectory) {
+		files, err := fsutils.ImageFilesOnDirectory(path.Join(b.thumbnail.baseDirectory, job.Name()))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			ext := path.Ext(file.Filename)
+			scans = append(scans, ImageDetails{
+				Name:          strings.TrimSuffix(file.Filename, ext),
+				LinkName:      strings.TrimSuffix(file.LinkName, ext),
+				Format:        ToFormat(ext[1:]),
+				Directory:     job.Name(),
+				BaseDirectory: b.thumbnail.baseDirectory,
+			})
+		}
+	}
+	b.mutex.Lock()
+	b.progress.Total = len(scans)
+	b.mutex.Unlock()
+	logger.Info("rebuilding thumbnails of %d scans with %d workers", len(scans), b.workers)
+
+	queue := make(chan ImageDetails)
+	var wg sync.WaitGroup
+	for i := 0; i < b.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for scan := range queue {
+				b.process(scan, filterChanged, report)
+			}
+		}()
+	}
+	for _, scan := range scans {
+		queue <- scan
+	}
+	close(queue)
+	wg.Wait()
+
+	b.mutex.Lock()
+	b.progress.Running = false
+	b.progress.Finished = time.Now()
+	b.mutex.Unlock()
+	b.writeMarker()
+	logger.Info("thumbnails rebuilt: %+v", b.Progress())
+}
+
+func (b *ThumbnailRebuild) process(scan ImageDetails, filterChanged bool, report func(RebuildProgress)) {
+	stale := filterChanged || b.thumbnail.Stale(scan.ImagePath())
+	var err error
+	if stale {
+		err = b.thumbnail.GenerateThumbnail(scan)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+
+	b.mutex.Lock()
+	b.progress.Processed++
+	switch {
+	case !stale:
+		b.progress.Skipped++
+	case err != nil:
+		b.progress.Failed++
+	default:
+		b.progress.Regenerated++
+	}
+	progress := b.progress
+	b.mutex.Unlock()
+	if report != nil {
+		report(progress)
+	}
+}
+
+// RecordFilter records the configured filter until a rebuild does, so the
+// thumbnails are regenerated once the filter changes.
+func (b *ThumbnailRebuild) RecordFilter() {
+	if _, found := b.readMarker(); !found {
+		b.writeMarker()
+	}
+}
+
+// readMarker returns false when the filter of the thumbnails is unknown, as
+// it is until the first rebuild.
+func (b *ThumbnailRebuild) readMarker() (rebuildMarker, bool) {
+	marker := rebuildMarker{}
+	file, err := ioutil.ReadFile(b.markerPath)
+	if err != nil {
+		return marker, false
+	}
+	if err := json.Unmarshal(file, &marker); err != nil {
+		logger.Error(fmt.Sprintf("unable to read %s. Error: %s", b.markerPath, err))
+		return marker, false
+	}
+	return marker, true
+}
+
+func (b *ThumbnailRebuild) writeMarker() {
+	markerJson, _ := json.Marshal(rebuildMarker{Filter: b.thumbnail.filterName})
+	if err := ioutil.WriteFile(b.markerPath, markerJson, 0644); err != nil {
+		logger.Error(fmt.Sprintf("unable to write %s. Error: %s", b.markerPath, err))
+	}
+}
+
+// Stale tells whether the thumbnail of the image is missing or older than the
+// image itself.
+func (t Thumbnail) Stale(imagePath string) bool {
+	image, err := os.Stat(imagePath)
+	if err != nil {
+		return false
+	}
+	preview, err := os.Stat(t.PreviewPath(imagePath))
+	if err != nil {
+		return true
+	}
+	return preview.ModTime().Before(image.ModTime())
+}
@@ -0,0 +1,93 @@
+package graphic
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeRebuildJob writes a job with a png page, a pdf page and a png page
+// whose thumbnail is up to date.
+func writeRebuildJob(t *testing.T, baseDirectory string) string {
+	jobPath := path.Join(baseDirectory, "job")
+	if err := os.MkdirAll(jobPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	document, err := ioutil.ReadFile(writeGofpdf(t, []string{"page"}, []string{"page"},
+		map[string]*bytes.Buffer{"page": pngPage(t, 40, 60, 0x80)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, page := range []struct {
+		name, link string
+		data       []byte
+	}{
+		{"20240102030401.png", "1.png", pngPage(t, 40, 30, 0x20).Bytes()},
+		{"20240102030402.pdf", "2.pdf", document},
+		{"20240102030403.png", "3.png", pngPage(t, 30, 40, 0xe0).Bytes()},
+	} {
+		scanPath := path.Join(jobPath, page.name)
+		if err := ioutil.WriteFile(scanPath, page.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(scanPath, old, old); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(page.name, path.Join(jobPath, page.link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(jobPath, "20240102030403.png.thumbnail"), []byte("fresh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return jobPath
+}
+
+func TestThumbnailRebuild(t *testing.T) {
+	tests := []struct {
+		name string
+		// marker is the filter of the last rebuild, none when empty
+		marker string
+		want   RebuildProgress
+	}{
+		{"missing and stale thumbnails", "", RebuildProgress{Total: 3, Processed: 3, Regenerated: 2, Skipped: 1}},
+		{"same filter", "lanczos", RebuildProgress{Total: 3, Processed: 3, Regenerated: 2, Skipped: 1}},
+		{"filter changed", "box", RebuildProgress{Total: 3, Processed: 3, Regenerated: 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			baseDirectory := t.TempDir()
+			jobPath := writeRebuildJob(t, baseDirectory)
+			markerPath := path.Join(t.TempDir(), "thumbnails.json")
+			if test.marker != "" {
+				markerJson, _ := json.Marshal(rebuildMarker{Filter: test.marker})
+				if err := ioutil.WriteFile(markerPath, markerJson, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rebuild := NewThumbnailRebuild(NewThumbnail("lanczos", baseDirectory, 1<<20), markerPath, 2)
+			if err := rebuild.Run(nil); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			progress := rebuild.Progress()
+			progress.Started, progress.Finished = time.Time{}, time.Time{}
+			if progress != test.want {
+				t.Errorf("progress is %+v, want %+v", progress, test.want)
+			}
+			for _, scan := range []string{"20240102030401.png", "20240102030402.pdf", "20240102030403.png"} {
+				if _, err := os.Stat(path.Join(jobPath, scan+".thumbnail")); err != nil {
+					t.Errorf("%s has no thumbnail", scan)
+				}
+			}
+			if marker, found := rebuild.readMarker(); !found || marker.Filter != "lanczos" {
+				t.Errorf("marker is %+v, want the filter lanczos", marker)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package graphic
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strconv"
+)
+
+// errReductionUnsupported tells that the image has to be decoded at full size
+// because its encoding cannot be read at a reduced scale.
+var errReductionUnsupported = errors.New("reduced decoding not supported")
+
+// fullSize asks the reduced decoders for the image at its full size.
+const fullSize = math.MaxInt32 / 2
+
+// maxImageSide is the largest width or height, in pixels, of the images read
+// row by row. Larger ones are taken for malformed.
+const maxImageSide = 1 << 20
+
+// decodeReduced decodes the image at a reduced scale that is still at least
+// twice as big as the given width and height, a zero meaning any size. Only a
+// few rows of the image are held in memory for the formats that allow it:
+// baseline jpeg, strips of tiff and pnm. Pdf documents are rendered from their
+// first page. Other images are decoded at full size.
+// It fails when the memory needed exceeds the limit, in bytes, and returns the
+// memory it used otherwise.
+func decodeReduced(imagePath string, width, height int, limit int64) (image.Image, int64, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var img image.Image
+	var memory int64
+	switch path.Ext(imagePath) {
+	case ".jpeg":
+		img, memory, err = decodeJpegDc(bufio.NewReader(file), width, height, limit)
+	case ".tiff":
+		img, memory, err = decodeTiffStrips(file, width, height, limit)
+	case ".pnm":
+		return decodePnm(bufio.NewReader(file), width, height, limit)
+	case ".pdf":
+		return decodePdf(file, width, height, limit)
+	default:
+		err = errReductionUnsupported
+	}
+	if err != errReductionUnsupported {
+		return img, memory, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	return decodeFull(file, limit)
+}
+
+// DecodePages decodes the pages stored in the scan at full size one after the
+// other: the image, or every page of a pdf document rendered at the
+// resolution in dots per inch. It fails when the memory needed for a page
+// exceeds the limit, in bytes.
+func DecodePages(imagePath string, resolution int, limit int64, page func(image.Image) error) error {
+	if path.Ext(imagePath) == Pdf.Extension() {
+		return decodePdfPages(imagePath, resolution, limit, page)
+	}
+	img, err := decodeImage(imagePath, limit)
+	if err != nil {
+		return err
+	}
+	return page(img)
+}
+
+// decodeImage decodes the image at full size, pdf documents excepted.
+func decodeImage(imagePath string, limit int64) (image.Image, error) {
+	if ext := path.Ext(imagePath); ext == Pdf.Extension() {
+		return nil, errors.New(fmt.Sprintf("image format not supported: %s", ext))
+	}
+	img, _, err := decodeReduced(imagePath, fullSize, fullSize, limit)
+	return img, err
+}
+
+// decodeFull decodes the whole image after checking it fits in the memory
+// limit.
+func decodeFull(file io.ReadSeeker, limit int64) (image.Image, int64, error) {
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	memory := int64(config.Width) * int64(config.Height) * bytesPerPixel(config.ColorModel)
+	if memory > limit {
+		return nil, memory, errors.New(fmt.Sprintf("%dx%d image needs %d MB to decode, more than the limit of %d MB",
+			config.Width, config.Height, memory>>20, limit>>20))
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	img, _, err := image.Decode(file)
+	return img, memory, err
+}
+
+func bytesPerPixel(model color.Model) int64 {
+	switch model {
+	case color.GrayModel:
+		return 1
+	case color.Gray16Model:
+		return 2
+	case color.YCbCrModel:
+		return 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	return 4
+}
+
+// reductionFactor returns the largest scale down that keeps the image at least
+// twice as big as the given width and height.
+func reductionFactor(imageWidth, imageHeight, width, height int) int {
+	factor := 0
+	if width > 0 {
+		factor = imageWidth / (2 * width)
+	}
+	if height > 0 && (factor == 0 || imageHeight/(2*height) < factor) {
+		factor = imageHeight / (2 * height)
+	}
+	if factor < 1 {
+		factor = 1
+	}
+	return factor
+}
+
+// boxReducer scales an image down while its rows are read one by one. Every
+// pixel of the result is the average of a square of factor x factor pixels.
+type boxReducer struct {
+	factor   int
+	width    int
+	channels int
+	sums     []uint32
+	rows     int
+	y        int
+	gray     *image.Gray
+	rgba     *image.NRGBA
+}
+
+// newBoxReducer scales an image of gray (1 channel) or RGB (3 channels)
+// samples down.
+func newBoxReducer(width, height, channels, factor int) *boxReducer {
+	reducedWidth := (width + factor - 1) / factor
+	reducedHeight := (height + factor - 1) / factor
+	b := &boxReducer{
+		factor:   factor,
+		width:    width,
+		channels: channels,
+		sums:     make([]uint32, reducedWidth*channels),
+	}
+	if channels == 1 {
+		b.gray = image.NewGray(image.Rect(0, 0, reducedWidth, reducedHeight))
+	} else {
+		b.rgba = image.NewNRGBA(image.Rect(0, 0, reducedWidth, reducedHeight))
+	}
+	return b
+}
+
+// boxReducerMemory returns the bytes a reducer of the image takes, so it is
+// known before it is allocated.
+func boxReducerMemory(width, height, channels, factor int) int64 {
+	reducedWidth := int64((width + factor - 1) / factor)
+	reducedHeight := int64((height + factor - 1) / factor)
+	pixelBytes := int64(4)
+	if channels == 1 {
+		pixelBytes = 1
+	}
+	return reducedWidth*int64(channels)*4 + reducedWidth*reducedHeight*pixelBytes
+}
+
+// addRow adds a row with 8 bit samples, as many as the width by the channels.
+func (b *boxReducer) addRow(samples []uint8) {
+	for x := 0; x < b.width; x++ {
+		column := x / b.factor * b.channels
+		for c := 0; c < b.channels; c++ {
+			b.sums[column+c] += uint32(samples[x*b.channels+c])
+		}
+	}
+	b.rows++
+	if b.rows == b.factor {
+		b.flush()
+	}
+}
+
+// flush writes the averages of the rows added since the last flush as a row
+// of the reduced image.
+func (b *boxReducer) flush() {
+	if b.rows == 0 {
+		return
+	}
+	reducedWidth := len(b.sums) / b.channels
+	for column := 0; column < reducedWidth; column++ {
+		columns := b.factor
+		if last := b.width - column*b.factor; last < columns {
+			columns = last
+		}
+		count := uint32(columns * b.rows)
+		for c := 0; c < b.channels; c++ {
+			value := uint8(b.sums[column*b.channels+c] / count)
+			if b.gray != nil {
+				b.gray.Pix[b.y*b.gray.Stride+column] = value
+			} else {
+				b.rgba.Pix[b.y*b.rgba.Stride+column*4+c] = value
+			}
+			b.sums[column*b.channels+c] = 0
+		}
+		if b.rgba != nil {
+			b.rgba.Pix[b.y*b.rgba.Stride+column*4+3] = 0xff
+		}
+	}
+	b.rows = 0
+	b.y++
+}
+
+func (b *boxReducer) image() image.Image {
+	b.flush()
+	if b.gray != nil {
+		return b.gray
+	}
+	return b.rgba
+}
+
+// decodePnm reads binary portable bitmaps (P4), graymaps (P5) and pixmaps
+// (P6), as written by scanimage, row by row.
+func decodePnm(r *bufio.Reader, width, height int, limit int64) (image.Image, int64, error) {
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, 0, err
+	}
+	if magic[0] != 'P' || magic[1] < '4' || magic[1] > '6' {
+		return nil, 0, errors.New(fmt.Sprintf("pnm format '%s' not supported", magic))
+	}
+	imageWidth, err := pnmNumber(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	imageHeight, err := pnmNumber(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	maxValue := 1
+	if magic[1] != '4' {
+		if maxValue, err = pnmNumber(r); err != nil {
+			return nil, 0, err
+		}
+	}
+	// a single whitespace separates the header from the samples
+	if _, err := r.ReadByte(); err != nil {
+		return nil, 0, err
+	}
+	if imageWidth < 1 || imageHeight < 1 || imageWidth > maxImageSide || imageHeight > maxImageSide ||
+		maxValue < 1 || maxValue > 0xffff {
+		return nil, 0, errors.New("malformed pnm header")
+	}
+
+	channels, sampleBytes := 1, 1
+	if magic[1] == '6' {
+		channels = 3
+	}
+	if maxValue > 0xff {
+		sampleBytes = 2
+	}
+	rowBytes := imageWidth * channels * sampleBytes
+	if magic[1] == '4' {
+		rowBytes = (imageWidth + 7) / 8
+	}
+
+	factor := reductionFactor(imageWidth, imageHeight, width, height)
+	memory := boxReducerMemory(imageWidth, imageHeight, channels, factor) + int64(rowBytes+imageWidth*channels)
+	if memory > limit {
+		return nil, memory, errors.New(fmt.Sprintf("%dx%d image needs %d MB to decode, more than the limit of %d MB",
+			imageWidth, imageHeight, memory>>20, limit>>20))
+	}
+	reducer := newBoxReducer(imageWidth, imageHeight, channels, factor)
+	row := make([]byte, rowBytes)
+	samples := make([]uint8, imageWidth*channels)
+
+	for y := 0; y < imageHeight; y++ {
+		if _, err := io.ReadFull(r, row); err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case magic[1] == '4':
+			// a set bit is black
+			for x := range samples {
+				samples[x] = 0xff
+				if row[x/8]&(0x80>>uint(x%8)) != 0 {
+					samples[x] = 0
+				}
+			}
+		case sampleBytes == 2:
+			for i := range samples {
+				samples[i] = uint8((int(row[2*i])<<8 | int(row[2*i+1])) * 0xff / maxValue)
+			}
+		default:
+			for i := range samples {
+				samples[i] = uint8(int(row[i]) * 0xff / maxValue)
+			}
+		}
+		reducer.addRow(samples)
+	}
+	return reducer.image(), memory, nil
+}
+
+// pnmNumber reads a decimal number of the header, skipping whitespace and
+// comments before it.
+func pnmNumber(r *bufio.Reader) (int, error) {
+	var digits []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case c == '#' && len(digits) == 0:
+			if _, err := r.ReadString('\n'); err != nil {
+				return 0, err
+			}
+		case c >= '0' && c <= '9':
+			digits = append(digits, c)
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if len(digits) > 0 {
+				if err := r.UnreadByte(); err != nil {
+					return 0, err
+				}
+				return strconv.Atoi(string(digits))
+			}
+		default:
+			return 0, errors.New("malformed pnm header")
+		}
+	}
+}
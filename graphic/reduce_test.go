@@ -0,0 +1,210 @@
+package graphic
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path"
+	"testing"
+)
+
+// gradient returns a gray or an opaque RGB image with smooth gradients, which
+// lossy encodings keep close to the original.
+func gradient(width, height int, gray bool) image.Image {
+	if gray {
+		img := image.NewGray(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.SetGray(x, y, color.Gray{Y: uint8((x + y) * 255 / (width + height))})
+			}
+		}
+		return img
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(x * 255 / width),
+				G: uint8(y * 255 / height),
+				B: uint8(255 - (x+y)*255/(width+height)),
+				A: 0xff,
+			})
+		}
+	}
+	return img
+}
+
+// boxReduce scales the image down like boxReducer, averaging every square of
+// factor x factor pixels.
+func boxReduce(img image.Image, factor int) *image.NRGBA {
+	bounds := img.Bounds()
+	reduced := image.NewNRGBA(image.Rect(0, 0, (bounds.Dx()+factor-1)/factor, (bounds.Dy()+factor-1)/factor))
+	for ry := 0; ry < reduced.Rect.Dy(); ry++ {
+		for rx := 0; rx < reduced.Rect.Dx(); rx++ {
+			var sums [3]int
+			count := 0
+			for y := ry * factor; y < (ry+1)*factor && y < bounds.Dy(); y++ {
+				for x := rx * factor; x < (rx+1)*factor && x < bounds.Dx(); x++ {
+					c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+					sums[0] += int(c.R)
+					sums[1] += int(c.G)
+					sums[2] += int(c.B)
+					count++
+				}
+			}
+			reduced.SetNRGBA(rx, ry, color.NRGBA{
+				R: uint8(sums[0] / count), G: uint8(sums[1] / count), B: uint8(sums[2] / count), A: 0xff,
+			})
+		}
+	}
+	return reduced
+}
+
+// compareImages fails the test when the images differ in size, or a sample
+// differs by more than the tolerance.
+func compareImages(t *testing.T, got, want image.Image, tolerance int) {
+	t.Helper()
+	if got.Bounds().Size() != want.Bounds().Size() {
+		t.Fatalf("image is %v, want %v", got.Bounds().Size(), want.Bounds().Size())
+	}
+	for y := 0; y < want.Bounds().Dy(); y++ {
+		for x := 0; x < want.Bounds().Dx(); x++ {
+			g := color.NRGBAModel.Convert(got.At(got.Bounds().Min.X+x, got.Bounds().Min.Y+y)).(color.NRGBA)
+			w := color.NRGBAModel.Convert(want.At(want.Bounds().Min.X+x, want.Bounds().Min.Y+y)).(color.NRGBA)
+			for i, pair := range [][2]uint8{{g.R, w.R}, {g.G, w.G}, {g.B, w.B}} {
+				if difference := int(pair[0]) - int(pair[1]); difference > tolerance || difference < -tolerance {
+					t.Fatalf("pixel %d,%d channel %d is %d, want %d", x, y, i, pair[0], pair[1])
+				}
+			}
+		}
+	}
+}
+
+// writeTestFile writes the data to a file of a temporary directory.
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	filePath := path.Join(t.TempDir(), name)
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func TestReductionFactor(t *testing.T) {
+	tests := []struct {
+		imageWidth, imageHeight, width, height int
+		want                                   int
+	}{
+		{2480, 3508, 200, 200, 6},
+		{2480, 3508, 200, 0, 6},
+		{2480, 3508, 0, 200, 8},
+		{2480, 3508, 0, 0, 1},
+		{300, 300, 200, 200, 1},
+		{100, 100, 200, 200, 1},
+		{2480, 3508, fullSize, fullSize, 1},
+	}
+	for _, test := range tests {
+		got := reductionFactor(test.imageWidth, test.imageHeight, test.width, test.height)
+		if got != test.want {
+			t.Errorf("reductionFactor(%d, %d, %d, %d) = %d, want %d",
+				test.imageWidth, test.imageHeight, test.width, test.height, got, test.want)
+		}
+	}
+}
+
+func TestDecodePnm(t *testing.T) {
+	gray := gradient(50, 30, true).(*image.Gray)
+	pixmap := gradient(50, 30, false).(*image.NRGBA)
+	var rgb, gray16, gray4 []byte
+	for i := 0; i < len(pixmap.Pix); i += 4 {
+		rgb = append(rgb, pixmap.Pix[i:i+3]...)
+	}
+	for _, sample := range gray.Pix {
+		gray16 = append(gray16, sample, sample)
+		gray4 = append(gray4, sample>>4)
+	}
+	bitmap := image.NewGray(image.Rect(0, 0, 10, 2))
+	for i := range bitmap.Pix {
+		bitmap.Pix[i] = 0xff
+	}
+	// the set bits are black
+	bitmap.Pix[0], bitmap.Pix[9], bitmap.Pix[12] = 0, 0, 0
+
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height int
+		limit         int64
+		want          image.Image
+		// tolerance allows for the rounding of the samples scaled to 8 bits
+		tolerance int
+		wantErr   bool
+	}{
+		{"graymap", append([]byte("P5\n50 30\n255\n"), gray.Pix...), 0, 0, 1 << 20, gray, 0, false},
+		{"graymap reduced", append([]byte("P5\n50 30\n255\n"), gray.Pix...), 10, 5, 1 << 20, boxReduce(gray, 2), 0, false},
+		{"graymap with comments", append([]byte("P5\n# scanimage\n50 30\n# max\n255\n"), gray.Pix...), 0, 0, 1 << 20, gray, 0, false},
+		{"graymap of 16 bits", append([]byte("P5 50 30 65535\n"), gray16...), 0, 0, 1 << 20, gray, 0, false},
+		{"graymap of 4 bits", append([]byte("P5 50 30 15\n"), gray4...), 0, 0, 1 << 20, gray, 17, false},
+		{"pixmap", append([]byte("P6\n50 30\n255\n"), rgb...), 0, 0, 1 << 20, pixmap, 0, false},
+		{"pixmap reduced", append([]byte("P6\n50 30\n255\n"), rgb...), 5, 0, 1 << 20, boxReduce(pixmap, 5), 0, false},
+		{"bitmap", []byte("P4\n10 2\n\x80\x40\x20\x00"), 0, 0, 1 << 20, bitmap, 0, false},
+		{"ascii graymap", []byte("P2\n2 1\n255\n0 255\n"), 0, 0, 1 << 20, nil, 0, true},
+		{"malformed header", []byte("P5\n50 x\n255\n"), 0, 0, 1 << 20, nil, 0, true},
+		{"truncated", append([]byte("P5\n50 30\n255\n"), gray.Pix[:100]...), 0, 0, 1 << 20, nil, 0, true},
+		{"over the memory limit", append([]byte("P5\n50 30\n255\n"), gray.Pix...), 0, 0, 1000, nil, 0, true},
+		// checked before anything is allocated for the image
+		{"oversized header", []byte("P5\n2000000000 1\n255\n"), 10, 10, 1 << 20, nil, 0, true},
+		{"oversized header at full size", []byte("P6\n1000000 1000000\n255\n"), fullSize, fullSize, 1 << 20, nil, 0, true},
+		{"wide header reduced", []byte("P6\n1000000 2\n255\n"), 10, 10, 1 << 20, nil, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img, _, err := decodePnm(bufio.NewReader(bytes.NewReader(test.data)), test.width, test.height, test.limit)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("decodePnm() error = %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr {
+				compareImages(t, img, test.want, test.tolerance)
+			}
+		})
+	}
+}
+
+func TestDecodeReduced(t *testing.T) {
+	img := gradient(64, 40, false)
+	encoded := new(bytes.Buffer)
+	if err := png.Encode(encoded, img); err != nil {
+		t.Fatal(err)
+	}
+	pngPath := writeTestFile(t, "20240102030405.png", encoded.Bytes())
+	pnmPath := writeTestFile(t, "20240102030405.pnm",
+		append([]byte("P5\n64 40\n255\n"), gradient(64, 40, true).(*image.Gray).Pix...))
+
+	tests := []struct {
+		name          string
+		imagePath     string
+		width, height int
+		limit         int64
+		want          image.Image
+		wantErr       bool
+	}{
+		{"png decoded at full size", pngPath, 8, 8, 1 << 20, img, false},
+		{"png over the memory limit", pngPath, 8, 8, 64 * 40, nil, true},
+		{"pnm reduced", pnmPath, 8, 5, 1 << 20, boxReduce(gradient(64, 40, true), 4), false},
+		{"pnm at full size", pnmPath, fullSize, fullSize, 1 << 20, gradient(64, 40, true), false},
+		{"missing file", path.Join(t.TempDir(), "20240102030405.jpeg"), 8, 8, 1 << 20, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, _, err := decodeReduced(test.imagePath, test.width, test.height, test.limit)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("decodeReduced() error = %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr {
+				compareImages(t, got, test.want, 0)
+			}
+		})
+	}
+}
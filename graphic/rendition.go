@@ -0,0 +1,220 @@
+package graphic
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/adelolmo/scanpi/logger"
+	"github.com/disintegration/imaging"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// renditionTouchInterval is how often the modification time of a cached
+// rendition is moved forward while it is used, the time Prune goes by.
+const renditionTouchInterval = 24 * time.Hour
+
+// maxKnownHashes bounds the hashes remembered, the ones dropped are computed
+// again when needed.
+const maxKnownHashes = 10000
+
+// renditionTemp prefixes the files renditions are written to before they are
+// complete.
+const renditionTemp = "rendition"
+
+// RenditionSizes are the sizes, in pixels of the longest side, an image can be
+// rendered at. The smallest one matches the thumbnails.
+var RenditionSizes = []int{250, 500, 1000, 2000}
+
+// Renditions keeps scaled down jpeg copies of the scans in a cache directory.
+// The copies are named after the hash of the content of the scan and their
+// size, so they never go stale.
+type Renditions struct {
+	directory string
+	filter    imaging.ResampleFilter
+	limit     int64
+	mutex     sync.Mutex
+	hashes    map[string]sourceHash
+}
+
+// sourceHash remembers the hash of a file while it is not modified, so it is
+// not read again on every request.
+type sourceHash struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+func ValidRenditionSize(size int) bool {
+	for _, renditionSize := range RenditionSizes {
+		if renditionSize == size {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRenditions renders the images decoding them with at most memoryLimit
+// bytes.
+func NewRenditions(directory, filter string, memoryLimit int64) *Renditions {
+	return &Renditions{
+		directory: directory,
+		filter:    toThumbnailFilter(filter),
+		limit:     memoryLimit,
+		hashes:    make(map[string]sourceHash),
+	}
+}
+
+// Rendition returns the path of the image scaled to fit the size, creating it
+// when it is not cached yet, and the tag that identifies its content.
+func (r *Renditions) Rendition(imagePath string, size int) (string, string, error) {
+	if !ValidRenditionSize(size) {
+		return "", "", errors.New(fmt.Sprintf("rendition size %d not supported", size))
+	}
+
+	hash, err := r.hash(imagePath)
+	if err != nil {
+		return "", "", err
+	}
+	tag := fmt.Sprintf("%s-%d", hash[:16], size)
+	renditionPath := path.Join(r.directory, hash[:2], fmt.Sprintf("%s-%d.jpeg", hash, size))
+	if info, err := os.Stat(renditionPath); err == nil {
+		if time.Since(info.ModTime()) > renditionTouchInterval {
+			now := time.Now()
+			if err := os.Chtimes(renditionPath, now, now); err != nil {
+				logger.Error(fmt.Sprintf("cannot touch rendition %s. Error: %s", renditionPath, err))
+			}
+		}
+		return renditionPath, tag, nil
+	}
+
+	start := time.Now()
+	img, memory, err := decodeReduced(imagePath, size, size, r.limit)
+	if err != nil {
+		return "", "", errors.New(fmt.Sprintf("cannot decode image %s. Error: %s", imagePath, err))
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() > size || bounds.Dy() > size {
+		img = imaging.Fit(img, size, size, r.filter)
+	}
+
+	if err := os.MkdirAll(path.Dir(renditionPath), os.ModePerm); err != nil {
+		return "", "", err
+	}
+	// concurrent requests for the same rendition each write their own file
+	file, err := os.CreateTemp(path.Dir(renditionPath), renditionTemp)
+	if err != nil {
+		return "", "", err
+	}
+	if err := imaging.Encode(file, img, imaging.JPEG, imaging.JPEGQuality(defaultJpegQuality)); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", "", err
+	}
+	if err := os.Rename(file.Name(), renditionPath); err != nil {
+		os.Remove(file.Name())
+		return "", "", err
+	}
+	logger.Info("rendition of %s at %dpx took %fs using about %d KB", imagePath, size,
+		time.Now().Sub(start).Seconds(), memory>>10)
+	return renditionPath, tag, nil
+}
+
+func (r *Renditions) hash(imagePath string) (string, error) {
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return "", err
+	}
+
+	r.mutex.Lock()
+	known, found := r.hashes[imagePath]
+	r.mutex.Unlock()
+	if found && known.modTime.Equal(info.ModTime()) && known.size == info.Size() {
+		return known.hash, nil
+	}
+
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	if _, err := io.Copy(digest, file); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(digest.Sum(nil))
+
+	r.mutex.Lock()
+	if len(r.hashes) >= maxKnownHashes {
+		for known := range r.hashes {
+			delete(r.hashes, known)
+			break
+		}
+	}
+	r.hashes[imagePath] = sourceHash{modTime: info.ModTime(), size: info.Size(), hash: hash}
+	r.mutex.Unlock()
+	return hash, nil
+}
+
+// Prune removes the renditions not used for longer than maxAge, the temporary
+// files left by failed renditions, and forgets the hashes of the scans that
+// are gone.
+func (r *Renditions) Prune(maxAge time.Duration) error {
+	directories, err := os.ReadDir(r.directory)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removed := 0
+	for _, directory := range directories {
+		if !directory.IsDir() {
+			continue
+		}
+		directoryPath := path.Join(r.directory, directory.Name())
+		files, err := ioutil.ReadDir(directoryPath)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			age := maxAge
+			if strings.HasPrefix(file.Name(), renditionTemp) {
+				// written at most a few seconds ago when still in use
+				age = time.Hour
+			}
+			if time.Since(file.ModTime()) < age {
+				continue
+			}
+			if err := os.Remove(path.Join(directoryPath, file.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			removed++
+		}
+	}
+	if removed > 0 {
+		logger.Info("%d cached renditions removed", removed)
+	}
+
+	r.mutex.Lock()
+	imagePaths := make([]string, 0, len(r.hashes))
+	for imagePath := range r.hashes {
+		imagePaths = append(imagePaths, imagePath)
+	}
+	r.mutex.Unlock()
+	for _, imagePath := range imagePaths {
+		if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+			r.mutex.Lock()
+			delete(r.hashes, imagePath)
+			r.mutex.Unlock()
+		}
+	}
+	return nil
+}
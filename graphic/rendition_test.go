@@ -0,0 +1,86 @@
+package graphic
+
+import (
+	"bytes"
+	"image/png"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRenditionsPrune(t *testing.T) {
+	// scans of different sizes, so their hashes differ
+	scan := func(name string, width int) string {
+		encoded := new(bytes.Buffer)
+		if err := png.Encode(encoded, gradient(width, 200, false)); err != nil {
+			t.Fatal(err)
+		}
+		return writeTestFile(t, name, encoded.Bytes())
+	}
+	used := scan("20240102030405.png", 400)
+	unused := scan("20240102030406.png", 401)
+	deleted := scan("20240102030407.png", 402)
+	renditions := NewRenditions(path.Join(t.TempDir(), "cache"), "", 1<<20)
+
+	render := func(imagePath string) string {
+		renditionPath, _, err := renditions.Rendition(imagePath, 250)
+		if err != nil {
+			t.Fatalf("Rendition() error = %v", err)
+		}
+		return renditionPath
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	usedRendition := render(used)
+	unusedRendition := render(unused)
+	for _, rendition := range []string{usedRendition, unusedRendition} {
+		if err := os.Chtimes(rendition, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a rendition used after a day is kept
+	if render(used) != usedRendition {
+		t.Fatal("rendition is not cached")
+	}
+	leftover, err := os.CreateTemp(path.Dir(usedRendition), renditionTemp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leftover.Close()
+	if err := os.Chtimes(leftover.Name(), old, old); err != nil {
+		t.Fatal(err)
+	}
+	render(deleted)
+	if err := os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := renditions.Prune(24 * time.Hour); err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	for _, test := range []struct {
+		path string
+		kept bool
+	}{
+		{usedRendition, true},
+		{unusedRendition, false},
+		{leftover.Name(), false},
+	} {
+		if _, err := os.Stat(test.path); (err == nil) != test.kept {
+			t.Errorf("%s kept %v, want %v", path.Base(test.path), err == nil, test.kept)
+		}
+	}
+	if _, known := renditions.hashes[deleted]; known {
+		t.Error("hash of a deleted scan is remembered")
+	}
+	if _, known := renditions.hashes[used]; !known {
+		t.Error("hash of a scan is forgotten")
+	}
+}
+
+func TestRenditionsPruneWithoutCache(t *testing.T) {
+	renditions := NewRenditions(path.Join(t.TempDir(), "cache"), "", 1<<20)
+	if err := renditions.Prune(time.Hour); err != nil {
+		t.Errorf("Prune() error = %v", err)
+	}
+}
@@ -3,11 +3,13 @@ package graphic
 import (
 	"errors"
 	"fmt"
+	"github.com/adelolmo/scanpi/fsutils"
 	"github.com/adelolmo/scanpi/logger"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 type Mode int
@@ -53,6 +55,7 @@ const (
 	Png
 	Jpeg
 	Pnm
+	Pdf
 )
 
 func (f Format) String() string {
@@ -65,6 +68,8 @@ func (f Format) String() string {
 		return "png"
 	case Pnm:
 		return "pnm"
+	case Pdf:
+		return "pdf"
 	default:
 		return "tiff"
 	}
@@ -87,18 +92,27 @@ func ToFormat(format string) Format {
 	}
 	if formattedMode == "Pnm" {
 		return Pnm
+	}
+	if formattedMode == "Pdf" {
+		return Pdf
 	} else {
 		return Jpeg
 	}
 }
 
 type scan struct {
-	mode       Mode
-	format     Format
-	resolution int
-	thumbnail  *Thumbnail
+	mode          Mode
+	format        Format
+	resolution    int
+	postProcessor *PostProcessor
+	lockPath      string
 }
 
+// scanner is held while scanimage runs, there is a single device to scan with.
+// The lock file of the scan job serializes the scans of other processes, like
+// the command line ones.
+var scanner sync.Mutex
+
 type ImageDetails struct {
 	Name          string
 	LinkName      string
@@ -123,48 +137,97 @@ func (d ImageDetails) LinkPath() string {
 	return filepath.Join(d.BaseDirectory, d.Directory, d.LinkFilename())
 }
 
-func NewScanJob(mode Mode, format Format, resolution int, thumbnail *Thumbnail) *scan {
+// NewScanJob returns a scan job that holds the lock file while it scans.
+func NewScanJob(mode Mode, format Format, resolution int, postProcessor *PostProcessor, lockPath string) *scan {
 	return &scan{format: format,
-		mode:       mode,
-		resolution: resolution,
-		thumbnail:  thumbnail,
+		mode:          mode,
+		resolution:    resolution,
+		postProcessor: postProcessor,
+		lockPath:      lockPath,
 	}
 }
 
-func (s scan) StartScanning(imageDetails ImageDetails) {
+// StartScanning scans in background into the directory of the details and
+// tells done the image stored, or why it was not. The scanner is released as
+// soon as the image is stored, its thumbnail and text are made by the post
+// processor.
+func (s scan) StartScanning(imageDetails ImageDetails, done func(ImageDetails, error)) {
 	go func() {
-		logger.Info("Scanning process for '%s' with symlink '%s'. Start",
-			imageDetails.Filename(), imageDetails.LinkFilename())
-
-		// su -s /bin/sh - saned
-		command := exec.Command("/usr/bin/scanimage",
-			fmt.Sprintf("--mode=%s", s.mode.String()),
-			fmt.Sprintf("--resolution=%d", s.resolution),
-			fmt.Sprintf("--format=%s", s.format.String()))
-		logger.Info(strings.Join(command.Args, " "))
-		out, err := command.Output()
+		stored, err := s.scanImage(imageDetails)
+		done(stored, err)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Error executing scanimage command. Output: %s. Error:%v", out, err))
+			logger.Error(err.Error())
 			return
 		}
+		s.postProcessor.Process(stored)
+	}()
+}
 
-		err = os.WriteFile(imageDetails.ImagePath(), out, 0644)
-		if err != nil {
-			logger.Error(fmt.Sprintf("Cannot write image file on '%s'. Error: %s", imageDetails.LinkFilename(), err))
-		}
+// Scan scans and stores the image into the directory of the details, and
+// queues its thumbnail and text for the post processor.
+func (s scan) Scan(imageDetails ImageDetails) (ImageDetails, error) {
+	stored, err := s.scanImage(imageDetails)
+	if err != nil {
+		return stored, err
+	}
+	s.postProcessor.Process(stored)
+	return stored, nil
+}
 
-		err = os.Symlink(imageDetails.Filename(), imageDetails.LinkPath())
-		if err != nil {
-			logger.Error(fmt.Sprintf("Cannot create symlink to image file on '%s'. Error: %s", imageDetails.LinkPath(), err))
-		}
+// scanImage names the image and its link while it holds the scanner, so
+// queued scans do not take the same page or file.
+func (s scan) scanImage(imageDetails ImageDetails) (ImageDetails, error) {
+	scanner.Lock()
+	defer scanner.Unlock()
+	unlock, err := fsutils.LockFile(s.lockPath)
+	if err != nil {
+		return imageDetails, errors.New(fmt.Sprintf("Cannot lock the scanner with '%s'. Error: %s", s.lockPath, err))
+	}
+	defer unlock()
+	logger.Info("Scanning process into '%s'. Start", imageDetails.Directory)
+
+	// su -s /bin/sh - saned
+	command := exec.Command("/usr/bin/scanimage",
+		fmt.Sprintf("--mode=%s", s.mode.String()),
+		fmt.Sprintf("--resolution=%d", s.resolution),
+		fmt.Sprintf("--format=%s", s.format.String()))
+	logger.Info(strings.Join(command.Args, " "))
+	out, err := command.Output()
+	if err != nil {
+		return imageDetails, errors.New(fmt.Sprintf("Error executing scanimage command. Output: %s. Error:%v", out, err))
+	}
 
-		logger.Info("Scanning process for '%s'. End", imageDetails.LinkFilename())
+	directory := filepath.Join(imageDetails.BaseDirectory, imageDetails.Directory)
+	linkName, err := fsutils.NextLinkName(directory)
+	if err != nil {
+		return imageDetails, err
+	}
+	extension := imageDetails.Format.Extension()
+	imageDetails.LinkName = linkName
+	imageDetails.Name = strings.TrimSuffix(
+		fsutils.AvailableDateFilename(directory, fsutils.GenerateDateFilename(), extension), extension)
 
-		// TODO extract and run after this async execution
-		if err = s.thumbnail.GenerateThumbnail(imageDetails); err != nil {
-			logger.Error(err.Error())
-		}
-	}()
+	file, err := os.OpenFile(imageDetails.ImagePath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return imageDetails, errors.New(fmt.Sprintf("Cannot write image file on '%s'. Error: %s", imageDetails.Filename(), err))
+	}
+	_, err = file.Write(out)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(imageDetails.ImagePath())
+		return imageDetails, errors.New(fmt.Sprintf("Cannot write image file on '%s'. Error: %s", imageDetails.Filename(), err))
+	}
+
+	if err := os.Symlink(imageDetails.Filename(), imageDetails.LinkPath()); err != nil {
+		return imageDetails, errors.New(fmt.Sprintf("Cannot create symlink to image file %s on '%s'. Error: %s",
+			imageDetails.Filename(), imageDetails.LinkPath(), err))
+	}
+
+	logger.Info("Scanning process for '%s' with symlink '%s'. End",
+		imageDetails.Filename(), imageDetails.LinkFilename())
+	return imageDetails, nil
 }
 
 func ScannerDevice() (string, error) {
@@ -0,0 +1,203 @@
+package graphic
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/image/tiff/lzw"
+	"image"
+	"io"
+	"os"
+)
+
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffRowsPerStrip    = 278
+	tiffStripByteCounts = 279
+	tiffPlanarConfig    = 284
+	tiffPredictor       = 317
+	tiffTileWidth       = 322
+)
+
+// tiffDirectory holds the values of the first image file directory, as many
+// as needed to read the image strip by strip.
+type tiffDirectory map[uint16][]uint32
+
+func (d tiffDirectory) value(tag uint16, defaultValue uint32) uint32 {
+	if values := d[tag]; len(values) > 0 {
+		return values[0]
+	}
+	return defaultValue
+}
+
+// decodeTiffStrips reads uncompressed, deflate and LZW compressed tiff images
+// row by row. Bilevel, gray and RGB images with 8 or 16 bits per sample are
+// supported, any other one is left to the full decoder.
+func decodeTiffStrips(file *os.File, width, height int, limit int64) (image.Image, int64, error) {
+	order, directory, err := readTiffDirectory(file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	imageWidth := int(directory.value(tiffImageWidth, 0))
+	imageHeight := int(directory.value(tiffImageLength, 0))
+	samplesPerPixel := int(directory.value(tiffSamplesPerPixel, 1))
+	bitsPerSample := int(directory.value(tiffBitsPerSample, 1))
+	photometric := directory.value(tiffPhotometric, 1)
+	compression := directory.value(tiffCompression, 1)
+	rowsPerStrip := int(directory.value(tiffRowsPerStrip, uint32(imageHeight)))
+	offsets, counts := directory[tiffStripOffsets], directory[tiffStripByteCounts]
+
+	channels := 1
+	switch {
+	case imageWidth < 1 || imageHeight < 1 || imageWidth > maxImageSide || imageHeight > maxImageSide || rowsPerStrip < 1:
+		return nil, 0, errors.New("malformed tiff directory")
+	case directory[tiffTileWidth] != nil || directory.value(tiffPlanarConfig, 1) != 1 ||
+		directory.value(tiffPredictor, 1) != 1 || len(offsets) == 0 || len(offsets) != len(counts):
+		return nil, 0, errReductionUnsupported
+	case photometric == 2 && (samplesPerPixel == 3 || samplesPerPixel == 4) && (bitsPerSample == 8 || bitsPerSample == 16):
+		channels = 3
+	case photometric <= 1 && samplesPerPixel == 1 && (bitsPerSample == 1 || bitsPerSample == 8 || bitsPerSample == 16):
+	default:
+		return nil, 0, errReductionUnsupported
+	}
+	if compression != 1 && compression != 5 && compression != 8 && compression != 32946 {
+		return nil, 0, errReductionUnsupported
+	}
+
+	factor := reductionFactor(imageWidth, imageHeight, width, height)
+	rowBytes := (imageWidth*samplesPerPixel*bitsPerSample + 7) / 8
+	memory := boxReducerMemory(imageWidth, imageHeight, channels, factor) + int64(rowBytes+imageWidth*channels)
+	if memory > limit {
+		return nil, memory, errors.New(fmt.Sprintf("%dx%d image needs %d MB to decode, more than the limit of %d MB",
+			imageWidth, imageHeight, memory>>20, limit>>20))
+	}
+	reducer := newBoxReducer(imageWidth, imageHeight, channels, factor)
+	row := make([]byte, rowBytes)
+	samples := make([]uint8, imageWidth*channels)
+
+	y := 0
+	for strip := range offsets {
+		var r io.Reader = bufio.NewReader(io.NewSectionReader(file, int64(offsets[strip]), int64(counts[strip])))
+		switch compression {
+		case 5:
+			r = lzw.NewReader(r, lzw.MSB, 8)
+		case 8, 32946:
+			if r, err = zlib.NewReader(r); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		for stripRow := 0; stripRow < rowsPerStrip && y < imageHeight; stripRow++ {
+			if _, err := io.ReadFull(r, row); err != nil {
+				return nil, 0, errors.New(fmt.Sprintf("cannot read row %d of tiff. Error: %s", y, err))
+			}
+			tiffSamples(row, samples, order, bitsPerSample, samplesPerPixel, channels, photometric == 0)
+			reducer.addRow(samples)
+			y++
+		}
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return reducer.image(), memory, nil
+}
+
+// tiffSamples converts a row of the image to 8 bit samples of the given
+// channels, dropping extra samples like alpha.
+func tiffSamples(row, samples []byte, order binary.ByteOrder, bitsPerSample, samplesPerPixel, channels int, whiteIsZero bool) {
+	pixels := len(samples) / channels
+	for x := 0; x < pixels; x++ {
+		for c := 0; c < channels; c++ {
+			var value uint8
+			switch bitsPerSample {
+			case 1:
+				value = 0
+				if row[x/8]&(0x80>>uint(x%8)) != 0 {
+					value = 0xff
+				}
+			case 8:
+				value = row[x*samplesPerPixel+c]
+			case 16:
+				i := (x*samplesPerPixel + c) * 2
+				value = uint8(order.Uint16(row[i:i+2]) >> 8)
+			}
+			if whiteIsZero {
+				value = 0xff - value
+			}
+			samples[x*channels+c] = value
+		}
+	}
+}
+
+func readTiffDirectory(file *os.File) (binary.ByteOrder, tiffDirectory, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, nil, err
+	}
+	var order binary.ByteOrder
+	switch string(header[:4]) {
+	case "II\x2a\x00":
+		order = binary.LittleEndian
+	case "MM\x00\x2a":
+		order = binary.BigEndian
+	default:
+		return nil, nil, errors.New("malformed tiff header")
+	}
+
+	offset := int64(order.Uint32(header[4:]))
+	count := make([]byte, 2)
+	if _, err := file.ReadAt(count, offset); err != nil {
+		return nil, nil, err
+	}
+	entries := make([]byte, 12*int(order.Uint16(count)))
+	if _, err := file.ReadAt(entries, offset+2); err != nil {
+		return nil, nil, err
+	}
+
+	directory := make(tiffDirectory)
+	for i := 0; i < len(entries); i += 12 {
+		entry := entries[i : i+12]
+		tag := order.Uint16(entry)
+		kind := order.Uint16(entry[2:])
+		valueCount := int(order.Uint32(entry[4:]))
+		size := 0
+		switch kind {
+		case 3:
+			size = 2
+		case 4:
+			size = 4
+		default:
+			// only short and long values are needed
+			continue
+		}
+		if valueCount > 1<<20 {
+			return nil, nil, errors.New("malformed tiff directory")
+		}
+		data := entry[8:12]
+		if valueCount*size > 4 {
+			data = make([]byte, valueCount*size)
+			if _, err := file.ReadAt(data, int64(order.Uint32(entry[8:]))); err != nil {
+				return nil, nil, err
+			}
+		}
+		values := make([]uint32, valueCount)
+		for v := range values {
+			if size == 2 {
+				values[v] = uint32(order.Uint16(data[v*2:]))
+			} else {
+				values[v] = order.Uint32(data[v*4:])
+			}
+		}
+		directory[tag] = values
+	}
+	return order, directory, nil
+}
@@ -0,0 +1,173 @@
+package graphic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/image/tiff"
+	"image"
+	"os"
+	"sort"
+	"testing"
+)
+
+// buildTiff writes a tiff file with a single directory of long values and the
+// strips of the image data.
+func buildTiff(order binary.ByteOrder, entries map[uint16][]uint32, strips [][]byte) []byte {
+	out := new(bytes.Buffer)
+	if order == binary.BigEndian {
+		out.WriteString("MM\x00\x2a")
+	} else {
+		out.WriteString("II\x2a\x00")
+	}
+	binary.Write(out, order, uint32(8))
+
+	entries[tiffStripOffsets] = nil
+	entries[tiffStripByteCounts] = nil
+	tags := make([]int, 0, len(entries))
+	for tag := range entries {
+		tags = append(tags, int(tag))
+	}
+	sort.Ints(tags)
+	// the strips and the values that do not fit in an entry follow the
+	// directory
+	dataOffset := 8 + 2 + 12*len(tags) + 4
+	var data bytes.Buffer
+	offsets := make([]uint32, len(strips))
+	counts := make([]uint32, len(strips))
+	for i, strip := range strips {
+		offsets[i], counts[i] = uint32(dataOffset+data.Len()), uint32(len(strip))
+		data.Write(strip)
+	}
+	entries[tiffStripOffsets], entries[tiffStripByteCounts] = offsets, counts
+
+	binary.Write(out, order, uint16(len(tags)))
+	for _, tag := range tags {
+		values := entries[uint16(tag)]
+		binary.Write(out, order, uint16(tag))
+		binary.Write(out, order, uint16(4))
+		binary.Write(out, order, uint32(len(values)))
+		if len(values) == 1 {
+			binary.Write(out, order, values[0])
+			continue
+		}
+		binary.Write(out, order, uint32(dataOffset+data.Len()))
+		for _, value := range values {
+			binary.Write(&data, order, value)
+		}
+	}
+	binary.Write(out, order, uint32(0))
+	out.Write(data.Bytes())
+	return out.Bytes()
+}
+
+func TestDecodeTiffStrips(t *testing.T) {
+	encode := func(img image.Image, compression tiff.CompressionType) []byte {
+		buffer := new(bytes.Buffer)
+		if err := tiff.Encode(buffer, img, &tiff.Options{Compression: compression}); err != nil {
+			t.Fatal(err)
+		}
+		return buffer.Bytes()
+	}
+	gray, rgb := gradient(60, 36, true), gradient(60, 36, false)
+	gray16 := image.NewGray16(gray.Bounds())
+	for i, sample := range gray.(*image.Gray).Pix {
+		gray16.Pix[2*i], gray16.Pix[2*i+1] = sample, 0x80
+	}
+
+	// a bilevel image where white is zero, in two strips of two rows
+	bilevel := image.NewGray(image.Rect(0, 0, 10, 3))
+	for i := range bilevel.Pix {
+		bilevel.Pix[i] = 0xff
+	}
+	bilevel.Pix[0], bilevel.Pix[11], bilevel.Pix[29] = 0, 0, 0
+	bilevelTiff := buildTiff(binary.BigEndian, map[uint16][]uint32{
+		tiffImageWidth:   {10},
+		tiffImageLength:  {3},
+		tiffPhotometric:  {0},
+		tiffRowsPerStrip: {2},
+	}, [][]byte{{0x80, 0x00, 0x40, 0x00}, {0x00, 0x40}})
+
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height int
+		limit         int64
+		want          image.Image
+		wantErr       error
+	}{
+		{"gray", encode(gray, tiff.Uncompressed), 0, 0, 1 << 20, gray, nil},
+		{"gray deflate", encode(gray, tiff.Deflate), 0, 0, 1 << 20, gray, nil},
+		{"gray reduced", encode(gray, tiff.Deflate), 10, 6, 1 << 20, boxReduce(gray, 3), nil},
+		{"gray of 16 bits", encode(gray16, tiff.Deflate), 0, 0, 1 << 20, gray, nil},
+		{"rgb with alpha", encode(rgb, tiff.Uncompressed), 0, 0, 1 << 20, rgb, nil},
+		{"rgb reduced", encode(rgb, tiff.Deflate), 0, 9, 1 << 20, boxReduce(rgb, 2), nil},
+		{"bilevel in strips", bilevelTiff, 0, 0, 1 << 20, bilevel, nil},
+		{"tiled", buildTiff(binary.LittleEndian, map[uint16][]uint32{
+			tiffImageWidth: {10}, tiffImageLength: {3}, tiffTileWidth: {16},
+		}, [][]byte{{0}}), 0, 0, 1 << 20, nil, errReductionUnsupported},
+		{"predictor", buildTiff(binary.LittleEndian, map[uint16][]uint32{
+			tiffImageWidth: {10}, tiffImageLength: {3}, tiffBitsPerSample: {8}, tiffPredictor: {2},
+		}, [][]byte{make([]byte, 30)}), 0, 0, 1 << 20, nil, errReductionUnsupported},
+		{"4 bits per sample", buildTiff(binary.LittleEndian, map[uint16][]uint32{
+			tiffImageWidth: {10}, tiffImageLength: {3}, tiffBitsPerSample: {4},
+		}, [][]byte{make([]byte, 15)}), 0, 0, 1 << 20, nil, errReductionUnsupported},
+		{"jpeg compressed", buildTiff(binary.LittleEndian, map[uint16][]uint32{
+			tiffImageWidth: {10}, tiffImageLength: {3}, tiffBitsPerSample: {8}, tiffCompression: {7},
+		}, [][]byte{make([]byte, 30)}), 0, 0, 1 << 20, nil, errReductionUnsupported},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := os.Open(writeTestFile(t, "20240102030405.tiff", test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			img, _, err := decodeTiffStrips(file, test.width, test.height, test.limit)
+			if err != test.wantErr {
+				t.Fatalf("decodeTiffStrips() error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil {
+				compareImages(t, img, test.want, 0)
+			}
+		})
+	}
+}
+
+func TestDecodeTiffStripsFailures(t *testing.T) {
+	gray := new(bytes.Buffer)
+	if err := tiff.Encode(gray, gradient(60, 36, true), nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		data  []byte
+		limit int64
+	}{
+		{"malformed header", []byte("XX\x2a\x00\x08\x00\x00\x00"), 1 << 20},
+		{"missing directory", []byte("II\x2a\x00\xff\x00\x00\x00"), 1 << 20},
+		{"truncated strip", buildTiff(binary.LittleEndian, map[uint16][]uint32{
+			tiffImageWidth: {10}, tiffImageLength: {3}, tiffBitsPerSample: {8},
+		}, [][]byte{make([]byte, 15)}), 1 << 20},
+		{"over the memory limit", gray.Bytes(), 1000},
+		// checked before anything is allocated for the image
+		{"oversized header", buildTiff(binary.LittleEndian, map[uint16][]uint32{
+			tiffImageWidth: {2000000000}, tiffImageLength: {1}, tiffBitsPerSample: {8},
+		}, [][]byte{make([]byte, 15)}), 1 << 20},
+		{"oversized header at full size", buildTiff(binary.LittleEndian, map[uint16][]uint32{
+			tiffImageWidth: {1000000}, tiffImageLength: {1000000}, tiffBitsPerSample: {8},
+		}, [][]byte{make([]byte, 15)}), 1 << 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := os.Open(writeTestFile(t, "20240102030405.tiff", test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			if _, _, err := decodeTiffStrips(file, fullSize, fullSize, test.limit); err == nil || err == errReductionUnsupported {
+				t.Errorf("decodeTiffStrips() error = %v, want a failure", err)
+			}
+		})
+	}
+}
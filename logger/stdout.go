@@ -24,7 +24,7 @@ func Info(format string, a ...interface{}) {
 	if a == nil {
 		fmt.Println(format)
 	} else {
-		fmt.Printf(format+"\n", a)
+		fmt.Printf(format+"\n", a...)
 	}
 }
 
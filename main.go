@@ -1,17 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/adelolmo/scanpi/auth"
 	"github.com/adelolmo/scanpi/fsutils"
 	"github.com/adelolmo/scanpi/graphic"
 	"github.com/adelolmo/scanpi/logger"
 	"github.com/adelolmo/scanpi/pdf"
+	"github.com/adelolmo/scanpi/tiffer"
+	"github.com/adelolmo/scanpi/worker"
 	"github.com/adelolmo/scanpi/zipper"
 	"github.com/gorilla/mux"
 	"html/template"
+	"io"
 	"io/fs"
 	"io/ioutil"
 	"log"
@@ -19,11 +24,9 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 )
 
@@ -33,6 +36,16 @@ type settings struct {
 	Format     string `json:"format"`
 	Resolution string `json:"resolution"`
 	Updated    bool   `json:"-"`
+	// User is the signed in user, Users every user when it is an administrator
+	User  auth.User   `json:"-"`
+	Users []auth.User `json:"-"`
+	// LocalUser tells whether the user signed in on scanpi, rather than on
+	// the proxy, and has a password here
+	LocalUser bool `json:"-"`
+	// Tokens are the api tokens of the user, NewToken the secret of the one
+	// just created, shown only once
+	Tokens   []auth.Token `json:"-"`
+	NewToken string       `json:"-"`
 }
 
 type pageJobs struct {
@@ -40,25 +53,69 @@ type pageJobs struct {
 	JobName      string
 	PreviousJobs []string
 	Scans        []image
+	Staged       []stagedPage
 	JobStarted   bool
 }
 
 type image struct {
 	Name     string
 	LinkName string
+	// Pages is the number of pages of a pdf document, zero for images
+	Pages int
+}
+
+// Number is the page number of the scan, the one of its link name.
+func (i image) Number() int {
+	number, err := strconv.Atoi(strings.TrimSuffix(i.LinkName, path.Ext(i.LinkName)))
+	if err != nil {
+		return 0
+	}
+	return number
 }
 
 type pageScanner struct {
-	Navigation string
-	JobName    string
-	Scans      []image
-	JobStarted bool
+	Navigation   string
+	JobName      string
+	PreviousJobs []string
+	Scans        []image
+	JobStarted   bool
 }
 
 type configuration struct {
+	Port            string
 	OutputDirectory string
 	WorkDirectory   string
 	ThumbnailFilter string
+	PdfAuthor       string
+	PdfProducer     string
+	OcrLanguage     string
+	Workers         int
+	// MemoryLimit is the most memory, in bytes, decoding a single image for
+	// its thumbnail or rendition may take
+	MemoryLimit int64
+	// UploadLimit is the largest upload, in bytes, with all its files
+	UploadLimit int64
+	// TrashRetention is the number of days deleted jobs and pages are kept,
+	// zero to keep them until deleted for good
+	TrashRetention int
+	// SessionLifetime is the number of days a user stays signed in
+	SessionLifetime int
+	// PublicPaths are reachable without signing in, a trailing slash opens
+	// the paths below
+	PublicPaths []string
+	// ProxyUserHeader is the header the user authenticated by a trusted
+	// proxy comes in, empty to sign in on scanpi only
+	ProxyUserHeader string
+	// TrustedProxies are the networks of the reverse proxies whose headers
+	// are trusted
+	TrustedProxies []string
+	// Tls serves https, with the certificate and key files when given or a
+	// self-signed certificate otherwise
+	Tls     bool
+	TlsCert string
+	TlsKey  string
+	// HttpRedirectPort is the port redirecting http to https, empty for none
+	HttpRedirectPort string
 }
 
 //go:embed assets templates/*
@@ -68,16 +125,60 @@ var indexTemplate *template.Template
 var jobTemplate *template.Template
 var jobsTemplate *template.Template
 var settingsTemplate *template.Template
+var stagingTemplate *template.Template
+var trashTemplate *template.Template
+var loginTemplate *template.Template
 
 var appConfiguration configuration
+var resolver *fsutils.Resolver
+var trash *fsutils.Trash
+var users *auth.Users
+var sessions *auth.Sessions
+var tokens *auth.Tokens
+var authenticator *auth.Authenticator
 var thumb *graphic.Thumbnail
+var renditions *graphic.Renditions
+var thumbnailRebuild *graphic.ThumbnailRebuild
+var postProcessor *graphic.PostProcessor
 
-func main() {
-	indexTemplate = template.Must(template.ParseFS(content, "templates/index.html", "templates/header.html"))
-	jobTemplate = template.Must(template.ParseFS(content, "templates/job.html", "templates/header.html"))
-	jobsTemplate = template.Must(template.ParseFS(content, "templates/jobs.html", "templates/header.html"))
-	settingsTemplate = template.Must(template.ParseFS(content, "templates/settings.html", "templates/header.html"))
+// workerQueueSize is the number of images that wait for their thumbnail or
+// their text recognition before new scans wait to be queued.
+const workerQueueSize = 100
+
+// defaultMemoryLimit is the memory, in MB, an image may take to decode when
+// thumbnail_memory_limit is not configured
+const defaultMemoryLimit = 128
+
+// defaultUploadLimit is the largest upload, in MB, when upload_limit is not
+// configured
+const defaultUploadLimit = 100
+
+// defaultTrashRetention is the number of days deleted jobs and pages are kept
+// when trash_retention is not configured
+const defaultTrashRetention = 30
 
+// defaultSessionLifetime is the number of days a user stays signed in when
+// session_lifetime is not configured
+const defaultSessionLifetime = 30
+
+// renditionLifetime is how long a rendition of a scan stays in the cache after
+// it was last requested
+const renditionLifetime = 30 * 24 * time.Hour
+
+// purgeInterval is how often the files kept for a while, the trash, the staged
+// photos and the renditions, are purged
+const purgeInterval = time.Hour
+
+// pageSidecars are the files stored next to a scan, named after it
+var pageSidecars = []string{".thumbnail", ".txt", ".hocr", graphic.PageCountSuffix}
+
+// scannerLockFile is the file in the work directory held while scanning, so
+// the scans of the web interface and of the command line take turns
+const scannerLockFile = "scanner.lock"
+
+var ocr *graphic.Ocr
+
+func main() {
 	port := os.Getenv("port")
 	if port == "" {
 		port = "8000"
@@ -86,68 +187,201 @@ func main() {
 	//migrate(outputDirectory)
 	workDirectory := os.Getenv("work_dir")
 	thumbnailFilter := os.Getenv("thumbnail_filter")
-	appConfiguration = configuration{
-		OutputDirectory: outputDirectory,
-		WorkDirectory:   workDirectory,
-		ThumbnailFilter: thumbnailFilter,
+	pdfProducer := os.Getenv("pdf_producer")
+	if pdfProducer == "" {
+		pdfProducer = "scanpi"
+	}
+	workers, err := strconv.Atoi(os.Getenv("workers"))
+	if err != nil || workers < 1 {
+		workers = 1
+	}
+	memoryLimit, err := strconv.Atoi(os.Getenv("thumbnail_memory_limit"))
+	if err != nil || memoryLimit < 1 {
+		memoryLimit = defaultMemoryLimit
+	}
+	uploadLimit, err := strconv.Atoi(os.Getenv("upload_limit"))
+	if err != nil || uploadLimit < 1 {
+		uploadLimit = defaultUploadLimit
+	}
+	trashRetention, err := strconv.Atoi(os.Getenv("trash_retention"))
+	if err != nil || trashRetention < 0 {
+		trashRetention = defaultTrashRetention
+	}
+	sessionLifetime, err := strconv.Atoi(os.Getenv("session_lifetime"))
+	if err != nil || sessionLifetime < 1 {
+		sessionLifetime = defaultSessionLifetime
 	}
-	fmt.Println(fmt.Sprintf("port: %s, output_dir: %s, work_dir: %s, thumbnail_filter: %s debug: %v",
-		port, outputDirectory, workDirectory, thumbnailFilter, logger.Enabled()))
+	publicPaths := splitList(os.Getenv("public_paths"))
+	trustedProxies := splitList(os.Getenv("trusted_proxies"))
+	appConfiguration = configuration{
+		Port:             port,
+		OutputDirectory:  outputDirectory,
+		WorkDirectory:    workDirectory,
+		ThumbnailFilter:  thumbnailFilter,
+		PdfAuthor:        os.Getenv("pdf_author"),
+		PdfProducer:      pdfProducer,
+		OcrLanguage:      os.Getenv("ocr_language"),
+		Workers:          workers,
+		MemoryLimit:      int64(memoryLimit) << 20,
+		UploadLimit:      int64(uploadLimit) << 20,
+		TrashRetention:   trashRetention,
+		SessionLifetime:  sessionLifetime,
+		PublicPaths:      publicPaths,
+		ProxyUserHeader:  os.Getenv("proxy_user_header"),
+		TrustedProxies:   trustedProxies,
+		Tls:              os.Getenv("tls") == "true",
+		TlsCert:          os.Getenv("tls_cert"),
+		TlsKey:           os.Getenv("tls_key"),
+		HttpRedirectPort: os.Getenv("http_redirect_port"),
+	}
+
+	resolver = fsutils.NewResolver(appConfiguration.OutputDirectory)
+	trash = fsutils.NewTrash(path.Join(appConfiguration.WorkDirectory, "trash"),
+		time.Duration(appConfiguration.TrashRetention)*24*time.Hour, resolver)
+	thumb = graphic.NewThumbnail(appConfiguration.ThumbnailFilter,
+		appConfiguration.OutputDirectory, appConfiguration.MemoryLimit)
+	ocr = graphic.NewOcr(appConfiguration.OcrLanguage)
+	renditions = graphic.NewRenditions(path.Join(appConfiguration.WorkDirectory, "cache"),
+		appConfiguration.ThumbnailFilter, appConfiguration.MemoryLimit)
+	thumbnailRebuild = graphic.NewThumbnailRebuild(thumb,
+		path.Join(appConfiguration.WorkDirectory, "thumbnails.json"), appConfiguration.Workers)
+
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// serveWeb serves the web interface and the api until it fails. The users,
+// their sessions and the settings are only loaded, or created, to serve.
+func serveWeb() {
+	fmt.Println(fmt.Sprintf("port: %s, output_dir: %s, work_dir: %s, thumbnail_filter: %s ocr_language: %s workers: %d thumbnail_memory_limit: %dMB upload_limit: %dMB trash_retention: %d session_lifetime: %d public_paths: %s proxy_user_header: %s trusted_proxies: %s tls: %v tls_cert: %s tls_key: %s http_redirect_port: %s debug: %v",
+		appConfiguration.Port, appConfiguration.OutputDirectory, appConfiguration.WorkDirectory,
+		appConfiguration.ThumbnailFilter, appConfiguration.OcrLanguage, appConfiguration.Workers,
+		appConfiguration.MemoryLimit>>20, appConfiguration.UploadLimit>>20, appConfiguration.TrashRetention, appConfiguration.SessionLifetime,
+		strings.Join(appConfiguration.PublicPaths, ","), appConfiguration.ProxyUserHeader,
+		strings.Join(appConfiguration.TrustedProxies, ","), appConfiguration.Tls, appConfiguration.TlsCert,
+		appConfiguration.TlsKey, appConfiguration.HttpRedirectPort, logger.Enabled()))
+
+	indexTemplate = parseTemplate("index.html")
+	jobTemplate = parseTemplate("job.html")
+	jobsTemplate = parseTemplate("jobs.html")
+	settingsTemplate = parseTemplate("settings.html")
+	stagingTemplate = parseTemplate("staging.html")
+	trashTemplate = parseTemplate("trash.html")
+	loginTemplate = parseTemplate("login.html")
 
 	settingsFile := path.Join(appConfiguration.WorkDirectory, "settings.json")
 	if _, err := os.Stat(settingsFile); os.IsNotExist(err) {
-		settings := &settings{
-			Mode:       graphic.Color.String(),
-			Format:     graphic.Jpeg.String(),
-			Resolution: "200",
-		}
-		settingsJson, _ := json.Marshal(settings)
-		if err := ioutil.WriteFile(path.Join(appConfiguration.WorkDirectory, "settings.json"), settingsJson, 0644); err != nil {
+		settingsJson, _ := json.Marshal(defaultSettings())
+		if err := ioutil.WriteFile(settingsFile, settingsJson, 0644); err != nil {
 			log.Fatalln(err)
 		}
 	}
 
-	thumb = graphic.NewThumbnail(appConfiguration.ThumbnailFilter,
-		appConfiguration.OutputDirectory)
+	var err error
+	users, err = auth.LoadUsers(path.Join(appConfiguration.WorkDirectory, "users.json"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	sessions = auth.LoadSessions(path.Join(appConfiguration.WorkDirectory, "sessions.json"),
+		time.Duration(appConfiguration.SessionLifetime)*24*time.Hour)
+	tokens, err = auth.LoadTokens(path.Join(appConfiguration.WorkDirectory, "tokens.json"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	proxy, err := auth.NewProxy(appConfiguration.ProxyUserHeader, appConfiguration.TrustedProxies)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	authenticator = auth.NewAuthenticator(users, sessions, tokens, proxy, appConfiguration.PublicPaths)
+
+	postProcessor = graphic.NewPostProcessor(thumb, ocr,
+		worker.NewPool("thumbnail", appConfiguration.Workers, workerQueueSize),
+		worker.NewPool("ocr", appConfiguration.Workers, workerQueueSize))
+	thumbnailRebuild.RecordFilter()
+	go purgeExpired()
 
+	log.Fatal(serve(appConfiguration.Port, newRouter()))
+}
+
+// purgeExpired deletes the expired entries of the trash, the photos staged for
+// too long and the renditions not used for long, now and then every interval.
+// It never returns, the server runs it in the background.
+func purgeExpired() {
+	for {
+		if err := trash.PurgeExpired(); err != nil {
+			logger.Error(fmt.Sprintf("unable to purge the trash. Error: %s", err))
+		}
+		if err := purgeStaging(); err != nil {
+			logger.Error(fmt.Sprintf("unable to purge the staged photos. Error: %s", err))
+		}
+		if err := renditions.Prune(renditionLifetime); err != nil {
+			logger.Error(fmt.Sprintf("unable to prune the renditions. Error: %s", err))
+		}
+		time.Sleep(purgeInterval)
+	}
+}
+
+// newRouter routes the pages and the api through the authentication, the
+// CSRF protection and the scopes of the tokens.
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
+	router.Use(authenticator.Middleware, auth.CSRFMiddleware, scopeMiddleware)
 	fsys, err := fs.Sub(content, "assets")
 	if err != nil {
 		log.Fatal(err)
 	}
 	router.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", http.FileServer(http.FS(fsys))))
 	router.HandleFunc("/", homePage).Methods("GET")
+	router.HandleFunc("/login", loginPage).Methods("GET")
+	router.HandleFunc("/login", loginHandler).Methods("POST")
+	router.HandleFunc("/logout", logoutHandler).Methods("POST")
+	router.HandleFunc("/setup", setupPage).Methods("GET")
+	router.HandleFunc("/setup", setupHandler).Methods("POST")
 	router.HandleFunc("/settings", showSettingsPage).Methods("GET")
 	router.HandleFunc("/settings", updateSettingsPage).Methods("POST")
+	router.HandleFunc("/password", changePasswordHandler).Methods("POST")
+	router.HandleFunc("/users", addUserHandler).Methods("POST")
+	router.HandleFunc("/users/delete", deleteUserHandler).Methods("POST")
+	router.HandleFunc("/tokens", createTokenHandler).Methods("POST")
+	router.HandleFunc("/tokens/revoke", revokeTokenHandler).Methods("POST")
 	router.HandleFunc("/jobs", showJobsPage).Methods("GET")
 	router.HandleFunc("/job", resumeJobPage).Methods("GET")
 	router.HandleFunc("/job", createJobHandler).Methods("POST")
 	router.HandleFunc("/deleteJob", deleteJobHandler).Methods("POST")
 	router.HandleFunc("/renameJob", renameJobHandler).Methods("POST")
+	router.HandleFunc("/mergeJob", mergeJobHandler).Methods("POST")
+	router.HandleFunc("/transferScans", transferScansHandler).Methods("POST")
 	router.HandleFunc("/scan", scanHandler).Methods("POST")
 	router.HandleFunc("/deleteScan", deleteScanHandler).Methods("POST")
+	router.HandleFunc("/upload", uploadHandler).Methods("POST")
+	router.HandleFunc("/staging", stagingPage).Methods("GET")
+	router.HandleFunc("/staging/photo", stagingPhotoHandler).Methods("GET")
+	router.HandleFunc("/staging/corners", stagingCornersHandler).Methods("GET", "POST")
+	router.HandleFunc("/staging/commit", stagingCommitHandler).Methods("POST")
+	router.HandleFunc("/staging/discard", stagingDiscardHandler).Methods("POST")
+	router.HandleFunc("/trash", trashPage).Methods("GET")
+	router.HandleFunc("/trash/preview", trashPreviewHandler).Methods("GET")
+	router.HandleFunc("/trash/restore", trashRestoreHandler).Methods("POST")
+	router.HandleFunc("/trash/delete", trashDeleteHandler).Methods("POST")
 	router.HandleFunc("/download", downloadFileHandler).Methods("GET")
 	router.HandleFunc("/image", imageHandler).Methods("GET")
 	router.HandleFunc("/downloadall", downloadAllHandler).Methods("GET")
 	router.HandleFunc("/preview", previewHandler).Methods("GET")
+	router.HandleFunc("/rendition", renditionHandler).Methods("GET")
+	router.HandleFunc("/thumbnails/rebuild", thumbnailRebuildHandler).Methods("GET", "POST")
 
 	router.HandleFunc("/scanner", scannerHandler).Methods("GET")
-
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), router))
+	router.HandleFunc("/health", healthHandler).Methods("GET")
+	registerApi(router)
+	return router
 }
 
 func homePage(w http.ResponseWriter, r *http.Request) {
-	var previousJobs []string
-	for _, dir := range fsutils.JobDirectories(appConfiguration.OutputDirectory) {
-		previousJobs = append(previousJobs, dir.Name())
-	}
-
 	type index struct {
 		Navigation string
 	}
 
 	w.Header().Add("Content-Type", "text/html")
-	if err := indexTemplate.Execute(w, &index{Navigation: "home"}); err != nil {
+	if err := render(w, r, indexTemplate, &index{Navigation: "home"}); err != nil {
 		fmt.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -156,8 +390,9 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 
 func showSettingsPage(w http.ResponseWriter, r *http.Request) {
 	settings := readSettings()
+	addUsers(settings, r)
 	w.Header().Add("Content-Type", "text/html")
-	if err := settingsTemplate.Execute(w, settings); err != nil {
+	if err := render(w, r, settingsTemplate, settings); err != nil {
 		fmt.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -165,24 +400,21 @@ func showSettingsPage(w http.ResponseWriter, r *http.Request) {
 }
 
 func updateSettingsPage(w http.ResponseWriter, r *http.Request) {
-	mode := r.FormValue("mode")
-	format := r.FormValue("format")
-	resolution := r.FormValue("resolution")
 	settings := &settings{
 		Navigation: "settings",
-		Mode:       mode,
-		Format:     format,
-		Resolution: resolution,
+		Mode:       r.FormValue("mode"),
+		Format:     r.FormValue("format"),
+		Resolution: r.FormValue("resolution"),
 		Updated:    true,
 	}
-	settingsJson, _ := json.Marshal(settings)
-	if err := ioutil.WriteFile(path.Join(appConfiguration.WorkDirectory, "settings.json"), settingsJson, 0644); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := saveSettings(userName(r), settings); err != nil {
+		resolveError(w, err)
 		return
 	}
+	addUsers(settings, r)
 
 	w.Header().Add("Content-Type", "text/html")
-	if err := settingsTemplate.Execute(w, settings); err != nil {
+	if err := render(w, r, settingsTemplate, settings); err != nil {
 		fmt.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -190,18 +422,13 @@ func updateSettingsPage(w http.ResponseWriter, r *http.Request) {
 }
 
 func showJobsPage(w http.ResponseWriter, r *http.Request) {
-	var previousJobs []string
-	for _, dir := range fsutils.JobDirectories(appConfiguration.OutputDirectory) {
-		previousJobs = append(previousJobs, dir.Name())
-	}
-
 	index := &pageJobs{
 		Navigation:   "jobs",
-		PreviousJobs: previousJobs,
+		PreviousJobs: listJobs(),
 	}
 
 	w.Header().Add("Content-Type", "text/html")
-	if err := jobsTemplate.Execute(w, index); err != nil {
+	if err := render(w, r, jobsTemplate, index); err != nil {
 		fmt.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -212,24 +439,27 @@ func resumeJobPage(w http.ResponseWriter, r *http.Request) {
 	encodedJobName := r.FormValue("jobName")
 	jobName, err := url.QueryUnescape(encodedJobName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	scans, err := listJobImages(jobName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		resolveError(w, err)
 		return
 	}
+	countDocumentPages(jobName, scans)
 
 	scanner := &pageJobs{
-		Navigation: "jobs",
-		JobName:    jobName,
-		Scans:      scans,
+		Navigation:   "jobs",
+		JobName:      jobName,
+		PreviousJobs: listJobs(),
+		Scans:        scans,
+		Staged:       stagedPages(jobName),
 	}
 
 	w.Header().Add("Content-Type", "text/html")
-	if err := jobTemplate.Execute(w, scanner); err != nil {
+	if err := render(w, r, jobTemplate, scanner); err != nil {
 		fmt.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -238,12 +468,8 @@ func resumeJobPage(w http.ResponseWriter, r *http.Request) {
 
 func createJobHandler(w http.ResponseWriter, r *http.Request) {
 	jobName := r.FormValue("jobName")
-	if len(jobName) == 0 {
-		http.Error(w, "jobName cannot be empty", http.StatusBadRequest)
-		return
-	}
-	if err := os.MkdirAll(path.Join(appConfiguration.OutputDirectory, jobName), os.ModePerm); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if _, err := createJob(userName(r), jobName); err != nil {
+		resolveError(w, err)
 		return
 	}
 
@@ -254,13 +480,14 @@ func createJobHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	scanner := &pageScanner{
-		Navigation: "jobs",
-		Scans:      scans,
-		JobName:    jobName,
+		Navigation:   "jobs",
+		Scans:        scans,
+		JobName:      jobName,
+		PreviousJobs: listJobs(),
 	}
 
 	w.Header().Add("Content-Type", "text/html")
-	if err := jobTemplate.Execute(w, scanner); err != nil {
+	if err := render(w, r, jobTemplate, scanner); err != nil {
 		fmt.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -270,24 +497,18 @@ func createJobHandler(w http.ResponseWriter, r *http.Request) {
 func deleteJobHandler(w http.ResponseWriter, r *http.Request) {
 	jobName := r.FormValue("jobName")
 
-	jobPath := path.Join(appConfiguration.OutputDirectory, jobName)
-	if err := os.RemoveAll(jobPath); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := deleteJob(userName(r), jobName); err != nil {
+		resolveError(w, err)
 		return
 	}
 
-	var previousJobs []string
-	for _, dir := range fsutils.JobDirectories(appConfiguration.OutputDirectory) {
-		previousJobs = append(previousJobs, dir.Name())
-	}
-
 	index := &pageJobs{
 		Navigation:   "jobs",
-		PreviousJobs: previousJobs,
+		PreviousJobs: listJobs(),
 	}
 
 	w.Header().Add("Content-Type", "text/html")
-	if err := jobsTemplate.Execute(w, index); err != nil {
+	if err := render(w, r, jobsTemplate, index); err != nil {
 		fmt.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -295,100 +516,164 @@ func deleteJobHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func renameJobHandler(w http.ResponseWriter, r *http.Request) {
-	currentJobName := r.FormValue("currentJobName")
 	newJobName := r.FormValue("newJobName")
+	if err := renameJob(userName(r), r.FormValue("currentJobName"), newJobName); err != nil {
+		resolveError(w, err)
+		return
+	}
 
-	currentJobPath := path.Join(appConfiguration.OutputDirectory, currentJobName)
-	newJobPath := path.Join(appConfiguration.OutputDirectory, newJobName)
+	redirect(w, r, "/job?jobName="+url.QueryEscape(newJobName))
+}
 
-	w.Header().Set("Location", "/job?jobName="+newJobName)
+func mergeJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobName := r.FormValue("jobName")
+	targetJobName := r.FormValue("targetJobName")
 
-	err := os.Rename(currentJobPath, newJobPath)
-	if err != nil {
-		if errors.Unwrap(err) == syscall.EEXIST {
-			w.WriteHeader(303)
-			return
-		}
-		fmt.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	logger.Info("merge job %s into %s", jobName, targetJobName)
+	if err := mergeJob(userName(r), jobName, targetJobName); err != nil {
+		resolveError(w, err)
 		return
 	}
 
-	w.WriteHeader(303)
+	redirect(w, r, "/job?jobName="+url.QueryEscape(targetJobName))
+}
+
+func transferScansHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jobName := r.FormValue("jobName")
+	targetJobName := r.FormValue("targetJobName")
+	keepSource := r.FormValue("action") == "copy"
+
+	logger.Info("transfer %v of %s to %s", r.Form["scan"], jobName, targetJobName)
+	if err := transferPages(userName(r), jobName, targetJobName, r.Form["scan"], keepSource); err != nil {
+		resolveError(w, err)
+		return
+	}
+
+	redirect(w, r, "/job?jobName="+url.QueryEscape(jobName))
 }
 
 func scanHandler(w http.ResponseWriter, r *http.Request) {
 	jobName := r.FormValue("jobName")
 	previousScans, err := listJobImages(jobName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		resolveError(w, err)
 		return
 	}
 
-	linkName := "1"
-	if len(previousScans) > 0 {
-		lastScanName := previousScans[len(previousScans)-1].LinkName
-		lastScanNumber, err := strconv.Atoi(strings.Split(lastScanName, ".")[0])
-		if err != nil {
-			fmt.Println(err)
-		}
-		linkName = strconv.Itoa(lastScanNumber + 1)
-	}
-
-	settings := readSettings()
-
-	resolution, _ := strconv.Atoi(settings.Resolution)
-	scanJob := graphic.NewScanJob(
-		graphic.ToMode(settings.Mode),
-		graphic.ToFormat(settings.Format),
-		resolution,
-		thumb,
-	)
-	imageDetails := graphic.ImageDetails{
-		Name:          fsutils.GenerateDateFilename(),
-		LinkName:      linkName,
-		Format:        graphic.ToFormat(readSettings().Format),
-		Directory:     jobName,
-		BaseDirectory: appConfiguration.OutputDirectory,
+	if _, err := startScan(userName(r), jobName); err != nil {
+		resolveError(w, err)
+		return
 	}
-	scanJob.StartScanning(imageDetails)
 
 	var scans []image
 	for _, file := range previousScans {
 		scans = append(scans, file)
 	}
+	countDocumentPages(jobName, scans)
 
 	scanner := &pageJobs{
-		Navigation: "jobs",
-		JobName:    jobName,
-		Scans:      scans,
-		JobStarted: true,
+		Navigation:   "jobs",
+		JobName:      jobName,
+		PreviousJobs: listJobs(),
+		Scans:        scans,
+		JobStarted:   true,
 	}
 
 	w.Header().Add("Content-Type", "text/html")
-	if err := jobTemplate.Execute(w, scanner); err != nil {
+	if err := render(w, r, jobTemplate, scanner); err != nil {
 		fmt.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func deleteScanHandler(w http.ResponseWriter, r *http.Request) {
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, appConfiguration.UploadLimit)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		if uploadTooLarge(r, err) {
+			http.Error(w, fmt.Sprintf("upload larger than the limit of %d MB", appConfiguration.UploadLimit>>20),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
 	jobName := r.FormValue("jobName")
-	scan := r.FormValue("scan")
-	imagePath := path.Join(appConfiguration.OutputDirectory, jobName, scan)
+	if _, err := resolver.Job(jobName); err != nil {
+		resolveError(w, err)
+		return
+	}
 
-	logger.Info("delete image %s", imagePath)
+	// photos are staged to confirm the corners of the document before the
+	// perspective is corrected
+	perspective := r.FormValue("perspective") == "on"
+	staged := false
 
-	if err := fsutils.DeleteFileAndLink(imagePath); err != nil {
-		fmt.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	for _, fileHeader := range r.MultipartForm.File["file"] {
+		file, err := fileHeader.Open()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		header := make([]byte, 8)
+		n, _ := io.ReadFull(file, header)
+		format, err := graphic.DetectFormat(header[:n])
+		if err != nil {
+			file.Close()
+			http.Error(w, fmt.Sprintf("%s: %s", fileHeader.Filename, err), http.StatusUnsupportedMediaType)
+			return
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("upload %s as %s into %s", fileHeader.Filename, format, jobName)
+		switch {
+		case format == graphic.Pdf:
+			err = importPdf(jobName, file)
+		case perspective && format != graphic.Pnm:
+			_, err = stagePhoto(jobName, file)
+			staged = true
+		default:
+			err = importImage(jobName, format, file)
+		}
+		file.Close()
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recordActivity(userName(r), "uploaded %q into job %q", fileHeader.Filename, jobName)
+	}
+
+	if staged {
+		redirectToNextStagedPage(w, r, jobName)
 		return
 	}
+	redirect(w, r, "/job?jobName="+url.QueryEscape(jobName))
+}
 
-	if err := thumb.DeletePreview(imagePath); err != nil {
-		fmt.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// uploadTooLarge tells whether reading the upload failed because it is larger
+// than the configured limit.
+func uploadTooLarge(r *http.Request, err error) bool {
+	return r.ContentLength > appConfiguration.UploadLimit || strings.Contains(err.Error(), "request body too large")
+}
+
+func deleteScanHandler(w http.ResponseWriter, r *http.Request) {
+	jobName := r.FormValue("jobName")
+	scan := r.FormValue("scan")
+
+	logger.Info("delete image %s of %s", scan, jobName)
+	if err := deletePage(userName(r), jobName, scan); err != nil {
+		resolveError(w, err)
 		return
 	}
 
@@ -398,15 +683,17 @@ func deleteScanHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	countDocumentPages(jobName, scans)
 
 	scanner := &pageJobs{
-		Navigation: "jobs",
-		JobName:    jobName,
-		Scans:      scans,
+		Navigation:   "jobs",
+		JobName:      jobName,
+		PreviousJobs: listJobs(),
+		Scans:        scans,
 	}
 
 	w.Header().Add("Content-Type", "text/html")
-	if err := jobTemplate.Execute(w, scanner); err != nil {
+	if err := render(w, r, jobTemplate, scanner); err != nil {
 		fmt.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -418,25 +705,55 @@ func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
 	encodedJobName := r.FormValue("jobName")
 	jobName, err := url.QueryUnescape(encodedJobName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	scan := r.FormValue("scan")
-
-	image, contentType, err := readImage(jobName, scan)
+	if path.Ext(scan) == "" {
+		http.Error(w, fmt.Sprintf("invalid scan '%s', it has no extension", scan), http.StatusBadRequest)
+		return
+	}
+	conversion, err := parseConversion(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", strconv.Itoa(len(image)))
-	w.Header().Set("content-disposition",
-		fmt.Sprintf("attachment; filename=\"%s-%s\"", jobName, scan))
-	if _, err := w.Write(image); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if conversion.Enabled() {
+		imagePath, err := resolver.Scan(jobName, scan)
+		if err != nil {
+			resolveError(w, err)
+			return
+		}
+		if !convertible(imagePath) {
+			http.Error(w, fmt.Sprintf("scan '%s' cannot be converted", scan), http.StatusUnsupportedMediaType)
+			return
+		}
+		img, err := conversion.Apply(imagePath, appConfiguration.MemoryLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		format := conversion.TargetFormat(graphic.ToFormat(path.Ext(scan)[1:]))
+		w.Header().Set("Content-Type", "image/"+format.String())
+		w.Header().Set("content-disposition",
+			attachment(fmt.Sprintf("%s-%s%s", jobName, strings.TrimSuffix(scan, path.Ext(scan)), format.Extension())))
+		counter := &countingWriter{writer: w}
+		if err := conversion.Encode(counter, img, format); err != nil {
+			if counter.count == 0 {
+				w.Header().Del("Content-Type")
+				w.Header().Del("content-disposition")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// the client must not take the partial image for a complete one
+			logger.Error(fmt.Sprintf("unable to convert %s after %d bytes. Error: %s", imagePath, counter.count, err))
+			panic(http.ErrAbortHandler)
+		}
 		return
 	}
+
+	serveImage(w, r, jobName, scan, fmt.Sprintf("%s-%s", jobName, scan))
 }
 
 func imageHandler(w http.ResponseWriter, r *http.Request) {
@@ -444,23 +761,12 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 	encodedJobName := r.FormValue("jobName")
 	jobName, err := url.QueryUnescape(encodedJobName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	scan := r.FormValue("scan")
 
-	image, contentType, err := readImage(jobName, scan)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", strconv.Itoa(len(image)))
-	if _, err := w.Write(image); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	serveImage(w, r, jobName, scan, "")
 }
 
 func downloadAllHandler(w http.ResponseWriter, r *http.Request) {
@@ -469,44 +775,183 @@ func downloadAllHandler(w http.ResponseWriter, r *http.Request) {
 	encodedJobName := r.FormValue("jobName")
 	jobName, err := url.QueryUnescape(encodedJobName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	download, err := prepareJobDownload(r, jobName, envelope)
+	if err != nil {
+		resolveError(w, err)
+		return
+	}
+	writeJobDownload(w, download, resolveError)
+}
 
+// errInvalidEnvelope tells that the pages of a job cannot be downloaded in
+// the file type asked for.
+var errInvalidEnvelope = errors.New("envelope not supported, use zip, tiff, pdf or pdfa")
+
+// envelopeExtension returns the extension of the file the pages of a job are
+// downloaded in.
+func envelopeExtension(envelope string) (string, error) {
+	switch envelope {
+	case "zip", "tiff":
+		return "." + envelope, nil
+	case "pdf", "pdfa":
+		return ".pdf", nil
+	}
+	return "", fmt.Errorf("%w: '%s'", errInvalidEnvelope, envelope)
+}
+
+// errInvalidDownload tells that the pages or the conversion asked for in a
+// download are not valid.
+var errInvalidDownload = errors.New("invalid download")
+
+// jobDownload is a download of the pages of a job that was checked before
+// anything is written.
+type jobDownload struct {
+	jobName    string
+	envelope   string
+	extension  string
+	scans      []image
+	conversion graphic.Conversion
+}
+
+// prepareJobDownload checks the job, the pages the request selects and their
+// conversion, so a download only fails once started when a page cannot be
+// read or converted.
+func prepareJobDownload(r *http.Request, jobName, envelope string) (jobDownload, error) {
+	download := jobDownload{jobName: jobName, envelope: envelope}
+	var err error
+	if download.extension, err = envelopeExtension(envelope); err != nil {
+		return download, err
+	}
 	scans, err := listJobImages(jobName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return download, err
 	}
+	if download.scans, err = selectPages(scans, r.FormValue("pages")); err != nil {
+		return download, fmt.Errorf("%w: %s", errInvalidDownload, err)
+	}
+	if download.conversion, err = parseConversion(r); err != nil {
+		return download, fmt.Errorf("%w: %s", errInvalidDownload, err)
+	}
+	for _, scan := range download.scans {
+		if _, err := os.Stat(path.Join(appConfiguration.OutputDirectory, jobName, scan.Name)); err != nil {
+			return download, fmt.Errorf("page '%s' cannot be read: %w", scan.LinkName, err)
+		}
+	}
+	return download, nil
+}
+
+// writeJobDownload answers with the pages of the job in the envelope, a zip,
+// tiff, pdf or pdfa file. Errors are answered by writeError until the first
+// byte is written. After that the answer cannot change anymore, the error is
+// logged and the connection closed, so the client does not take a partial
+// file for a complete one.
+func writeJobDownload(w http.ResponseWriter, download jobDownload, writeError func(http.ResponseWriter, error)) {
+	w.Header().Set("content-disposition", attachment(download.jobName+download.extension))
+	counter := &countingWriter{writer: w}
+	err := writeJob(counter, download.jobName, download.envelope, download.scans, download.conversion)
+	switch {
+	case err == nil:
+	case counter.count == 0:
+		w.Header().Del("content-disposition")
+		writeError(w, err)
+	default:
+		logger.Error(fmt.Sprintf("unable to write the %s download of job %s after %d bytes. Error: %s",
+			download.envelope, download.jobName, counter.count, err))
+		panic(http.ErrAbortHandler)
+	}
+}
 
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// writeJob writes the scans of the job to w in a single file of the envelope,
+// converted when requested.
+func writeJob(w io.Writer, jobName, envelope string, scans []image, conversion graphic.Conversion) error {
 	switch envelope {
 	case "zip":
-		w.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", jobName))
 		zip := zipper.NewZipper(w)
+		entries := make(map[string]bool)
 		for _, scanImage := range scans {
-			if err := zip.AddFile(path.Join(appConfiguration.OutputDirectory, jobName, scanImage.Name), scanImage.Name); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+			imagePath := path.Join(appConfiguration.OutputDirectory, jobName, scanImage.Name)
+			if !conversion.Enabled() || !convertible(imagePath) {
+				if err := zip.AddFile(imagePath, scanImage.Name); err != nil {
+					return err
+				}
+				continue
+			}
+			format := conversion.TargetFormat(graphic.ToFormat(path.Ext(imagePath)[1:]))
+			entryName := strings.TrimSuffix(scanImage.Name, path.Ext(scanImage.Name)) + format.Extension()
+			if entries[entryName] {
+				// scans of the same second only differed by their extension
+				entryName = strings.TrimSuffix(entryName, format.Extension()) + "-" +
+					strings.TrimSuffix(scanImage.LinkName, path.Ext(scanImage.LinkName)) + format.Extension()
+			}
+			entries[entryName] = true
+			entry, err := zip.Create(entryName)
+			if err != nil {
+				return err
+			}
+			if err := conversion.Convert(imagePath, entry, appConfiguration.MemoryLimit); err != nil {
+				return err
 			}
 		}
-		if err := zip.Close(); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		return zip.Close()
+	case "tiff":
+		tiff := tiffer.NewTiffer(w)
+		for _, scanImage := range scans {
+			imagePath := path.Join(appConfiguration.OutputDirectory, jobName, scanImage.Name)
+			if !convertible(imagePath) || !conversion.Enabled() {
+				if err := graphic.DecodePages(imagePath, documentResolution(), appConfiguration.MemoryLimit, tiff.AddImage); err != nil {
+					return err
+				}
+				continue
+			}
+			img, err := conversion.Apply(imagePath, appConfiguration.MemoryLimit)
+			if err != nil {
+				return err
+			}
+			if err := tiff.AddImage(img); err != nil {
+				return err
+			}
 		}
-	case "pdf":
-		w.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=\"%s.pdf\"", jobName))
+		return tiff.Close()
+	case "pdf", "pdfa":
 		pdfFile := pdf.NewPdfFile()
+		if envelope == "pdfa" {
+			pdfFile = pdf.NewArchivalPdfFile()
+		}
+		pdfFile.SetInfo(pdf.Info{
+			Title:        jobName,
+			Author:       appConfiguration.PdfAuthor,
+			Producer:     appConfiguration.PdfProducer,
+			CreationDate: jobCreationDate(jobName, scans),
+		})
 		for _, scanImage := range scans {
-			if err := pdfFile.AddImage(path.Join(appConfiguration.OutputDirectory, jobName, scanImage.Name)); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+			imagePath := path.Join(appConfiguration.OutputDirectory, jobName, scanImage.Name)
+			if err := addPdfPage(pdfFile, imagePath, conversion); err != nil {
+				return err
+			}
+			if hocrPath := ocr.HocrPath(imagePath); hocrPath != "" {
+				if err := pdfFile.AddText(hocrPath); err != nil {
+					logger.Error(err.Error())
+				}
 			}
 		}
-		if err := pdfFile.Generate(w); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		return pdfFile.Generate(w)
 	}
+	return fmt.Errorf("%w: '%s'", errInvalidEnvelope, envelope)
 }
 
 func previewHandler(w http.ResponseWriter, r *http.Request) {
@@ -514,40 +959,123 @@ func previewHandler(w http.ResponseWriter, r *http.Request) {
 	encodedJobName := r.FormValue("jobName")
 	jobName, err := url.QueryUnescape(encodedJobName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	scan := r.FormValue("scan")
 
-	imagePath := path.Join(appConfiguration.OutputDirectory, jobName, scan)
-	buffer, err := thumb.Preview(imagePath)
+	imagePath, err := resolver.Scan(jobName, scan)
 	if err != nil {
-		fsys, err := fs.Sub(content, "assets")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		file, err := fs.ReadFile(fsys, "not_available.jpeg")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if _, err := w.Write(file); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		resolveError(w, err)
+		return
+	}
+	preview, err := os.Open(thumb.PreviewPath(imagePath))
+	if err != nil {
+		servePlaceholder(w, r)
+		return
+	}
+	defer preview.Close()
+	info, err := preview.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", info.ModTime(), preview)
+}
+
+// renditionHandler serves the scan scaled down to one of the rendition sizes
+// from the cache. Clients revalidate their copy with the entity tag.
+func renditionHandler(w http.ResponseWriter, r *http.Request) {
+	encodedJobName := r.FormValue("jobName")
+	jobName, err := url.QueryUnescape(encodedJobName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scan := r.FormValue("scan")
+	size := graphic.RenditionSizes[0]
+	if value := r.FormValue("size"); value != "" {
+		if size, err = strconv.Atoi(value); err != nil {
+			http.Error(w, fmt.Sprintf("invalid size '%s'", value), http.StatusBadRequest)
 			return
 		}
-		w.Header().Set("Content-Type", "image/jpeg")
-		w.Header().Set("Content-Length", strconv.Itoa(len(file)))
+	}
+	if !graphic.ValidRenditionSize(size) {
+		http.Error(w, fmt.Sprintf("size %d not supported", size), http.StatusBadRequest)
+		return
+	}
+
+	imagePath, err := resolver.Scan(jobName, scan)
+	if err != nil {
+		resolveError(w, err)
+		return
+	}
+	renditionPath, tag, err := renditions.Rendition(imagePath, size)
+	if err != nil {
+		logger.Error(err.Error())
+		servePlaceholder(w, r)
+		return
+	}
+	rendition, err := os.Open(renditionPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rendition.Close()
+	info, err := rendition.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	fileContentType := fmt.Sprintf("image/%s", filepath.Ext(imagePath)[1:])
-	w.Header().Set("Content-Type", fileContentType)
-	w.Header().Set("Content-Length", strconv.Itoa(len(buffer.Bytes())))
-	if _, err := w.Write(buffer.Bytes()); err != nil {
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", tag))
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", info.ModTime(), rendition)
+}
+
+// servePlaceholder answers with the image shown for scans that cannot be
+// previewed.
+func servePlaceholder(w http.ResponseWriter, r *http.Request) {
+	fsys, err := fs.Sub(content, "assets")
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	file, err := fs.ReadFile(fsys, "not_available.jpeg")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(file))
+}
+
+// thumbnailRebuildHandler starts the regeneration of the thumbnails of every
+// job on POST, and tells its progress on GET.
+func thumbnailRebuildHandler(w http.ResponseWriter, r *http.Request) {
+	if user, _ := auth.CurrentUser(r); !user.Admin {
+		http.Error(w, "only administrators can rebuild the thumbnails", http.StatusForbidden)
+		return
+	}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		logger.Info("rebuild thumbnails")
+		status = http.StatusAccepted
+		if !thumbnailRebuild.Start() {
+			status = http.StatusConflict
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(thumbnailRebuild.Progress()); err != nil {
+		fmt.Println(err)
+	}
 }
 
 func scannerHandler(w http.ResponseWriter, r *http.Request) {
@@ -574,9 +1102,135 @@ func scannerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// selectPages keeps the scans selected by a list of page numbers and ranges,
+// like 1-3,7, in the order of the job. A range selects the pages it spans, so
+// deleted pages may leave gaps in it. All the scans are kept without pages.
+func selectPages(scans []image, pages string) ([]image, error) {
+	if strings.TrimSpace(pages) == "" {
+		return scans, nil
+	}
+	selected := make(map[int]bool)
+	for _, part := range strings.Split(pages, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid page '%s'", part))
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil || last < first {
+				return nil, errors.New(fmt.Sprintf("invalid page range '%s'", part))
+			}
+		}
+		found := false
+		for _, scan := range scans {
+			if number := scan.Number(); number >= first && number <= last {
+				selected[number] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New(fmt.Sprintf("page '%s' not found", part))
+		}
+	}
+
+	var selection []image
+	for _, scan := range scans {
+		if selected[scan.Number()] {
+			selection = append(selection, scan)
+		}
+	}
+	return selection, nil
+}
+
+// parseConversion reads how the downloaded images are converted from the
+// query parameters format, quality, maxSize, dpi and gray.
+func parseConversion(r *http.Request) (graphic.Conversion, error) {
+	conversion := graphic.Conversion{
+		Format: r.FormValue("format"),
+	}
+	switch conversion.Format {
+	case "", "jpeg", "png", "tiff":
+	default:
+		return conversion, errors.New(fmt.Sprintf("format '%s' not supported", conversion.Format))
+	}
+
+	for _, parameter := range []struct {
+		name  string
+		value *int
+		max   int
+	}{
+		{"quality", &conversion.Quality, 100},
+		{"maxSize", &conversion.MaxSize, 0},
+		{"dpi", &conversion.Dpi, 0},
+	} {
+		value := r.FormValue(parameter.name)
+		if value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 || (parameter.max > 0 && number > parameter.max) {
+			return conversion, errors.New(fmt.Sprintf("invalid %s '%s'", parameter.name, value))
+		}
+		*parameter.value = number
+	}
+
+	if gray := r.FormValue("gray"); gray != "" {
+		grayscale, err := strconv.ParseBool(gray)
+		if err != nil {
+			return conversion, errors.New(fmt.Sprintf("invalid gray '%s'", gray))
+		}
+		conversion.Grayscale = grayscale
+	}
+	return conversion, nil
+}
+
+// convertible tells whether the image can be decoded to be converted. Other
+// files, like stored pdf documents, are downloaded as they are.
+func convertible(imagePath string) bool {
+	switch path.Ext(imagePath) {
+	case ".jpeg", ".png", ".tiff", ".pnm":
+		return true
+	}
+	return false
+}
+
+// addPdfPage adds the image as a page of the pdf document, converted when
+// requested. Converted pages are either jpeg or png. The images pdf documents
+// cannot embed, and the pages of stored pdf documents, are decoded first.
+func addPdfPage(pdfFile *pdf.Document, imagePath string, conversion graphic.Conversion) error {
+	if !convertible(imagePath) || !conversion.Enabled() {
+		switch path.Ext(imagePath) {
+		case ".jpeg", ".png":
+			return pdfFile.AddImage(imagePath)
+		}
+		return graphic.DecodePages(imagePath, documentResolution(), appConfiguration.MemoryLimit, pdfFile.AddDecodedImage)
+	}
+	img, err := conversion.Apply(imagePath, appConfiguration.MemoryLimit)
+	if err != nil {
+		return err
+	}
+	format := conversion.TargetFormat(graphic.ToFormat(path.Ext(imagePath)[1:]))
+	if format != graphic.Png {
+		format = graphic.Jpeg
+	}
+	buffer := new(bytes.Buffer)
+	if err := conversion.Encode(buffer, img, format); err != nil {
+		return err
+	}
+	return pdfFile.AddImageData(buffer, format.String())
+}
+
 func readSettings() *settings {
 	settingsFile := path.Join(appConfiguration.WorkDirectory, "settings.json")
 	file, err := ioutil.ReadFile(settingsFile)
+	if os.IsNotExist(err) {
+		// the settings are written once the web interface is served
+		settings := defaultSettings()
+		settings.Navigation = "settings"
+		return settings
+	}
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -589,27 +1243,248 @@ func readSettings() *settings {
 	return settings
 }
 
-func readImage(jobName string, scan string) ([]byte, string, error) {
-	imagePath := path.Join(appConfiguration.OutputDirectory, jobName, scan)
+// defaultSettings are the settings of the scans until they are changed.
+func defaultSettings() *settings {
+	return &settings{
+		Mode:       graphic.Color.String(),
+		Format:     graphic.Jpeg.String(),
+		Resolution: "200",
+	}
+}
+
+// resolveError answers with the status matching the error.
+func resolveError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		fmt.Println(err)
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// errorStatus returns the status matching an error of the resolver or the
+// services: 400 for invalid names and requests, 404 for missing jobs and
+// scans, 409 for names already taken.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, fsutils.ErrInvalidName), errors.Is(err, fsutils.ErrInvalidOrder),
+		errors.Is(err, errSameJob), errors.Is(err, errInvalidSettings), errors.Is(err, errInvalidEnvelope),
+		errors.Is(err, errInvalidDownload):
+		return http.StatusBadRequest
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fsutils.ErrJobExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// splitList returns the values of a comma separated configuration.
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// parseTemplate parses the page with the shared header. Its links start with
+// {{ prefix }}, the sub-path scanpi is served under, and its forms carry the
+// {{ csrf }} token.
+func parseTemplate(name string) *template.Template {
+	return template.Must(template.New(name).
+		Funcs(template.FuncMap{
+			"prefix": func() string { return "" },
+			"csrf":   func() string { return "" },
+		}).
+		ParseFS(content, "templates/"+name, "templates/header.html"))
+}
+
+// render executes a copy of the template with the prefix and the form token
+// of the request, so the parsed template stays unexecuted and can be copied
+// again.
+func render(w http.ResponseWriter, r *http.Request, t *template.Template, data interface{}) error {
+	page, err := t.Clone()
+	if err != nil {
+		return err
+	}
+	prefix := auth.Prefix(r)
+	token := auth.CSRFToken(r)
+	page.Funcs(template.FuncMap{
+		"prefix": func() string { return prefix },
+		"csrf":   func() string { return token },
+	})
+	return page.Execute(w, data)
+}
+
+// redirect sends the browser to the location of scanpi after a form post.
+func redirect(w http.ResponseWriter, r *http.Request, location string) {
+	w.Header().Set("Location", auth.Prefix(r)+location)
+	w.WriteHeader(303)
+}
+
+// serveImage streams the original scan from disk, answering conditional and
+// range requests. It is downloaded as the given file name, if any.
+func serveImage(w http.ResponseWriter, r *http.Request, jobName string, scan string, filename string) {
+	imagePath, err := resolver.Scan(jobName, scan)
+	if err != nil {
+		resolveError(w, err)
+		return
+	}
 	logger.Info("imagePath: %s", imagePath)
-	file, err := ioutil.ReadFile(imagePath)
+	file, err := os.Open(imagePath)
 	if err != nil {
-		return nil, "", err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	return file, contentType(imagePath), nil
+
+	// unknown types are sniffed from the content by ServeContent
+	if contentType := contentType(imagePath); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if filename != "" {
+		w.Header().Set("content-disposition", attachment(filename))
+	}
+	http.ServeContent(w, r, "", info.ModTime(), file)
 }
 
 func contentType(imagePath string) string {
-	imageType := path.Ext(imagePath)[1:]
-	if imageType == "pdf" {
+	switch path.Ext(imagePath) {
+	case ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".tiff":
+		return "image/tiff"
+	case ".pnm":
+		return "image/x-portable-anymap"
+	case ".pdf":
 		return "application/pdf"
 	}
-	return fmt.Sprintf("image/%s", imageType)
+	return ""
+}
+
+// attachment returns the Content-Disposition of a download with the file
+// name. Browsers that support RFC 5987 take the UTF-8 name, the others an
+// ASCII approximation of it.
+func attachment(filename string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range filename {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(filename) {
+		if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf("attachment; filename=\"%s\"; filename*=UTF-8''%s", fallback.String(), encoded.String())
+}
+
+// importImage stores the image in the job as the next scan.
+func importImage(jobName string, format graphic.Format, r io.Reader) error {
+	jobPath, err := resolver.Job(jobName)
+	if err != nil {
+		return err
+	}
+	linkName, err := fsutils.NextLinkName(jobPath)
+	if err != nil {
+		return err
+	}
+	filename := fsutils.AvailableDateFilename(jobPath, fsutils.GenerateDateFilename(), format.Extension())
+	imageDetails := graphic.ImageDetails{
+		Name:          strings.TrimSuffix(filename, format.Extension()),
+		LinkName:      linkName,
+		Format:        format,
+		Directory:     jobName,
+		BaseDirectory: appConfiguration.OutputDirectory,
+	}
+	return graphic.ImportImage(r, imageDetails, postProcessor)
+}
+
+// importPdf stores every page of the pdf document as a scan of the job. The
+// document is stored as it is when its pages cannot be extracted.
+func importPdf(jobName string, r io.ReadSeeker) error {
+	temporaryDirectory, err := os.MkdirTemp(appConfiguration.WorkDirectory, "upload")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(temporaryDirectory)
+
+	pdfPath := path.Join(temporaryDirectory, "upload.pdf")
+	pdfFile, err := os.Create(pdfPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(pdfFile, r); err != nil {
+		pdfFile.Close()
+		return err
+	}
+	if err := pdfFile.Close(); err != nil {
+		return err
+	}
+
+	pages, err := graphic.ExtractPdfPages(pdfPath, temporaryDirectory, documentResolution())
+	if err != nil || len(pages) == 0 {
+		logger.Error(fmt.Sprintf("unable to extract pdf pages, storing the document instead. Error: %v", err))
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return importImage(jobName, graphic.Pdf, r)
+	}
+
+	for _, page := range pages {
+		file, err := os.Open(page)
+		if err != nil {
+			return err
+		}
+		err = importImage(jobName, graphic.Png, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// documentResolution is the resolution, in dots per inch, the pages of pdf
+// documents are rendered at: the one of the scans.
+func documentResolution() int {
+	resolution, err := strconv.Atoi(readSettings().Resolution)
+	if err != nil {
+		return 200
+	}
+	return resolution
+}
+
+func listJobs() []string {
+	var jobs []string
+	for _, dir := range fsutils.JobDirectories(appConfiguration.OutputDirectory) {
+		jobs = append(jobs, dir.Name())
+	}
+	return jobs
 }
 
 func listJobImages(jobName string) ([]image, error) {
 	var scans []image
-	fileMetaDataSlice, err := fsutils.ImageFilesOnDirectory(path.Join(appConfiguration.OutputDirectory, jobName))
+	jobPath, err := resolver.Job(jobName)
+	if err != nil {
+		return []image{}, err
+	}
+	fileMetaDataSlice, err := fsutils.ImageFilesOnDirectory(jobPath)
 	if err != nil {
 		return []image{}, err
 	}
@@ -622,6 +1497,39 @@ func listJobImages(jobName string) ([]image, error) {
 	return scans, nil
 }
 
+// countDocumentPages sets the number of pages of the pdf documents of the job,
+// shown on their cards. The count is cached next to the document.
+func countDocumentPages(jobName string, scans []image) {
+	for i, scan := range scans {
+		if path.Ext(scan.Name) != ".pdf" {
+			continue
+		}
+		pages, err := graphic.CachedPdfPageCount(path.Join(appConfiguration.OutputDirectory, jobName, scan.Name))
+		if err != nil {
+			logger.Error(fmt.Sprintf("cannot count the pages of '%s'. Error: %s", scan.Name, err))
+		}
+		scans[i].Pages = pages
+	}
+}
+
+// jobCreationDate returns the date of the first scan in the job. The dated
+// filename is preferred over the modification time, which changes on copies.
+func jobCreationDate(jobName string, scans []image) time.Time {
+	if len(scans) == 0 {
+		return time.Now()
+	}
+	first := scans[0].Name
+	created, err := time.ParseInLocation("20060102150405", strings.TrimSuffix(first, path.Ext(first)), time.Local)
+	if err == nil {
+		return created
+	}
+	info, err := os.Stat(path.Join(appConfiguration.OutputDirectory, jobName, first))
+	if err != nil {
+		return time.Now()
+	}
+	return info.ModTime()
+}
+
 // TODO delete
 func migrate(baseDir string) {
 	files, err := ioutil.ReadDir(baseDir)
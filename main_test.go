@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/adelolmo/scanpi/fsutils"
+	"github.com/adelolmo/scanpi/graphic"
+	"github.com/adelolmo/scanpi/pdf"
+	"github.com/adelolmo/scanpi/worker"
+	"github.com/gorilla/mux"
+	"golang.org/x/image/tiff"
+	goimage "image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setUpJob points the output directory to a temporary one with an empty job,
+// and returns the post processor that makes the thumbnails of its uploads.
+func setUpJob(t *testing.T, jobName string) (*graphic.PostProcessor, func()) {
+	directory := t.TempDir()
+	appConfiguration = configuration{
+		OutputDirectory: path.Join(directory, "output"),
+		WorkDirectory:   path.Join(directory, "work"),
+		Workers:         1,
+		MemoryLimit:     defaultMemoryLimit << 20,
+		UploadLimit:     defaultUploadLimit << 20,
+	}
+	for _, dir := range []string{appConfiguration.WorkDirectory, path.Join(appConfiguration.OutputDirectory, jobName)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolver = fsutils.NewResolver(appConfiguration.OutputDirectory)
+	trash = fsutils.NewTrash(path.Join(appConfiguration.WorkDirectory, "trash"), time.Hour, resolver)
+	thumb = graphic.NewThumbnail("", appConfiguration.OutputDirectory, appConfiguration.MemoryLimit)
+	ocr = graphic.NewOcr("")
+	renditions = graphic.NewRenditions(path.Join(appConfiguration.WorkDirectory, "cache"), "", appConfiguration.MemoryLimit)
+	thumbnails := worker.NewPool("thumbnail", 1, workerQueueSize)
+	recognition := worker.NewPool("ocr", 1, workerQueueSize)
+	return graphic.NewPostProcessor(thumb, ocr, thumbnails, recognition), func() {
+		thumbnails.Close()
+		recognition.Close()
+	}
+}
+
+func testPage(gray bool) goimage.Image {
+	bounds := goimage.Rect(0, 0, 64, 48)
+	if gray {
+		img := goimage.NewGray(bounds)
+		for y := 0; y < 48; y++ {
+			for x := 0; x < 64; x++ {
+				img.SetGray(x, y, color.Gray{Y: uint8(x * 4)})
+			}
+		}
+		return img
+	}
+	img := goimage.NewNRGBA(bounds)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 5), B: 0x80, A: 0xff})
+		}
+	}
+	return img
+}
+
+func encodeTiff(t *testing.T, img goimage.Image) []byte {
+	buffer := new(bytes.Buffer)
+	if err := tiff.Encode(buffer, img, &tiff.Options{Compression: tiff.Deflate}); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func encodePdf(t *testing.T, pages ...goimage.Image) []byte {
+	document := pdf.NewPdfFile()
+	for _, page := range pages {
+		if err := document.AddDecodedImage(page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buffer := new(bytes.Buffer)
+	if err := document.Generate(buffer); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestWriteJobDecodesUploads(t *testing.T) {
+	pgm := append([]byte("P5\n64 48\n255\n"), testPage(true).(*goimage.Gray).Pix...)
+	tests := []struct {
+		name     string
+		format   graphic.Format
+		upload   func(t *testing.T) []byte
+		envelope string
+		pages    int
+	}{
+		{"gray tiff to pdf", graphic.Tiff, func(t *testing.T) []byte { return encodeTiff(t, testPage(true)) }, "pdf", 1},
+		{"color tiff to pdf", graphic.Tiff, func(t *testing.T) []byte { return encodeTiff(t, testPage(false)) }, "pdf", 1},
+		{"color tiff to pdfa", graphic.Tiff, func(t *testing.T) []byte { return encodeTiff(t, testPage(false)) }, "pdfa", 1},
+		{"pnm to pdf", graphic.Pnm, func(*testing.T) []byte { return pgm }, "pdf", 1},
+		{"pnm to tiff", graphic.Pnm, func(*testing.T) []byte { return pgm }, "tiff", 1},
+		{"stored pdf to pdf", graphic.Pdf, func(t *testing.T) []byte { return encodePdf(t, testPage(false)) }, "pdf", 1},
+		{"stored pdf of two pages to pdf", graphic.Pdf, func(t *testing.T) []byte {
+			return encodePdf(t, testPage(true), testPage(false))
+		}, "pdf", 2},
+		{"stored pdf to tiff", graphic.Pdf, func(t *testing.T) []byte { return encodePdf(t, testPage(true)) }, "tiff", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			postProcessor, closePools := setUpJob(t, "job")
+			err := graphic.ImportImage(bytes.NewReader(test.upload(t)), graphic.ImageDetails{
+				Name:          "20240102030405",
+				LinkName:      "1",
+				Format:        test.format,
+				Directory:     "job",
+				BaseDirectory: appConfiguration.OutputDirectory,
+			}, postProcessor)
+			closePools()
+			if err != nil {
+				t.Fatal(err)
+			}
+			scans, err := listJobImages("job")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.format == graphic.Pdf {
+				// the pages were counted along with the thumbnail
+				countPath := path.Join(appConfiguration.OutputDirectory, "job", scans[0].Name+graphic.PageCountSuffix)
+				if _, err := os.Stat(countPath); err != nil {
+					t.Errorf("page count not cached: %v", err)
+				}
+				countDocumentPages("job", scans)
+				if scans[0].Pages != test.pages {
+					t.Errorf("document pages = %d, want %d", scans[0].Pages, test.pages)
+				}
+			}
+
+			out := new(bytes.Buffer)
+			if err := writeJob(out, "job", test.envelope, scans, graphic.Conversion{}); err != nil {
+				t.Fatalf("writeJob() error = %v", err)
+			}
+			if test.envelope == "tiff" {
+				img, err := tiff.Decode(out)
+				if err != nil {
+					t.Fatalf("tiff.Decode() error = %v", err)
+				}
+				if bounds := img.Bounds(); bounds.Dx() != 64 || bounds.Dy() != 48 {
+					t.Errorf("page is %dx%d, want 64x48", bounds.Dx(), bounds.Dy())
+				}
+				return
+			}
+			if !bytes.HasPrefix(out.Bytes(), []byte("%PDF-")) {
+				t.Fatal("output is not a pdf document")
+			}
+			documentPath := path.Join(t.TempDir(), "job.pdf")
+			if err := os.WriteFile(documentPath, out.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if pages, err := graphic.PdfPageCount(documentPath); err != nil || pages != test.pages {
+				t.Errorf("PdfPageCount() = %d, %v, want %d pages", pages, err, test.pages)
+			}
+		})
+	}
+}
+
+func TestApiDownloadJobHandler(t *testing.T) {
+	_, closePools := setUpJob(t, "job")
+	closePools()
+	jobPath := path.Join(appConfiguration.OutputDirectory, "job")
+	// the first page is not compressed, so it is written out before the
+	// second one fails
+	uncompressed := new(bytes.Buffer)
+	if err := tiff.Encode(uncompressed, goimage.NewNRGBA(goimage.Rect(0, 0, 256, 256)), nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"20240102030405.tiff": uncompressed.Bytes(),
+		"20240102030406.tiff": []byte("II*\x00 not a tiff"),
+	} {
+		if err := os.WriteFile(path.Join(jobPath, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"1.tiff": "20240102030405.tiff",
+		"2.tiff": "20240102030406.tiff",
+		"3.tiff": "20240102030407.tiff",
+	} {
+		if err := os.Symlink(target, path.Join(jobPath, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		job        string
+		query      string
+		wantStatus int
+		wantAbort  bool
+	}{
+		{"one page", "job", "envelope=pdf&pages=1", http.StatusOK, false},
+		{"unknown envelope", "job", "envelope=rar", http.StatusBadRequest, false},
+		{"missing job", "nojob", "envelope=pdf", http.StatusNotFound, false},
+		{"invalid pages", "job", "envelope=pdf&pages=x", http.StatusBadRequest, false},
+		{"invalid conversion", "job", "envelope=pdf&pages=1&quality=101", http.StatusBadRequest, false},
+		{"page linking to a missing file", "job", "envelope=pdf&pages=1-3", http.StatusNotFound, false},
+		{"unreadable first page", "job", "envelope=tiff&pages=2", http.StatusInternalServerError, false},
+		{"unreadable page once written", "job", "envelope=tiff&pages=1-2", http.StatusOK, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/v1/jobs/"+test.job+"/download?"+test.query, nil)
+			request = mux.SetURLVars(request, map[string]string{"job": test.job})
+			recorder := httptest.NewRecorder()
+			aborted := func() (aborted bool) {
+				defer func() {
+					if r := recover(); r != nil {
+						if r != http.ErrAbortHandler {
+							panic(r)
+						}
+						aborted = true
+					}
+				}()
+				apiDownloadJobHandler(recorder, request)
+				return false
+			}()
+
+			if aborted != test.wantAbort {
+				t.Errorf("aborted = %v, want %v", aborted, test.wantAbort)
+			}
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if test.wantStatus == http.StatusOK {
+				return
+			}
+			var answer apiError
+			if err := json.Unmarshal(recorder.Body.Bytes(), &answer); err != nil || answer.Status != test.wantStatus {
+				t.Errorf("answer = %q, want a json error with status %d", recorder.Body.String(), test.wantStatus)
+			}
+			if disposition := recorder.Header().Get("content-disposition"); disposition != "" {
+				t.Errorf("error answered as attachment: %s", disposition)
+			}
+		})
+	}
+}
+
+func TestDownloadFileHandler(t *testing.T) {
+	_, closePools := setUpJob(t, "job")
+	closePools()
+	jobPath := path.Join(appConfiguration.OutputDirectory, "job")
+	pngPage := new(bytes.Buffer)
+	if err := png.Encode(pngPage, testPage(false)); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"20240102030401.png": pngPage.Bytes(),
+		"20240102030402.pnm": append([]byte("P5\n64 48\n255\n"), testPage(true).(*goimage.Gray).Pix...),
+		"20240102030403.pdf": encodePdf(t, testPage(true)),
+	} {
+		if err := os.WriteFile(path.Join(jobPath, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(name, path.Join(jobPath, name[13:14]+path.Ext(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		wantStatus  int
+		wantType    string
+		wantDecoded bool
+	}{
+		{"png as stored", "scan=1.png", http.StatusOK, "image/png", true},
+		{"png to jpeg", "scan=1.png&format=jpeg&quality=80", http.StatusOK, "image/jpeg", true},
+		{"pnm with quality", "scan=2.pnm&quality=80", http.StatusOK, "image/png", true},
+		{"pnm to jpeg", "scan=2.pnm&format=jpeg&maxSize=32", http.StatusOK, "image/jpeg", true},
+		{"pdf as stored", "scan=3.pdf", http.StatusOK, "application/pdf", false},
+		{"pdf converted", "scan=3.pdf&maxSize=32", http.StatusUnsupportedMediaType, "", false},
+		{"pdf to jpeg", "scan=3.pdf&format=jpeg", http.StatusUnsupportedMediaType, "", false},
+		{"invalid quality", "scan=1.png&quality=0", http.StatusBadRequest, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/download?jobName=job&"+test.query, nil)
+			recorder := httptest.NewRecorder()
+			downloadFileHandler(recorder, request)
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, test.wantStatus, recorder.Body.String())
+			}
+			if test.wantType == "" {
+				if disposition := recorder.Header().Get("content-disposition"); disposition != "" {
+					t.Errorf("error answered as the attachment %s", disposition)
+				}
+				return
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != test.wantType {
+				t.Errorf("content type = %s, want %s", contentType, test.wantType)
+			}
+			if recorder.Body.Len() == 0 {
+				t.Fatal("empty answer")
+			}
+			if !test.wantDecoded {
+				return
+			}
+			if _, format, err := goimage.Decode(recorder.Body); err != nil || "image/"+format != test.wantType {
+				t.Errorf("answer decoded as %s, %v", format, err)
+			}
+		})
+	}
+}
+
+// multipartUpload returns the body and content type of an upload of the
+// files into the job.
+func multipartUpload(t *testing.T, jobName string, files map[string][]byte) (*bytes.Buffer, string) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	if err := writer.WriteField("jobName", jobName); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		part, err := writer.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body, writer.FormDataContentType()
+}
+
+func TestUploadHandler(t *testing.T) {
+	pgm := append([]byte("P5\n64 48\n255\n"), testPage(true).(*goimage.Gray).Pix...)
+	tests := []struct {
+		name       string
+		files      map[string][]byte
+		limit      int64
+		wantStatus int
+		wantPages  int
+	}{
+		{"binary pnm", map[string][]byte{"page.pnm": pgm}, defaultUploadLimit << 20, http.StatusSeeOther, 1},
+		{"plain pnm", map[string][]byte{"page.pnm": []byte("P2\n1 1\n255\n0\n")}, defaultUploadLimit << 20, http.StatusUnsupportedMediaType, 0},
+		{"plain bitmap", map[string][]byte{"page.pbm": []byte("P1\n1 1\n0\n")}, defaultUploadLimit << 20, http.StatusUnsupportedMediaType, 0},
+		{"unknown file", map[string][]byte{"page.txt": []byte("not an image")}, defaultUploadLimit << 20, http.StatusUnsupportedMediaType, 0},
+		{"larger than the limit", map[string][]byte{"page.pnm": pgm}, 1 << 10, http.StatusRequestEntityTooLarge, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			processor, closePools := setUpJob(t, "job")
+			postProcessor = processor
+			appConfiguration.UploadLimit = test.limit
+			body, contentType := multipartUpload(t, "job", test.files)
+			request := httptest.NewRequest(http.MethodPost, "/upload", body)
+			request.Header.Set("Content-Type", contentType)
+			// a chunked upload, the limit is only hit while reading it
+			request.ContentLength = -1
+			recorder := httptest.NewRecorder()
+			uploadHandler(recorder, request)
+			closePools()
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, test.wantStatus, recorder.Body.String())
+			}
+			scans, err := listJobImages("job")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(scans) != test.wantPages {
+				t.Errorf("job has %d pages, want %d", len(scans), test.wantPages)
+			}
+		})
+	}
+}
+
+func TestTransferTakesBackPagesOnFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		transfer func() error
+		// wantMoved tells whether the pages are moved out of the job
+		wantMoved bool
+	}{
+		{"merge", func() error { return mergeJob("admin", "job", "target") }, true},
+		{"move", func() error { return transferPages("admin", "job", "target", []string{"1.jpeg", "2.jpeg"}, false) }, true},
+		{"copy", func() error { return transferPages("admin", "job", "target", []string{"1.jpeg", "2.jpeg"}, true) }, false},
+	}
+	for _, test := range tests {
+		for _, failing := range []bool{false, true} {
+			_, closePools := setUpJob(t, "job")
+			closePools()
+			jobPath := path.Join(appConfiguration.OutputDirectory, "job")
+			targetPath := path.Join(appConfiguration.OutputDirectory, "target")
+			for i, name := range []string{"20240102030401.jpeg", "20240102030402.jpeg"} {
+				for _, suffix := range []string{"", ".thumbnail"} {
+					if err := os.WriteFile(path.Join(jobPath, name+suffix), []byte(name), 0644); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.Symlink(name+suffix, path.Join(jobPath, fmt.Sprintf("%d.jpeg%s", i+1, suffix))); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := os.Mkdir(targetPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if failing {
+				// the thumbnail of the second page cannot be moved over it
+				if err := os.MkdirAll(path.Join(targetPath, "20240102030402.jpeg.thumbnail", "taken"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := test.transfer()
+			if (err != nil) != failing {
+				t.Fatalf("%s: error = %v, want error %v", test.name, err, failing)
+			}
+			scans, _ := listJobImages("job")
+			targetScans, _ := listJobImages("target")
+			wantScans, wantTargetScans := 2, 2
+			if failing {
+				wantTargetScans = 0
+			} else if test.wantMoved {
+				wantScans = 0
+			}
+			if len(scans) != wantScans || len(targetScans) != wantTargetScans {
+				t.Errorf("%s failing %v: job has %d pages, target %d, want %d and %d",
+					test.name, failing, len(scans), len(targetScans), wantScans, wantTargetScans)
+			}
+			if failing {
+				for _, name := range []string{"1.jpeg", "1.jpeg.thumbnail", "2.jpeg", "2.jpeg.thumbnail"} {
+					if _, err := os.Stat(path.Join(jobPath, name)); err != nil {
+						t.Errorf("%s: page of the job broken: %v", test.name, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSelectPages(t *testing.T) {
+	// page 3 was deleted
+	scans := []image{
+		{Name: "20240102030401.jpeg", LinkName: "1.jpeg"},
+		{Name: "20240102030402.jpeg", LinkName: "2.jpeg"},
+		{Name: "20240102030404.png", LinkName: "4.png"},
+		{Name: "20240102030405.pdf", LinkName: "5.pdf"},
+	}
+	tests := []struct {
+		name    string
+		pages   string
+		want    []string
+		wantErr bool
+	}{
+		{"all pages", " ", []string{"1.jpeg", "2.jpeg", "4.png", "5.pdf"}, false},
+		{"list", "5,1", []string{"1.jpeg", "5.pdf"}, false},
+		{"range over a gap", "2-4", []string{"2.jpeg", "4.png"}, false},
+		{"list and range", "1, 4-5", []string{"1.jpeg", "4.png", "5.pdf"}, false},
+		{"single page range", "2-2", []string{"2.jpeg"}, false},
+		{"negative page", "-1-2", nil, true},
+		{"huge bounds", "1-9223372036854775807", []string{"1.jpeg", "2.jpeg", "4.png", "5.pdf"}, false},
+		{"out of range bound", "1-99999999999999999999", nil, true},
+		{"reversed range", "4-2", nil, true},
+		{"deleted page", "3", nil, true},
+		{"range without pages", "6-100", nil, true},
+		{"not a number", "one", nil, true},
+		{"open range", "2-", nil, true},
+		{"empty part", "1,,2", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selection, err := selectPages(scans, test.pages)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("selectPages() error = %v, want error %v", err, test.wantErr)
+			}
+			var got []string
+			for _, scan := range selection {
+				got = append(got, scan.LinkName)
+			}
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("selectPages() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestScanHandlersConfineScansToTheJob(t *testing.T) {
+	_, closePools := setUpJob(t, "job")
+	closePools()
+	jobPath := path.Join(appConfiguration.OutputDirectory, "job")
+	secret := path.Join(appConfiguration.WorkDirectory, "20240102030406.jpeg")
+	for _, file := range []string{path.Join(jobPath, "20240102030405.jpeg"), path.Join(jobPath, "20240102030405.jpeg.thumbnail"), secret} {
+		if err := os.WriteFile(file, []byte("scan"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"1.jpeg":           "20240102030405.jpeg",
+		"1.jpeg.thumbnail": "20240102030405.jpeg.thumbnail",
+		"2.jpeg":           secret,
+		"3.jpeg":           "../../work/20240102030406.jpeg",
+	} {
+		if err := os.Symlink(target, path.Join(jobPath, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handlers := []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+		api     bool
+	}{
+		{"image", imageHandler, false},
+		{"download", downloadFileHandler, false},
+		{"preview", previewHandler, false},
+		{"rendition", renditionHandler, false},
+		{"api page file", apiPageFileHandler, true},
+		{"api page", apiPageHandler, true},
+	}
+	tests := []struct {
+		name       string
+		job        string
+		scan       string
+		wantStatus int
+	}{
+		{"page", "job", "1.jpeg", http.StatusOK},
+		{"parent directory in the job", "..", "output/job/1.jpeg", http.StatusBadRequest},
+		{"escaped parent directory in the job", "%2E%2E", "1.jpeg", http.StatusBadRequest},
+		{"parent directory in the scan", "job", "../../work/20240102030406.jpeg", http.StatusBadRequest},
+		{"absolute path", "job", secret, http.StatusBadRequest},
+		{"backslash", "job", "..\\1.jpeg", http.StatusBadRequest},
+		{"hidden name", "job", ".1.jpeg", http.StatusBadRequest},
+		{"control character", "job", "1.jpeg\x00", http.StatusBadRequest},
+		{"absolute link out of the output directory", "job", "2.jpeg", http.StatusBadRequest},
+		{"relative link out of the output directory", "job", "3.jpeg", http.StatusBadRequest},
+		{"sidecar", "job", "1.jpeg.thumbnail", http.StatusNotFound},
+		{"missing scan", "job", "9.jpeg", http.StatusNotFound},
+		{"missing job", "nojob", "1.jpeg", http.StatusNotFound},
+	}
+	for _, handler := range handlers {
+		for _, test := range tests {
+			if handler.api && test.job == "%2E%2E" {
+				// the api takes the job from the path, unescaped by the router
+				continue
+			}
+			t.Run(handler.name+" "+test.name, func(t *testing.T) {
+				query := url.Values{"jobName": {test.job}, "scan": {test.scan}}
+				request := httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil)
+				request = mux.SetURLVars(request, map[string]string{"job": test.job, "page": test.scan})
+				recorder := httptest.NewRecorder()
+				handler.handler(recorder, request)
+				if recorder.Code != test.wantStatus {
+					t.Errorf("status = %d, want %d: %s", recorder.Code, test.wantStatus, recorder.Body.String())
+				}
+			})
+		}
+	}
+}
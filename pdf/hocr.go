@@ -0,0 +1,118 @@
+package pdf
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type hocrWord struct {
+	x0, y0, x1, y1 float64
+	text           string
+}
+
+type hocrPage struct {
+	width, height float64
+	words         []hocrWord
+}
+
+// parseHocr reads the page size and the word boxes of a tesseract hOCR file.
+func parseHocr(r io.Reader) (*hocrPage, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	page := &hocrPage{}
+	var word *hocrWord
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse hocr: %s", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if word != nil {
+				depth++
+				continue
+			}
+			class, title := attribute(t, "class"), attribute(t, "title")
+			switch {
+			case hasClass(class, "ocr_page"):
+				if box, ok := bbox(title); ok {
+					page.width, page.height = box[2], box[3]
+				}
+			case hasClass(class, "ocrx_word"):
+				if box, ok := bbox(title); ok {
+					word = &hocrWord{x0: box[0], y0: box[1], x1: box[2], y1: box[3]}
+					depth = 0
+				}
+			}
+		case xml.CharData:
+			if word != nil {
+				word.text += string(t)
+			}
+		case xml.EndElement:
+			if word == nil {
+				continue
+			}
+			if depth > 0 {
+				depth--
+				continue
+			}
+			word.text = strings.TrimSpace(word.text)
+			if word.text != "" {
+				page.words = append(page.words, *word)
+			}
+			word = nil
+		}
+	}
+	if page.width == 0 || page.height == 0 {
+		return nil, fmt.Errorf("hocr without page size")
+	}
+	return page, nil
+}
+
+func attribute(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func hasClass(class, name string) bool {
+	for _, c := range strings.Fields(class) {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bbox extracts the coordinates from a title like "bbox 10 20 30 40; x_wconf 95".
+func bbox(title string) ([4]float64, bool) {
+	var box [4]float64
+	for _, property := range strings.Split(title, ";") {
+		fields := strings.Fields(property)
+		if len(fields) != 5 || fields[0] != "bbox" {
+			continue
+		}
+		for i := range box {
+			value, err := strconv.ParseFloat(fields[i+1], 64)
+			if err != nil {
+				return box, false
+			}
+			box[i] = value
+		}
+		return box, true
+	}
+	return box, false
+}
@@ -0,0 +1,111 @@
+package pdf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// srgbProfile builds an ICC version 2 display profile with the sRGB primaries
+// and tone curve, adapted to the D50 profile connection space. It is embedded
+// as output intent of the PDF/A documents.
+func srgbProfile() []byte {
+	type tag struct {
+		signature string
+		data      []byte
+	}
+	tags := []tag{
+		{"desc", iccDescription("sRGB IEC61966-2.1")},
+		{"cprt", iccText("No copyright, use freely")},
+		{"wtpt", iccXYZ(0.9642, 1.0, 0.8249)},
+		{"rXYZ", iccXYZ(0.4361, 0.2225, 0.0139)},
+		{"gXYZ", iccXYZ(0.3851, 0.7169, 0.0971)},
+		{"bXYZ", iccXYZ(0.1431, 0.0606, 0.7141)},
+		{"rTRC", iccSrgbCurve()},
+		{"gTRC", iccSrgbCurve()},
+		{"bTRC", iccSrgbCurve()},
+	}
+
+	offset := 128 + 4 + 12*len(tags)
+	table := new(bytes.Buffer)
+	data := new(bytes.Buffer)
+	_ = binary.Write(table, binary.BigEndian, uint32(len(tags)))
+	for _, t := range tags {
+		table.WriteString(t.signature)
+		_ = binary.Write(table, binary.BigEndian, uint32(offset+data.Len()))
+		_ = binary.Write(table, binary.BigEndian, uint32(len(t.data)))
+		data.Write(t.data)
+		// tag data is aligned on four bytes
+		for data.Len()%4 != 0 {
+			data.WriteByte(0)
+		}
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], uint32(offset+data.Len()))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	binary.BigEndian.PutUint16(header[24:], 2019)
+	binary.BigEndian.PutUint16(header[26:], 1)
+	binary.BigEndian.PutUint16(header[28:], 1)
+	copy(header[36:], "acsp")
+	// D50 illuminant of the profile connection space
+	copy(header[68:], iccXYZ(0.9642, 1.0, 0.8249)[8:])
+
+	profile := new(bytes.Buffer)
+	profile.Write(header)
+	profile.Write(table.Bytes())
+	profile.Write(data.Bytes())
+	return profile.Bytes()
+}
+
+func iccXYZ(x, y, z float64) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("XYZ ")
+	buf.Write(make([]byte, 4))
+	for _, v := range []float64{x, y, z} {
+		_ = binary.Write(buf, binary.BigEndian, int32(math.Round(v*65536)))
+	}
+	return buf.Bytes()
+}
+
+func iccText(text string) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("text")
+	buf.Write(make([]byte, 4))
+	buf.WriteString(text)
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+func iccDescription(text string) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("desc")
+	buf.Write(make([]byte, 4))
+	_ = binary.Write(buf, binary.BigEndian, uint32(len(text)+1))
+	buf.WriteString(text)
+	buf.WriteByte(0)
+	// empty unicode and script code descriptions
+	buf.Write(make([]byte, 4+4+2+1+67))
+	return buf.Bytes()
+}
+
+func iccSrgbCurve() []byte {
+	const entries = 1024
+	buf := new(bytes.Buffer)
+	buf.WriteString("curv")
+	buf.Write(make([]byte, 4))
+	_ = binary.Write(buf, binary.BigEndian, uint32(entries))
+	for i := 0; i < entries; i++ {
+		v := float64(i) / (entries - 1)
+		if v <= 0.04045 {
+			v = v / 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		_ = binary.Write(buf, binary.BigEndian, uint16(math.Round(v*65535)))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,252 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const outputCondition = "sRGB IEC61966-2.1"
+
+var (
+	startXrefPattern = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF\s*$`)
+	rootPattern      = regexp.MustCompile(`/Root (\d+) 0 R`)
+)
+
+// NewArchivalPdfFile creates a document that is written after the rules of
+// PDF/A-2b, the variant of PDF meant for long term archiving. The documents
+// are not checked by a validator, so their conformance is not guaranteed.
+func NewArchivalPdfFile() *Document {
+	document := NewPdfFile()
+	document.archival = true
+	return document
+}
+
+// toArchival rewrites a document produced by gofpdf for PDF/A-2b. It adds the
+// binary header comment, the XMP metadata, the sRGB output intent and the file
+// identifier, and writes a new cross-reference table for the shifted objects.
+func toArchival(original []byte, info Info, w io.Writer) error {
+	match := startXrefPattern.FindSubmatch(original)
+	if match == nil {
+		return fmt.Errorf("pdf without cross-reference table")
+	}
+	xrefOffset, err := strconv.Atoi(string(match[1]))
+	if err != nil || xrefOffset >= len(original) {
+		return fmt.Errorf("pdf cross-reference table out of the document")
+	}
+	offsets, err := readXref(original[xrefOffset:])
+	if err != nil {
+		return err
+	}
+	trailer := original[xrefOffset:]
+	rootMatch := rootPattern.FindSubmatch(trailer)
+	if rootMatch == nil {
+		return fmt.Errorf("pdf trailer without root")
+	}
+	root, _ := strconv.Atoi(string(rootMatch[1]))
+	if root <= 0 || root >= len(offsets) {
+		return fmt.Errorf("pdf root %d not in the cross-reference table", root)
+	}
+	catalog, err := objectDictionary(original, offsets[root])
+	if err != nil {
+		return err
+	}
+
+	headerEnd := bytes.IndexByte(original, '\n') + 1
+	out := new(bytes.Buffer)
+	out.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	shift := out.Len() - headerEnd
+	for i := range offsets {
+		offsets[i] += shift
+	}
+	out.Write(original[headerEnd:xrefOffset])
+
+	newObject := func() int {
+		offsets = append(offsets, out.Len())
+		number := len(offsets) - 1
+		out.WriteString(fmt.Sprintf("%d 0 obj\n", number))
+		return number
+	}
+
+	metadata := newObject()
+	xmp := xmpMetadata(info)
+	out.WriteString(fmt.Sprintf("<</Type /Metadata /Subtype /XML /Length %d>>\nstream\n", len(xmp)))
+	out.Write(xmp)
+	out.WriteString("\nendstream\nendobj\n")
+
+	profile := newObject()
+	compressed := new(bytes.Buffer)
+	zw := zlib.NewWriter(compressed)
+	if _, err := zw.Write(srgbProfile()); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	out.WriteString(fmt.Sprintf("<</N 3 /Filter /FlateDecode /Length %d>>\nstream\n", compressed.Len()))
+	out.Write(compressed.Bytes())
+	out.WriteString("\nendstream\nendobj\n")
+
+	intent := newObject()
+	out.WriteString(fmt.Sprintf("<</Type /OutputIntent /S /GTS_PDFA1 /OutputConditionIdentifier (%s) /Info (%s) /DestOutputProfile %d 0 R>>\nendobj\n",
+		outputCondition, outputCondition, profile))
+
+	// the information dictionary and the catalog are written again, the
+	// original ones are left unreferenced
+	newInfo := newObject()
+	out.WriteString(fmt.Sprintf("<<%s>>\nendobj\n", infoDictionary(info)))
+
+	newRoot := newObject()
+	out.WriteString(fmt.Sprintf("<<%s\n/Metadata %d 0 R\n/OutputIntents [%d 0 R]\n>>\nendobj\n", catalog, metadata, intent))
+
+	startXref := out.Len()
+	out.WriteString(fmt.Sprintf("xref\n0 %d\n", len(offsets)))
+	out.WriteString("0000000000 65535 f \n")
+	for _, offset := range offsets[1:] {
+		out.WriteString(fmt.Sprintf("%010d 00000 n \n", offset))
+	}
+	id := md5.Sum(out.Bytes())
+	out.WriteString("trailer\n<<\n")
+	out.WriteString(fmt.Sprintf("/Size %d\n/Root %d 0 R\n/Info %d 0 R\n", len(offsets), newRoot, newInfo))
+	out.WriteString(fmt.Sprintf("/ID [<%x> <%x>]\n", id, id))
+	out.WriteString(fmt.Sprintf(">>\nstartxref\n%d\n%%%%EOF\n", startXref))
+
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// readXref parses a cross-reference table with a single subsection, as written
+// by gofpdf. The returned slice is indexed by object number.
+func readXref(data []byte) ([]int, error) {
+	lines := strings.Split(string(data), "\n")
+	if len(lines) < 3 || strings.TrimSpace(lines[0]) != "xref" {
+		return nil, fmt.Errorf("malformed cross-reference table")
+	}
+	var first, count int
+	if _, err := fmt.Sscanf(lines[1], "%d %d", &first, &count); err != nil || first != 0 || count < 1 || len(lines) < count+2 {
+		return nil, fmt.Errorf("malformed cross-reference subsection")
+	}
+	offsets := make([]int, count)
+	for i := 1; i < count; i++ {
+		// blank or truncated lines have no offset
+		fields := strings.Fields(lines[i+2])
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("malformed cross-reference entry %d", i)
+		}
+		offset, err := strconv.Atoi(fields[0])
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("malformed cross-reference entry %d", i)
+		}
+		offsets[i] = offset
+	}
+	return offsets, nil
+}
+
+// objectDictionary returns the entries of the dictionary object at the offset,
+// without the enclosing angle brackets.
+func objectDictionary(data []byte, offset int) (string, error) {
+	if offset >= len(data) {
+		return "", fmt.Errorf("object offset %d out of the document", offset)
+	}
+	object := data[offset:]
+	end := bytes.Index(object, []byte("endobj"))
+	start := bytes.Index(object, []byte("<<"))
+	if end < 0 || start < 0 || start > end {
+		return "", fmt.Errorf("malformed object at offset %d", offset)
+	}
+	dictionary := bytes.TrimSpace(object[start:end])
+	if !bytes.HasSuffix(dictionary, []byte(">>")) {
+		return "", fmt.Errorf("object at offset %d is not a dictionary", offset)
+	}
+	return string(dictionary[2 : len(dictionary)-2]), nil
+}
+
+// infoDictionary holds the same values as the one written by gofpdf, but with
+// the time zone of the creation date, so it unambiguously matches the XMP date.
+func infoDictionary(info Info) string {
+	entries := new(bytes.Buffer)
+	for _, entry := range []struct{ key, value string }{
+		{"Title", info.Title},
+		{"Author", info.Author},
+		{"Subject", info.Subject},
+		{"Keywords", info.Keywords},
+		{"Creator", info.Producer},
+		{"Producer", info.Producer},
+	} {
+		if entry.value != "" {
+			entries.WriteString(fmt.Sprintf("/%s %s\n", entry.key, textString(entry.value)))
+		}
+	}
+	_, offset := info.CreationDate.Zone()
+	zone := "Z"
+	if offset != 0 {
+		sign := "+"
+		if offset < 0 {
+			sign, offset = "-", -offset
+		}
+		zone = fmt.Sprintf("%s%02d'%02d'", sign, offset/3600, offset%3600/60)
+	}
+	entries.WriteString(fmt.Sprintf("/CreationDate (D:%s%s)\n", info.CreationDate.Format("20060102150405"), zone))
+	return entries.String()
+}
+
+// textString encodes the text as UTF-16 hexadecimal string with byte order mark.
+func textString(text string) string {
+	encoded := new(bytes.Buffer)
+	encoded.WriteString("<FEFF")
+	for _, unit := range utf16.Encode([]rune(text)) {
+		encoded.WriteString(fmt.Sprintf("%04X", unit))
+	}
+	encoded.WriteString(">")
+	return encoded.String()
+}
+
+// xmpMetadata describes the document with the same values as its information
+// dictionary, which PDF/A requires to be kept in sync.
+func xmpMetadata(info Info) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	buf.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	buf.WriteString("<rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	buf.WriteString("<rdf:Description rdf:about=\"\"\n")
+	buf.WriteString(" xmlns:pdfaid=\"http://www.aiim.org/pdfa/ns/id/\"\n")
+	buf.WriteString(" xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n")
+	buf.WriteString(" xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\"\n")
+	buf.WriteString(" xmlns:pdf=\"http://ns.adobe.com/pdf/1.3/\">\n")
+	buf.WriteString("<pdfaid:part>2</pdfaid:part>\n")
+	buf.WriteString("<pdfaid:conformance>B</pdfaid:conformance>\n")
+	buf.WriteString(fmt.Sprintf("<xmp:CreateDate>%s</xmp:CreateDate>\n", info.CreationDate.Format(time.RFC3339)))
+	if info.Title != "" {
+		buf.WriteString(fmt.Sprintf("<dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:title>\n", escapeXml(info.Title)))
+	}
+	if info.Author != "" {
+		buf.WriteString(fmt.Sprintf("<dc:creator><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:creator>\n", escapeXml(info.Author)))
+	}
+	if info.Subject != "" {
+		buf.WriteString(fmt.Sprintf("<dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>\n", escapeXml(info.Subject)))
+	}
+	if info.Keywords != "" {
+		buf.WriteString(fmt.Sprintf("<pdf:Keywords>%s</pdf:Keywords>\n", escapeXml(info.Keywords)))
+	}
+	if info.Producer != "" {
+		buf.WriteString(fmt.Sprintf("<pdf:Producer>%s</pdf:Producer>\n", escapeXml(info.Producer)))
+		buf.WriteString(fmt.Sprintf("<xmp:CreatorTool>%s</xmp:CreatorTool>\n", escapeXml(info.Producer)))
+	}
+	buf.WriteString("</rdf:Description>\n</rdf:RDF>\n</x:xmpmeta>\n")
+	buf.WriteString("<?xpacket end=\"w\"?>")
+	return buf.Bytes()
+}
+
+func escapeXml(s string) string {
+	buf := new(bytes.Buffer)
+	_ = xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
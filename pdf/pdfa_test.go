@@ -0,0 +1,149 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var objectPattern = regexp.MustCompile(`^(\d+) 0 obj`)
+
+// archivalDocument writes a PDF/A document with the pages.
+func archivalDocument(t *testing.T, pages int, info Info) []byte {
+	document := NewArchivalPdfFile()
+	document.SetInfo(info)
+	for i := 0; i < pages; i++ {
+		if err := document.AddDecodedImage(image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := new(bytes.Buffer)
+	if err := document.Generate(out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestToArchival(t *testing.T) {
+	creation := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	tests := []struct {
+		name  string
+		pages int
+		info  Info
+	}{
+		{"one page", 1, Info{CreationDate: creation}},
+		{"pages with info", 3, Info{Title: "Invoice", Author: "Zoë", Subject: "a < b", Keywords: "scan",
+			Producer: "scanpi", CreationDate: creation}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := archivalDocument(t, test.pages, test.info)
+			if !bytes.HasPrefix(data, []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")) {
+				t.Errorf("header is %q", data[:20])
+			}
+
+			match := startXrefPattern.FindSubmatch(data)
+			if match == nil {
+				t.Fatal("no startxref")
+			}
+			xrefOffset, _ := strconv.Atoi(string(match[1]))
+			offsets, err := readXref(data[xrefOffset:])
+			if err != nil {
+				t.Fatalf("readXref() error = %v", err)
+			}
+			// every entry of the new table points to its object
+			for number := 1; number < len(offsets); number++ {
+				object := objectPattern.FindSubmatch(data[offsets[number]:])
+				if object == nil || string(object[1]) != strconv.Itoa(number) {
+					t.Errorf("object %d is not at offset %d", number, offsets[number])
+				}
+			}
+
+			trailer := string(data[xrefOffset:])
+			for _, pattern := range []string{
+				fmt.Sprintf(`/Size %d\b`, len(offsets)),
+				`/Info \d+ 0 R`,
+				`/ID \[<[0-9a-f]{32}> <[0-9a-f]{32}>\]`,
+			} {
+				if !regexp.MustCompile(pattern).MatchString(trailer) {
+					t.Errorf("trailer does not match %s:\n%s", pattern, trailer)
+				}
+			}
+			root, _ := strconv.Atoi(rootPattern.FindStringSubmatch(trailer)[1])
+			catalog, err := objectDictionary(data, offsets[root])
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pattern := range []string{`/Type /Catalog`, `/Pages \d+ 0 R`, `/Metadata \d+ 0 R`, `/OutputIntents \[\d+ 0 R\]`} {
+				if !regexp.MustCompile(pattern).MatchString(catalog) {
+					t.Errorf("catalog does not match %s: %s", pattern, catalog)
+				}
+			}
+			if pages := bytes.Count(data, []byte("/Type /Page\n")); pages != test.pages {
+				t.Errorf("document has %d pages, want %d", pages, test.pages)
+			}
+			if !bytes.Contains(data, []byte("/CreationDate (D:20240102030405+01'00')")) {
+				t.Error("creation date without time zone")
+			}
+		})
+	}
+}
+
+func TestToArchivalFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+	}{
+		{"no cross-reference table", "%PDF-1.3\n1 0 obj\n<<>>\nendobj\n%%EOF\n"},
+		{"malformed table", "%PDF-1.3\nxref\nnonsense\ntrailer\n<<>>\nstartxref\n9\n%%EOF\n"},
+		{"no root", "%PDF-1.3\nxref\n0 1\n0000000000 65535 f \ntrailer\n<</Size 1>>\nstartxref\n9\n%%EOF\n"},
+		// the cross-reference table is read from the offset after startxref
+		{"blank entry", "%PDF-1.3\nxref\n0 3\n0000000000 65535 f \n\n\ntrailer\n<</Root 1 0 R>>\nstartxref\n9\n%%EOF\n"},
+		{"truncated table", "%PDF-1.3\nxref\n0 3\n0000000000 65535 f \n\nstartxref\n9\n%%EOF\n"},
+		{"negative count", "%PDF-1.3\nxref\n0 -1\ntrailer\n<</Root 1 0 R>>\nstartxref\n9\n%%EOF\n"},
+		{"table after the end", "%PDF-1.3\nxref\n0 1\n0000000000 65535 f \nstartxref\n9999\n%%EOF\n"},
+		{"root out of the table", "%PDF-1.3\nxref\n0 2\n0000000000 65535 f \n0000000009 00000 n \ntrailer\n<</Root 5 0 R>>\nstartxref\n9\n%%EOF\n"},
+		{"root after the end", "%PDF-1.3\nxref\n0 2\n0000000000 65535 f \n0000009999 00000 n \ntrailer\n<</Root 1 0 R>>\nstartxref\n9\n%%EOF\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := toArchival([]byte(test.original), Info{}, new(bytes.Buffer)); err == nil {
+				t.Error("toArchival() did not fail")
+			}
+		})
+	}
+}
+
+func TestReadXref(t *testing.T) {
+	tests := []struct {
+		name    string
+		xref    string
+		want    []int
+		wantErr bool
+	}{
+		{"objects", "xref\n0 3\n0000000000 65535 f \n0000000009 00000 n \n0000000074 00000 n \ntrailer\n", []int{0, 9, 74}, false},
+		{"carriage returns", "xref\r\n0 2\r\n0000000000 65535 f\r\n0000000015 00000 n\r\ntrailer\r\n", []int{0, 15}, false},
+		{"not a table", "trailer\n<<>>\n", nil, true},
+		{"subsection not from zero", "xref\n1 1\n0000000009 00000 n \n", nil, true},
+		{"too few entries", "xref\n0 3\n0000000000 65535 f \n", nil, true},
+		{"malformed entry", "xref\n0 2\n0000000000 65535 f \nnine 00000 n \n", nil, true},
+		{"blank entry", "xref\n0 3\n0000000000 65535 f \n\n0000000074 00000 n \n", nil, true},
+		{"negative offset", "xref\n0 2\n0000000000 65535 f \n-9 00000 n \n", nil, true},
+		{"negative count", "xref\n0 -2\n", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readXref([]byte(test.xref))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("readXref() error = %v, want error %v", err, test.wantErr)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("readXref() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -1,14 +1,39 @@
 package pdf
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/jung-kurt/gofpdf"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"io"
+	"os"
 	"path"
+	"strings"
+	"time"
+)
+
+const (
+	pageWidth  = 210
+	pageHeight = 295
 )
 
 type Document struct {
-	file *gofpdf.Fpdf
+	file     *gofpdf.Fpdf
+	info     Info
+	archival bool
+}
+
+// Info holds the values written to the document information dictionary.
+type Info struct {
+	Title        string
+	Author       string
+	Subject      string
+	Keywords     string
+	Producer     string
+	CreationDate time.Time
 }
 
 func NewPdfFile() *Document {
@@ -17,17 +42,129 @@ func NewPdfFile() *Document {
 	}
 }
 
+func (d *Document) SetInfo(info Info) {
+	d.info = info
+	// empty values are skipped, gofpdf would write a lonely byte order mark otherwise
+	if info.Title != "" {
+		d.file.SetTitle(info.Title, true)
+	}
+	if info.Author != "" {
+		d.file.SetAuthor(info.Author, true)
+	}
+	if info.Subject != "" {
+		d.file.SetSubject(info.Subject, true)
+	}
+	if info.Keywords != "" {
+		d.file.SetKeywords(info.Keywords, true)
+	}
+	if info.Producer != "" {
+		d.file.SetProducer(info.Producer, true)
+		d.file.SetCreator(info.Producer, true)
+	}
+	if info.CreationDate.IsZero() {
+		d.info.CreationDate = time.Now()
+	}
+	d.file.SetCreationDate(d.info.CreationDate)
+}
+
+// AddImage adds a page with the image stored on disk, which is either jpeg or
+// png.
 func (d *Document) AddImage(imagePath string) error {
-	imageType := path.Ext(imagePath)[1:]
+	imageType := strings.TrimPrefix(path.Ext(imagePath), ".")
+	if imageType != "jpeg" && imageType != "png" {
+		return fmt.Errorf("image format '%s' not supported", imageType)
+	}
+	d.file.AddPage()
+	options := gofpdf.ImageOptions{ImageType: imageType, ReadDpi: true, AllowNegativePosition: false}
+	d.file.ImageOptions(imagePath, 0, 0, pageWidth, pageHeight, false, options, 0, "")
+	return d.file.Error()
+}
+
+// AddImageData adds a page with an image that is not stored on disk, like a
+// converted scan. The image type is either jpeg or png.
+func (d *Document) AddImageData(r io.Reader, imageType string) error {
 	if imageType != "jpeg" && imageType != "png" {
 		return fmt.Errorf("image format '%s' not supported", imageType)
 	}
 	d.file.AddPage()
-	options := gofpdf.ImageOptions{ImageType: "jpeg", ReadDpi: true, AllowNegativePosition: false}
-	d.file.ImageOptions(imagePath, 0, 0, 210, 295, false, options, 0, "")
-	return nil
+	name := fmt.Sprintf("page%d", d.file.PageNo())
+	options := gofpdf.ImageOptions{ImageType: imageType, ReadDpi: true, AllowNegativePosition: false}
+	d.file.RegisterImageOptionsReader(name, options, r)
+	d.file.ImageOptions(name, 0, 0, pageWidth, pageHeight, false, options, 0, "")
+	return d.file.Error()
+}
+
+// AddDecodedImage adds a page with an image that is only decoded, like a page
+// of a stored pdf document. It is embedded losslessly as png.
+func (d *Document) AddDecodedImage(img image.Image) error {
+	switch img.(type) {
+	case *image.Gray, *image.NRGBA, *image.RGBA, *image.Paletted:
+	default:
+		// 16 bit samples are not supported by the pdf documents
+		bounds := img.Bounds()
+		var eightBit draw.Image = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		if img.ColorModel() == color.Gray16Model {
+			eightBit = image.NewGray(eightBit.Bounds())
+		}
+		draw.Draw(eightBit, eightBit.Bounds(), img, bounds.Min, draw.Src)
+		img = eightBit
+	}
+	buffer := new(bytes.Buffer)
+	if err := png.Encode(buffer, img); err != nil {
+		return err
+	}
+	return d.AddImageData(buffer, "png")
+}
+
+// AddText lays the words of a hOCR file as invisible text over the last added
+// image, which makes the page searchable and its text copyable.
+func (d *Document) AddText(hocrPath string) error {
+	file, err := os.Open(hocrPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", hocrPath, err)
+	}
+	defer file.Close()
+
+	page, err := parseHocr(file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", hocrPath, err)
+	}
+
+	scaleX := pageWidth / page.width
+	scaleY := pageHeight / page.height
+	translate := d.file.UnicodeTranslatorFromDescriptor("")
+	// rendering mode 3 neither fills nor strokes the glyphs
+	d.file.RawWriteStr("3 Tr")
+	for _, word := range page.words {
+		text := translate(word.text)
+		height := (word.y1 - word.y0) * scaleY
+		width := (word.x1 - word.x0) * scaleX
+		if height <= 0 || width <= 0 {
+			continue
+		}
+		d.file.SetFont("Helvetica", "", height*72/25.4)
+		naturalWidth := d.file.GetStringWidth(text)
+		if naturalWidth <= 0 {
+			continue
+		}
+		// stretch the glyphs horizontally so the selection matches the word box
+		d.file.RawWriteStr(fmt.Sprintf("%.2f Tz", width/naturalWidth*100))
+		d.file.Text(word.x0*scaleX, word.y1*scaleY-height*0.2, text)
+	}
+	d.file.RawWriteStr("100 Tz 0 Tr")
+	return d.file.Error()
 }
 
 func (d *Document) Generate(w io.Writer) error {
-	return d.file.Output(w)
+	if !d.archival {
+		return d.file.Output(w)
+	}
+	if d.info.CreationDate.IsZero() {
+		d.SetInfo(d.info)
+	}
+	buf := new(bytes.Buffer)
+	if err := d.file.Output(buf); err != nil {
+		return err
+	}
+	return toArchival(buf.Bytes(), d.info, w)
 }
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/adelolmo/scanpi/fsutils"
+	"github.com/adelolmo/scanpi/graphic"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The functions in this file do what both the pages and the api ask for, so
+// they behave the same. They record who did what in the activity log.
+
+var errSameJob = errors.New("cannot merge or move pages into the same job")
+var errInvalidSettings = errors.New("invalid settings")
+var errScanNotFound = fmt.Errorf("scan not found: %w", os.ErrNotExist)
+
+// scanHistory is the number of latest scans whose status is kept.
+const scanHistory = 50
+
+// scanStatus is a scan started in background.
+type scanStatus struct {
+	Id      string `json:"id"`
+	JobName string `json:"job"`
+	// LinkName is the page the scan is stored as, once done
+	LinkName string     `json:"page,omitempty"`
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+const (
+	scanRunning = "scanning"
+	scanDone    = "done"
+	scanFailed  = "failed"
+)
+
+var scansMutex sync.Mutex
+var scans []*scanStatus
+
+// createJob creates the job, it tells whether it existed already.
+func createJob(user, jobName string) (bool, error) {
+	if len(jobName) == 0 {
+		return false, fmt.Errorf("%w: job name cannot be empty", fsutils.ErrInvalidName)
+	}
+	jobPath, err := resolver.JobPath(jobName)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(jobPath); err == nil {
+		return false, nil
+	}
+	if err := os.MkdirAll(jobPath, os.ModePerm); err != nil {
+		return false, err
+	}
+	recordActivity(user, "created job %q", jobName)
+	return true, nil
+}
+
+// deleteJob moves the job to the trash.
+func deleteJob(user, jobName string) error {
+	if err := trash.DeleteJob(jobName); err != nil {
+		return err
+	}
+	recordActivity(user, "deleted job %q", jobName)
+	return nil
+}
+
+func renameJob(user, currentJobName, newJobName string) error {
+	currentJobPath, err := resolver.Job(currentJobName)
+	if err != nil {
+		return err
+	}
+	newJobPath, err := resolver.JobPath(newJobName)
+	if err != nil {
+		return err
+	}
+	if currentJobPath == newJobPath {
+		return nil
+	}
+
+	// renaming onto an empty job would silently replace it
+	if _, err := os.Stat(newJobPath); err == nil {
+		return fmt.Errorf("%w: '%s', merge the jobs instead", fsutils.ErrJobExists, newJobName)
+	}
+	if err := os.Rename(currentJobPath, newJobPath); err != nil {
+		if errors.Unwrap(err) == syscall.EEXIST {
+			return fmt.Errorf("%w: '%s', merge the jobs instead", fsutils.ErrJobExists, newJobName)
+		}
+		return err
+	}
+	recordActivity(user, "renamed job %q to %q", currentJobName, newJobName)
+	return nil
+}
+
+// mergeJob moves every page of the job to the end of the target job, and
+// removes the emptied job.
+func mergeJob(user, jobName, targetJobName string) error {
+	if jobName == targetJobName {
+		return errSameJob
+	}
+	targetJobPath, err := resolver.Job(targetJobName)
+	if err != nil {
+		return err
+	}
+	jobPath, err := resolver.Job(jobName)
+	if err != nil {
+		return err
+	}
+	scans, err := listJobImages(jobName)
+	if err != nil {
+		return err
+	}
+
+	var linkPaths []string
+	for _, scan := range scans {
+		linkPaths = append(linkPaths, path.Join(jobPath, scan.LinkName))
+	}
+	if err := transferLinks(targetJobPath, linkPaths, false); err != nil {
+		return err
+	}
+	if err := os.Remove(jobPath); err != nil {
+		return errors.New(fmt.Sprintf("unable to remove merged job '%s'. Error: %s", jobName, err))
+	}
+	recordActivity(user, "merged job %q into %q", jobName, targetJobName)
+	return nil
+}
+
+// transferPages moves, or copies when keepSource is set, the pages to the end
+// of the target job.
+func transferPages(user, jobName, targetJobName string, linkNames []string, keepSource bool) error {
+	if jobName == targetJobName {
+		return errSameJob
+	}
+	targetJobPath, err := resolver.Job(targetJobName)
+	if err != nil {
+		return err
+	}
+
+	var linkPaths []string
+	for _, linkName := range linkNames {
+		linkPath, err := resolver.Scan(jobName, linkName)
+		if err != nil {
+			return err
+		}
+		linkPaths = append(linkPaths, linkPath)
+	}
+	if err := transferLinks(targetJobPath, linkPaths, keepSource); err != nil {
+		return err
+	}
+	for _, linkName := range linkNames {
+		if keepSource {
+			recordActivity(user, "copied page %q of job %q to %q", linkName, jobName, targetJobName)
+		} else {
+			recordActivity(user, "moved page %q of job %q to %q", linkName, jobName, targetJobName)
+		}
+	}
+	return nil
+}
+
+// transferLinks transfers the pages of the links to the end of the target job,
+// all of them or none. The target is checked first, and when a page fails
+// anyway the pages already transferred are taken back, so the source job
+// stays as it was.
+func transferLinks(targetJobPath string, linkPaths []string, keepSource bool) error {
+	if err := fsutils.CheckTransfer(targetJobPath, linkPaths, keepSource, pageSidecars...); err != nil {
+		return err
+	}
+	var transferred []string
+	for _, linkPath := range linkPaths {
+		linkName, err := fsutils.TransferFileAndLink(linkPath, targetJobPath, keepSource, pageSidecars...)
+		if err != nil {
+			for i := len(transferred) - 1; i >= 0; i-- {
+				targetLinkPath := path.Join(targetJobPath, transferred[i])
+				if undoErr := fsutils.RevertTransfer(targetLinkPath, linkPaths[i], keepSource, pageSidecars...); undoErr != nil {
+					return errors.New(fmt.Sprintf("%s. Pages %s were transferred as %s and cannot be taken back. Error: %s",
+						err, strings.Join(linkBases(linkPaths[:i+1]), ", "), strings.Join(transferred[:i+1], ", "), undoErr))
+				}
+			}
+			return err
+		}
+		transferred = append(transferred, linkName)
+	}
+	return nil
+}
+
+// linkBases returns the link names of the link paths.
+func linkBases(linkPaths []string) []string {
+	names := make([]string, 0, len(linkPaths))
+	for _, linkPath := range linkPaths {
+		names = append(names, path.Base(linkPath))
+	}
+	return names
+}
+
+// deletePage moves the page to the trash.
+func deletePage(user, jobName, linkName string) error {
+	if err := trash.DeletePage(jobName, linkName, pageSidecars...); err != nil {
+		return err
+	}
+	recordActivity(user, "deleted page %q of job %q", linkName, jobName)
+	return nil
+}
+
+// reorderPages numbers the pages of the job again in the order given, which
+// lists every page of the job.
+func reorderPages(user, jobName string, linkNames []string) error {
+	jobPath, err := resolver.Job(jobName)
+	if err != nil {
+		return err
+	}
+	if err := fsutils.ReorderLinks(jobPath, linkNames, pageSidecars...); err != nil {
+		return err
+	}
+	recordActivity(user, "reordered the pages of job %q", jobName)
+	return nil
+}
+
+// startScan scans a page into the job with the current settings. The scan
+// runs in background, its status tells when the page is stored.
+func startScan(user, jobName string) (scanStatus, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return scanStatus{}, err
+	}
+
+	settings := readSettings()
+	resolution, _ := strconv.Atoi(settings.Resolution)
+	format := graphic.ToFormat(settings.Format)
+	imageDetails, err := scanTarget(jobName, format)
+	if err != nil {
+		return scanStatus{}, err
+	}
+	scanJob := graphic.NewScanJob(
+		graphic.ToMode(settings.Mode),
+		format,
+		resolution,
+		postProcessor,
+		path.Join(appConfiguration.WorkDirectory, scannerLockFile),
+	)
+	status := &scanStatus{
+		Id:      hex.EncodeToString(id),
+		JobName: jobName,
+		State:   scanRunning,
+		Started: time.Now(),
+	}
+	scansMutex.Lock()
+	scans = append(scans, status)
+	if len(scans) > scanHistory {
+		scans = scans[len(scans)-scanHistory:]
+	}
+	started := *status
+	scansMutex.Unlock()
+
+	scanJob.StartScanning(imageDetails, func(stored graphic.ImageDetails, err error) {
+		scansMutex.Lock()
+		defer scansMutex.Unlock()
+		finished := time.Now()
+		status.Finished = &finished
+		status.State = scanDone
+		if err != nil {
+			status.State = scanFailed
+			status.Error = err.Error()
+			return
+		}
+		status.LinkName = stored.LinkFilename()
+		recordActivity(user, "scanned page %q into job %q", stored.LinkFilename(), jobName)
+	})
+	recordActivity(user, "started scanning into job %q", jobName)
+	return started, nil
+}
+
+// scanTarget returns the details of an image scanned into the job. The
+// scanner names the image and its page once it is its turn.
+func scanTarget(jobName string, format graphic.Format) (graphic.ImageDetails, error) {
+	if _, err := resolver.Job(jobName); err != nil {
+		return graphic.ImageDetails{}, err
+	}
+	return graphic.ImageDetails{
+		Format:        format,
+		Directory:     jobName,
+		BaseDirectory: appConfiguration.OutputDirectory,
+	}, nil
+}
+
+// scanStatuses returns the latest scans, the newest first.
+func scanStatuses() []scanStatus {
+	scansMutex.Lock()
+	defer scansMutex.Unlock()
+	statuses := make([]scanStatus, 0, len(scans))
+	for i := len(scans) - 1; i >= 0; i-- {
+		statuses = append(statuses, *scans[i])
+	}
+	return statuses
+}
+
+func findScanStatus(id string) (scanStatus, error) {
+	scansMutex.Lock()
+	defer scansMutex.Unlock()
+	for _, status := range scans {
+		if status.Id == id {
+			return *status, nil
+		}
+	}
+	return scanStatus{}, errScanNotFound
+}
+
+// saveSettings stores the scan settings once they are valid.
+func saveSettings(user string, settings *settings) error {
+	if err := validateSettings(settings); err != nil {
+		return err
+	}
+	settingsJson, _ := json.Marshal(settings)
+	if err := ioutil.WriteFile(path.Join(appConfiguration.WorkDirectory, "settings.json"), settingsJson, 0644); err != nil {
+		return err
+	}
+	recordActivity(user, "changed the settings to %s %s at %s dpi", settings.Mode, settings.Format, settings.Resolution)
+	return nil
+}
+
+// validateSettings checks the settings against the options of scanimage.
+func validateSettings(settings *settings) error {
+	if settings.Mode != graphic.ToMode(settings.Mode).String() {
+		return fmt.Errorf("%w: unknown mode '%s'", errInvalidSettings, settings.Mode)
+	}
+	if format := graphic.ToFormat(settings.Format); format == graphic.Pdf || settings.Format != format.String() {
+		return fmt.Errorf("%w: unknown format '%s'", errInvalidSettings, settings.Format)
+	}
+	if resolution, err := strconv.Atoi(settings.Resolution); err != nil || resolution < 1 {
+		return fmt.Errorf("%w: invalid resolution '%s'", errInvalidSettings, settings.Resolution)
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/adelolmo/scanpi/graphic"
+	"github.com/adelolmo/scanpi/logger"
+	"github.com/disintegration/imaging"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// stagedPage is a photo waiting for its corners to be confirmed before the
+// rectified page is added to the job.
+type stagedPage struct {
+	Id           string                `json:"id"`
+	JobName      string                `json:"jobName"`
+	Width        int                   `json:"width"`
+	Height       int                   `json:"height"`
+	Corners      graphic.Quadrilateral `json:"corners"`
+	DocumentMode bool                  `json:"documentMode"`
+	Created      time.Time             `json:"created"`
+}
+
+type pageStaging struct {
+	Navigation string
+	Page       stagedPage
+}
+
+const (
+	stagedPhoto       = "photo"
+	stagedPreview     = "preview.jpeg"
+	stagedDescription = "page.json"
+	previewSize       = 1000
+	// stagedPhotoLifetime is how long a photo waits for its corners to be
+	// confirmed before it is discarded
+	stagedPhotoLifetime = 7 * 24 * time.Hour
+)
+
+var stagingIdPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+func stagingDirectory() string {
+	return path.Join(appConfiguration.WorkDirectory, "staging")
+}
+
+// stagePhoto stores the photo in the staging area and detects the document on
+// it. The corners are expressed in pixels of the photo once rotated by its EXIF
+// orientation.
+func stagePhoto(jobName string, r io.Reader) (*stagedPage, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	page := &stagedPage{
+		Id:      hex.EncodeToString(id),
+		JobName: jobName,
+		Created: time.Now(),
+	}
+	pageDirectory := path.Join(stagingDirectory(), page.Id)
+	if err := os.MkdirAll(pageDirectory, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	photoPath := path.Join(pageDirectory, stagedPhoto)
+	photo, err := os.Create(photoPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(photo, r); err != nil {
+		photo.Close()
+		return nil, err
+	}
+	if err := photo.Close(); err != nil {
+		return nil, err
+	}
+
+	img, err := graphic.OpenPhoto(photoPath, appConfiguration.MemoryLimit)
+	if err != nil {
+		os.RemoveAll(pageDirectory)
+		return nil, errors.New(fmt.Sprintf("unable to decode photo. Error: %s", err))
+	}
+	page.Width, page.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	page.Corners = graphic.DetectDocument(img)
+	logger.Info("document detected at %v on photo %s", page.Corners, page.Id)
+
+	preview := imaging.Fit(img, previewSize, previewSize, imaging.Lanczos)
+	if err := imaging.Save(preview, path.Join(pageDirectory, stagedPreview), imaging.JPEGQuality(85)); err != nil {
+		os.RemoveAll(pageDirectory)
+		return nil, err
+	}
+	if err := saveStagedPage(page); err != nil {
+		os.RemoveAll(pageDirectory)
+		return nil, err
+	}
+	return page, nil
+}
+
+// purgeStaging discards the photos staged longer ago than their lifetime,
+// along with what is left of the photos that failed to be staged.
+func purgeStaging() error {
+	entries, err := ioutil.ReadDir(stagingDirectory())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !stagingIdPattern.MatchString(entry.Name()) {
+			continue
+		}
+		created := entry.ModTime()
+		if page, err := readStagedPage(entry.Name()); err == nil {
+			created = page.Created
+		}
+		if time.Since(created) < stagedPhotoLifetime {
+			continue
+		}
+		logger.Info("discard photo %s staged on %s", entry.Name(), created.Format("2006-01-02 15:04"))
+		if err := os.RemoveAll(path.Join(stagingDirectory(), entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readStagedPage(id string) (*stagedPage, error) {
+	if !stagingIdPattern.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	file, err := ioutil.ReadFile(path.Join(stagingDirectory(), id, stagedDescription))
+	if err != nil {
+		return nil, err
+	}
+	page := &stagedPage{}
+	if err := json.Unmarshal(file, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func saveStagedPage(page *stagedPage) error {
+	pageJson, _ := json.Marshal(page)
+	return ioutil.WriteFile(path.Join(stagingDirectory(), page.Id, stagedDescription), pageJson, 0644)
+}
+
+// stagedPages returns the pages of the job waiting for confirmation, oldest
+// first.
+func stagedPages(jobName string) []stagedPage {
+	entries, err := ioutil.ReadDir(stagingDirectory())
+	if err != nil {
+		return nil
+	}
+	var pages []stagedPage
+	for _, entry := range entries {
+		page, err := readStagedPage(entry.Name())
+		if err != nil || page.JobName != jobName {
+			continue
+		}
+		pages = append(pages, *page)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].Created.Before(pages[j].Created)
+	})
+	return pages
+}
+
+// redirectToNextStagedPage continues with the next photo of the job waiting
+// for confirmation, or goes back to the job when there is none.
+func redirectToNextStagedPage(w http.ResponseWriter, r *http.Request, jobName string) {
+	location := "/job?jobName=" + url.QueryEscape(jobName)
+	if pages := stagedPages(jobName); len(pages) > 0 {
+		location = "/staging?id=" + pages[0].Id
+	}
+	redirect(w, r, location)
+}
+
+func stagingPage(w http.ResponseWriter, r *http.Request) {
+	page, err := readStagedPage(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "staged photo not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	if err := render(w, r, stagingTemplate, &pageStaging{Navigation: "jobs", Page: *page}); err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func stagingPhotoHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := readStagedPage(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "staged photo not found", http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, path.Join(stagingDirectory(), page.Id, stagedPreview))
+}
+
+func stagingCornersHandler(w http.ResponseWriter, r *http.Request) {
+	// the body holds the corners, the id is only taken from the query
+	page, err := readStagedPage(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "staged photo not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var update struct {
+			Corners      *graphic.Quadrilateral `json:"corners"`
+			DocumentMode *bool                  `json:"documentMode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if update.Corners != nil {
+			for _, corner := range update.Corners {
+				if corner.X < 0 || corner.Y < 0 || corner.X >= page.Width || corner.Y >= page.Height {
+					http.Error(w, fmt.Sprintf("corner %d,%d outside of the photo", corner.X, corner.Y), http.StatusBadRequest)
+					return
+				}
+			}
+			page.Corners = *update.Corners
+		}
+		if update.DocumentMode != nil {
+			page.DocumentMode = *update.DocumentMode
+		}
+		if err := saveStagedPage(page); err != nil {
+			fmt.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// stagingCommitHandler rectifies the photo with the confirmed corners and
+// adds it to the job.
+func stagingCommitHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := readStagedPage(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "staged photo not found", http.StatusNotFound)
+		return
+	}
+	if _, err := resolver.Job(page.JobName); err != nil {
+		resolveError(w, err)
+		return
+	}
+	pageDirectory := path.Join(stagingDirectory(), page.Id)
+
+	img, err := graphic.OpenPhoto(path.Join(pageDirectory, stagedPhoto), appConfiguration.MemoryLimit)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rectified, err := graphic.Rectify(img, page.Corners, appConfiguration.MemoryLimit)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if page.DocumentMode {
+		rectified = graphic.DocumentMode(rectified)
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := imaging.Encode(buffer, rectified, imaging.JPEG, imaging.JPEGQuality(90)); err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Info("commit photo %s into %s", page.Id, page.JobName)
+	if err := importImage(page.JobName, graphic.Jpeg, buffer); err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.RemoveAll(pageDirectory); err != nil {
+		logger.Error(fmt.Sprintf("unable to remove staged photo %s. Error: %s", page.Id, err))
+	}
+	recordActivity(userName(r), "added a photo to job %q", page.JobName)
+
+	redirectToNextStagedPage(w, r, page.JobName)
+}
+
+func stagingDiscardHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := readStagedPage(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "staged photo not found", http.StatusNotFound)
+		return
+	}
+	logger.Info("discard photo %s of %s", page.Id, page.JobName)
+	if err := os.RemoveAll(path.Join(stagingDirectory(), page.Id)); err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	redirectToNextStagedPage(w, r, page.JobName)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPurgeStaging(t *testing.T) {
+	_, closePools := setUpJob(t, "job")
+	closePools()
+	old := time.Now().Add(-stagedPhotoLifetime - time.Hour)
+	for _, staged := range []struct {
+		id      string
+		created time.Time
+		// broken entries have no description, their age is the one of the
+		// directory
+		broken bool
+	}{
+		{"0000000000000001", time.Now(), false},
+		{"0000000000000002", old, false},
+		{"0000000000000003", time.Now(), true},
+		{"0000000000000004", old, true},
+		{"not-a-staged-id", old, true},
+	} {
+		if err := os.MkdirAll(path.Join(stagingDirectory(), staged.id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if !staged.broken {
+			if err := saveStagedPage(&stagedPage{Id: staged.id, JobName: "job", Created: staged.created}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Chtimes(path.Join(stagingDirectory(), staged.id), staged.created, staged.created); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := purgeStaging(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(stagingDirectory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	sort.Strings(left)
+	want := []string{"0000000000000001", "0000000000000003", "not-a-staged-id"}
+	if !reflect.DeepEqual(left, want) {
+		t.Errorf("left %v, want %v", left, want)
+	}
+}
+
+func TestPurgeStagingWithoutStagedPhotos(t *testing.T) {
+	_, closePools := setUpJob(t, "job")
+	closePools()
+	if err := purgeStaging(); err != nil {
+		t.Errorf("purgeStaging() error = %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package tiffer
+
+import (
+	"bytes"
+	"image"
+)
+
+type bitWriter struct {
+	buf   bytes.Buffer
+	bits  uint32
+	nBits uint
+}
+
+func (b *bitWriter) write(c code) {
+	for i := int(c.length) - 1; i >= 0; i-- {
+		b.bits = b.bits<<1 | (c.bits>>uint(i))&1
+		b.nBits++
+		if b.nBits == 8 {
+			b.buf.WriteByte(byte(b.bits))
+			b.bits, b.nBits = 0, 0
+		}
+	}
+}
+
+func (b *bitWriter) flush() []byte {
+	if b.nBits > 0 {
+		b.buf.WriteByte(byte(b.bits << (8 - b.nBits)))
+		b.bits, b.nBits = 0, 0
+	}
+	return b.buf.Bytes()
+}
+
+func (b *bitWriter) writeRun(length int, black bool) {
+	terminating, makeup := &whiteTerminatingCodes, &whiteMakeupCodes
+	if black {
+		terminating, makeup = &blackTerminatingCodes, &blackMakeupCodes
+	}
+	for length >= 2560+64 {
+		b.write(makeup[len(makeup)-1])
+		length -= 2560
+	}
+	if length >= 64 {
+		b.write(makeup[length/64-1])
+		length %= 64
+	}
+	b.write(terminating[length])
+}
+
+// encodeG4 compresses a bilevel image with the CCITT group 4 (T.6) coding.
+// Pixels darker than the middle gray are black.
+func encodeG4(img *image.Gray) []byte {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	reference := make([]bool, width)
+	line := make([]bool, width)
+	w := &bitWriter{}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, y):]
+		for x := range line {
+			line[x] = row[x] < 0x80
+		}
+
+		a0, black := -1, false
+		for a0 < width {
+			a1 := nextColor(line, a0+1, !black)
+			b1 := nextChange(reference, a0, !black)
+			b2 := nextColor(reference, b1+1, black)
+			switch {
+			case b2 < a1:
+				w.write(passCode)
+				a0 = b2
+			case a1-b1 >= -3 && a1-b1 <= 3:
+				w.write(verticalCodes[a1-b1+3])
+				a0, black = a1, !black
+			default:
+				a2 := nextColor(line, a1+1, black)
+				start := a0
+				if start < 0 {
+					start = 0
+				}
+				w.write(horizontalCode)
+				w.writeRun(a1-start, black)
+				w.writeRun(a2-a1, !black)
+				a0 = a2
+			}
+		}
+		reference, line = line, reference
+	}
+
+	// end of facsimile block
+	w.write(endOfLineCode)
+	w.write(endOfLineCode)
+	return w.flush()
+}
+
+// nextColor returns the first position from start on with the given color, or
+// the width of the line.
+func nextColor(line []bool, start int, black bool) int {
+	for i := start; i < len(line); i++ {
+		if line[i] == black {
+			return i
+		}
+	}
+	return len(line)
+}
+
+// nextChange returns the first changing element to the given color after the
+// position a0. The line is preceded by an imaginary white pixel.
+func nextChange(line []bool, a0 int, black bool) int {
+	for i := a0 + 1; i < len(line); i++ {
+		previous := false
+		if i > 0 {
+			previous = line[i-1]
+		}
+		if line[i] == black && previous != black {
+			return i
+		}
+	}
+	return len(line)
+}
@@ -0,0 +1,117 @@
+package tiffer
+
+import (
+	"bytes"
+	"golang.org/x/image/ccitt"
+	"golang.org/x/image/tiff"
+	"image"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// bilevel returns a black and white image, with the pixels for which black
+// returns true set to black.
+func bilevel(width, height int, black func(x, y int) bool) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if !black(x, y) {
+				img.Pix[y*img.Stride+x] = 0xff
+			}
+		}
+	}
+	return img
+}
+
+func TestEncodeG4(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	noise := make([]bool, 97*31)
+	for i := range noise {
+		noise[i] = random.Intn(2) == 0
+	}
+	tests := []struct {
+		name string
+		img  *image.Gray
+	}{
+		{"white", bilevel(64, 8, func(x, y int) bool { return false })},
+		{"black", bilevel(64, 8, func(x, y int) bool { return true })},
+		{"single row", bilevel(20, 1, func(x, y int) bool { return x%3 == 0 })},
+		{"single column", bilevel(1, 20, func(x, y int) bool { return y%2 == 0 })},
+		{"checkerboard", bilevel(33, 17, func(x, y int) bool { return (x+y)%2 == 0 })},
+		{"stripes", bilevel(40, 10, func(x, y int) bool { return x/4%2 == 1 })},
+		{"diagonal", bilevel(50, 50, func(x, y int) bool { return x > y })},
+		{"text like", bilevel(120, 40, func(x, y int) bool { return y%10 < 3 && x%12 < 9 && x > 5 })},
+		{"runs longer than the makeup codes", bilevel(5200, 3, func(x, y int) bool { return x >= 2600+y })},
+		{"noise", bilevel(97, 31, func(x, y int) bool { return noise[y*97+x] })},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height := test.img.Rect.Dx(), test.img.Rect.Dy()
+			encoded := encodeG4(test.img)
+
+			r := ccitt.NewReader(bytes.NewReader(encoded), ccitt.MSB, ccitt.Group4, width, height, nil)
+			decoded, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("cannot decode: %v", err)
+			}
+			rowBytes := (width + 7) / 8
+			if len(decoded) != rowBytes*height {
+				t.Fatalf("decoded %d bytes, want %d", len(decoded), rowBytes*height)
+			}
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					// the decoder sets the bits of the white pixels
+					white := decoded[y*rowBytes+x/8]&(0x80>>uint(x%8)) != 0
+					if want := test.img.Pix[y*test.img.Stride+x] == 0xff; white != want {
+						t.Fatalf("pixel %d,%d is white %v, want %v", x, y, white, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAddImage(t *testing.T) {
+	img := bilevel(90, 45, func(x, y int) bool { return (x/9+y/5)%2 == 0 })
+	// a gray image that is not bilevel is not compressed with G4
+	gray := image.NewGray(image.Rect(0, 0, 4, 4))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 16)
+	}
+	for _, test := range []struct {
+		name string
+		img  *image.Gray
+	}{
+		{"bilevel", img},
+		{"gray", gray},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			out := new(bytes.Buffer)
+			tiffer := NewTiffer(out)
+			if err := tiffer.AddImage(test.img); err != nil {
+				t.Fatal(err)
+			}
+			if err := tiffer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := tiff.Decode(out)
+			if err != nil {
+				t.Fatalf("tiff.Decode() error = %v", err)
+			}
+			if decoded.Bounds() != test.img.Bounds() {
+				t.Fatalf("page is %v, want %v", decoded.Bounds(), test.img.Bounds())
+			}
+			for y := 0; y < test.img.Rect.Dy(); y++ {
+				for x := 0; x < test.img.Rect.Dx(); x++ {
+					got, _, _, _ := decoded.At(x, y).RGBA()
+					want, _, _, _ := test.img.At(x, y).RGBA()
+					if got>>8 != want>>8 {
+						t.Fatalf("pixel %d,%d is %d, want %d", x, y, got>>8, want>>8)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package tiffer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagBitsPerSample   = 258
+	tagCompression     = 259
+	tagPhotometric     = 262
+	tagStripOffsets    = 273
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagXResolution     = 282
+	tagYResolution     = 283
+	tagT6Options       = 293
+	tagResolutionUnit  = 296
+
+	typeShort    = 3
+	typeLong     = 4
+	typeRational = 5
+
+	compressionG4      = 4
+	compressionDeflate = 8
+
+	photometricWhiteIsZero = 0
+	photometricBlackIsZero = 1
+	photometricRGB         = 2
+
+	// pages are assumed to be as wide as an A4 sheet, the same way the pdf
+	// documents are laid out
+	pageWidthInches = 210 / 25.4
+)
+
+type entry struct {
+	tag    uint16
+	kind   uint16
+	values []uint32
+}
+
+type page struct {
+	entries []entry
+	data    []byte
+}
+
+// TiffWriter writes the added images as pages of a single tiff file. Every page
+// is written out as soon as the next one is added, so only one compressed page
+// is held in memory.
+type TiffWriter struct {
+	w       io.Writer
+	offset  uint32
+	pending *page
+}
+
+func NewTiffer(writer io.Writer) TiffWriter {
+	return TiffWriter{
+		w: writer,
+	}
+}
+
+// AddImage encodes the image as a new page. Bilevel images are compressed with
+// CCITT group 4, gray and color images with deflate.
+func (t *TiffWriter) AddImage(img image.Image) error {
+	bounds := img.Bounds()
+	width, height := uint32(bounds.Dx()), uint32(bounds.Dy())
+	dpi := uint32(math.Round(float64(width) / pageWidthInches))
+	if dpi == 0 {
+		dpi = 1
+	}
+
+	next := &page{
+		entries: []entry{
+			{tagImageWidth, typeLong, []uint32{width}},
+			{tagImageLength, typeLong, []uint32{height}},
+			{tagRowsPerStrip, typeLong, []uint32{height}},
+			{tagXResolution, typeRational, []uint32{dpi, 1}},
+			{tagYResolution, typeRational, []uint32{dpi, 1}},
+			{tagResolutionUnit, typeShort, []uint32{2}},
+		},
+	}
+
+	var err error
+	gray, isGray := img.(*image.Gray)
+	switch {
+	case isGray && isBilevel(gray):
+		next.data = encodeG4(gray)
+		next.entries = append(next.entries,
+			entry{tagBitsPerSample, typeShort, []uint32{1}},
+			entry{tagSamplesPerPixel, typeShort, []uint32{1}},
+			entry{tagCompression, typeShort, []uint32{compressionG4}},
+			entry{tagPhotometric, typeShort, []uint32{photometricWhiteIsZero}},
+			entry{tagT6Options, typeLong, []uint32{0}})
+	case isGray:
+		next.data, err = deflate(gray.Pix[gray.PixOffset(bounds.Min.X, bounds.Min.Y):], gray.Stride, bounds.Dx(), bounds.Dy())
+		next.entries = append(next.entries,
+			entry{tagBitsPerSample, typeShort, []uint32{8}},
+			entry{tagSamplesPerPixel, typeShort, []uint32{1}},
+			entry{tagCompression, typeShort, []uint32{compressionDeflate}},
+			entry{tagPhotometric, typeShort, []uint32{photometricBlackIsZero}})
+	default:
+		next.data, err = deflate(rgb(img), bounds.Dx()*3, bounds.Dx()*3, bounds.Dy())
+		next.entries = append(next.entries,
+			entry{tagBitsPerSample, typeShort, []uint32{8, 8, 8}},
+			entry{tagSamplesPerPixel, typeShort, []uint32{3}},
+			entry{tagCompression, typeShort, []uint32{compressionDeflate}},
+			entry{tagPhotometric, typeShort, []uint32{photometricRGB}})
+	}
+	if err != nil {
+		return err
+	}
+
+	if t.pending == nil {
+		if err := t.writeHeader(); err != nil {
+			return err
+		}
+	} else if err := t.writePage(t.pending, true); err != nil {
+		return err
+	}
+	t.pending = next
+	return nil
+}
+
+// Close writes the last page. The file is empty when no page was added.
+func (t *TiffWriter) Close() error {
+	if t.pending == nil {
+		return nil
+	}
+	err := t.writePage(t.pending, false)
+	t.pending = nil
+	return err
+}
+
+func (t *TiffWriter) writeHeader() error {
+	// little endian, version 42, first directory right after the header
+	header := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	_, err := t.w.Write(header)
+	t.offset = uint32(len(header))
+	return err
+}
+
+// writePage writes the image file directory followed by its values that do
+// not fit in an entry and the strip with the image data.
+func (t *TiffWriter) writePage(p *page, more bool) error {
+	p.entries = append(p.entries,
+		entry{tagStripOffsets, typeLong, []uint32{0}},
+		entry{tagStripByteCounts, typeLong, []uint32{uint32(len(p.data))}})
+	// the entries of a directory are sorted by tag
+	sort.Slice(p.entries, func(i, j int) bool {
+		return p.entries[i].tag < p.entries[j].tag
+	})
+
+	directorySize := uint32(2 + 12*len(p.entries) + 4)
+	extraOffset := t.offset + directorySize
+	extraSize := 0
+	for _, e := range p.entries {
+		if size := valueSize(e); size > 4 {
+			extraSize += size
+		}
+	}
+	dataOffset := extraOffset + uint32(extraSize)
+	nextOffset := uint32(0)
+	if more {
+		// directories start on a word boundary
+		nextOffset = dataOffset + uint32(len(p.data)) + uint32(len(p.data)%2)
+	}
+
+	directory := new(bytes.Buffer)
+	extra := new(bytes.Buffer)
+	_ = binary.Write(directory, binary.LittleEndian, uint16(len(p.entries)))
+	for _, e := range p.entries {
+		if e.tag == tagStripOffsets {
+			e.values = []uint32{dataOffset}
+		}
+		_ = binary.Write(directory, binary.LittleEndian, e.tag)
+		_ = binary.Write(directory, binary.LittleEndian, e.kind)
+		count := uint32(len(e.values))
+		if e.kind == typeRational {
+			count /= 2
+		}
+		_ = binary.Write(directory, binary.LittleEndian, count)
+		value := new(bytes.Buffer)
+		for _, v := range e.values {
+			if e.kind == typeShort {
+				_ = binary.Write(value, binary.LittleEndian, uint16(v))
+			} else {
+				_ = binary.Write(value, binary.LittleEndian, v)
+			}
+		}
+		if value.Len() > 4 {
+			_ = binary.Write(directory, binary.LittleEndian, extraOffset+uint32(extra.Len()))
+			extra.Write(value.Bytes())
+			continue
+		}
+		for value.Len() < 4 {
+			value.WriteByte(0)
+		}
+		directory.Write(value.Bytes())
+	}
+	_ = binary.Write(directory, binary.LittleEndian, nextOffset)
+
+	for _, chunk := range [][]byte{directory.Bytes(), extra.Bytes(), p.data} {
+		if _, err := t.w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	t.offset = dataOffset + uint32(len(p.data))
+	if more && len(p.data)%2 == 1 {
+		if _, err := t.w.Write([]byte{0}); err != nil {
+			return err
+		}
+		t.offset++
+	}
+	return nil
+}
+
+func valueSize(e entry) int {
+	if e.kind == typeShort {
+		return 2 * len(e.values)
+	}
+	return 4 * len(e.values)
+}
+
+func isBilevel(img *image.Gray) bool {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, y) : img.PixOffset(bounds.Min.X, y)+bounds.Dx()]
+		for _, v := range row {
+			if v != 0 && v != 0xff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func rgb(img image.Image) []byte {
+	bounds := img.Bounds()
+	rgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	pix := make([]byte, 0, bounds.Dx()*bounds.Dy()*3)
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		pix = append(pix, rgba.Pix[i], rgba.Pix[i+1], rgba.Pix[i+2])
+	}
+	return pix
+}
+
+func deflate(pix []byte, stride, rowLength, rows int) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := zlib.NewWriter(buf)
+	for y := 0; y < rows; y++ {
+		if _, err := zw.Write(pix[y*stride : y*stride+rowLength]); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
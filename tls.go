@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/adelolmo/scanpi/logger"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certificateLifetime is how long a self-signed certificate is valid. Apple
+// devices refuse certificates valid for longer than 825 days.
+const certificateLifetime = 825 * 24 * time.Hour
+
+// certificateRenewal is how long before it expires a self-signed certificate
+// is replaced.
+const certificateRenewal = 30 * 24 * time.Hour
+
+// certificateCheck is how often the self-signed certificate is checked for
+// its expiry and for the addresses of the network interfaces.
+const certificateCheck = time.Minute
+
+// serve listens for the browsers, over https when enabled, and redirects the
+// requests to the http port to https.
+func serve(port string, handler http.Handler) error {
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%s", port),
+		Handler: handler,
+	}
+	if !appConfiguration.Tls {
+		return server.ListenAndServe()
+	}
+
+	certFile, keyFile := appConfiguration.TlsCert, appConfiguration.TlsKey
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile == "" || keyFile == "" {
+		certificates := &selfSignedCertificates{directory: path.Join(appConfiguration.WorkDirectory, "tls")}
+		if _, err := certificates.GetCertificate(nil); err != nil {
+			return err
+		}
+		server.TLSConfig.GetCertificate = certificates.GetCertificate
+		certFile, keyFile = "", ""
+	}
+
+	if appConfiguration.HttpRedirectPort != "" {
+		go func() {
+			redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, httpsLocation(r, port), http.StatusMovedPermanently)
+			})
+			if err := http.ListenAndServe(fmt.Sprintf(":%s", appConfiguration.HttpRedirectPort), redirect); err != nil {
+				logger.Error(fmt.Sprintf("cannot redirect http to https. Error: %s", err))
+			}
+		}()
+	}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// httpsLocation returns the address of the request on the https port.
+func httpsLocation(r *http.Request, port string) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
+
+// selfSignedCertificates serves the self-signed certificate of a directory,
+// replaced while the server runs when it is about to expire or when the
+// addresses of the network interfaces change.
+type selfSignedCertificates struct {
+	directory   string
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	checked     time.Time
+}
+
+// GetCertificate returns the current certificate, the one used before when a
+// new one cannot be generated.
+func (s *selfSignedCertificates) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.certificate != nil && time.Since(s.checked) < certificateCheck {
+		return s.certificate, nil
+	}
+	s.checked = time.Now()
+	if s.certificate != nil && currentCertificate(s.certificate.Leaf) {
+		return s.certificate, nil
+	}
+	certificate, err := selfSignedCertificate(s.directory)
+	if err != nil {
+		if s.certificate == nil {
+			return nil, err
+		}
+		logger.Error(fmt.Sprintf("cannot replace the self-signed certificate. Error: %s", err))
+		return s.certificate, nil
+	}
+	s.certificate = certificate
+	return certificate, nil
+}
+
+// selfSignedCertificate returns the certificate stored in the directory,
+// generating it when missing, about to expire or not for the current
+// addresses. The same certificate is kept across restarts, so browsers only
+// need to accept it once.
+func selfSignedCertificate(directory string) (*tls.Certificate, error) {
+	certFile := path.Join(directory, "cert.pem")
+	keyFile := path.Join(directory, "key.pem")
+	if certificate, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err == nil && currentCertificate(leaf) {
+			certificate.Leaf = leaf
+			logCertificate(leaf)
+			return &certificate, nil
+		}
+	}
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "scanpi"
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"scanpi"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certificateLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              []string{hostname, hostname + ".local", "localhost"},
+		IPAddresses:           localAddresses(),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, err
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot read the generated certificate. Error: %s", err))
+	}
+	if certificate.Leaf, err = x509.ParseCertificate(der); err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot read the generated certificate. Error: %s", err))
+	}
+	fmt.Println(fmt.Sprintf("generated a self-signed certificate in %s", directory))
+	logCertificate(certificate.Leaf)
+	return &certificate, nil
+}
+
+// currentCertificate tells whether a self-signed certificate can still be
+// served: it is not about to expire and is for the current addresses. The
+// certificates generated as authorities are replaced by leaf ones.
+func currentCertificate(leaf *x509.Certificate) bool {
+	if leaf.IsCA || !time.Now().Add(certificateRenewal).Before(leaf.NotAfter) {
+		return false
+	}
+	return sameAddresses(leaf.IPAddresses, localAddresses())
+}
+
+// sameAddresses tells whether both lists hold the same addresses, in any
+// order.
+func sameAddresses(a, b []net.IP) bool {
+	contains := func(addresses []net.IP, ip net.IP) bool {
+		for _, address := range addresses {
+			if address.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, ip := range a {
+		if !contains(b, ip) {
+			return false
+		}
+	}
+	for _, ip := range b {
+		if !contains(a, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// logCertificate prints the fingerprint of the certificate, to compare with
+// the one the browser shows before accepting it.
+func logCertificate(certificate *x509.Certificate) {
+	fingerprint := sha256.Sum256(certificate.Raw)
+	fmt.Println(fmt.Sprintf("certificate for %s valid until %s, SHA-256 fingerprint %X",
+		strings.Join(certificate.DNSNames, ", "), certificate.NotAfter.Format("2006-01-02"), fingerprint))
+}
+
+// localAddresses returns the addresses of the network interfaces, which the
+// browsers on the network connect to.
+func localAddresses() []net.IP {
+	addresses := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	interfaceAddresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return addresses
+	}
+	for _, address := range interfaceAddresses {
+		if ipNet, ok := address.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			addresses = append(addresses, ipNet.IP)
+		}
+	}
+	return addresses
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeCertificate stores a self-signed certificate in the directory, the way
+// selfSignedCertificate does.
+func writeCertificate(t *testing.T, directory string, notAfter time.Time, addresses []net.IP) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "scanpi"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           addresses,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(directory, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(directory, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelfSignedCertificates(t *testing.T) {
+	valid := time.Now().Add(certificateLifetime)
+	tests := []struct {
+		name       string
+		notAfter   time.Time
+		addresses  []net.IP
+		wantStored bool
+	}{
+		{"current certificate", valid, localAddresses(), true},
+		{"about to expire", time.Now().Add(certificateRenewal / 2), localAddresses(), false},
+		{"address gone", valid, append(localAddresses(), net.ParseIP("192.0.2.1")), false},
+		{"new address", valid, localAddresses()[:1], false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := path.Join(t.TempDir(), "tls")
+			writeCertificate(t, directory, test.notAfter, test.addresses)
+			stored, err := tls.LoadX509KeyPair(path.Join(directory, "cert.pem"), path.Join(directory, "key.pem"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			certificates := &selfSignedCertificates{directory: directory}
+			certificate, err := certificates.GetCertificate(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := string(certificate.Certificate[0]) == string(stored.Certificate[0]); kept != test.wantStored {
+				t.Errorf("stored certificate served = %v, want %v", kept, test.wantStored)
+			}
+			if !currentCertificate(certificate.Leaf) {
+				t.Errorf("certificate until %s for %v served", certificate.Leaf.NotAfter, certificate.Leaf.IPAddresses)
+			}
+			if again, err := certificates.GetCertificate(nil); err != nil || again != certificate {
+				t.Errorf("certificate replaced before the next check, %v", err)
+			}
+		})
+	}
+}
+
+func TestSelfSignedCertificatesReplacedWhileServing(t *testing.T) {
+	directory := path.Join(t.TempDir(), "tls")
+	certificates := &selfSignedCertificates{directory: directory}
+	first, err := certificates.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the addresses changed since the certificate was generated
+	first.Leaf.IPAddresses = append(first.Leaf.IPAddresses, net.ParseIP("192.0.2.1"))
+	if again, err := certificates.GetCertificate(nil); err != nil || again != first {
+		t.Fatalf("certificate replaced before the next check, %v", err)
+	}
+	certificates.checked = time.Now().Add(-certificateCheck)
+	second, err := certificates.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("certificate not replaced")
+	}
+	if !currentCertificate(second.Leaf) {
+		t.Errorf("certificate for %v served", second.Leaf.IPAddresses)
+	}
+}
+
+func TestSameAddresses(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []net.IP
+		want bool
+	}{
+		{"same order", []net.IP{net.ParseIP("192.0.2.1"), net.IPv6loopback}, []net.IP{net.ParseIP("192.0.2.1"), net.IPv6loopback}, true},
+		{"other order", []net.IP{net.ParseIP("192.0.2.1"), net.IPv6loopback}, []net.IP{net.IPv6loopback, net.ParseIP("192.0.2.1")}, true},
+		{"4 and 16 bytes", []net.IP{net.ParseIP("192.0.2.1").To4()}, []net.IP{net.ParseIP("192.0.2.1")}, true},
+		{"address missing", []net.IP{net.ParseIP("192.0.2.1"), net.IPv6loopback}, []net.IP{net.IPv6loopback}, false},
+		{"address added", []net.IP{net.IPv6loopback}, []net.IP{net.ParseIP("192.0.2.1"), net.IPv6loopback}, false},
+		{"other address", []net.IP{net.ParseIP("192.0.2.1")}, []net.IP{net.ParseIP("192.0.2.2")}, false},
+		{"none", nil, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := sameAddresses(test.a, test.b); got != test.want {
+				t.Errorf("sameAddresses() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
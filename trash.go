@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adelolmo/scanpi/auth"
+	"github.com/adelolmo/scanpi/fsutils"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+type trashItem struct {
+	fsutils.TrashEntry
+	Expires time.Time
+}
+
+type pageTrash struct {
+	Navigation string
+	Entries    []trashItem
+	Retention  int
+	// Admin tells whether the user can delete entries for good
+	Admin bool
+}
+
+func trashPage(w http.ResponseWriter, r *http.Request) {
+	entries, err := trash.Entries()
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user, _ := auth.CurrentUser(r)
+	page := &pageTrash{
+		Navigation: "trash",
+		Retention:  appConfiguration.TrashRetention,
+		Admin:      user.Admin,
+	}
+	for _, entry := range entries {
+		page.Entries = append(page.Entries, trashItem{TrashEntry: entry, Expires: trash.Expires(entry)})
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	if err := render(w, r, trashTemplate, page); err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func trashPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	previewPath, err := trash.PreviewPath(r.FormValue("id"))
+	if err != nil {
+		resolveError(w, err)
+		return
+	}
+	preview, err := os.Open(previewPath)
+	if err != nil {
+		servePlaceholder(w, r)
+		return
+	}
+	defer preview.Close()
+	info, err := preview.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, "", info.ModTime(), preview)
+}
+
+// trashRestoreHandler moves the entry back to its job and shows the job.
+func trashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	entry, err := trash.Restore(r.FormValue("id"), pageSidecars...)
+	if errors.Is(err, fsutils.ErrJobExists) {
+		http.Error(w, fmt.Sprintf("%s, rename it before restoring the deleted one", err), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		resolveError(w, err)
+		return
+	}
+	if entry.LinkName != "" {
+		recordActivity(userName(r), "restored page %q of job %q", entry.LinkName, entry.JobName)
+	} else {
+		recordActivity(userName(r), "restored job %q", entry.JobName)
+	}
+
+	redirect(w, r, "/job?jobName="+url.QueryEscape(entry.JobName))
+}
+
+func trashDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if user, _ := auth.CurrentUser(r); !user.Admin {
+		http.Error(w, "only administrators can delete from the trash for good", http.StatusForbidden)
+		return
+	}
+	if err := trash.Purge(r.FormValue("id")); err != nil {
+		resolveError(w, err)
+		return
+	}
+	recordActivity(userName(r), "deleted %s from the trash for good", r.FormValue("id"))
+
+	redirect(w, r, "/trash")
+}
@@ -0,0 +1,83 @@
+package worker
+
+import (
+	"fmt"
+	"github.com/adelolmo/scanpi/logger"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type task struct {
+	name string
+	run  func() error
+}
+
+// Pool runs tasks in background with a fixed number of workers. The tasks
+// wait their turn in a bounded queue: adding a task to a full queue blocks
+// until a worker picks up the next one.
+type Pool struct {
+	name    string
+	queue   chan task
+	pending int32
+	wg      sync.WaitGroup
+}
+
+// NewPool starts the workers of the pool, at least one.
+func NewPool(name string, workers, queueSize int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &Pool{
+		name:  name,
+		queue: make(chan task, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	logger.Info("%s pool started with %d workers", name, workers)
+	return p
+}
+
+// Submit queues the task. The name identifies it in the log.
+func (p *Pool) Submit(name string, run func() error) {
+	atomic.AddInt32(&p.pending, 1)
+	p.queue <- task{name: name, run: run}
+}
+
+// Pending returns the number of tasks queued or running.
+func (p *Pool) Pending() int {
+	return int(atomic.LoadInt32(&p.pending))
+}
+
+// Close waits for the queued tasks to finish. No task can be submitted after.
+func (p *Pool) Close() {
+	close(p.queue)
+	p.wg.Wait()
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for t := range p.queue {
+		start := time.Now()
+		if err := t.runSafely(); err != nil {
+			logger.Error(fmt.Sprintf("%s task '%s' failed. Error: %s", p.name, t.name, err))
+		} else {
+			logger.Info("%s task '%s' took %fs", p.name, t.name, time.Now().Sub(start).Seconds())
+		}
+		atomic.AddInt32(&p.pending, -1)
+	}
+}
+
+// runSafely runs the task, turning a panic into its failure so the worker
+// keeps running the next tasks.
+func (t task) runSafely() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return t.run()
+}
@@ -0,0 +1,62 @@
+package worker
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPoolSurvivesFailingTasks(t *testing.T) {
+	tasks := []struct {
+		name string
+		run  func() error
+	}{
+		{"succeeds", func() error { return nil }},
+		{"fails", func() error { return errors.New("failed") }},
+		{"panics", func() error { panic("broken image") }},
+		{"panics with nil map", func() error {
+			var m map[string]int
+			m["page"]++
+			return nil
+		}},
+	}
+	pool := NewPool("test", 1, len(tasks))
+	var done int32
+	for _, task := range tasks {
+		run := task.run
+		pool.Submit(task.name, func() error {
+			defer atomic.AddInt32(&done, 1)
+			return run()
+		})
+	}
+	pool.Close()
+
+	if got := atomic.LoadInt32(&done); got != int32(len(tasks)) {
+		t.Errorf("%d tasks ran, want %d", got, len(tasks))
+	}
+	if pending := pool.Pending(); pending != 0 {
+		t.Errorf("Pending() = %d, want 0", pending)
+	}
+}
+
+func TestRunSafely(t *testing.T) {
+	tests := []struct {
+		name    string
+		run     func() error
+		wantErr string
+	}{
+		{"succeeds", func() error { return nil }, ""},
+		{"fails", func() error { return errors.New("failed") }, "failed"},
+		{"panics", func() error { panic("broken image") }, "panic: broken image"},
+	}
+	for _, test := range tests {
+		err := task{name: test.name, run: test.run}.runSafely()
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: runSafely() error = %v, want none", test.name, err)
+		case test.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), test.wantErr)):
+			t.Errorf("%s: runSafely() error = %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
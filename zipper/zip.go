@@ -38,6 +38,16 @@ func (z *ZipWriter) AddFile(path string, filename string) error {
 	return nil
 }
 
+// Create adds an entry to the zip file and returns the writer for its content,
+// which is valid until the next entry is added.
+func (z *ZipWriter) Create(filename string) (io.Writer, error) {
+	wr, err := z.w.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create entry %s in zip file: %s", filename, err)
+	}
+	return wr, nil
+}
+
 func (z *ZipWriter) Close() error {
 	return z.w.Close()
 }